@@ -0,0 +1,130 @@
+// Package barcode encodes Code 128 barcodes, the symbology carriers scan on
+// shipping labels.
+package barcode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// patterns holds the bar and space widths of every Code 128 symbol, in
+// modules, starting with a bar. Each symbol is 11 modules wide; the stop
+// symbol is 13.
+var patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	codeC  = 99
+	codeB  = 100
+	startB = 104
+	startC = 105
+	stop   = 106
+)
+
+var ErrUnsupported = errors.New("code 128 supports printable ASCII only")
+
+// Code128 returns the bar and space widths, in modules, of text encoded as
+// Code 128. The first width is a bar. Runs of four or more digits are packed
+// two to a symbol with code set C; everything else uses code set B.
+func Code128(text string) ([]int, error) {
+	if text == "" {
+		return nil, errors.New("nothing to encode")
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] < 32 || text[i] > 126 {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupported, text[i])
+		}
+	}
+
+	var symbols []int
+	set := 0
+	for i := 0; i < len(text); {
+		run := digitRun(text[i:])
+		// A run is worth packing when it saves symbols, which a lone
+		// pair in the middle of the text does not once the switch
+		// symbols are paid for.
+		useC := run >= 4 || (run == len(text) && run%2 == 0)
+		if useC && run%2 == 1 {
+			// The odd digit goes out in set B so the rest pairs up.
+			if set != startB {
+				symbols = append(symbols, switchTo(set, startB))
+				set = startB
+			}
+			symbols = append(symbols, int(text[i])-32)
+			i++
+			run--
+		}
+		if useC {
+			if set != startC {
+				symbols = append(symbols, switchTo(set, startC))
+				set = startC
+			}
+			for ; run >= 2; run -= 2 {
+				symbols = append(symbols, int(text[i]-'0')*10+int(text[i+1]-'0'))
+				i += 2
+			}
+			continue
+		}
+
+		if set != startB {
+			symbols = append(symbols, switchTo(set, startB))
+			set = startB
+		}
+		symbols = append(symbols, int(text[i])-32)
+		i++
+	}
+
+	sum := symbols[0]
+	for i, symbol := range symbols[1:] {
+		sum += (i + 1) * symbol
+	}
+	symbols = append(symbols, sum%103, stop)
+
+	widths := make([]int, 0, len(symbols)*6+1)
+	for _, symbol := range symbols {
+		for _, width := range patterns[symbol] {
+			widths = append(widths, int(width-'0'))
+		}
+	}
+	return widths, nil
+}
+
+// switchTo returns the start symbol at the beginning of the text and the
+// code set switch afterwards.
+func switchTo(from, to int) int {
+	if from == 0 {
+		return to
+	}
+	if to == startC {
+		return codeC
+	}
+	return codeB
+}
+
+func digitRun(text string) int {
+	n := 0
+	for n < len(text) && text[n] >= '0' && text[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// Modules is the total width of an encoding in modules, without quiet zones.
+func Modules(widths []int) int {
+	total := 0
+	for _, width := range widths {
+		total += width
+	}
+	return total
+}
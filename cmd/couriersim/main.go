@@ -0,0 +1,60 @@
+// Command couriersim posts the webhook deliveries of a simulated parcel to a
+// running shop, one scan at a time.
+//
+//	couriersim -carrier generic -tracking AWB123 -scenario retry
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"kars/couriers"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:3000", "shop base URL")
+	carrier := flag.String("carrier", "generic", "carrier the webhooks are sent as")
+	secret := flag.String("secret", "", "webhook secret (default $COURIER_<CARRIER>_SECRET)")
+	tracking := flag.String("tracking", "", "tracking number of the shipment")
+	scenario := flag.String("scenario", couriers.ScenarioDelivered, "delivered, retry or failed")
+	delay := flag.Duration("delay", time.Second, "wait between deliveries")
+	flag.Parse()
+
+	if *tracking == "" {
+		log.Fatal("-tracking is required")
+	}
+	if *secret == "" {
+		*secret = os.Getenv(couriers.SecretEnv(*carrier))
+	}
+
+	deliveries, err := couriers.NewSimulator(*secret).Script(*tracking, *scenario, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/api/couriers/%s/webhook", *baseURL, *carrier)
+	for i, delivery := range deliveries {
+		if i > 0 {
+			time.Sleep(*delay)
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(delivery.Body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(couriers.SignatureHeader, delivery.Signature)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reply, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("%s -> %s %s\n", delivery.Body, resp.Status, bytes.TrimSpace(reply))
+	}
+}
@@ -0,0 +1,71 @@
+// Command journal exports the accounting vouchers of a range of days from
+// the shop's database, for import into bookkeeping software.
+//
+//	journal -from 2026-09-01 -to 2026-09-30 -format xml -accounts chart.json -out september.xml
+package main
+
+import (
+	"bufio"
+	"flag"
+	"kars/database"
+	"kars/journal"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	from := flag.String("from", "", "first day, YYYY-MM-DD")
+	to := flag.String("to", "", "last day, YYYY-MM-DD")
+	format := flag.String("format", journal.FormatCSV, "csv or xml (Tally)")
+	accounts := flag.String("accounts", "", "chart of accounts JSON (default $JOURNAL_ACCOUNTS)")
+	company := flag.String("company", "", "Tally company to import into (default $TALLY_COMPANY)")
+	out := flag.String("out", "", "file to write (default stdout)")
+	flag.Parse()
+
+	// The database settings are usually kept in the shop's .env.
+	_ = godotenv.Load()
+	if *accounts == "" {
+		*accounts = os.Getenv("JOURNAL_ACCOUNTS")
+	}
+	if *company == "" {
+		*company = os.Getenv("TALLY_COMPANY")
+	}
+
+	if *format != journal.FormatCSV && *format != journal.FormatTally {
+		log.Fatal("-format must be csv or xml")
+	}
+	start, end, err := journal.Period(*from, *to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chart, err := journal.LoadChart(*accounts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database.ConnectDB()
+	vouchers, err := journal.Build(database.DB, chart, start, end)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file := os.Stdout
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	w := bufio.NewWriter(file)
+	if err := journal.Write(w, vouchers, *format, *company); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d vouchers", len(vouchers))
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"kars/database"
 	"kars/models"
+	"kars/shipping"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -19,6 +20,7 @@ type NewAddress struct {
 	Country      string `json:"country"`
 	LandMark     string `json:"land_mark"`
 	AddressType  string `json:"address_type"`
+	IsDefault    bool   `json:"is_default"`
 }
 
 func UserAddAddress(c *fiber.Ctx) error {
@@ -56,6 +58,10 @@ func UserAddAddress(c *fiber.Ctx) error {
 		})
 	}
 
+	if _, err := shipping.CheckPincode(database.DB, Address.PostalCode, false); err != nil {
+		return pincodeError(c, err)
+	}
+
 	address := models.Address{
 		UserID:       Address.UserID,
 		Name:         Address.Name,
@@ -70,7 +76,22 @@ func UserAddAddress(c *fiber.Ctx) error {
 		AddressType:  Address.AddressType,
 	}
 
-	if err := database.DB.Create(&address).Error; err != nil {
+	// The first address becomes the default one.
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&address).Error; err != nil {
+			return err
+		}
+		var others int64
+		if err := tx.Model(&models.Address{}).Where("user_id = ? AND id <> ?", address.UserID, address.ID).Count(&others).Error; err != nil {
+			return err
+		}
+		if !Address.IsDefault && others > 0 {
+			return nil
+		}
+		address.IsDefault = true
+		return setDefaultAddress(tx, address.UserID, address.ID)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to create address",
 		})
@@ -143,6 +164,9 @@ func UserEditAddress(c *fiber.Ctx) error {
 		fields["state"] = address.State
 	}
 	if address.PostalCode != "" {
+		if _, err := shipping.CheckPincode(database.DB, address.PostalCode, false); err != nil {
+			return pincodeError(c, err)
+		}
 		fields["postal_code"] = address.PostalCode
 	}
 	if address.Country != "" {
@@ -157,7 +181,18 @@ func UserEditAddress(c *fiber.Ctx) error {
 
 	var NewAddress models.Address
 
-	if err := database.DB.Model(&NewAddress).Where("id = ? AND user_id = ?", addressID, userID).Updates(&fields).Error; err != nil {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if len(fields) > 0 {
+			if err := tx.Model(&NewAddress).Where("id = ? AND user_id = ?", addressID, userID).Updates(&fields).Error; err != nil {
+				return err
+			}
+		}
+		if address.IsDefault {
+			return setDefaultAddress(tx, userID, add.ID)
+		}
+		return nil
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update address",
 		})
@@ -206,7 +241,26 @@ func UserDeleteAddress(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := database.DB.Delete(&address).Error; err != nil {
+	// Deleting the default address hands the default on to the user's
+	// oldest remaining address, so delivery estimates keep working.
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&address).Error; err != nil {
+			return err
+		}
+		if !address.IsDefault {
+			return nil
+		}
+		var next models.Address
+		err := tx.Where("user_id = ?", address.UserID).Order("id").First(&next).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return setDefaultAddress(tx, address.UserID, next.ID)
+	})
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to delete address",
 		})
@@ -257,6 +311,7 @@ func UserListAddress(c *fiber.Ctx) error {
 			"country":       address.PostalCode,
 			"land_mark":     address.LandMark,
 			"address_type":  address.AddressType,
+			"is_default":    address.IsDefault,
 			"created_at":    address.CreatedAt,
 		})
 	}
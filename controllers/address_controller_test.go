@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"fmt"
+	"kars/models"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Deleting the default address makes the oldest remaining address the
+// default.
+func TestDeleteDefaultAddress(t *testing.T) {
+	db := testDB(t)
+	user, first := newUser(t, db)
+	second := first
+	second.ID = 0
+	second.IsDefault = false
+	create(t, db, &second)
+	third := second
+	third.ID = 0
+	create(t, db, &third)
+
+	app := fiber.New()
+	app.Delete("/address/:address_id", asUser(user, UserDeleteAddress))
+
+	if status, body := call(t, app, fiber.MethodDelete, fmt.Sprintf("/address/%d", first.ID), nil); status != fiber.StatusOK {
+		t.Fatalf("delete default address: got %d %v", status, body)
+	}
+
+	var defaults []models.Address
+	if err := db.Where("user_id = ? AND is_default = ?", user.ID, true).Find(&defaults).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(defaults) != 1 || defaults[0].ID != second.ID {
+		t.Errorf("got default addresses %v, want only %d", defaults, second.ID)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"kars/database"
 	"kars/jwtoken"
+	"kars/lifecycle"
 	"kars/models"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
@@ -220,39 +222,44 @@ func ChangeStatusShipped(c *fiber.Ctx) error {
 		})
 	}
 
-	var order models.Order
-	if err := database.DB.First(&order, "id = ?", orderid).Error; err != nil {
-		log.Println(err)
-		if err == gorm.ErrRecordNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "order not found",
+	var input shipmentInput
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request data",
 			})
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to retrieve order",
-		})
-	}
-
-	switch order.OrderStatus {
-	case "cancelled":
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already cancelled",
-		})
-	case "shipped":
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already cancelled",
-		})
 	}
-
-	if err := database.DB.Model(&order).Update("order_status", "shipped").Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to update order status",
-		})
+	// Shipping the whole order is one parcel with everything left in it.
+	input.Items = nil
+
+	actor := lifecycle.AdminActor(c.Locals("admin_id"))
+	var shipment models.Shipment
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderid)
+		if err != nil {
+			return err
+		}
+		if shipment, err = createShipment(tx, order, input); err != nil {
+			return err
+		}
+		event := models.TrackingEvent{
+			Status:     lifecycle.ShipmentInTransit,
+			Source:     actor,
+			OccurredAt: time.Now(),
+		}
+		if err := recordTrackingEvent(tx, &shipment, event); err != nil {
+			return err
+		}
+		return rollUpOrder(tx, &order, actor)
+	})
+	if err != nil {
+		return shipmentError(c, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message": "successfully updated order status",
-		"order":   order,
+		"message":  "order shipped",
+		"shipment": shipment,
 	})
 }
 
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/models"
+	"kars/shipping"
+	"kars/tax"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var errNoBusinessProfile = errors.New("register a business profile before choosing a B2B invoice")
+
+type businessProfileInput struct {
+	GSTIN        string `json:"gstin"`
+	LegalName    string `json:"legal_name"`
+	AddressLine1 string `json:"address_line1"`
+	AddressLine2 string `json:"address_line2"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+	PostalCode   string `json:"postal_code"`
+}
+
+// validate normalizes the input and checks the GSTIN against the state of
+// the billing address, which must be where the business is registered.
+func (input *businessProfileInput) validate() error {
+	input.GSTIN = tax.NormalizeGSTIN(input.GSTIN)
+	input.LegalName = strings.TrimSpace(input.LegalName)
+	input.PostalCode = shipping.NormalizePincode(input.PostalCode)
+
+	if err := tax.ValidateGSTIN(input.GSTIN); err != nil {
+		return err
+	}
+	if input.LegalName == "" {
+		return errors.New("legal name is required")
+	}
+	if strings.TrimSpace(input.AddressLine1) == "" || strings.TrimSpace(input.City) == "" || strings.TrimSpace(input.State) == "" {
+		return errors.New("billing address needs address_line1, city and state")
+	}
+	if len(input.PostalCode) != 6 {
+		return shipping.ErrInvalidPincode
+	}
+	state := tax.StateCode(input.State)
+	if state == "" {
+		return errors.New("unknown billing state")
+	}
+	if state != tax.GSTINState(input.GSTIN) {
+		return errors.New("the GSTIN is registered in " + tax.StateName(tax.GSTINState(input.GSTIN)) + ", not the billing state")
+	}
+	return nil
+}
+
+func GetBusinessProfile(c *fiber.Ctx) error {
+	var profile models.BusinessProfile
+	if err := database.DB.First(&profile, "user_id = ?", c.Locals("user_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "business profile not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve business profile"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":          "business profile",
+		"business_profile": profile,
+	})
+}
+
+// SaveBusinessProfile registers or replaces the user's business profile.
+// Orders already invoiced keep the details they were billed with.
+func SaveBusinessProfile(c *fiber.Ctx) error {
+	var input businessProfileInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", c.Locals("user_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve user"})
+	}
+
+	var profile models.BusinessProfile
+	err := database.DB.Unscoped().Where("user_id = ?", user.ID).First(&profile).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve business profile"})
+	}
+
+	profile.UserID = user.ID
+	profile.GSTIN = input.GSTIN
+	profile.LegalName = input.LegalName
+	profile.AddressLine1 = strings.TrimSpace(input.AddressLine1)
+	profile.AddressLine2 = strings.TrimSpace(input.AddressLine2)
+	profile.City = strings.TrimSpace(input.City)
+	profile.State = tax.StateName(tax.StateCode(input.State))
+	profile.PostalCode = input.PostalCode
+	profile.DeletedAt = gorm.DeletedAt{}
+	if err := database.DB.Unscoped().Save(&profile).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to save business profile"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":          "business profile saved",
+		"business_profile": profile,
+	})
+}
+
+func DeleteBusinessProfile(c *fiber.Ctx) error {
+	result := database.DB.Where("user_id = ?", c.Locals("user_id")).Delete(&models.BusinessProfile{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete business profile"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "business profile not found"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "business profile deleted"})
+}
+
+// billingAddress is the profile's address on one line, as printed on
+// invoices.
+func billingAddress(profile models.BusinessProfile) string {
+	var parts []string
+	for _, part := range []string{profile.AddressLine1, profile.AddressLine2, profile.City, profile.State + " " + profile.PostalCode} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
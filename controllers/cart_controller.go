@@ -3,6 +3,9 @@ package controllers
 import (
 	"kars/database"
 	"kars/models"
+	"kars/pricing"
+	"kars/tax"
+	"time"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -48,7 +51,17 @@ func AddToCart(c *fiber.Ctx) error{
 		})
 	}
 
-	if product.Quantity <= 0 {
+	// Products sold in variants are added as one of them, from its stock.
+	variant, err := requestedVariant(database.DB, product, c.Query("variant_id"), true)
+	if err != nil {
+		return variantError(c, err)
+	}
+	stock := product.Quantity
+	if variant != nil {
+		stock = variant.Quantity
+	}
+
+	if stock <= 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "product is out of stock",
 		})
@@ -66,26 +79,14 @@ func AddToCart(c *fiber.Ctx) error{
 		})
 	}
 
-	var productPrice float64
-	if category.OfferValue < product.OfferValue {
-		if product.OfferType == "percentage" {
-			discountPrice := product.Price * product.OfferValue / 100
-			productPrice = product.Price - discountPrice
-		} else if product.OfferType == "fixed" {
-			productPrice = product.Price - product.OfferValue
-		}
-	} else {
-		if category.OfferType == "percentage" {
-			discountPrice := product.Price * category.OfferValue / 100
-			productPrice = product.Price - discountPrice
-		} else if product.Category.OfferType == "fixed" {
-			productPrice = product.Price - category.OfferValue
-		}
-	}
-
-	if productPrice <= 0 {
-		productPrice = product.Price
+	offers, err := pricing.Active(database.DB, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve offers",
+		})
 	}
+	price := pricing.Price(pricing.Variant(product, variant), category, pricing.Promotions(offers, product)...)
+	productPrice := price.Price
 
 	var cart models.Cart
     if err := database.DB.Where("user_id = ?", userID).First(&cart).Error; err != nil {
@@ -108,16 +109,20 @@ func AddToCart(c *fiber.Ctx) error{
 
 	var cartitem models.CartItem
 
-	if err := database.DB.Where("cart_id = ? AND product_id = ?",cart.ID, productID).First(&cartitem).Error; err != nil{
+	if err := whereVariant(database.DB, c.Query("variant_id")).Where("cart_id = ? AND product_id = ?",cart.ID, productID).First(&cartitem).Error; err != nil{
 		
 		cartitem = models.CartItem{
 			CartID: cart.ID,
 			ProductID: product.ID,
-			ProductName: product.ProductName,
+			ProductName: variantName(product, variant),
 			ProductPrice: productPrice,
 			Quantity: 1,
 			TotalPrice: productPrice,
 		}
+		if variant != nil {
+			cartitem.VariantID = &variant.ID
+			cartitem.SKU = variant.SKU
+		}
 		if err := database.DB.Create(&cartitem).Error; err != nil{
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to add the product to cart",
@@ -132,13 +137,14 @@ func AddToCart(c *fiber.Ctx) error{
 			})
 		}
 
-		if cartitem.Quantity >= product.Quantity {
+		if cartitem.Quantity >= stock {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "cannot add more of this product; maximum stock reached",
 			})
 		}
 
 		cartitem.Quantity++
+		cartitem.ProductPrice = productPrice
 		cartitem.TotalPrice = float64(cartitem.Quantity) * productPrice
 		if err := database.DB.Save(&cartitem).Error; err != nil{
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -157,6 +163,7 @@ func AddToCart(c *fiber.Ctx) error{
 		"message": "product added to the cart successfully",
 		"cart": cart,
 		"cart_items": cartitem,
+		"price_breakdown": price,
 	})
 
 }
@@ -190,7 +197,7 @@ func RemoveFromCart(c *fiber.Ctx) error {
 	}
 
 	var cartitem models.CartItem
-	if err := database.DB.Where("cart_id = ? AND product_id = ?", cart.ID, productID).First(&cartitem).Error; err != nil{
+	if err := whereVariant(database.DB, c.Query("variant_id")).Where("cart_id = ? AND product_id = ?", cart.ID, productID).First(&cartitem).Error; err != nil{
 		if err == gorm.ErrRecordNotFound{
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "product not found in the cart",
@@ -249,8 +256,83 @@ func ListCartProducts(c *fiber.Ctx) error {
 		})
 	}
 
+	// Prices are shown as they stand now, which is what checkout charges.
+	prices, err := cartPrices(database.DB, cartItems)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to price cart items",
+		})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "Carts products",
 		"cart": cartItems,
+		"price_breakdown": prices,
+		"delivery": deliveryEstimate(database.DB, userID),
 	})
-}
\ No newline at end of file
+}
+
+// cartPrice is a cart item's price breakdown with the GST checkout adds to
+// products priced without it, and the item total checkout charges.
+type cartPrice struct {
+	pricing.Breakdown
+	GST   float64 `json:"gst"`
+	Total float64 `json:"total"`
+}
+
+// cartPrices reprices cart items at their current prices, GST included as
+// checkout charges it, keyed by cart item id. Items whose product is gone
+// keep the price they were added at.
+func cartPrices(db *gorm.DB, items []models.CartItem) (map[uint]cartPrice, error) {
+	productIDs := make([]uint, 0, len(items))
+	variantIDs := make([]*uint, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+		variantIDs = append(variantIDs, item.VariantID)
+	}
+	var products []models.Product
+	if len(productIDs) > 0 {
+		if err := db.Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[uint]models.Product, len(products))
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+	variants, err := variantsByID(db, variantIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	pricer, err := pricing.NewPricer(db, products, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	taxConfigs, err := productTaxConfigs(db, byID)
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[uint]cartPrice, len(items))
+	for i, item := range items {
+		product, ok := byID[item.ProductID]
+		if !ok {
+			continue
+		}
+		var variant *models.ProductVariant
+		if item.VariantID != nil {
+			found, ok := variants[*item.VariantID]
+			if !ok {
+				continue
+			}
+			variant = &found
+		}
+		price := pricer.Price(product, variant)
+		net := tax.Round(price.Price * float64(item.Quantity))
+		gross := tax.Gross(net, taxConfigs[item.ProductID])
+		prices[item.ID] = cartPrice{Breakdown: price, GST: tax.Round(gross - net), Total: gross}
+		items[i].ProductPrice = tax.Round(gross / float64(item.Quantity))
+		items[i].TotalPrice = gross
+	}
+	return prices, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"kars/database"
+	"kars/lifecycle"
 	"kars/models"
 	"log"
 	"time"
@@ -273,7 +274,7 @@ func CancelCoupon(c *fiber.Ctx) error {
 		})
 	}
 
-	if order.PaymentStatus == "paid"{
+	if order.PaymentStatus == lifecycle.PaymentPaid{
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "payment already paid; you can't cancel the coupon",
 		})
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"kars/couriers"
+	"kars/database"
+	"kars/lifecycle"
+	"kars/models"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errUnknownShipment marks courier events for tracking numbers the shop did
+// not ship. They are acknowledged so the carrier stops retrying them.
+var errUnknownShipment = errors.New("courier event does not reference a known shipment")
+
+// CourierWebhook receives tracking updates from a carrier. Each event is
+// applied in its own transaction and at most once, like payment webhooks,
+// so one stale scan in a batch does not hold back the others.
+func CourierWebhook(c *fiber.Ctx) error {
+	adapter, err := couriers.Get(c.Params("carrier"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown carrier"})
+	}
+
+	body := c.Body()
+	if err := adapter.Verify(body, func(key string) string { return c.Get(key) }); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid webhook signature"})
+	}
+
+	events, err := adapter.Parse(body)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid webhook payload"})
+	}
+
+	results := make([]fiber.Map, 0, len(events))
+	for _, event := range events {
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			return applyCourierEvent(tx, adapter.Name(), event)
+		})
+
+		status := "ok"
+		if errors.Is(err, errUnknownShipment) || errors.Is(err, lifecycle.ErrInvalidTransition) {
+			log.Printf("ignoring %s event %s for %s: %v", adapter.Name(), event.ID, event.TrackingNumber, err)
+			status = "ignored"
+		} else if err != nil {
+			log.Printf("failed to process %s event %s for %s: %v", adapter.Name(), event.ID, event.TrackingNumber, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to process webhook"})
+		}
+		results = append(results, fiber.Map{"event_id": event.ID, "status": status})
+	}
+
+	return c.JSON(fiber.Map{"status": "ok", "events": results})
+}
+
+func applyCourierEvent(tx *gorm.DB, carrier string, event couriers.Event) error {
+	record := models.WebhookEvent{
+		Source:  carrier,
+		EventID: event.ID,
+		Event:   event.Code,
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	// Tracking numbers are only unique per carrier, so a scan must not move
+	// another carrier's parcel that happens to share the number.
+	var shipment models.Shipment
+	err := tx.Where("tracking_number = ? AND LOWER(carrier) = ?", event.TrackingNumber, strings.ToLower(carrier)).
+		Order("id DESC").First(&shipment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errUnknownShipment
+	}
+	if err != nil {
+		return err
+	}
+
+	description := event.Description
+	if description == "" {
+		description = event.Code
+	}
+	_, err = trackShipment(tx, shipment.ID, models.TrackingEvent{
+		Status:      event.Status,
+		Location:    event.Location,
+		Description: description,
+		Source:      carrier,
+		OccurredAt:  event.OccurredAt,
+	}, lifecycle.CourierActor(carrier))
+	return err
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kars/couriers"
+	"kars/lifecycle"
+	"kars/models"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const simulatorSecret = "simulator-secret"
+
+// courierApp serves the courier webhook for a generic carrier registered
+// under a name of its own, with the checkout and shipment routes needed to
+// get a parcel on its way.
+func courierApp(t *testing.T, user models.User) (*fiber.App, string) {
+	t.Helper()
+	carrier := unique("sim")
+	couriers.Register(couriers.NewGeneric(carrier, simulatorSecret))
+
+	app := fiber.New()
+	app.Post("/order/:user_id", asUser(user, PlaceOrder))
+	app.Post("/admin/orders/:order_id/shipments", CreateShipment)
+	app.Post("/api/couriers/:carrier/webhook", CourierWebhook)
+	return app, carrier
+}
+
+// shipCashOrder places a cash on delivery order for user and packs all of
+// it into one parcel with the given carrier and tracking number.
+func shipCashOrder(t *testing.T, db *gorm.DB, app *fiber.App, user models.User, address models.Address, carrier, trackingNumber string) (models.Order, models.Shipment) {
+	t.Helper()
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/order/%d", user.ID), userInput{AddressId: address.ID, PaymentMethod: "cash on delivery"})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	orderID, _ := placed["ID"].(float64)
+
+	status, body = call(t, app, fiber.MethodPost, fmt.Sprintf("/admin/orders/%d/shipments", uint(orderID)), shipmentInput{Carrier: carrier, TrackingNumber: trackingNumber})
+	if status != fiber.StatusCreated {
+		t.Fatalf("create shipment: got %d %v", status, body)
+	}
+	created, _ := body["shipment"].(map[string]interface{})
+	shipmentID, _ := created["ID"].(float64)
+
+	var order models.Order
+	if err := db.First(&order, uint(orderID)).Error; err != nil {
+		t.Fatal(err)
+	}
+	var shipment models.Shipment
+	if err := db.First(&shipment, uint(shipmentID)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return order, shipment
+}
+
+// deliver posts each delivery to the courier webhook of carrier and returns
+// the event statuses it answered with.
+func deliver(t *testing.T, app *fiber.App, carrier string, deliveries []couriers.Delivery) []string {
+	t.Helper()
+	var statuses []string
+	for _, delivery := range deliveries {
+		req := httptest.NewRequest(fiber.MethodPost, "/api/couriers/"+carrier+"/webhook", bytes.NewReader(delivery.Body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(couriers.SignatureHeader, delivery.Signature)
+
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Events []struct {
+				Status string `json:"status"`
+			} `json:"events"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("webhook: got status %d", resp.StatusCode)
+		}
+		for _, event := range result.Events {
+			statuses = append(statuses, event.Status)
+		}
+	}
+	return statuses
+}
+
+// simulate plays scenario for a parcel through the courier webhook and
+// returns the order status after each scan.
+func simulate(t *testing.T, db *gorm.DB, app *fiber.App, carrier, scenario string, order models.Order, shipment models.Shipment) []string {
+	t.Helper()
+	deliveries, err := couriers.NewSimulator(simulatorSecret).Script(shipment.TrackingNumber, scenario, time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []string
+	for _, delivery := range deliveries {
+		if got := deliver(t, app, carrier, []couriers.Delivery{delivery}); len(got) != 1 || got[0] != "ok" {
+			t.Fatalf("webhook answered %q, want one applied event", got)
+		}
+		if err := db.First(&order, order.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, order.OrderStatus)
+	}
+	return statuses
+}
+
+// courierChanges lists the status changes the carrier made to an order.
+func courierChanges(t *testing.T, db *gorm.DB, order models.Order, carrier string) []string {
+	t.Helper()
+	history, err := lifecycle.History(db, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, record := range history {
+		if record.Actor == lifecycle.CourierActor(carrier) {
+			changes = append(changes, record.Field+": "+record.FromStatus+" -> "+record.ToStatus)
+		}
+	}
+	return changes
+}
+
+func TestSimulatedDelivery(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 300, 5), 1)
+	app, carrier := courierApp(t, user)
+	order, shipment := shipCashOrder(t, db, app, user, address, carrier, unique("TRK"))
+
+	statuses := simulate(t, db, app, carrier, couriers.ScenarioDelivered, order, shipment)
+
+	want := []string{lifecycle.OrderShipped, lifecycle.OrderShipped, lifecycle.OrderOutForDelivery, lifecycle.OrderDelivered}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("order statuses = %q, want %q", statuses, want)
+	}
+
+	if err := db.First(&shipment, shipment.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if shipment.Status != lifecycle.ShipmentDelivered || shipment.ShippedAt == nil || shipment.DeliveredAt == nil {
+		t.Errorf("shipment = %q shipped %v delivered %v, want delivered with both times", shipment.Status, shipment.ShippedAt, shipment.DeliveredAt)
+	}
+	var events int64
+	if err := db.Model(&models.TrackingEvent{}).Where("shipment_id = ?", shipment.ID).Count(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if events != 4 {
+		t.Errorf("got %d tracking events, want 4", events)
+	}
+
+	// The courier collects the cash, so delivery settles the payment.
+	if err := db.First(&order, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.PaymentStatus != lifecycle.PaymentPaid {
+		t.Errorf("payment status = %q, want %q", order.PaymentStatus, lifecycle.PaymentPaid)
+	}
+	wantChanges := []string{
+		"order_status: placed -> shipped",
+		"order_status: shipped -> out for delivery",
+		"order_status: out for delivery -> delivered",
+		"payment_status: pending -> paid",
+	}
+	if changes := courierChanges(t, db, order, carrier); !slices.Equal(changes, wantChanges) {
+		t.Errorf("courier changes = %q, want %q", changes, wantChanges)
+	}
+}
+
+func TestSimulatedRetry(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 300, 5), 1)
+	app, carrier := courierApp(t, user)
+	order, shipment := shipCashOrder(t, db, app, user, address, carrier, unique("TRK"))
+
+	statuses := simulate(t, db, app, carrier, couriers.ScenarioRetry, order, shipment)
+
+	// A failed attempt does not move the order back to shipped.
+	want := []string{
+		lifecycle.OrderShipped, lifecycle.OrderShipped, lifecycle.OrderOutForDelivery,
+		lifecycle.OrderOutForDelivery, lifecycle.OrderOutForDelivery, lifecycle.OrderDelivered,
+	}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("order statuses = %q, want %q", statuses, want)
+	}
+	if changes := courierChanges(t, db, order, carrier); len(changes) != 4 {
+		t.Errorf("got courier changes %q, want 3 order and 1 payment change", changes)
+	}
+}
+
+func TestSimulatedFailure(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 300, 5), 1)
+	app, carrier := courierApp(t, user)
+	order, shipment := shipCashOrder(t, db, app, user, address, carrier, unique("TRK"))
+
+	statuses := simulate(t, db, app, carrier, couriers.ScenarioFailed, order, shipment)
+
+	if got := statuses[len(statuses)-1]; got != lifecycle.OrderOutForDelivery {
+		t.Errorf("order status = %q, want %q", got, lifecycle.OrderOutForDelivery)
+	}
+	if err := db.First(&shipment, shipment.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if shipment.Status != lifecycle.ShipmentDeliveryFailed || shipment.DeliveredAt != nil {
+		t.Errorf("shipment = %q delivered %v, want delivery failed", shipment.Status, shipment.DeliveredAt)
+	}
+	if err := db.First(&order, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.PaymentStatus != lifecycle.PaymentPending {
+		t.Errorf("payment status = %q, want %q", order.PaymentStatus, lifecycle.PaymentPending)
+	}
+}
+
+// A carrier's scans only move its own parcels, even when another carrier
+// uses the same tracking number, and a repeated delivery is applied once.
+func TestCourierEventCarrier(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 300, 5), 1)
+	app, carrier := courierApp(t, user)
+	trackingNumber := unique("TRK")
+	_, shipment := shipCashOrder(t, db, app, user, address, "another carrier", trackingNumber)
+
+	deliveries, err := couriers.NewSimulator(simulatorSecret).Script(trackingNumber, couriers.ScenarioDelivered, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deliver(t, app, carrier, deliveries[:1]); !slices.Equal(got, []string{"ignored"}) {
+		t.Errorf("scan for another carrier's parcel answered %q, want ignored", got)
+	}
+	if err := db.First(&shipment, shipment.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if shipment.Status != lifecycle.ShipmentCreated {
+		t.Errorf("shipment = %q, want %q", shipment.Status, lifecycle.ShipmentCreated)
+	}
+
+	fillCart(t, db, user, newProduct(t, db, 300, 5), 1)
+	_, shipment = shipCashOrder(t, db, app, user, address, carrier, trackingNumber)
+	// The ignored scan was not recorded, so the carrier's retry applies.
+	if got := deliver(t, app, carrier, []couriers.Delivery{deliveries[0], deliveries[0]}); !slices.Equal(got, []string{"ok", "ok"}) {
+		t.Errorf("scan answered %q, want ok twice", got)
+	}
+	var events int64
+	if err := db.Model(&models.TrackingEvent{}).Where("shipment_id = ?", shipment.ID).Count(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 {
+		t.Errorf("got %d tracking events for a repeated scan, want 1", events)
+	}
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"kars/database"
+	"kars/models"
+	"kars/shipping"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func pincodeError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, shipping.ErrInvalidPincode), errors.Is(err, shipping.ErrNotServiceable), errors.Is(err, shipping.ErrCODNotAvailable):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to check pincode"})
+}
+
+// setDefaultAddress makes addressID the only default address of the user.
+func setDefaultAddress(tx *gorm.DB, userID interface{}, addressID uint) error {
+	if err := tx.Model(&models.Address{}).Where("user_id = ? AND id <> ?", userID, addressID).Update("is_default", false).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Address{}).Where("user_id = ? AND id = ?", userID, addressID).Update("is_default", true).Error
+}
+
+// deliveryEstimate describes delivery to the user's default address, or is
+// nil when the user has none.
+func deliveryEstimate(db *gorm.DB, userID interface{}) fiber.Map {
+	var address models.Address
+	if err := db.Where("user_id = ? AND is_default = ?", userID, true).First(&address).Error; err != nil {
+		return nil
+	}
+	return pincodeEstimate(db, address.PostalCode, false)
+}
+
+func pincodeEstimate(db *gorm.DB, code string, cod bool) fiber.Map {
+	estimate := fiber.Map{"pincode": shipping.NormalizePincode(code)}
+	pincode, err := shipping.CheckPincode(db, code, cod)
+	if err != nil {
+		estimate["serviceable"] = false
+		estimate["reason"] = err.Error()
+		return estimate
+	}
+	estimate["serviceable"] = true
+	// Without an imported pincode table there is nothing to estimate from.
+	if pincode.Code != "" {
+		estimate["cod_available"] = pincode.CODAvailable
+		estimate["transit_days"] = pincode.TransitDays
+		estimate["estimated_date"] = shipping.EstimateDelivery(pincode, time.Now()).Format("2006-01-02")
+	}
+	return estimate
+}
+
+// CheckPincodeDelivery tells a shopper whether a pincode is served and when
+// an order placed now would arrive there.
+func CheckPincodeDelivery(c *fiber.Ctx) error {
+	cod := c.Query("payment_method") == "cash on delivery"
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "pincode delivery",
+		"delivery": pincodeEstimate(database.DB, c.Params("pincode"), cod),
+	})
+}
+
+// ImportPincodes loads the serviceability table from a CSV, sent either as
+// the "file" form field or as the raw request body.
+func ImportPincodes(c *fiber.Ctx) error {
+	var reader io.Reader = bytes.NewReader(c.Body())
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "failed to read file"})
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	result, err := shipping.ImportPincodes(database.DB, reader)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "failed to import pincodes: " + err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "pincodes imported",
+		"imported": result.Imported,
+		"errors":   result.Errors,
+	})
+}
+
+func ListPincodes(c *fiber.Ctx) error {
+	query := database.DB.Order("code")
+	if code := c.Query("code"); code != "" {
+		query = query.Where("code LIKE ?", shipping.NormalizePincode(code)+"%")
+	}
+
+	var pincodes []models.Pincode
+	if err := query.Limit(100).Find(&pincodes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve pincodes"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "pincodes", "pincodes": pincodes})
+}
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"kars/database"
+	"kars/fitment"
+	"kars/models"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var errNoGarageVehicle = errors.New("save a vehicle in your garage to see the products that fit it")
+
+// garageVehicle is the vehicle the user saved in My Garage, or nil when
+// there is none.
+func garageVehicle(db *gorm.DB, userID interface{}) (*models.Vehicle, error) {
+	var garage models.GarageVehicle
+	if err := db.Preload("Vehicle").First(&garage, "user_id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &garage.Vehicle, nil
+}
+
+// fitmentVehicle is the vehicle a product listing is filtered to: the one
+// ?vehicle_id= names, or the user's garage vehicle with ?compatible=true.
+// It is zero when the listing is not filtered.
+func fitmentVehicle(c *fiber.Ctx) (uint, error) {
+	if value := c.Query("vehicle_id"); value != "" {
+		vehicleID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fiber.NewError(fiber.StatusBadRequest, "vehicle_id must be a vehicle id")
+		}
+		return uint(vehicleID), nil
+	}
+	if !c.QueryBool("compatible") {
+		return 0, nil
+	}
+	vehicle, err := garageVehicle(database.DB, c.Locals("user_id"))
+	if err != nil {
+		return 0, err
+	}
+	if vehicle == nil {
+		return 0, errNoGarageVehicle
+	}
+	return vehicle.ID, nil
+}
+
+func fitmentError(c *fiber.Ctx, err error) error {
+	var fiberErr *fiber.Error
+	switch {
+	case errors.Is(err, errNoGarageVehicle):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.As(err, &fiberErr):
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve garage"})
+}
+
+// ImportVehicles loads the vehicle table from a CSV, sent either as the
+// "file" form field or as the raw request body.
+func ImportVehicles(c *fiber.Ctx) error {
+	var reader io.Reader = bytes.NewReader(c.Body())
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "failed to read file"})
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	result, err := fitment.ImportVehicles(database.DB, reader)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "failed to import vehicles: " + err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "vehicles imported",
+		"imported": result.Imported,
+		"errors":   result.Errors,
+	})
+}
+
+// ListVehicles looks vehicles up by ?make=, ?model=, ?year= and ?trim=, so
+// shoppers can find theirs.
+func ListVehicles(c *fiber.Ctx) error {
+	var vehicles []models.Vehicle
+	query := fitment.Search(database.DB, c.Query("make"), c.Query("model"), c.QueryInt("year"), c.Query("trim"))
+	if err := query.Order("make, model, year, trim").Limit(100).Find(&vehicles).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve vehicles"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "vehicles", "vehicles": vehicles})
+}
+
+// AddVehicle adds a vehicle to the table, or restores it if it was deleted.
+func AddVehicle(c *fiber.Ctx) error {
+	var vehicle models.Vehicle
+	if err := c.BodyParser(&vehicle); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	vehicle.Model = gorm.Model{}
+	if err := fitment.Normalize(&vehicle); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := fitment.Save(database.DB, &vehicle); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create vehicle"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "vehicle created", "vehicle": vehicle})
+}
+
+// DeleteVehicle removes a vehicle along with the fitments naming it and
+// the garages it is saved in.
+func DeleteVehicle(c *fiber.Ctx) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var vehicle models.Vehicle
+		if err := tx.First(&vehicle, "id = ?", c.Params("vehicle_id")).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("vehicle_id = ?", vehicle.ID).Delete(&models.ProductFitment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("vehicle_id = ?", vehicle.ID).Delete(&models.GarageVehicle{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&vehicle).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "vehicle not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete vehicle"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "vehicle deleted"})
+}
+
+// fitmentInput names the vehicles a product fits, either by id or as every
+// vehicle of a make and model, optionally limited to a trim and a range of
+// model years.
+type fitmentInput struct {
+	VariantID  *uint  `json:"variant_id"`
+	VehicleIDs []uint `json:"vehicle_ids"`
+	Make       string `json:"make"`
+	Model      string `json:"model"`
+	Trim       string `json:"trim"`
+	YearFrom   int    `json:"year_from"`
+	YearTo     int    `json:"year_to"`
+}
+
+func (input fitmentInput) vehicles(db *gorm.DB) ([]models.Vehicle, error) {
+	var vehicles []models.Vehicle
+	if len(input.VehicleIDs) > 0 {
+		if err := db.Where("id IN ?", input.VehicleIDs).Find(&vehicles).Error; err != nil {
+			return nil, err
+		}
+		if len(vehicles) != len(input.VehicleIDs) {
+			return nil, fiber.NewError(fiber.StatusNotFound, "vehicle not found")
+		}
+		return vehicles, nil
+	}
+
+	if input.Make == "" || input.Model == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "give vehicle_ids, or a make and model")
+	}
+	query := fitment.Search(db, input.Make, input.Model, 0, input.Trim)
+	if input.YearFrom != 0 {
+		query = query.Where("year >= ?", input.YearFrom)
+	}
+	if input.YearTo != 0 {
+		query = query.Where("year <= ?", input.YearTo)
+	}
+	if err := query.Find(&vehicles).Error; err != nil {
+		return nil, err
+	}
+	if len(vehicles) == 0 {
+		return nil, fiber.NewError(fiber.StatusNotFound, "no vehicles match")
+	}
+	return vehicles, nil
+}
+
+func ListProductFitments(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+		return shippingLookupError(c, err, "product")
+	}
+
+	var fitments []models.ProductFitment
+	if err := database.DB.Preload("Vehicle").Where("product_id = ?", product.ID).Order("id").Find(&fitments).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve fitments"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "product fitments", "fitments": fitments})
+}
+
+// AddProductFitments maps a product, or one variant of it, to the vehicles
+// it fits. Vehicles it is already mapped to are skipped.
+func AddProductFitments(c *fiber.Ctx) error {
+	var input fitmentInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	var added []models.ProductFitment
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var product models.Product
+		if err := tx.First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+			return err
+		}
+		if _, err := requestedVariant(tx, product, variantParam(input.VariantID), false); err != nil {
+			if errors.Is(err, errVariantNotFound) {
+				return fiber.NewError(fiber.StatusNotFound, err.Error())
+			}
+			return err
+		}
+
+		vehicles, err := input.vehicles(tx)
+		if err != nil {
+			return err
+		}
+
+		var existing []models.ProductFitment
+		if err := whereVariant(tx, variantParam(input.VariantID)).Where("product_id = ?", product.ID).Find(&existing).Error; err != nil {
+			return err
+		}
+		mapped := make(map[uint]bool, len(existing))
+		for _, fitment := range existing {
+			mapped[fitment.VehicleID] = true
+		}
+		for _, vehicle := range vehicles {
+			if !mapped[vehicle.ID] {
+				mapped[vehicle.ID] = true
+				added = append(added, models.ProductFitment{ProductID: product.ID, VariantID: input.VariantID, VehicleID: vehicle.ID})
+			}
+		}
+		if len(added) == 0 {
+			return nil
+		}
+		return tx.Create(&added).Error
+	})
+	if err != nil {
+		var fiberErr *fiber.Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "product not found"})
+		case errors.As(err, &fiberErr):
+			return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to add fitments"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "fitments added", "added": len(added), "fitments": added})
+}
+
+// variantParam is variantID as the query parameter whereVariant takes.
+func variantParam(variantID *uint) string {
+	if variantID == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*variantID), 10)
+}
+
+func DeleteProductFitment(c *fiber.Ctx) error {
+	result := database.DB.Delete(&models.ProductFitment{}, "id = ?", c.Params("fitment_id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete fitment"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "fitment not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "fitment deleted"})
+}
+
+func GetGarage(c *fiber.Ctx) error {
+	vehicle, err := garageVehicle(database.DB, c.Locals("user_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve garage"})
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no vehicle saved in your garage"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "garage", "vehicle": vehicle})
+}
+
+// SaveGarage saves the vehicle the user drives, replacing any saved before.
+func SaveGarage(c *fiber.Ctx) error {
+	var input struct {
+		VehicleID uint `json:"vehicle_id"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	userID, err := convertToUint(c.Locals("user_id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id"})
+	}
+
+	var vehicle models.Vehicle
+	if err := database.DB.First(&vehicle, "id = ?", input.VehicleID).Error; err != nil {
+		return shippingLookupError(c, err, "vehicle")
+	}
+
+	var garage models.GarageVehicle
+	err = database.DB.Unscoped().Where("user_id = ?", userID).First(&garage).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve garage"})
+	}
+
+	garage.UserID = userID
+	garage.VehicleID = vehicle.ID
+	garage.Vehicle = vehicle
+	garage.DeletedAt = gorm.DeletedAt{}
+	if err := database.DB.Unscoped().Omit("Vehicle").Save(&garage).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to save garage"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "vehicle saved to your garage", "vehicle": vehicle})
+}
+
+func DeleteGarage(c *fiber.Ctx) error {
+	result := database.DB.Delete(&models.GarageVehicle{}, "user_id = ?", c.Locals("user_id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to clear garage"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no vehicle saved in your garage"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "garage cleared"})
+}
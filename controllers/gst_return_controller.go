@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"kars/database"
+	"kars/gstr1"
+	"kars/tax"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExportGSTR1 builds the GSTR-1 of a month (?month=2026-09) from the
+// invoices and credit notes issued in it, as the portal's JSON or, with
+// ?format=xlsx, as a workbook for the offline tool.
+func ExportGSTR1(c *fiber.Ctx) error {
+	period, err := time.Parse("2006-01", c.Query("month"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "month must be given as YYYY-MM"})
+	}
+	format := c.Query("format", "json")
+	if format != "json" && format != "xlsx" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be json or xlsx"})
+	}
+
+	gstin := tax.SellerGSTIN()
+	if gstin == "" {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "SELLER_GSTIN is not configured"})
+	}
+
+	ret, err := gstr1.Build(database.DB, gstin, period.Year(), period.Month())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to build GSTR-1"})
+	}
+	if format == "json" {
+		return c.Status(fiber.StatusOK).JSON(ret)
+	}
+
+	file, err := gstr1.XLSX(ret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate GSTR-1 workbook"})
+	}
+	defer file.Close()
+	buf, err := file.WriteToBuffer()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate GSTR-1 workbook"})
+	}
+
+	c.Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	c.Set("Content-Disposition", "attachment; filename=GSTR1_"+ret.Period+".xlsx")
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/database"
+	"kars/invoices"
+	"kars/lifecycle"
+	"kars/models"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errNotInvoiced = errors.New("order is not invoiced until it is paid")
+
+// invoiceable reports whether an order has been sold: orders are invoiced
+// when placed, and online orders once they are paid.
+func invoiceable(order models.Order) bool {
+	if order.PaymentMethod == "online payment" {
+		return order.PaymentStatus == lifecycle.PaymentPaid
+	}
+	return order.OrderStatus != lifecycle.OrderPending
+}
+
+// creditOrder works out the credit for quantities of an order's items and
+// shipping, and issues a credit note for it. Orders sold before invoices
+// were stored are invoiced first, so the credit note has an invoice to go
+// against. The caller must hold the order lock and call it before moving
+// the payment status.
+func creditOrder(tx *gorm.DB, order models.Order, quantities map[uint]int, shipping float64, reason string, returnRequestID *uint) ([]models.CreditNoteLine, *models.CreditNote, error) {
+	lines, err := invoices.CreditLines(tx, order, quantities)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !invoiceable(order) {
+		return lines, nil, nil
+	}
+	if _, err := invoices.Issue(tx, order); err != nil {
+		return nil, nil, err
+	}
+	note, err := invoices.IssueCreditNote(tx, order, reason, returnRequestID, lines, shipping)
+	return lines, note, err
+}
+
+// InvoiceDownload serves the invoice stored when the order was sold. Orders
+// sold before invoices were stored get theirs issued on first download.
+func InvoiceDownload(c *fiber.Ctx) error {
+	orderID := c.Query("order_id")
+	if orderID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order id is required",
+		})
+	}
+
+	var invoice models.Invoice
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ? AND user_id = ?", orderID, c.Locals("user_id")).Error; err != nil {
+			return err
+		}
+		if !invoiceable(order) {
+			return errNotInvoiced
+		}
+		var err error
+		invoice, err = invoices.Issue(tx, order)
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+	case errors.Is(err, errNotInvoiced):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve invoice"})
+	}
+
+	return sendDocument(c, invoice.Number, invoice.Document)
+}
+
+func AdminInvoiceDownload(c *fiber.Ctx) error {
+	var invoice models.Invoice
+	if err := database.DB.First(&invoice, "id = ?", c.Params("invoice_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "invoice not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve invoice"})
+	}
+	return sendDocument(c, invoice.Number, invoice.Document)
+}
+
+func CreditNoteDownload(c *fiber.Ctx) error {
+	query := database.DB
+	if userID := c.Locals("user_id"); userID != nil {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var note models.CreditNote
+	if err := query.First(&note, "id = ?", c.Params("credit_note_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "credit note not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve credit note"})
+	}
+	return sendDocument(c, note.Number, note.Document)
+}
+
+func sendDocument(c *fiber.Ctx, number string, document []byte) error {
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", strings.ReplaceAll(number, "/", "_")))
+	return c.Send(document)
+}
+
+// ListInvoices lists invoices, newest first, optionally for one financial
+// year (?financial_year=2026-27), order or type (?type=b2b or b2c).
+func ListInvoices(c *fiber.Ctx) error {
+	query := database.DB.Preload("Lines").Order("id DESC")
+	if year := c.Query("financial_year"); year != "" {
+		query = query.Where("financial_year = ?", year)
+	}
+	switch c.Query("type") {
+	case "b2b":
+		query = query.Where("buyer_gstin <> ''")
+	case "b2c":
+		query = query.Where("COALESCE(buyer_gstin, '') = ''")
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		query = query.Where("order_id = ?", orderID)
+	}
+
+	var list []models.Invoice
+	if err := query.Find(&list).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve invoices"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "invoices",
+		"invoices": list,
+	})
+}
+
+func ListCreditNotes(c *fiber.Ctx) error {
+	query := database.DB.Preload("Lines").Order("id DESC")
+	if year := c.Query("financial_year"); year != "" {
+		query = query.Where("financial_year = ?", year)
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		query = query.Where("order_id = ?", orderID)
+	}
+
+	var notes []models.CreditNote
+	if err := query.Find(&notes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve credit notes"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":      "credit notes",
+		"credit_notes": notes,
+	})
+}
+
+func ListUserCreditNotes(c *fiber.Ctx) error {
+	var notes []models.CreditNote
+	if err := database.DB.Preload("Lines").Where("user_id = ?", c.Locals("user_id")).Order("id DESC").Find(&notes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve credit notes"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":      "credit notes",
+		"credit_notes": notes,
+	})
+}
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"bytes"
+	"kars/database"
+	"kars/journal"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExportJournal exports the accounting vouchers of a range of days
+// (?from=2026-09-01&to=2026-09-30) as CSV or, with ?format=xml, as a Tally
+// import. Ledger names come from the chart in JOURNAL_ACCOUNTS, if set.
+func ExportJournal(c *fiber.Ctx) error {
+	start, end, err := journal.Period(c.Query("from"), c.Query("to"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	format := c.Query("format", journal.FormatCSV)
+	if format != journal.FormatCSV && format != journal.FormatTally {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be csv or xml"})
+	}
+
+	chart, err := journal.LoadChart(os.Getenv("JOURNAL_ACCOUNTS"))
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to load the chart of accounts"})
+	}
+
+	vouchers, err := journal.Build(database.DB, chart, start, end)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to build the journal"})
+	}
+
+	var buf bytes.Buffer
+	if err := journal.Write(&buf, vouchers, format, os.Getenv("TALLY_COMPANY")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to write the journal"})
+	}
+
+	contentType := "text/csv"
+	if format == journal.FormatTally {
+		contentType = "application/xml"
+	}
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", "attachment; filename=journal_"+c.Query("from")+"_"+c.Query("to")+"."+format)
+	return c.Send(buf.Bytes())
+}
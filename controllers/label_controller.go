@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"kars/barcode"
+	"kars/database"
+	"kars/invoices"
+	"kars/models"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jung-kurt/gofpdf/v2"
+)
+
+// shopAddress is the return address printed on labels and slips.
+const shopAddress = "Kars\nNear Thrissur Round\nThrissur, kerala, 680702\nPhone: +91 8921236125"
+
+// A label is 4x6 inches, the size thermal label printers take.
+var labelSize = gofpdf.SizeType{Wd: 101.6, Ht: 152.4}
+
+// maxBatchOrders bounds one batch print so a single request cannot render
+// the whole order table.
+const maxBatchOrders = 100
+
+// ShippingLabel prints one label per shipment of an order, or a single label
+// when nothing has been packed into a shipment yet.
+func ShippingLabel(c *fiber.Ctx) error {
+	return printOrders(c, []string{c.Params("order_id")}, "label", newLabelPDF, drawLabels)
+}
+
+func PackingSlip(c *fiber.Ctx) error {
+	return printOrders(c, []string{c.Params("order_id")}, "packing-slip", newSlipPDF, drawPackingSlip)
+}
+
+// BatchShippingLabels prints the labels of every order in the order_ids
+// query parameter (comma separated) into one PDF.
+func BatchShippingLabels(c *fiber.Ctx) error {
+	return printOrders(c, strings.Split(c.Query("order_ids"), ","), "labels", newLabelPDF, drawLabels)
+}
+
+func BatchPackingSlips(c *fiber.Ctx) error {
+	return printOrders(c, strings.Split(c.Query("order_ids"), ","), "packing-slips", newSlipPDF, drawPackingSlip)
+}
+
+func newLabelPDF() *gofpdf.Fpdf {
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{UnitStr: "mm", Size: labelSize})
+	pdf.SetMargins(4, 4, 4)
+	pdf.SetAutoPageBreak(false, 0)
+	return pdf
+}
+
+func newSlipPDF() *gofpdf.Fpdf {
+	return gofpdf.New("P", "mm", "A4", "")
+}
+
+func printOrders(c *fiber.Ctx, ids []string, name string, newPDF func() *gofpdf.Fpdf, draw func(*gofpdf.Fpdf, models.Order, []models.Shipment) error) error {
+	var orderIDs []uint
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		orderID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid order id " + id})
+		}
+		orderIDs = append(orderIDs, uint(orderID))
+	}
+	if len(orderIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "order id is required"})
+	}
+	if len(orderIDs) > maxBatchOrders {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("at most %d orders can be printed at once", maxBatchOrders)})
+	}
+
+	var orders []models.Order
+	if err := database.DB.Preload("OrderItems").Where("id IN ?", orderIDs).Find(&orders).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve orders"})
+	}
+	byID := map[uint]models.Order{}
+	for _, order := range orders {
+		byID[order.ID] = order
+	}
+
+	var shipments []models.Shipment
+	if err := database.DB.Preload("Items").Where("order_id IN ?", orderIDs).Order("id").Find(&shipments).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve shipments"})
+	}
+	shipmentsByOrder := map[uint][]models.Shipment{}
+	for _, shipment := range shipments {
+		shipmentsByOrder[shipment.OrderID] = append(shipmentsByOrder[shipment.OrderID], shipment)
+	}
+
+	// Pages follow the order the ids were given in, which is the order the
+	// warehouse picks in.
+	pdf := newPDF()
+	for _, id := range orderIDs {
+		order, ok := byID[id]
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("order %d not found", id)})
+		}
+		if err := draw(pdf, order, shipmentsByOrder[id]); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate PDF"})
+	}
+
+	filename := name + ".pdf"
+	if len(orderIDs) == 1 {
+		filename = fmt.Sprintf("%s-%d.pdf", name, orderIDs[0])
+	}
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", "attachment; filename="+filename)
+	return c.Send(buf.Bytes())
+}
+
+func drawLabels(pdf *gofpdf.Fpdf, order models.Order, shipments []models.Shipment) error {
+	// Cancelled items are credited rather than taken off the order, so the
+	// cash due is what is left after the credit notes.
+	credited, err := invoices.Credited(database.DB, order.ID)
+	if err != nil {
+		return err
+	}
+	due := math.Max(order.FinalPrice-credited, 0)
+
+	if len(shipments) == 0 {
+		return drawLabel(pdf, order, models.Shipment{}, 1, 1, due)
+	}
+	for i, shipment := range shipments {
+		if err := drawLabel(pdf, order, shipment, i+1, len(shipments), due); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawLabel prints the label of parcel n of total. Cash on delivery, due, is
+// collected in full with the first parcel.
+func drawLabel(pdf *gofpdf.Fpdf, order models.Order, shipment models.Shipment, n, total int, due float64) error {
+	pdf.AddPage()
+	width := labelSize.Wd - 8
+
+	pdf.SetFont("Arial", "B", 9)
+	pdf.CellFormat(width, 5, "FROM:", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 8)
+	pdf.MultiCell(width, 4, shopAddress, "", "L", false)
+	pdf.Ln(2)
+	pdf.Line(4, pdf.GetY(), 4+width, pdf.GetY())
+	pdf.Ln(2)
+
+	address := order.OrderAddress
+	pdf.SetFont("Arial", "B", 10)
+	pdf.CellFormat(width, 6, "TO:", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "B", 13)
+	pdf.MultiCell(width, 6, address.Name, "", "L", false)
+	pdf.SetFont("Arial", "", 11)
+	lines := []string{address.AddressLine1, address.AddressLine2, address.LandMark,
+		fmt.Sprintf("%s, %s %s", address.City, address.State, address.PostalCode), address.Country,
+		"Phone: " + address.PhoneNo}
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			pdf.MultiCell(width, 5, line, "", "L", false)
+		}
+	}
+	pdf.Ln(2)
+	pdf.Line(4, pdf.GetY(), 4+width, pdf.GetY())
+	pdf.Ln(2)
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(width/2, 6, fmt.Sprintf("Order #%d", order.ID), "", 0, "L", false, 0, "")
+	pdf.CellFormat(width/2, 6, fmt.Sprintf("Parcel %d of %d", n, total), "", 1, "R", false, 0, "")
+	pdf.SetFont("Arial", "", 9)
+	pdf.CellFormat(width/2, 5, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
+	pdf.CellFormat(width/2, 5, shipment.Carrier, "", 1, "R", false, 0, "")
+	pdf.Ln(2)
+
+	if order.PaymentMethod == "cash on delivery" && order.PaymentStatus != "paid" {
+		pdf.SetFont("Arial", "B", 14)
+		text := fmt.Sprintf("COD: COLLECT Rs %.2f", due)
+		if n > 1 {
+			pdf.SetFont("Arial", "B", 10)
+			text = fmt.Sprintf("COD: Rs %.2f collected with parcel 1", due)
+		}
+		pdf.CellFormat(width, 10, text, "1", 1, "C", false, 0, "")
+	} else {
+		pdf.SetFont("Arial", "B", 14)
+		pdf.CellFormat(width, 10, "PREPAID", "1", 1, "C", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	code := shipment.TrackingNumber
+	if code == "" {
+		code = fmt.Sprintf("KARS%d", order.ID)
+	}
+	if err := drawCode128(pdf, code, 4, pdf.GetY(), width, 22); err != nil {
+		return fmt.Errorf("order %d: %v", order.ID, err)
+	}
+	pdf.SetY(pdf.GetY() + 23)
+	pdf.SetFont("Courier", "B", 11)
+	pdf.CellFormat(width, 5, code, "", 1, "C", false, 0, "")
+	return nil
+}
+
+// drawCode128 draws text as a Code 128 barcode centred in a box of the
+// given width, leaving the ten module quiet zone scanners need on each side.
+func drawCode128(pdf *gofpdf.Fpdf, text string, x, y, width, height float64) error {
+	widths, err := barcode.Code128(text)
+	if err != nil {
+		return err
+	}
+
+	modules := barcode.Modules(widths) + 20
+	module := width / float64(modules)
+	if module > 0.5 {
+		module = 0.5
+	}
+	if module < 0.19 {
+		return errors.New("barcode does not fit on the label")
+	}
+
+	x += (width - module*float64(modules)) / 2
+	x += 10 * module
+	pdf.SetFillColor(0, 0, 0)
+	for i, w := range widths {
+		if i%2 == 0 {
+			pdf.Rect(x, y, module*float64(w), height, "F")
+		}
+		x += module * float64(w)
+	}
+	return nil
+}
+
+// drawPackingSlip lists what goes into the box: every item not cancelled,
+// and which parcel each unit was packed into.
+func drawPackingSlip(pdf *gofpdf.Fpdf, order models.Order, shipments []models.Shipment) error {
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "B", 20)
+	pdf.CellFormat(190, 12, "PACKING SLIP", "0", 1, "C", false, 0, "")
+	pdf.Ln(6)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(40, 10, "From:")
+	pdf.SetFont("Arial", "", 12)
+	pdf.MultiCell(150, 7, shopAddress, "0", "L", false)
+	pdf.Ln(3)
+
+	address := order.OrderAddress
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(40, 10, "Ship To:")
+	pdf.SetFont("Arial", "", 12)
+	pdf.MultiCell(150, 7, fmt.Sprintf("%s\n%s\n%s, %s %s\n%s",
+		address.Name, address.AddressLine1, address.City, address.State, address.PostalCode, address.PhoneNo), "0", "L", false)
+	pdf.Ln(5)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(40, 8, "Order ID:")
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(60, 8, fmt.Sprintf("%d", order.ID))
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(30, 8, "Date:")
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(60, 8, order.CreatedAt.Format("2006-01-02"))
+	pdf.Ln(12)
+
+	parcels := map[uint][]string{}
+	for i, shipment := range shipments {
+		for _, item := range shipment.Items {
+			parcels[item.OrderItemID] = append(parcels[item.OrderItemID], fmt.Sprintf("#%d x%d", i+1, item.Quantity))
+		}
+	}
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.CellFormat(20, 10, "Item ID", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(85, 10, "Item Name", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(20, 10, "Quantity", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(45, 10, "Parcel", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(20, 10, "Packed", "1", 1, "C", false, 0, "")
+
+	pdf.SetFont("Arial", "", 12)
+	units := 0
+	for _, item := range order.OrderItems {
+		if item.IsCancelled == "cancelled" {
+			continue
+		}
+		units += item.Quantity
+		pdf.CellFormat(20, 10, fmt.Sprintf("%d", item.ProductID), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(85, 10, item.ProductName, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(20, 10, fmt.Sprintf("%d", item.Quantity), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(45, 10, strings.Join(parcels[item.ID], ", "), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(20, 10, "", "1", 1, "C", false, 0, "")
+	}
+	if units == 0 {
+		return fmt.Errorf("order %d has no items to pack", order.ID)
+	}
+
+	pdf.Ln(6)
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(140, 10, "Total Units:")
+	pdf.Cell(40, 10, fmt.Sprintf("%d", units))
+	return nil
+}
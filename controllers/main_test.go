@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kars/database"
+	"kars/models"
+	"kars/shipping"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The handler tests run against the PostgreSQL database in TEST_DB_DSN,
+// such as "host=localhost user=postgres password=password dbname=kars_test
+// sslmode=disable", and are skipped without one. Each test creates the
+// rows it uses, so they can share a database with other data.
+var (
+	setupOnce sync.Once
+	setupErr  error
+	fixtureID atomic.Int64
+)
+
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	setupOnce.Do(func() {
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			setupErr = err
+			return
+		}
+		database.DB = db
+		if setupErr = database.MigrateModels(); setupErr != nil {
+			return
+		}
+		setupErr = shipping.SeedDefaults(db)
+	})
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+	return database.DB
+}
+
+// unique returns a string no other fixture of this or an earlier run uses.
+func unique(prefix string) string {
+	return fmt.Sprintf("%s-%d-%d", prefix, time.Now().UnixNano(), fixtureID.Add(1))
+}
+
+func create(t *testing.T, db *gorm.DB, value interface{}) {
+	t.Helper()
+	if err := db.Create(value).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newUser creates an active user with a default address.
+func newUser(t *testing.T, db *gorm.DB) (models.User, models.Address) {
+	t.Helper()
+	user := models.User{UserName: "test", Email: unique("user") + "@example.com", Password: "x", Status: "Active"}
+	create(t, db, &user)
+	address := models.Address{
+		UserID:       user.ID,
+		Name:         "Test User",
+		PhoneNo:      "9999999999",
+		AddressLine1: "1 MG Road",
+		City:         "Bengaluru",
+		State:        "Karnataka",
+		PostalCode:   "560001",
+		Country:      "India",
+		AddressType:  "shipping",
+		IsDefault:    true,
+	}
+	create(t, db, &address)
+	return user, address
+}
+
+// newProduct creates a listed product, tax included in its price, in a
+// category of its own.
+func newProduct(t *testing.T, db *gorm.DB, price float64, quantity int) models.Product {
+	t.Helper()
+	category := models.Category{CategoryName: unique("category"), GSTRate: 18, PricesIncludeTax: true}
+	create(t, db, &category)
+	product := models.Product{ProductName: unique("product"), Price: price, Quantity: quantity, CategoryID: category.ID}
+	create(t, db, &product)
+	return product
+}
+
+// fillCart gives user a cart holding quantity of product.
+func fillCart(t *testing.T, db *gorm.DB, user models.User, product models.Product, quantity int) models.Cart {
+	t.Helper()
+	cart := models.Cart{UserID: user.ID, TotalItems: quantity, CartItems: []models.CartItem{{
+		ProductID:    product.ID,
+		ProductName:  product.ProductName,
+		ProductPrice: product.Price,
+		TotalPrice:   product.Price * float64(quantity),
+		Quantity:     quantity,
+	}}}
+	create(t, db, &cart)
+	return cart
+}
+
+// asUser runs handler as the signed in user, the way CheckUserStatus
+// leaves the JWT claim.
+func asUser(user models.User, handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user_id", float64(user.ID))
+		return handler(c)
+	}
+}
+
+// call sends a JSON request to app and decodes the JSON response.
+func call(t *testing.T, app *fiber.App, method, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
+		t.Fatalf("%s %s: decoding response: %v", method, path, err)
+	}
+	return resp.StatusCode, result
+}
@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/models"
+	"kars/pricing"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Pointer fields let PATCH requests change only what they send. Times are
+// RFC 3339; an empty ends_at leaves the offer open ended.
+type offerInput struct {
+	Name       *string  `json:"name"`
+	Target     *string  `json:"target"`
+	TargetID   *uint    `json:"target_id"`
+	OfferType  *string  `json:"offer_type"`
+	OfferValue *float64 `json:"offer_value"`
+	Priority   *int     `json:"priority"`
+	Stacking   *string  `json:"stacking"`
+	StartsAt   *string  `json:"starts_at"`
+	EndsAt     *string  `json:"ends_at"`
+	IsActive   *bool    `json:"is_active"`
+}
+
+func (input offerInput) apply(offer *models.Offer) error {
+	if input.Name != nil {
+		offer.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Target != nil {
+		offer.Target = *input.Target
+		if offer.Target == pricing.TargetAll {
+			offer.TargetID = nil
+		}
+	}
+	if input.TargetID != nil {
+		offer.TargetID = input.TargetID
+	}
+	if input.OfferType != nil {
+		offer.OfferType = *input.OfferType
+	}
+	if input.OfferValue != nil {
+		offer.OfferValue = *input.OfferValue
+	}
+	if input.Priority != nil {
+		offer.Priority = *input.Priority
+	}
+	if input.Stacking != nil {
+		offer.Stacking = *input.Stacking
+	}
+	if input.StartsAt != nil {
+		startsAt, err := time.Parse(time.RFC3339, *input.StartsAt)
+		if err != nil {
+			return errors.New("starts_at must be an RFC 3339 time")
+		}
+		offer.StartsAt = startsAt
+	}
+	if input.EndsAt != nil {
+		if *input.EndsAt == "" {
+			offer.EndsAt = nil
+		} else {
+			endsAt, err := time.Parse(time.RFC3339, *input.EndsAt)
+			if err != nil {
+				return errors.New("ends_at must be an RFC 3339 time")
+			}
+			offer.EndsAt = &endsAt
+		}
+	}
+	if input.IsActive != nil {
+		offer.IsActive = *input.IsActive
+	}
+	if err := pricing.Validate(*offer); err != nil {
+		return err
+	}
+
+	switch offer.Target {
+	case pricing.TargetProduct:
+		if err := database.DB.First(&models.Product{}, *offer.TargetID).Error; err != nil {
+			return errors.New("product not found")
+		}
+	case pricing.TargetCategory:
+		if err := database.DB.First(&models.Category{}, *offer.TargetID).Error; err != nil {
+			return errors.New("category not found")
+		}
+	}
+	return nil
+}
+
+// ListOffers lists scheduled offers, optionally only those running now,
+// scheduled to start or expired (?status=running, scheduled or expired).
+func ListOffers(c *fiber.Ctx) error {
+	now := time.Now()
+	query := database.DB.Order("starts_at DESC, id DESC")
+	switch c.Query("status") {
+	case "":
+	case "running":
+		query = query.Where("is_active = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", true, now, now)
+	case "scheduled":
+		query = query.Where("starts_at > ?", now)
+	case "expired":
+		query = query.Where("ends_at <= ?", now)
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status must be running, scheduled or expired"})
+	}
+
+	var offers []models.Offer
+	if err := query.Find(&offers).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve offers"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "offers", "offers": offers})
+}
+
+func AddOffer(c *fiber.Ctx) error {
+	var input offerInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	offer := models.Offer{Stacking: pricing.StackingExclusive, IsActive: true}
+	if err := input.apply(&offer); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Create(&offer).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create offer"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "offer created", "offer": offer})
+}
+
+func EditOffer(c *fiber.Ctx) error {
+	var offer models.Offer
+	if err := database.DB.First(&offer, "id = ?", c.Params("offer_id")).Error; err != nil {
+		return shippingLookupError(c, err, "offer")
+	}
+
+	var input offerInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.apply(&offer); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Save(&offer).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update offer"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "offer updated", "offer": offer})
+}
+
+func DeleteOffer(c *fiber.Ctx) error {
+	result := database.DB.Delete(&models.Offer{}, "id = ?", c.Params("offer_id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete offer"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "offer not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "offer deleted"})
+}
+
+// PreviewProductPrice prices a product, or a variant of it (?variant_id=),
+// as it will sell at a time (?at=2026-11-01T00:00:00+05:30), now if none is
+// given.
+func PreviewProductPrice(c *fiber.Ctx) error {
+	at := time.Now()
+	if value := c.Query("at"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "at must be an RFC 3339 time"})
+		}
+		at = parsed
+	}
+
+	var product models.Product
+	if err := database.DB.First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+		return shippingLookupError(c, err, "product")
+	}
+
+	variant, err := requestedVariant(database.DB, product, c.Query("variant_id"), false)
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	pricer, err := pricing.NewPricer(database.DB, []models.Product{product}, at)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to price product"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":         "price preview",
+		"product_id":      product.ID,
+		"at":              at,
+		"price_breakdown": pricer.Price(product, variant),
+	})
+}
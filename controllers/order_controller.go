@@ -4,17 +4,30 @@ import (
 	"errors"
 	"fmt"
 	"kars/database"
+	"kars/invoices"
+	"kars/ledger"
+	"kars/lifecycle"
 	"kars/models"
+	"kars/pricing"
+	"kars/shipping"
+	"kars/tax"
 	"log"
+	"math"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type userInput struct {
 	AddressId     uint   `json:"address_id"`
 	CouponCode    string `json:"coupon_code"`
 	PaymentMethod string `json:"payment_method"`
+	// UseWallet puts the wallet balance toward an online payment order.
+	UseWallet bool `json:"use_wallet"`
+	// B2BInvoice bills the order to the user's business profile.
+	B2BInvoice bool `json:"b2b_invoice"`
 }
 
 func PlaceOrder(c *fiber.Ctx) error {
@@ -39,6 +52,18 @@ func PlaceOrder(c *fiber.Ctx) error {
 		})
 	}
 
+	if input.PaymentMethod != "cash on delivery" && input.PaymentMethod != "online payment" && input.PaymentMethod != "wallet" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "payment method must be 'cash on delivery', 'online payment' or 'wallet'",
+		})
+	}
+
+	if input.UseWallet && input.PaymentMethod != "online payment" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "use_wallet is only allowed with online payment",
+		})
+	}
+
 	var address models.Address
 	if err := database.DB.First(&address, "id = ? AND user_id = ?", input.AddressId, userID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -46,10 +71,46 @@ func PlaceOrder(c *fiber.Ctx) error {
 				"error": "address not found",
 			})
 		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve address",
+		})
+	}
+
+	if _, err := shipping.CheckPincode(database.DB, address.PostalCode, input.PaymentMethod == "cash on delivery"); err != nil {
+		return pincodeError(c, err)
+	}
+
+	var business models.BusinessProfile
+	if input.B2BInvoice {
+		if err := database.DB.First(&business, "user_id = ?", userID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": errNoBusinessProfile.Error(),
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to retrieve business profile",
+			})
+		}
 	}
 
+	tx := database.DB.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if tx.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "unable to start transaction",
+		})
+	}
+
+	// Locking the cart row serialises concurrent checkouts of the same cart.
 	var cart models.Cart
-	if err := database.DB.Preload("CartItems").First(&cart, "user_id = ?", userID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cart, "user_id = ?", userID).Error; err != nil {
+		tx.Rollback()
 		log.Println("failed to fetch cart details:", err)
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -61,10 +122,123 @@ func PlaceOrder(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := tx.Find(&cart.CartItems, "cart_id = ?", cart.ID).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve cart items",
+		})
+	}
+
+	if len(cart.CartItems) == 0 {
+		tx.Rollback()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "cart is empty",
+		})
+	}
+
+	// Products are locked in id order so that two checkouts sharing products
+	// cannot deadlock each other.
+	productIDs := make([]uint, 0, len(cart.CartItems))
+	for _, item := range cart.CartItems {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	var products []models.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", productIDs).Order("id").Find(&products).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch products",
+		})
+	}
+
+	stock := make(map[uint]models.Product, len(products))
+	for _, product := range products {
+		stock[product.ID] = product
+	}
+
+	// Items of products sold in variants take their stock from the variant;
+	// the product's stock, being the sum of its variants', goes down with it.
+	variantIDs := make([]uint, 0, len(cart.CartItems))
+	for _, item := range cart.CartItems {
+		if item.VariantID != nil {
+			variantIDs = append(variantIDs, *item.VariantID)
+		}
+	}
+	var variants []models.ProductVariant
+	if len(variantIDs) > 0 {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", variantIDs).Order("id").Find(&variants).Error; err != nil {
+			tx.Rollback()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to fetch product variants",
+			})
+		}
+	}
+	variantStock := make(map[uint]models.ProductVariant, len(variants))
+	for _, variant := range variants {
+		variantStock[variant.ID] = variant
+	}
+	var withVariants []uint
+	if err := tx.Model(&models.ProductVariant{}).Where("product_id IN ?", productIDs).Distinct().Pluck("product_id", &withVariants).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch product variants",
+		})
+	}
+	hasVariants := make(map[uint]bool, len(withVariants))
+	for _, id := range withVariants {
+		hasVariants[id] = true
+	}
+
+	for _, item := range cart.CartItems {
+		product, ok := stock[item.ProductID]
+		if !ok {
+			tx.Rollback()
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "product not found: " + item.ProductName,
+			})
+		}
+
+		if item.VariantID == nil && hasVariants[item.ProductID] {
+			tx.Rollback()
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "choose a variant of " + product.ProductName,
+			})
+		}
+
+		if item.VariantID != nil {
+			variant, ok := variantStock[*item.VariantID]
+			if !ok {
+				tx.Rollback()
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "product variant not found: " + item.ProductName,
+				})
+			}
+			if variant.Quantity < item.Quantity {
+				tx.Rollback()
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Not enough stock for product " + item.ProductName,
+				})
+			}
+			variant.Quantity -= item.Quantity
+			variantStock[variant.ID] = variant
+		}
+
+		if product.Quantity < item.Quantity {
+			tx.Rollback()
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Not enough stock for product " + product.ProductName,
+			})
+		}
+
+		product.Quantity -= item.Quantity
+		stock[item.ProductID] = product
+	}
+
 	var coupon models.Coupon
 	var couponUsage models.CouponUsage
 	if input.CouponCode != "" {
-		if err := database.DB.Where("coupon_code = ?", input.CouponCode).First(&coupon).Error; err != nil {
+		if err := tx.Where("coupon_code = ?", input.CouponCode).First(&coupon).Error; err != nil {
+			tx.Rollback()
 			if err == gorm.ErrRecordNotFound {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 					"error": "coupon not found",
@@ -76,43 +250,93 @@ func PlaceOrder(c *fiber.Ctx) error {
 		}
 
 		if !coupon.IsActive {
+			tx.Rollback()
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "coupon is not active",
 			})
 		}
 
-		if err := database.DB.First(&couponUsage, "user_id = ? AND coupon_code = ?", userID, input.CouponCode).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				couponUsageLimit := models.CouponUsage{
-					CouponCode: input.CouponCode,
-					UserID:     cart.UserID,
-					Limit:      0,
-				}
-
-				if err := database.DB.Create(&couponUsageLimit).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to create coupon usage",
-					})
-				}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&couponUsage, "user_id = ? AND coupon_code = ?", userID, input.CouponCode).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				tx.Rollback()
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to retrieve coupon usage",
+				})
+			}
+
+			couponUsage = models.CouponUsage{
+				CouponCode: input.CouponCode,
+				UserID:     cart.UserID,
+				Limit:      0,
+			}
+
+			if err := tx.Create(&couponUsage).Error; err != nil {
+				tx.Rollback()
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "failed to create coupon usage",
+				})
 			}
 		}
 
 		if coupon.UsageLimit <= couponUsage.Limit {
+			tx.Rollback()
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "you exceeded the coupon usage limit",
 			})
 		}
 	}
+
+	// Items are charged at the products' current prices, not the ones they
+	// were added to the cart at.
+	pricer, err := pricing.NewPricer(tx, products, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to price products",
+		})
+	}
+	for i, item := range cart.CartItems {
+		var variant *models.ProductVariant
+		if item.VariantID != nil {
+			found := variantStock[*item.VariantID]
+			variant = &found
+		}
+		price := pricer.Price(stock[item.ProductID], variant)
+		cart.CartItems[i].ProductPrice = price.Price
+		cart.CartItems[i].TotalPrice = tax.Round(price.Price * float64(item.Quantity))
+	}
+
+	taxConfigs, err := productTaxConfigs(tx, stock)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve tax rates",
+		})
+	}
+
+	// Items priced without tax get it added here, so each order item's
+	// total is what the customer pays for it.
+	var orderItems []models.OrderItem
 	totalPrice := 0.0
 	for _, item := range cart.CartItems {
-		totalPrice += item.TotalPrice
+		gross := tax.Gross(item.TotalPrice, taxConfigs[item.ProductID])
+		orderItems = append(orderItems, models.OrderItem{
+			ProductID:    item.ProductID,
+			ProductName:  item.ProductName,
+			ProductPrice: tax.Round(gross / float64(item.Quantity)),
+			Quantity:     item.Quantity,
+			TotalPrice:   gross,
+			VariantID:    item.VariantID,
+			SKU:          item.SKU,
+		})
+		totalPrice += gross
 	}
 
 	var discountAmount float64
 	if coupon.DiscountType == "fixed" {
 		discountAmount = coupon.DiscountValue
 	}
-	
+
 	if coupon.DiscountType == "percentage" {
 		discountAmount = totalPrice * coupon.DiscountValue / 100
 	}
@@ -123,37 +347,79 @@ func PlaceOrder(c *fiber.Ctx) error {
 		}
 	}
 
-	finalPrice := 0.0
-	shippingAmount := 0.0
-	if totalPrice > 500 {
-		shippingAmount = 30
+	weight := 0
+	for _, item := range cart.CartItems {
+		weight += stock[item.ProductID].Weight * item.Quantity
 	}
+	quote, err := shipping.QuoteFor(tx, shipping.Parcel{
+		Weight:     weight,
+		Value:      totalPrice,
+		COD:        input.PaymentMethod == "cash on delivery",
+		State:      address.State,
+		PostalCode: address.PostalCode,
+	})
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, shipping.ErrNoRate) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to calculate shipping",
+		})
+	}
+
+	finalPrice := 0.0
+	shippingAmount := quote.Total
 	finalPrice = totalPrice + shippingAmount - discountAmount
 
+	taxes := applyItemTax(orderItems, taxConfigs, math.Min(discountAmount, totalPrice), address.State)
+
 	var orderStatus string
 	var paymentStatus string
 
 	if input.PaymentMethod == "cash on delivery" {
 
 		if finalPrice > 1000 {
+			tx.Rollback()
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "cash on delivery is not allowed for orders with a final price greater than 1000",
 			})
 		}
 
-		orderStatus = "placed"
-		paymentStatus = "pending"
+		orderStatus = lifecycle.OrderPlaced
+		paymentStatus = lifecycle.PaymentPending
+	}
+
+	// With use_wallet the wallet balance is held for the order and only the
+	// remainder is paid online. A balance that covers the whole order turns
+	// it into a plain wallet order.
+	var walletAmount float64
+	if input.UseWallet {
+		wallet, err := ledger.LockWallet(tx, cart.UserID, false)
+		if err != nil && !errors.Is(err, ledger.ErrWalletNotFound) {
+			tx.Rollback()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to retrieve user wallet",
+			})
+		}
+		walletAmount = math.Round(math.Min(math.Max(wallet.TotalAmount, 0), finalPrice)*100) / 100
+		if walletAmount >= finalPrice {
+			input.PaymentMethod = "wallet"
+		}
 	}
 
 	if input.PaymentMethod == "online payment" {
-		orderStatus = "pending"
-		paymentStatus = "pending"
+		orderStatus = lifecycle.OrderPending
+		paymentStatus = lifecycle.PaymentPending
 	}
 
 	if input.PaymentMethod == "wallet" {
-		var wallet models.Wallet
-		if err := database.DB.First(&wallet, "user_id = ?", userID).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
+		wallet, err := ledger.LockWallet(tx, cart.UserID, false)
+		if err != nil {
+			tx.Rollback()
+			if errors.Is(err, ledger.ErrWalletNotFound) {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 					"error": "user wallet not found",
 				})
@@ -164,34 +430,20 @@ func PlaceOrder(c *fiber.Ctx) error {
 		}
 
 		if wallet.TotalAmount < finalPrice {
+			tx.Rollback()
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "not enough balance",
 			})
-		} else {
-
-			newBalance := wallet.TotalAmount - finalPrice
-			fmt.Println(newBalance)
-			if err := database.DB.Model(&wallet).Update("total_amount", newBalance).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to update wallet balance",
-				})
-			}
-
-			walletHistory := models.WalletHistory{
-				WalletID: wallet.ID,
-				Type:     "debit",
-				Amount:   finalPrice,
-			}
+		}
 
-			if err := database.DB.Create(&walletHistory).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to update wallet history",
-				})
-			}
+		paymentStatus = lifecycle.PaymentPaid
+		orderStatus = lifecycle.OrderPlaced
+		walletAmount = finalPrice
+	}
 
-			paymentStatus = "paid "
-			orderStatus = "placed"
-		}
+	var onlineAmount float64
+	if input.PaymentMethod == "online payment" {
+		onlineAmount = finalPrice - walletAmount
 	}
 
 	order := models.Order{
@@ -200,6 +452,8 @@ func PlaceOrder(c *fiber.Ctx) error {
 		DiscountAmount: discountAmount,
 		ShippingAmount: shippingAmount,
 		FinalPrice:     finalPrice,
+		WalletAmount:   walletAmount,
+		OnlineAmount:   onlineAmount,
 		OrderAddress: models.OrderAddress{
 			Name:         address.Name,
 			PhoneNo:      address.PhoneNo,
@@ -215,71 +469,114 @@ func PlaceOrder(c *fiber.Ctx) error {
 		OrderStatus:   orderStatus,
 		PaymentStatus: paymentStatus,
 		CouponCode:    input.CouponCode,
+		TaxableAmount: taxes.TaxableValue,
+		CGSTAmount:    taxes.CGST,
+		SGSTAmount:    taxes.SGST,
+		IGSTAmount:    taxes.IGST,
+		PlaceOfSupply: address.State,
+
+		BuyerGSTIN:     business.GSTIN,
+		BuyerLegalName: business.LegalName,
+	}
+	if input.B2BInvoice {
+		order.BuyerBillingAddress = billingAddress(business)
 	}
+	applyShippingTax(&order, orderItems, address.State)
 
-	if err := database.DB.Create(&order).Error; err != nil {
+	if err := tx.Create(&order).Error; err != nil {
+		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create order",
 		})
 	}
 
-	var orderItems []models.OrderItem
-	for _, item := range cart.CartItems {
-		orderItems = append(orderItems, models.OrderItem{
-			OrderID:      order.ID,
-			ProductID:    item.ProductID,
-			ProductName:  item.ProductName,
-			ProductPrice: item.ProductPrice,
-			Quantity:     item.Quantity,
-			TotalPrice:   item.TotalPrice,
+	if err := lifecycle.RecordCreated(tx, &order, lifecycle.UserActor(userID)); err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to record order status",
 		})
 	}
 
-	if err := database.DB.Create(&orderItems).Error; err != nil {
+	for i := range orderItems {
+		orderItems[i].OrderID = order.ID
+	}
+
+	if err := tx.Create(&orderItems).Error; err != nil {
+		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create order items",
 		})
 	}
 
-	for _, item := range orderItems {
-		var product models.Product
-		if err := database.DB.First(&product, item.ProductID).Error; err != nil {
+	for _, product := range stock {
+		if err := tx.Model(&product).Update("quantity", product.Quantity).Error; err != nil {
+			tx.Rollback()
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to fetch product",
+				"error": "Failed to update product quantity",
 			})
 		}
+	}
 
-		if product.Quantity < item.Quantity {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Not enough stock for product " + product.ProductName,
+	for _, variant := range variantStock {
+		if err := tx.Model(&variant).Update("quantity", variant.Quantity).Error; err != nil {
+			tx.Rollback()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update product quantity",
 			})
 		}
+	}
 
-		product.Quantity -= item.Quantity
-		if err := database.DB.Model(&product).Update("quantity", product.Quantity).Error; err != nil {
+	if input.PaymentMethod == "wallet" {
+		_, err := ledger.DebitWallet(tx, cart.UserID, finalPrice, ledger.AccountSales, ledger.KindOrderPayment, ledger.OrderRef(order.ID), "order payment")
+		if err != nil {
+			tx.Rollback()
+			log.Println("failed to debit wallet:", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to update product quantity",
+				"error": "failed to update wallet balance",
 			})
 		}
 	}
 
-	if err := database.DB.Delete(&models.Cart{}, "id = ?", cart.ID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "order place but failed to clear cart",
-		})
+	if input.PaymentMethod == "online payment" && walletAmount > 0 {
+		if err := ledger.HoldWallet(tx, cart.UserID, order.ID, walletAmount); err != nil {
+			tx.Rollback()
+			log.Println("failed to hold wallet:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to hold wallet balance",
+			})
+		}
 	}
 
-	if err := database.DB.First(&couponUsage, "user_id = ? AND coupon_code = ?", userID, input.CouponCode).Error; err != nil {
+	if input.CouponCode != "" {
+		if err := tx.Model(&couponUsage).Update("limit", gorm.Expr(`"limit" + 1`)).Error; err != nil {
+			tx.Rollback()
+			log.Print(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to update the coupon usage limit",
+			})
+		}
+	}
+
+	if order.OrderStatus == lifecycle.OrderPlaced {
+		if _, err := invoices.Issue(tx, order); err != nil {
+			tx.Rollback()
+			log.Println("failed to issue invoice:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to issue invoice",
+			})
+		}
+	}
+
+	if err := tx.Delete(&models.Cart{}, "id = ?", cart.ID).Error; err != nil {
+		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to retrieve coupon usage",
+			"error": "failed to clear cart",
 		})
 	}
 
-	couponUsage.Limit += 1
-	if err := database.DB.Save(&couponUsage).Error; err != nil {
-		log.Print(err)
+	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to update the coupon usage limit",
+			"error": "Transaction commit failed",
 		})
 	}
 
@@ -299,8 +596,44 @@ func CancelOrder(c *fiber.Ctx) error {
 		})
 	}
 
+	var input struct {
+		Reason       string `json:"reason"`
+		RefundMethod string `json:"refund_method"`
+	}
+	c.BodyParser(&input)
+
+	method, err := refundMethod(input.RefundMethod)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx := database.DB.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if tx.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "unable to start transaction",
+		})
+	}
+
+	// The same handler serves the user and the admin cancel routes; only the
+	// user route sets user_id.
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	actor := lifecycle.AdminActor(c.Locals("admin_id"))
+	if userID := c.Locals("user_id"); userID != nil {
+		query = query.Where("user_id = ?", userID)
+		actor = lifecycle.UserActor(userID)
+	}
+
 	var order models.Order
-	if err := database.DB.First(&order, "id = ?", orderID).Error; err != nil {
+	if err := query.First(&order, "id = ?", orderID).Error; err != nil {
+		tx.Rollback()
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "order not found",
@@ -311,104 +644,71 @@ func CancelOrder(c *fiber.Ctx) error {
 		})
 	}
 
-	switch order.OrderStatus {
-	case "shipped":
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already shipped and you can't cancel the order",
-		})
-	case "cancelled":
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already cancelled",
-		})
+	if err := lifecycle.TransitionOrder(tx, &order, lifecycle.OrderCancelled, actor, input.Reason); err != nil {
+		tx.Rollback()
+		return transitionError(c, err)
 	}
 
 	var orderItems []models.OrderItem
-	if err := database.DB.Find(&orderItems, "order_id = ?", order.ID).Error; err != nil {
+	if err := tx.Find(&orderItems, "order_id = ? AND is_cancelled = ?", order.ID, "ordered").Error; err != nil {
+		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to retrieve order items",
 		})
 	}
 
 	for _, item := range orderItems {
-		var product models.Product
-		if err := database.DB.First(&product, item.ProductID).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to retrieve product",
-			})
-		}
-
-		product.Quantity += item.Quantity
-		if err := database.DB.Model(&product).Update("quantity", product.Quantity).Error; err != nil {
+		if err := restock(tx, item.ProductID, item.VariantID, item.Quantity); err != nil {
+			tx.Rollback()
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "failed to update product quantity",
 			})
 		}
 	}
 
-	if order.PaymentStatus == "paid" {
-		var wallet models.Wallet
-
-		if err := database.DB.First(&wallet, "user_id = ?", order.UserID).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
+	uncredited, err := invoices.Uncredited(tx, order)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order items",
+		})
+	}
 
-				newWallet := models.Wallet{
-					UserID:      order.UserID,
-					TotalAmount: order.FinalPrice,
-				}
-				if err := database.DB.Create(&newWallet).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to create wallet",
-					})
-				}
-
-				walletHistory := models.WalletHistory{
-					WalletID: newWallet.ID,
-					Type:     "credit",
-					Amount:   order.FinalPrice,
-				}
-				if err := database.DB.Create(&walletHistory).Error; err != nil {
-					log.Print(err)
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to update wallet history",
-					})
-				}
-			} else {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to retrieve wallet",
-				})
-			}
-		} else {
-			wallet.TotalAmount += order.FinalPrice
-			if err := database.DB.Model(&wallet).Update("total_amount", wallet.TotalAmount).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to update wallet",
-				})
-			}
+	lines, note, err := creditOrder(tx, order, uncredited, order.ShippingAmount, "order cancelled", nil)
+	if err != nil {
+		tx.Rollback()
+		log.Print(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to issue credit note",
+		})
+	}
 
-			walletHistory := models.WalletHistory{
-				WalletID: wallet.ID,
-				Type:     "credit",
-				Amount:   order.FinalPrice,
-			}
-			if err := database.DB.Create(&walletHistory).Error; err != nil {
-				log.Print(err)
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to update wallet history",
-				})
-			}
+	if lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentRefunded) {
+		if err := refundOrder(tx, &order, invoices.CreditTotal(lines, order.ShippingAmount), method, actor, "order cancelled", note); err != nil {
+			tx.Rollback()
+			return refundError(c, err)
+		}
+	} else {
+		if err := ledger.ReleaseHold(tx, order.UserID, order.ID, "order cancelled"); err != nil {
+			tx.Rollback()
+			log.Print(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to update wallet",
+			})
 		}
-	}
 
-	updates := map[string]interface{}{
-		"order_status":   "cancelled",
-		"payment_status": "returned",
+		if err := lifecycle.TransitionPayment(tx, &order, lifecycle.PaymentCancelled, actor, "order cancelled"); err != nil {
+			tx.Rollback()
+			return transitionError(c, err)
+		}
 	}
 
-	if err := database.DB.Model(&order).Updates(updates).Error; err != nil {
+	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to update order status",
+			"error": "Transaction commit failed",
 		})
 	}
+	sendGatewayRefunds(database.DB, order.ID)
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "order successfully cancelled",
@@ -416,6 +716,8 @@ func CancelOrder(c *fiber.Ctx) error {
 	})
 }
 
+// ReturnOrder asks to return every item of a delivered order that is still
+// returnable. Like any return request it waits for an admin to review it.
 func ReturnOrder(c *fiber.Ctx) error {
 
 	userID := c.Locals("user_id")
@@ -432,105 +734,34 @@ func ReturnOrder(c *fiber.Ctx) error {
 		})
 	}
 
-	var order models.Order
-	if err := database.DB.First(&order, "id = ?", orderID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "order not found",
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to retrieve order",
-		})
-	}
-
-	if order.OrderStatus == "cancelled" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already cancelled",
-		})
-	}
-
-	if order.OrderStatus == "shipped" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "you can't return the order",
-		})
-	}
+	var input returnInput
+	c.BodyParser(&input)
 
-	if order.OrderStatus == "placed" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order not shipped, you can cancel the order instead",
-		})
-	}
-
-	if order.OrderStatus == "delivered" {
-		var wallet models.Wallet
-		if err := database.DB.First(&wallet, "user_id = ?", order.UserID).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				newWallet := models.Wallet{
-					UserID:      order.UserID,
-					TotalAmount: order.FinalPrice,
-				}
-
-				if err := database.DB.Create(&newWallet).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to create wallet",
-					})
-				}
-
-				walletHistory := models.WalletHistory{
-					WalletID: wallet.ID,
-					Type:     "credit",
-					Amount:   order.FinalPrice,
-				}
-
-				if err := database.DB.Create(&walletHistory).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to update wallet history",
-					})
-				}
-
-			} else {
-				wallet.TotalAmount += order.FinalPrice
-				if err := database.DB.Save(&wallet).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to udpate wallet",
-					})
-				}
-
-				walletHistory := models.WalletHistory{
-					WalletID: wallet.ID,
-					Type:     "credit",
-					Amount:   order.FinalPrice,
-				}
-
-				if err := database.DB.Create(&walletHistory).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to update wallet history",
-					})
-				}
+	var request models.ReturnRequest
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ? AND user_id = ?", orderID, userID).Error; err != nil {
+			return err
+		}
 
+		returnable, err := returnableQuantities(tx, order.ID)
+		if err != nil {
+			return err
+		}
+		input.Items = nil
+		for itemID, quantity := range returnable {
+			if quantity > 0 {
+				input.Items = append(input.Items, returnLine{OrderItemID: itemID, Quantity: quantity})
 			}
 		}
-
-		order.OrderStatus = "returned"
-		order.PaymentStatus = "returned"
-		if err := database.DB.Save(&order).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed update order",
-			})
+		if len(input.Items) == 0 {
+			return fmt.Errorf("%w: nothing left to return on this order", errInvalidReturn)
 		}
-	}
 
-	if err := database.DB.First(&order, "id = ?", orderID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to retrieve updated order",
-		})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message":       "order successfully updated",
-		"updated_order": order,
+		request, err = createReturnRequest(tx, order, input)
+		return err
 	})
+	return returnRequestCreated(c, request, err)
 }
 
 func ListOrdersForUser(c *fiber.Ctx) error {
@@ -613,22 +844,25 @@ func GetWallet(c *fiber.Ctx) error {
 		})
 	}
 
-	var walletHistory []models.WalletHistory
-	if err := database.DB.Find(&walletHistory, "wallet_id = ?", wallet.ID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "wallet history not found",
-			})
-		}
+	history, err := ledger.Entries(database.DB, wallet.ID)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to retrieve wallet history",
 		})
 	}
 
+	var topUps []models.WalletTopUp
+	if err := database.DB.Where("user_id = ? AND status IN ?", wallet.UserID, []string{topUpCreated, topUpFailed}).Order("created_at DESC").Find(&topUps).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve wallet top-ups",
+		})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "successfully get wallet",
 		"wallet":  wallet,
-		"history": walletHistory,
+		"history": history,
+		"top_ups": topUps,
 	})
 }
 
@@ -648,8 +882,20 @@ func CancelOneProduct(c *fiber.Ctx) error {
 		})
 	}
 
+	var input struct {
+		RefundMethod string `json:"refund_method"`
+	}
+	c.BodyParser(&input)
+
+	method, err := refundMethod(input.RefundMethod)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	var order models.Order
-	if err := database.DB.First(&order, "id = ?", orderID).Error; err != nil {
+	if err := database.DB.First(&order, "id = ? AND user_id = ?", orderID, c.Locals("user_id")).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "order not found",
@@ -660,20 +906,14 @@ func CancelOneProduct(c *fiber.Ctx) error {
 		})
 	}
 
-	if order.OrderStatus == "cancelled" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order already cancelled",
-		})
-	}
-
-	if order.OrderStatus == "shipped" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order shipped you can't cancel the order",
-		})
+	if err := lifecycle.CheckOrder(&order, lifecycle.OrderCancelled); err != nil {
+		return transitionError(c, err)
 	}
 
+	// Items of products sold in variants are told apart by ?variant_id, as
+	// in the cart.
 	var orderItems models.OrderItem
-	if err := database.DB.First(&orderItems, "order_id = ? AND product_id = ?", orderID, productID).Error; err != nil {
+	if err := whereVariant(database.DB, c.Query("variant_id")).First(&orderItems, "order_id = ? AND product_id = ?", order.ID, productID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "order item not found",
@@ -696,161 +936,109 @@ func CancelOneProduct(c *fiber.Ctx) error {
 		})
 	}
 
-	if orderItems.IsCancelled == "cancelled" {
+	if orderItems.IsCancelled != "ordered" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order item already cancelled",
+			"error": "order item already " + orderItems.IsCancelled,
 		})
 	}
 
-	if orderItems.IsCancelled == "ordered" {
-		if err := database.DB.Model(&orderItems).Update("is_cancelled", "cancelled").Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed cancel order item",
-			})
+	tx := database.DB.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
 		}
+	}()
 
-		var returnPrice, newDiscountAmount, finalPrice float64
-		amount := order.TotalPrice - orderItems.ProductPrice
-		var couponCode string
-
-		if order.CouponCode != "" {
+	// The order row lock serialises item cancellations so each credit is
+	// worked out from the credit notes issued before it. The order may have
+	// shipped or been cancelled since it was read.
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, order.ID).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order",
+		})
+	}
+	if err := lifecycle.CheckOrder(&order, lifecycle.OrderCancelled); err != nil {
+		tx.Rollback()
+		return transitionError(c, err)
+	}
 
-			var coupon models.Coupon
-			if err := database.DB.First(&coupon, "coupon_code = ?", order.CouponCode).Error; err != nil {
-				if err == gorm.ErrRecordNotFound {
-					return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-						"error": "coupon not found",
-					})
-				}
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to retireve coupon",
-				})
-			}
+	// Only an item still on order is cancelled, credited and restocked;
+	// the conditional update keeps a concurrent cancel or return from doing
+	// it twice.
+	uncredited, err := invoices.Uncredited(tx, order)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order items",
+		})
+	}
 
-			if coupon.MinimumAmount > amount {
-				if coupon.DiscountType == "percentage" || coupon.DiscountType == "fixed" {
-					returnPrice = order.FinalPrice - amount
-					finalPrice = amount
-					newDiscountAmount = 0
-					couponCode = ""
-
-					var couponUsage models.CouponUsage
-					if err := database.DB.First(&couponUsage, "user_id", order.UserID).Error; err != nil {
-						if err == gorm.ErrRecordNotFound {
-							return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-								"error": "coupon usage limit not found",
-							})
-						}
-						return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-							"error": "failed to retrieve coupon usage",
-						})
-					}
-
-					couponUsage.Limit--
-					if err := database.DB.Model(&couponUsage).Update("limit", couponUsage.Limit).Error; err != nil {
-						return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-							"error": "failed to update coupon usage",
-						})
-					}
-				}
-			} else {
-				if coupon.DiscountType == "percentage" {
-					newDiscountAmount = amount * coupon.DiscountValue / 100
-					finalPrice = amount - newDiscountAmount
-					returnPrice = order.FinalPrice - finalPrice
-					couponCode = order.CouponCode
-				} else if coupon.CouponCode == "fixed" {
-					finalPrice = order.FinalPrice - product.Price
-					returnPrice = product.Price
-					newDiscountAmount = coupon.DiscountValue
-					couponCode = order.CouponCode
-				}
-			}
+	result := tx.Model(&orderItems).Where("is_cancelled = ?", "ordered").Update("is_cancelled", "cancelled")
+	if result.Error != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed cancel order item",
+		})
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order item already cancelled",
+		})
+	}
 
-		} else if order.CouponCode == "" {
-			returnPrice = product.Price
-			finalPrice = order.TotalPrice - product.Price
-			newDiscountAmount = 0
-			couponCode = ""
-		}
+	// The order keeps its totals and coupon; the item is credited
+	// against the invoice at what it sold for after the discount. A
+	// paid order refunds the credit, and an unpaid one is owed that
+	// much less.
+	quantities := map[uint]int{orderItems.ID: uncredited[orderItems.ID]}
+	lines, note, err := creditOrder(tx, order, quantities, 0, "order item cancelled", nil)
+	if err != nil {
+		tx.Rollback()
+		log.Print(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to issue credit note",
+		})
+	}
 
-		updates := map[string]interface{}{
-			"final_price":     finalPrice,
-			"discount_amount": newDiscountAmount,
-			"total_price":     amount,
-			"coupon_code":     couponCode,
+	returnPrice := invoices.CreditTotal(lines, 0)
+	if lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentRefunded) && returnPrice > 0 {
+		items := []models.RefundItem{{
+			OrderItemID: orderItems.ID,
+			ProductID:   orderItems.ProductID,
+			Quantity:    orderItems.Quantity,
+			Amount:      returnPrice,
+		}}
+		if _, err := issueRefund(tx, order, returnPrice, method, "order item cancelled", items, note); err != nil {
+			tx.Rollback()
+			return refundError(c, err)
 		}
-
-		fmt.Println(updates)
-
-		if err := database.DB.Model(&order).Updates(updates).Error; err != nil {
+	} else if order.PaymentStatus == lifecycle.PaymentPending || order.PaymentStatus == lifecycle.PaymentFailed {
+		if err := reduceAmountDue(tx, &order, returnPrice, "order item cancelled"); err != nil {
+			tx.Rollback()
+			log.Print(err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "failed to update order",
+				"error": "failed to update the amount due",
 			})
 		}
-
-		var wallet models.Wallet
-
-		if err := database.DB.Where("user_id = ?", order.UserID).First(&wallet).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				newWallet := models.Wallet{
-					UserID:      order.UserID,
-					TotalAmount: returnPrice,
-				}
-
-				if err := database.DB.Create(&newWallet).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "Failed to create wallet",
-					})
-				}
-
-				walletHistory := models.WalletHistory{
-					WalletID: wallet.ID,
-					Type:     "credit",
-					Amount:   returnPrice,
-				}
-
-				if err := database.DB.Create(&walletHistory).Error; err != nil {
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"error": "failed to update wallet history",
-					})
-				}
-
-			} else {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "Failed to query wallet",
-				})
-			}
-		} else {
-			wallet.TotalAmount += returnPrice
-			if err := database.DB.Save(&wallet).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "Failed to update wallet",
-				})
-			}
-
-			walletHistory := models.WalletHistory{
-				WalletID: wallet.ID,
-				Type:     "credit",
-				Amount:   returnPrice,
-			}
-
-			if err := database.DB.Create(&walletHistory).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "failed to update wallet history",
-				})
-			}
-		}
 	}
 
-	quantity := orderItems.Quantity + product.Quantity
-
-	if err := database.DB.Model(&product).Update("quantity", quantity).Error; err != nil {
+	if err := restock(tx, product.ID, orderItems.VariantID, orderItems.Quantity); err != nil {
+		tx.Rollback()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to update product quantity",
 		})
 	}
 
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Transaction commit failed",
+		})
+	}
+	sendGatewayRefunds(database.DB, order.ID)
+
 	if err := database.DB.First(&order, "id = ?", orderID).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to retrieve updated order",
@@ -0,0 +1,333 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kars/invoices"
+	"kars/models"
+	"kars/tax"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Two customers checking out the last unit at the same time must not both
+// get it: the product row lock makes the second checkout see no stock.
+func TestPlaceOrderLastUnit(t *testing.T) {
+	db := testDB(t)
+	product := newProduct(t, db, 100, 1)
+
+	app := fiber.New()
+	var bodies [][]byte
+	for i := 0; i < 2; i++ {
+		user, address := newUser(t, db)
+		fillCart(t, db, user, product, 1)
+		app.Post(fmt.Sprintf("/order/%d", i), asUser(user, PlaceOrder))
+
+		body, err := json.Marshal(userInput{AddressId: address.ID, PaymentMethod: "cash on delivery"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+
+	statuses := make([]int, len(bodies))
+	errs := make([]error, len(bodies))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			req := httptest.NewRequest(fiber.MethodPost, fmt.Sprintf("/order/%d", i), bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			<-start
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i, body)
+	}
+	close(start)
+	wg.Wait()
+
+	created, refused := 0, 0
+	for i, status := range statuses {
+		switch {
+		case errs[i] != nil:
+			t.Fatalf("checkout %d: %v", i, errs[i])
+		case status == fiber.StatusCreated:
+			created++
+		case status == fiber.StatusBadRequest:
+			refused++
+		default:
+			t.Errorf("checkout %d: got status %d", i, status)
+		}
+	}
+	if created != 1 || refused != 1 {
+		t.Errorf("got %d placed and %d refused checkouts, want 1 of each", created, refused)
+	}
+
+	if err := db.First(&product, product.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if product.Quantity != 0 {
+		t.Errorf("stock = %d, want 0", product.Quantity)
+	}
+}
+
+// Each variant of a product on an order can be cancelled on its own.
+func TestCancelOneVariant(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	product := newProduct(t, db, 200, 4)
+
+	var variants []models.ProductVariant
+	cart := models.Cart{UserID: user.ID, TotalItems: 2}
+	for _, color := range []string{"black", "beige"} {
+		variant := models.ProductVariant{ProductID: product.ID, SKU: unique("sku"), Attributes: map[string]string{"color": color}, Quantity: 2}
+		create(t, db, &variant)
+		variants = append(variants, variant)
+		cart.CartItems = append(cart.CartItems, models.CartItem{
+			ProductID: product.ID, ProductName: product.ProductName, ProductPrice: product.Price,
+			TotalPrice: product.Price, Quantity: 1, VariantID: &variant.ID, SKU: variant.SKU,
+		})
+	}
+	create(t, db, &cart)
+
+	app := fiber.New()
+	app.Post("/order", asUser(user, PlaceOrder))
+	app.Post("/cancel/:order_id/:product_id", asUser(user, CancelOneProduct))
+
+	status, body := call(t, app, fiber.MethodPost, "/order", userInput{AddressId: address.ID, PaymentMethod: "cash on delivery"})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	orderID, _ := placed["ID"].(float64)
+
+	path := fmt.Sprintf("/cancel/%d/%d?variant_id=%d", int(orderID), product.ID, variants[1].ID)
+	if status, body := call(t, app, fiber.MethodPost, path, nil); status != fiber.StatusOK {
+		t.Fatalf("cancel second variant: got %d %v", status, body)
+	}
+
+	var items []models.OrderItem
+	if err := db.Where("order_id = ?", uint(orderID)).Order("id").Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	cancelled := map[uint]string{}
+	for _, item := range items {
+		cancelled[*item.VariantID] = item.IsCancelled
+	}
+	if cancelled[variants[0].ID] != "ordered" || cancelled[variants[1].ID] != "cancelled" {
+		t.Errorf("item states by variant = %v, want only variant %d cancelled", cancelled, variants[1].ID)
+	}
+
+	if err := db.First(&variants[1], variants[1].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if variants[1].Quantity != 2 {
+		t.Errorf("cancelled variant stock = %d, want 2", variants[1].Quantity)
+	}
+
+	if status, body := call(t, app, fiber.MethodPost, path, nil); status != fiber.StatusBadRequest {
+		t.Errorf("cancelling it again: got %d %v, want 400", status, body)
+	}
+}
+
+// Two cancellations of the same item racing each other credit and restock
+// it once: the second finds the item no longer on order.
+func TestCancelItemTwiceAtOnce(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	product := newProduct(t, db, 200, 3)
+	fillCart(t, db, user, product, 2)
+
+	app := fiber.New()
+	app.Post("/order", asUser(user, PlaceOrder))
+	app.Post("/cancel/:order_id/:product_id", asUser(user, CancelOneProduct))
+
+	status, body := call(t, app, fiber.MethodPost, "/order", userInput{AddressId: address.ID, PaymentMethod: "cash on delivery"})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	orderID, _ := placed["ID"].(float64)
+	path := fmt.Sprintf("/cancel/%d/%d", int(orderID), product.ID)
+
+	statuses := make([]int, 2)
+	errs := make([]error, 2)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(fiber.MethodPost, path, nil)
+			<-start
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	cancelled, refused := 0, 0
+	for i, status := range statuses {
+		switch {
+		case errs[i] != nil:
+			t.Fatalf("cancel %d: %v", i, errs[i])
+		case status == fiber.StatusOK:
+			cancelled++
+		case status == fiber.StatusBadRequest:
+			refused++
+		default:
+			t.Errorf("cancel %d: got status %d", i, status)
+		}
+	}
+	if cancelled != 1 || refused != 1 {
+		t.Errorf("got %d cancelled and %d refused requests, want 1 of each", cancelled, refused)
+	}
+
+	if err := db.First(&product, product.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if product.Quantity != 3 {
+		t.Errorf("stock after cancelling = %d, want 3", product.Quantity)
+	}
+	var notes int64
+	if err := db.Model(&models.CreditNote{}).Where("order_id = ?", uint(orderID)).Count(&notes).Error; err != nil {
+		t.Fatal(err)
+	}
+	if notes != 1 {
+		t.Errorf("got %d credit notes, want 1", notes)
+	}
+}
+
+// Cancelling an item of an order not yet paid lowers what it is due, and a
+// payment already started at the old amount gets the difference back.
+func TestCancelItemOfUnpaidOrder(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+	user, address := newUser(t, db)
+	kept, cancelled := newProduct(t, db, 300, 1), newProduct(t, db, 200, 1)
+
+	cart := fillCart(t, db, user, kept, 1)
+	create(t, db, &models.CartItem{
+		CartID: cart.ID, ProductID: cancelled.ID, ProductName: cancelled.ProductName,
+		ProductPrice: cancelled.Price, TotalPrice: cancelled.Price, Quantity: 1,
+	})
+
+	app := fiber.New()
+	app.Post("/order/:user_id", asUser(user, PlaceOrder))
+	app.Post("/create-order/:order_id", asUser(user, CreateOrder))
+	app.Post("/cancel/:order_id/:product_id", asUser(user, CancelOneProduct))
+	app.Post("/verify-payment/:order_id", VerifyPayment)
+
+	order := placeOnlineOrder(t, app, user, address)
+	status, created := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d", order.ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, created)
+	}
+	gatewayOrderID, _ := created["order_id"].(string)
+
+	path := fmt.Sprintf("/cancel/%d/%d", order.ID, cancelled.ID)
+	if status, body := call(t, app, fiber.MethodPost, path, nil); status != fiber.StatusOK {
+		t.Fatalf("cancel item: got %d %v", status, body)
+	}
+	placedPrice := order.FinalPrice
+	if err := db.First(&order, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := placedPrice - cancelled.Price; order.FinalPrice != want {
+		t.Errorf("final price = %v, want %v", order.FinalPrice, want)
+	}
+
+	payment, signature, err := fake.Pay(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", order.ID), map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("verify-payment: got %d %v", status, body)
+	}
+
+	var refund models.Refund
+	if err := db.First(&refund, "gateway_payment_id = ?", payment.ID).Error; err != nil {
+		t.Fatalf("no refund recorded for the overpayment: %v", err)
+	}
+	if refund.GatewayAmount != cancelled.Price {
+		t.Errorf("refunded %v of the payment, want %v", refund.GatewayAmount, cancelled.Price)
+	}
+}
+
+// Products priced without GST show it in the cart, and checkout charges
+// what the cart showed. Shipping is taxed at the rate of the principal
+// supply and invoiced with its GST.
+func TestShippingAndExclusiveTax(t *testing.T) {
+	db := testDB(t)
+	user, address := newUser(t, db)
+	category := models.Category{CategoryName: unique("category"), GSTRate: 12, PricesIncludeTax: false}
+	create(t, db, &category)
+	product := models.Product{ProductName: unique("product"), Price: 100, Quantity: 2, CategoryID: category.ID, Weight: 500}
+	create(t, db, &product)
+	fillCart(t, db, user, product, 2)
+
+	app := fiber.New()
+	app.Get("/cart", asUser(user, ListCartProducts))
+	app.Post("/order", asUser(user, PlaceOrder))
+
+	status, body := call(t, app, fiber.MethodGet, "/cart", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("cart: got %d %v", status, body)
+	}
+	items, _ := body["cart"].([]interface{})
+	item, _ := items[0].(map[string]interface{})
+	if total, _ := item["total_price"].(float64); total != 224 {
+		t.Errorf("cart item total = %v, want 224 with GST", item["total_price"])
+	}
+
+	status, body = call(t, app, fiber.MethodPost, "/order", userInput{AddressId: address.ID, PaymentMethod: "cash on delivery"})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	orderID, _ := placed["ID"].(float64)
+
+	var order models.Order
+	if err := db.First(&order, uint(orderID)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.TotalPrice != 224 {
+		t.Errorf("order total = %v, want the 224 the cart showed", order.TotalPrice)
+	}
+	if order.ShippingAmount > 0 {
+		shippingTax := order.ShippingCGST + order.ShippingSGST + order.ShippingIGST
+		if order.ShippingGSTRate != 12 || shippingTax == 0 || tax.Round(order.ShippingTaxableValue+shippingTax) != order.ShippingAmount {
+			t.Errorf("shipping of %v split %v + %v at %v%%, want it taxed at 12%%", order.ShippingAmount, order.ShippingTaxableValue, shippingTax, order.ShippingGSTRate)
+		}
+	}
+
+	invoice, err := invoices.Issue(db, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.TotalAmount != order.FinalPrice {
+		t.Errorf("invoice total = %v, want the order's %v", invoice.TotalAmount, order.FinalPrice)
+	}
+}
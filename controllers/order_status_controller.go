@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/lifecycle"
+	"kars/models"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// transitionError renders a lifecycle error. Invalid transitions are the
+// caller's fault; anything else is a database failure.
+func transitionError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, lifecycle.ErrInvalidTransition) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	log.Println(err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "failed to update order status",
+	})
+}
+
+// UpdateOrderStatus lets an admin move an order through the fulfilment
+// statuses. Cancellation and returns have their own endpoints because they
+// also restock and refund.
+func UpdateOrderStatus(c *fiber.Ctx) error {
+
+	orderID := c.Params("order_id")
+	if orderID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order id is required",
+		})
+	}
+
+	var input struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "failed to parse status",
+		})
+	}
+
+	switch input.Status {
+	case lifecycle.OrderShipped, lifecycle.OrderOutForDelivery, lifecycle.OrderDelivered:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "status must be 'shipped', 'out for delivery' or 'delivered'",
+		})
+	}
+
+	return changeFulfilmentStatus(c, orderID, input.Status, input.Reason)
+}
+
+func changeFulfilmentStatus(c *fiber.Ctx, orderID, status, reason string) error {
+
+	tx := database.DB.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if tx.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "unable to start transaction",
+		})
+	}
+
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", orderID).Error; err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "order not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order",
+		})
+	}
+
+	actor := lifecycle.AdminActor(c.Locals("admin_id"))
+	if err := lifecycle.TransitionOrder(tx, &order, status, actor, reason); err != nil {
+		tx.Rollback()
+		return transitionError(c, err)
+	}
+
+	if err := collectCashOnDelivery(tx, &order, actor); err != nil {
+		tx.Rollback()
+		return transitionError(c, err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Transaction commit failed",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "successfully updated order status",
+		"order":   order,
+	})
+}
+
+// collectCashOnDelivery marks a delivered cash on delivery order paid; the
+// courier collects the cash on handover.
+func collectCashOnDelivery(tx *gorm.DB, order *models.Order, actor string) error {
+	if order.OrderStatus != lifecycle.OrderDelivered || order.PaymentMethod != "cash on delivery" {
+		return nil
+	}
+	if !lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentPaid) {
+		return nil
+	}
+	return lifecycle.TransitionPayment(tx, order, lifecycle.PaymentPaid, actor, "cash collected on delivery")
+}
+
+func GetOrderStatusHistory(c *fiber.Ctx) error {
+
+	orderID := c.Params("order_id")
+	if orderID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order id is required",
+		})
+	}
+
+	query := database.DB
+	if userID := c.Locals("user_id"); userID != nil {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var order models.Order
+	if err := query.First(&order, "id = ?", orderID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "order not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order",
+		})
+	}
+
+	history, err := lifecycle.History(database.DB, order.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve order status history",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":        "order status history",
+		"order_status":   order.OrderStatus,
+		"payment_status": order.PaymentStatus,
+		"history":        history,
+	})
+}
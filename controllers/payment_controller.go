@@ -1,66 +1,146 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"kars/database"
+	"kars/invoices"
+	"kars/ledger"
+	"kars/lifecycle"
 	"kars/models"
+	"kars/payments"
+	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/razorpay/razorpay-go"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-var count uint
+// maxFailedPaymentAttempts is how many failed online payments an order may
+// have before it can no longer be paid online.
+const maxFailedPaymentAttempts = 3
+
+const (
+	attemptCreated = "created"
+	attemptPaid    = "paid"
+	attemptFailed  = "failed"
+)
 
 func RenderRayzorPay(c *fiber.Ctx) error {
 	orderId := c.Query("order_id")
 	if orderId == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "order id is required"})
 	}
-	fmt.Print(orderId)
+
+	var order models.Order
+	if err := database.DB.First(&order, "id = ? AND user_id = ?", orderId, c.Locals("user_id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+	}
+
+	if err := checkPaymentAttempts(database.DB, order.ID); err != nil {
+		return paymentAttemptError(c, err)
+	}
+
+	// The page calls back into routes that need the user's token.
 	return c.Render("templates/payment.html", fiber.Map{
-		"order_id": orderId, // Replace with any necessary data
+		"authorization": c.Get("Authorization"),
+		"create_url":    fmt.Sprintf("/api/user/create-order/%d", order.ID),
+		"verify_url":    fmt.Sprintf("/api/user/verify-payment/%d", order.ID),
+		"failed_url":    fmt.Sprintf("/api/user/failed-handling/%d", order.ID),
 	})
 }
 
-// Create an order in Razorpay
+// Create an order on the payment gateway
 func CreateOrder(c *fiber.Ctx) error {
 	orderID := c.Params("order_id")
 	if orderID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "order id is required"})
 	}
 
-	client := razorpay.NewClient("rzp_test_J7PdmiC5AUYYOX", "osI3mJcQapZ2KQbOi3iemNew")
-
 	var order models.Order
-	if err := database.DB.Where("id = ?", orderID).First(&order).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "order not found"})
+	if err := database.DB.Where("id = ? AND user_id = ?", orderID, c.Locals("user_id")).First(&order).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
 	}
 
-	if order.PaymentStatus == "paid" {
+	if order.PaymentStatus == lifecycle.PaymentPaid {
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{"error": "order already paid"})
 	}
+	if !payable(order) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": errOrderNotPayable.Error()})
+	}
+
+	if err := checkPaymentAttempts(database.DB, order.ID); err != nil {
+		return paymentAttemptError(c, err)
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, order.ID).Error; err != nil {
+			return err
+		}
+		return ensureWalletHold(tx, &order)
+	})
+	if errors.Is(err, errOrderNotPayable) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to hold wallet balance"})
+	}
 
-	amount := int(order.FinalPrice * 100)
-	fmt.Print(amount)
-	data := map[string]interface{}{
-		"amount":   amount,
-		"currency": "INR",
-		"receipt":  "order_rcptid_11",
+	notes := map[string]string{
+		"order_id": fmt.Sprint(order.ID),
 	}
 
-	razorOrder, err := client.Order.Create(data, nil)
+	gatewayOrder, err := payments.Default.CreateOrder(payments.ToPaise(onlineDue(order)), "INR", fmt.Sprintf("order_%d", order.ID), notes)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "inable to create order"})
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "unable to create order"})
 	}
 
-	return c.JSON(razorOrder)
+	attempt := models.PaymentAttempt{
+		OrderID:        order.ID,
+		Gateway:        payments.Default.Name(),
+		GatewayOrderID: gatewayOrder.ID,
+		Status:         attemptCreated,
+		Amount:         onlineDue(order),
+	}
+	if err := database.DB.Create(&attempt).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to record payment attempt"})
+	}
+
+	return c.JSON(fiber.Map{
+		"order_id": gatewayOrder.ID,
+		"amount":   gatewayOrder.Amount,
+		"currency": gatewayOrder.Currency,
+		"key":      payments.Default.KeyID(),
+	})
+}
+
+// FakePay completes a checkout against the fake gateway, standing in for the
+// Razorpay popup when PAYMENT_GATEWAY=fake. The response carries the same
+// fields the popup hands to verify-payment.
+func FakePay(c *fiber.Ctx) error {
+	fake, ok := payments.Default.(*payments.Fake)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "fake gateway is not enabled"})
+	}
+
+	payment, signature, err := fake.Pay(c.Params("gateway_order_id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   payment.OrderID,
+		"razorpay_signature":  signature,
+	})
 }
 
 // Verify Razorpay payment
 func VerifyPayment(c *fiber.Ctx) error {
 	orderID := c.Params("order_id")
-	fmt.Println(orderID)
 	if orderID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "order id is required"})
 	}
@@ -74,65 +154,354 @@ func VerifyPayment(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
 	}
 
+	if PaymentInfo.RazorpayOrderID == "" || PaymentInfo.RazorpayPaymentID == "" || PaymentInfo.RazorpaySignature == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment id, order id and signature are required"})
+	}
+
+	if err := payments.Default.VerifySignature(PaymentInfo.RazorpayOrderID, PaymentInfo.RazorpayPaymentID, PaymentInfo.RazorpaySignature); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment signature verification failed"})
+	}
+
+	payment, err := payments.Default.FetchPayment(PaymentInfo.RazorpayPaymentID)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "failed to fetch payment from gateway"})
+	}
+
+	if payment.OrderID != PaymentInfo.RazorpayOrderID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment does not belong to this order"})
+	}
+
+	// An authorized payment is not money received yet: it may never be
+	// captured and is then released back to the customer. The order stays
+	// pending until the capture, which the payment.captured webhook also
+	// settles.
+	if payment.Status != "captured" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment is " + payment.Status})
+	}
+
 	tx := database.DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
 			tx.Rollback()
+			panic(r)
 		}
 	}()
 	if tx.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Unable to start transaction"})
 	}
 
-	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Update("payment_status", "paid").Error; err != nil {
+	// The signature only proves the gateway issued this payment; the attempt
+	// ties the gateway order to our order.
+	attempt, err := paymentAttemptFor(tx, payment.OrderID, payment.ID)
+	if err != nil || fmt.Sprint(attempt.OrderID) != orderID {
 		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment does not belong to this order"})
 	}
 
-	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Update("order_status", "placed").Error; err != nil {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", attempt.OrderID).Error; err != nil {
 		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch order"})
 	}
 
-	var orderItems []models.OrderItem
-	if err := tx.Where("id = ?", orderID).Find(&orderItems).Error; err != nil {
+	if payment.Amount < payments.ToPaise(onlineDue(order)) {
 		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch order items"})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment amount does not cover the order"})
 	}
-	for _, item := range orderItems {
-		if err := tx.Model(&models.Product{}).Where("id = ?", item.ProductID).Update("quantity", gorm.Expr("quantity - ?", item.Quantity)).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update product stock"})
-		}
+
+	if err := recordAttemptPaid(tx, &attempt, payment); err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to record payment attempt"})
+	}
+
+	refunded, err := applyCapture(tx, &order, attempt, payment, "online payment verified")
+	if err != nil {
+		tx.Rollback()
+		return transitionError(c, err)
 	}
 
 	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Transaction commit failed"})
 	}
 
+	if refunded {
+		sendGatewayRefunds(database.DB, order.ID)
+	}
+	if order.PaymentStatus != lifecycle.PaymentPaid {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "the order can no longer be paid; the payment is being refunded"})
+	}
+
 	return c.JSON(fiber.Map{"status": "success", "message": "Payment verified and recorded successfully"})
 }
 
+// applyCapture records a captured payment against its order. An order that
+// can no longer be paid, such as one cancelled while the customer was at
+// the checkout, gets the payment refunded instead. So does whatever the
+// payment took above what the order is due, when items were cancelled after
+// the gateway order was made. refunded is true when a refund was recorded.
+func applyCapture(tx *gorm.DB, order *models.Order, attempt models.PaymentAttempt, payment payments.Payment, reason string) (refunded bool, err error) {
+	if order.OrderStatus == lifecycle.OrderCancelled ||
+		(order.PaymentStatus != lifecycle.PaymentPaid && !lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentPaid)) {
+		return true, refundCapture(tx, *order, attempt, payment, payment.Amount, fmt.Sprintf("payment captured after the order was %s", order.OrderStatus))
+	}
+	if excess := payment.Amount - payments.ToPaise(onlineDue(*order)); excess > 0 && order.PaymentStatus != lifecycle.PaymentPaid {
+		if err := refundCapture(tx, *order, attempt, payment, excess, "payment above the amount due after items were cancelled"); err != nil {
+			return false, err
+		}
+		refunded = true
+	}
+	return refunded, markOrderPaid(tx, order, reason)
+}
+
+// refundCapture records a refund of paise of a payment the order cannot
+// keep, for sendGatewayRefunds to send once committed. It lists with the
+// other refunds so admins can follow it. A capture reported by both the
+// checkout page and the webhook is refunded once.
+func refundCapture(tx *gorm.DB, order models.Order, attempt models.PaymentAttempt, payment payments.Payment, paise int64, reason string) error {
+	var refunds int64
+	if err := tx.Model(&models.Refund{}).Where("gateway_payment_id = ?", payment.ID).Count(&refunds).Error; err != nil {
+		return err
+	}
+	if refunds > 0 {
+		return nil
+	}
+
+	log.Printf("payment %s captured for order %d, which is %s/%s; refunding %d paise", payment.ID, order.ID, order.OrderStatus, order.PaymentStatus, paise)
+	amount := payments.FromPaise(paise)
+	return tx.Create(&models.Refund{
+		OrderID:          order.ID,
+		UserID:           order.UserID,
+		Amount:           amount,
+		GatewayAmount:    amount,
+		Method:           refundToSource,
+		Status:           refundPending,
+		Reason:           reason,
+		Gateway:          attempt.Gateway,
+		GatewayPaymentID: payment.ID,
+	}).Error
+}
+
+// markOrderPaid records a confirmed online payment and settles the wallet
+// part of a split order. It is a no-op for an order that is already paid,
+// since the checkout callback and the webhook both report the same payment.
+// Stock was already reserved when the order was placed; the invoice is
+// issued now that the sale is confirmed.
+func markOrderPaid(tx *gorm.DB, order *models.Order, reason string) error {
+	if order.PaymentStatus == lifecycle.PaymentPaid {
+		return nil
+	}
+
+	if err := lifecycle.TransitionPayment(tx, order, lifecycle.PaymentPaid, lifecycle.ActorSystem, reason); err != nil {
+		return err
+	}
+
+	if err := settleWalletHold(tx, order); err != nil {
+		return err
+	}
+
+	if order.OrderStatus == lifecycle.OrderPending {
+		if err := lifecycle.TransitionOrder(tx, order, lifecycle.OrderPlaced, lifecycle.ActorSystem, reason); err != nil {
+			return err
+		}
+	}
+	if order.OrderStatus != lifecycle.OrderPlaced {
+		return nil
+	}
+	_, err := invoices.Issue(tx, *order)
+	return err
+}
+
 func FailedHandling(c *fiber.Ctx) error {
-	fmt.Println("poda panny")
 	orderID := c.Params("order_id")
 	if orderID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid order ID"})
 	}
 
+	var input struct {
+		Reason            string `json:"reason"`
+		RazorpayOrderID   string `json:"razorpay_order_id"`
+		RazorpayPaymentID string `json:"razorpay_payment_id"`
+		ErrorCode         string `json:"error_code"`
+		ErrorDescription  string `json:"error_description"`
+	}
+	c.BodyParser(&input)
+	if input.Reason == "" {
+		input.Reason = c.Query("reason")
+	}
+	if input.ErrorDescription == "" {
+		input.ErrorDescription = input.Reason
+	}
+
 	var order models.Order
-	if count >= 3 {
-		if err := database.DB.Model(&order).Where("id = ?", orderID).Update("payment_status", "failed").Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ? AND user_id = ?", orderID, c.Locals("user_id")).Error; err != nil {
+			return err
+		}
+
+		// A failure the webhook already recorded leaves no open attempt.
+		attempt, err := failedAttemptFor(tx, order.ID, input.RazorpayOrderID, input.RazorpayPaymentID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
 		}
-		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many failed attempts"})
+
+		if err == nil {
+			if err := recordAttemptFailed(tx, &attempt, input.ErrorCode, input.ErrorDescription); err != nil {
+				return err
+			}
+		}
+
+		if order.PaymentStatus != lifecycle.PaymentPending {
+			return nil
+		}
+		if err := lifecycle.TransitionPayment(tx, &order, lifecycle.PaymentFailed, lifecycle.ActorSystem, input.Reason); err != nil {
+			return err
+		}
+		return ledger.ReleaseHold(tx, order.UserID, order.ID, "online payment failed")
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+	}
+	if err != nil {
+		return transitionError(c, err)
 	}
 
-	if err := database.DB.Model(&order).Where("id = ?", orderID).Update("payment_status", "failed").Error; err != nil {
-		count++
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
+	if err := checkPaymentAttempts(database.DB, order.ID); err != nil {
+		return paymentAttemptError(c, err)
 	}
 
-	count = 0
 	return c.JSON(fiber.Map{"message": "Payment status updated to failed successfully"})
-}
\ No newline at end of file
+}
+
+func ListPaymentAttempts(c *fiber.Ctx) error {
+	orderID := c.Params("order_id")
+	if orderID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "order id is required"})
+	}
+
+	var attempts []models.PaymentAttempt
+	if err := database.DB.Where("order_id = ?", orderID).Order("created_at").Find(&attempts).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve payment attempts"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":  "payment attempts",
+		"attempts": attempts,
+	})
+}
+
+var errTooManyPaymentAttempts = errors.New("too many failed payment attempts for this order")
+
+// checkPaymentAttempts returns errTooManyPaymentAttempts once an order has
+// used up its failed online payments.
+func checkPaymentAttempts(db *gorm.DB, orderID uint) error {
+	var failed int64
+	if err := db.Model(&models.PaymentAttempt{}).Where("order_id = ? AND status = ?", orderID, attemptFailed).Count(&failed).Error; err != nil {
+		return err
+	}
+	if failed >= maxFailedPaymentAttempts {
+		return errTooManyPaymentAttempts
+	}
+	return nil
+}
+
+func paymentAttemptError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errTooManyPaymentAttempts) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to check payment attempts"})
+}
+
+// paymentAttemptFor returns the attempt for a payment made against a gateway
+// order. The first payment fills in the attempt created with the gateway
+// order; later payments (retries inside the same checkout) get rows of their
+// own. It returns gorm.ErrRecordNotFound for gateway orders we never created.
+func paymentAttemptFor(tx *gorm.DB, gatewayOrderID, paymentID string) (models.PaymentAttempt, error) {
+	var attempt models.PaymentAttempt
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("gateway_order_id = ? AND payment_id = ?", gatewayOrderID, paymentID).
+		First(&attempt).Error
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return attempt, err
+	}
+
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("gateway_order_id = ?", gatewayOrderID).
+		Order("payment_id = '' DESC, created_at DESC").
+		First(&attempt).Error
+	if err != nil {
+		return attempt, err
+	}
+
+	if attempt.PaymentID == "" {
+		attempt.PaymentID = paymentID
+		return attempt, tx.Model(&attempt).Update("payment_id", paymentID).Error
+	}
+
+	retry := models.PaymentAttempt{
+		OrderID:        attempt.OrderID,
+		Gateway:        attempt.Gateway,
+		GatewayOrderID: gatewayOrderID,
+		PaymentID:      paymentID,
+		Status:         attemptCreated,
+		Amount:         attempt.Amount,
+	}
+	return retry, tx.Create(&retry).Error
+}
+
+// failedAttemptFor finds the attempt a browser-reported failure belongs to.
+// Dismissing the checkout popup reports no payment id, in which case the
+// latest open attempt of the order is used.
+func failedAttemptFor(tx *gorm.DB, orderID uint, gatewayOrderID, paymentID string) (models.PaymentAttempt, error) {
+	if gatewayOrderID != "" && paymentID != "" {
+		attempt, err := paymentAttemptFor(tx, gatewayOrderID, paymentID)
+		if err == nil && attempt.OrderID != orderID {
+			return attempt, gorm.ErrRecordNotFound
+		}
+		return attempt, err
+	}
+
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_id = ? AND status = ?", orderID, attemptCreated)
+	if gatewayOrderID != "" {
+		query = query.Where("gateway_order_id = ?", gatewayOrderID)
+	}
+
+	var attempt models.PaymentAttempt
+	err := query.Order("created_at DESC").First(&attempt).Error
+	return attempt, err
+}
+
+func recordAttemptPaid(tx *gorm.DB, attempt *models.PaymentAttempt, payment payments.Payment) error {
+	if attempt.Status == attemptPaid {
+		return nil
+	}
+	now := time.Now()
+	attempt.Status = attemptPaid
+	attempt.PaidAt = &now
+	attempt.Fee = payments.FromPaise(payment.Fee)
+	return tx.Model(attempt).Updates(map[string]interface{}{
+		"status":  attempt.Status,
+		"paid_at": attempt.PaidAt,
+		"fee":     attempt.Fee,
+	}).Error
+}
+
+func recordAttemptFailed(tx *gorm.DB, attempt *models.PaymentAttempt, code, description string) error {
+	if attempt.Status != attemptCreated {
+		return nil
+	}
+	now := time.Now()
+	attempt.Status = attemptFailed
+	attempt.ErrorCode = code
+	attempt.ErrorDescription = description
+	attempt.FailedAt = &now
+	return tx.Model(attempt).Updates(map[string]interface{}{
+		"status":            attempt.Status,
+		"error_code":        attempt.ErrorCode,
+		"error_description": attempt.ErrorDescription,
+		"failed_at":         attempt.FailedAt,
+	}).Error
+}
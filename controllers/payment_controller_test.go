@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"fmt"
+	"kars/ledger"
+	"kars/lifecycle"
+	"kars/models"
+	"kars/payments"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// useFakeGateway makes the handlers pay through a fake gateway for the
+// rest of the test.
+func useFakeGateway(t *testing.T) *payments.Fake {
+	t.Helper()
+	previous := payments.Default
+	fake := payments.NewFake("")
+	payments.Default = fake
+	t.Cleanup(func() { payments.Default = previous })
+	return fake
+}
+
+// placeOnlineOrder checks out a cart of one product for online payment and
+// returns the pending order.
+func placeOnlineOrder(t *testing.T, app *fiber.App, user models.User, address models.Address) models.Order {
+	t.Helper()
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/order/%d", user.ID), userInput{AddressId: address.ID, PaymentMethod: "online payment"})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	id, _ := placed["ID"].(float64)
+
+	var order models.Order
+	if err := testDB(t).First(&order, uint(id)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestOnlinePaymentWithFakeGateway(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+
+	user, address := newUser(t, db)
+	product := newProduct(t, db, 250, 5)
+	fillCart(t, db, user, product, 2)
+
+	app := fiber.New()
+	app.Post("/order/:user_id", asUser(user, PlaceOrder))
+	app.Post("/create-order/:order_id", asUser(user, CreateOrder))
+	app.Post("/verify-payment/:order_id", VerifyPayment)
+
+	order := placeOnlineOrder(t, app, user, address)
+	if order.OrderStatus != lifecycle.OrderPending || order.PaymentStatus != lifecycle.PaymentPending {
+		t.Fatalf("placed order is %q/%q, want pending/pending", order.OrderStatus, order.PaymentStatus)
+	}
+
+	status, created := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d", order.ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, created)
+	}
+	gatewayOrderID, _ := created["order_id"].(string)
+	if amount, _ := created["amount"].(float64); int64(amount) != payments.ToPaise(order.FinalPrice) {
+		t.Errorf("gateway order amount = %v paise, want %d", created["amount"], payments.ToPaise(order.FinalPrice))
+	}
+
+	payment, signature, err := fake.Pay(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	}
+
+	forged := map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  "forged",
+	}
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", order.ID), forged); status != fiber.StatusBadRequest {
+		t.Errorf("forged signature: got %d %v, want 400", status, body)
+	}
+
+	// The checkout page may call back twice; the second call changes nothing.
+	for i := 0; i < 2; i++ {
+		if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", order.ID), verify); status != fiber.StatusOK || body["status"] != "success" {
+			t.Fatalf("verify-payment %d: got %d %v", i+1, status, body)
+		}
+	}
+
+	if err := db.First(&order, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderStatus != lifecycle.OrderPlaced || order.PaymentStatus != lifecycle.PaymentPaid {
+		t.Errorf("paid order is %q/%q, want placed/paid", order.OrderStatus, order.PaymentStatus)
+	}
+
+	var attempt models.PaymentAttempt
+	if err := db.First(&attempt, "order_id = ? AND gateway_order_id = ?", order.ID, gatewayOrderID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if attempt.Status != attemptPaid || attempt.Fee != payments.FromPaise(payment.Fee) {
+		t.Errorf("attempt is %q with fee %v, want paid with fee %v", attempt.Status, attempt.Fee, payments.FromPaise(payment.Fee))
+	}
+
+	var invoices int64
+	if err := db.Model(&models.Invoice{}).Where("order_id = ?", order.ID).Count(&invoices).Error; err != nil {
+		t.Fatal(err)
+	}
+	if invoices != 1 {
+		t.Errorf("got %d invoices for the paid order, want 1", invoices)
+	}
+}
+
+// A payment the bank authorized but the gateway has not captured does not
+// pay the order.
+func TestVerifyAuthorizedPayment(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 250, 5), 1)
+
+	app := fiber.New()
+	app.Post("/order/:user_id", asUser(user, PlaceOrder))
+	app.Post("/create-order/:order_id", asUser(user, CreateOrder))
+	app.Post("/verify-payment/:order_id", VerifyPayment)
+
+	order := placeOnlineOrder(t, app, user, address)
+	status, created := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d", order.ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, created)
+	}
+	gatewayOrderID, _ := created["order_id"].(string)
+
+	payment, signature, err := fake.Authorize(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	}
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", order.ID), verify); status != fiber.StatusBadRequest {
+		t.Errorf("verify-payment: got %d %v, want 400", status, body)
+	}
+
+	if err := db.First(&order, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderStatus != lifecycle.OrderPending || order.PaymentStatus != lifecycle.PaymentPending {
+		t.Errorf("order is %q/%q, want pending/pending", order.OrderStatus, order.PaymentStatus)
+	}
+}
+
+// A payment made for one order cannot be used to verify another.
+func TestVerifyPaymentOfAnotherOrder(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+
+	app := fiber.New()
+	var orders []models.Order
+	for i := 0; i < 2; i++ {
+		user, address := newUser(t, db)
+		fillCart(t, db, user, newProduct(t, db, 100, 1), 1)
+		app.Post(fmt.Sprintf("/order/%d", user.ID), asUser(user, PlaceOrder))
+		app.Post(fmt.Sprintf("/create-order/%d/:order_id", user.ID), asUser(user, CreateOrder))
+		orders = append(orders, placeOnlineOrder(t, app, user, address))
+	}
+	app.Post("/verify-payment/:order_id", VerifyPayment)
+
+	status, created := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d/%d", orders[0].UserID, orders[0].ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, created)
+	}
+	gatewayOrderID, _ := created["order_id"].(string)
+	payment, signature, err := fake.Pay(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", orders[1].ID), map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	})
+	if status != fiber.StatusBadRequest {
+		t.Errorf("got %d %v, want 400", status, body)
+	}
+
+	// Nor can another user start a payment for the order.
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d/%d", orders[1].UserID, orders[0].ID), nil); status != fiber.StatusNotFound {
+		t.Errorf("create-order for another user's order: got %d %v, want 404", status, body)
+	}
+}
+
+// A payment that completes after the order was cancelled is refunded, not
+// kept.
+func TestPaymentAfterCancellation(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 300, 1), 1)
+
+	app := fiber.New()
+	app.Post("/order/:user_id", asUser(user, PlaceOrder))
+	app.Post("/create-order/:order_id", asUser(user, CreateOrder))
+	app.Patch("/cancel/:order_id", asUser(user, CancelOrder))
+	app.Post("/verify-payment/:order_id", VerifyPayment)
+
+	order := placeOnlineOrder(t, app, user, address)
+	status, created := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d", order.ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, created)
+	}
+	gatewayOrderID, _ := created["order_id"].(string)
+
+	if status, body := call(t, app, fiber.MethodPatch, fmt.Sprintf("/cancel/%d", order.ID), map[string]string{"reason": "changed my mind"}); status != fiber.StatusOK {
+		t.Fatalf("cancel: got %d %v", status, body)
+	}
+
+	payment, signature, err := fake.Pay(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/verify-payment/%d", order.ID), map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	})
+	if status != fiber.StatusConflict {
+		t.Errorf("verify-payment: got %d %v, want 409", status, body)
+	}
+
+	var refund models.Refund
+	if err := db.First(&refund, "gateway_payment_id = ?", payment.ID).Error; err != nil {
+		t.Fatalf("no refund recorded for the payment: %v", err)
+	}
+	if refund.Status != refundProcessed || refund.GatewayRefundID == "" || payments.ToPaise(refund.GatewayAmount) != payment.Amount {
+		t.Errorf("refund is %q for %v with gateway id %q, want processed for the whole payment", refund.Status, refund.GatewayAmount, refund.GatewayRefundID)
+	}
+	if payment, err = fake.FetchPayment(payment.ID); err != nil || payment.AmountRefunded != payment.Amount {
+		t.Errorf("gateway refunded %d of %d paise (%v)", payment.AmountRefunded, payment.Amount, err)
+	}
+}
+
+// A cancelled split order cannot be checked out again, which would put its
+// wallet part back on hold with nothing left to release it.
+func TestCreateOrderAfterCancellation(t *testing.T) {
+	db := testDB(t)
+	useFakeGateway(t)
+
+	user, address := newUser(t, db)
+	fillCart(t, db, user, newProduct(t, db, 400, 1), 1)
+	if _, err := ledger.CreditWallet(db, user.ID, 100, ledger.AccountOpening, ledger.KindOpeningBalance, ledger.Ref{}, "test balance"); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/order", asUser(user, PlaceOrder))
+	app.Post("/create-order/:order_id", asUser(user, CreateOrder))
+	app.Patch("/cancel/:order_id", asUser(user, CancelOrder))
+
+	status, body := call(t, app, fiber.MethodPost, "/order", userInput{AddressId: address.ID, PaymentMethod: "online payment", UseWallet: true})
+	if status != fiber.StatusCreated {
+		t.Fatalf("place order: got %d %v", status, body)
+	}
+	placed, _ := body["order"].(map[string]interface{})
+	orderID, _ := placed["ID"].(float64)
+
+	if status, body := call(t, app, fiber.MethodPatch, fmt.Sprintf("/cancel/%d", int(orderID)), map[string]string{"reason": "changed my mind"}); status != fiber.StatusOK {
+		t.Fatalf("cancel: got %d %v", status, body)
+	}
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/create-order/%d", int(orderID)), nil); status != fiber.StatusConflict {
+		t.Errorf("create-order for a cancelled order: got %d %v, want 409", status, body)
+	}
+
+	var wallet models.Wallet
+	if err := db.First(&wallet, "user_id = ?", user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if wallet.TotalAmount != 100 {
+		t.Errorf("wallet balance = %v, want all 100 back", wallet.TotalAmount)
+	}
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/ledger"
+	"kars/lifecycle"
+	"kars/models"
+	"kars/payments"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errUnknownOrder marks webhook events that cannot be matched to an order.
+// They are acknowledged so the gateway stops retrying them.
+var errUnknownOrder = errors.New("webhook does not reference a known order")
+
+// PaymentWebhook receives gateway events. Each event is applied at most once:
+// its id is stored in the same transaction as the changes it causes, and the
+// handlers themselves ignore events the order has already moved past.
+func PaymentWebhook(c *fiber.Ctx) error {
+	body := c.Body()
+	if err := payments.VerifyWebhook(body, c.Get("X-Razorpay-Signature")); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid webhook signature"})
+	}
+
+	webhook, err := payments.ParseWebhook(body, c.Get("X-Razorpay-Event-Id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid webhook payload"})
+	}
+
+	var refundedOrderID uint
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		event := models.WebhookEvent{
+			Source:  "razorpay",
+			EventID: webhook.ID,
+			Event:   webhook.Event,
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		if handled, err := handleTopUpWebhook(tx, webhook); handled || err != nil {
+			return err
+		}
+
+		switch webhook.Event {
+		case payments.EventPaymentCaptured:
+			var err error
+			refundedOrderID, err = handlePaymentCaptured(tx, webhook)
+			return err
+		case payments.EventPaymentFailed:
+			return handlePaymentFailed(tx, webhook)
+		case payments.EventRefundProcessed, payments.EventRefundFailed:
+			return handleRefundWebhook(tx, webhook)
+		}
+		return nil
+	})
+
+	if errors.Is(err, errUnknownOrder) || errors.Is(err, lifecycle.ErrInvalidTransition) {
+		log.Printf("ignoring %s webhook %s: %v", webhook.Event, webhook.ID, err)
+		return c.JSON(fiber.Map{"status": "ignored"})
+	}
+	if err != nil {
+		log.Printf("failed to process %s webhook %s: %v", webhook.Event, webhook.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to process webhook"})
+	}
+	if refundedOrderID != 0 {
+		sendGatewayRefunds(database.DB, refundedOrderID)
+	}
+
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// webhookOrder locks the order a webhook payment was made for, found through
+// the payment attempt that created its gateway order.
+func webhookOrder(tx *gorm.DB, webhook payments.Webhook) (models.Order, models.PaymentAttempt, error) {
+	var order models.Order
+	if webhook.Payment == nil || webhook.Payment.OrderID == "" {
+		return order, models.PaymentAttempt{}, errUnknownOrder
+	}
+
+	attempt, err := paymentAttemptFor(tx, webhook.Payment.OrderID, webhook.Payment.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return order, attempt, errUnknownOrder
+	}
+	if err != nil {
+		return order, attempt, err
+	}
+
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", attempt.OrderID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return order, attempt, errUnknownOrder
+	}
+	return order, attempt, err
+}
+
+// handlePaymentCaptured marks the order paid. When the order can no longer
+// be paid the capture is refunded, as is any part of it above what the
+// order is due, and the order's id is returned so the refund can be sent
+// once the event is committed.
+func handlePaymentCaptured(tx *gorm.DB, webhook payments.Webhook) (uint, error) {
+	order, attempt, err := webhookOrder(tx, webhook)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := recordAttemptPaid(tx, &attempt, *webhook.Payment); err != nil {
+		return 0, err
+	}
+
+	if webhook.Payment.Amount < payments.ToPaise(onlineDue(order)) {
+		log.Printf("payment %s for order %d captured %d paise, order needs %.2f", webhook.Payment.ID, order.ID, webhook.Payment.Amount, onlineDue(order))
+		return 0, nil
+	}
+
+	refunded, err := applyCapture(tx, &order, attempt, *webhook.Payment, "payment captured webhook")
+	if err != nil || !refunded {
+		return 0, err
+	}
+	return order.ID, nil
+}
+
+func handlePaymentFailed(tx *gorm.DB, webhook payments.Webhook) error {
+	order, attempt, err := webhookOrder(tx, webhook)
+	if err != nil {
+		return err
+	}
+
+	if err := recordAttemptFailed(tx, &attempt, webhook.Payment.ErrorCode, webhook.Payment.ErrorDescription); err != nil {
+		return err
+	}
+
+	// A failed attempt after a successful one changes nothing.
+	if order.PaymentStatus != lifecycle.PaymentPending {
+		return nil
+	}
+
+	if err := lifecycle.TransitionPayment(tx, &order, lifecycle.PaymentFailed, lifecycle.ActorSystem, webhook.Payment.ErrorDescription); err != nil {
+		return err
+	}
+	return ledger.ReleaseHold(tx, order.UserID, order.ID, "online payment failed")
+}
+
+func handleRefundProcessed(tx *gorm.DB, webhook payments.Webhook) error {
+	order, _, err := webhookOrder(tx, webhook)
+	if err != nil {
+		return err
+	}
+
+	if webhook.Refund == nil || webhook.Refund.Amount < webhook.Payment.Amount {
+		return nil
+	}
+
+	if order.PaymentStatus != lifecycle.PaymentPaid {
+		return nil
+	}
+
+	return lifecycle.TransitionPayment(tx, &order, lifecycle.PaymentRefunded, lifecycle.ActorSystem, "refund processed webhook")
+}
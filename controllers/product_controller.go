@@ -1,10 +1,16 @@
 package controllers
 
 import (
+	"errors"
 	"kars/database"
+	"kars/fitment"
 	"kars/models"
+	"kars/pricing"
+	"kars/search"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -20,6 +26,7 @@ type Product struct {
 	Status      string  `json:"status"`
 	OfferType   string  `json:"offer_type"`
 	OfferValue  float64 `json:"offer_value"`
+	Weight      int     `json:"weight"`
 }
 
 func AddProduct(c *fiber.Ctx) error {
@@ -66,6 +73,7 @@ func AddProduct(c *fiber.Ctx) error {
 		Status:      input.Status,
 		OfferType:   input.OfferType,
 		OfferValue:  input.OfferValue,
+		Weight:      input.Weight,
 	}
 
 	if err := database.DB.Create(&NewProduct).Error; err != nil {
@@ -97,6 +105,7 @@ func AddProduct(c *fiber.Ctx) error {
 		"OfferType":   NewProduct.OfferType,
 		"OfferValue":  NewProduct.OfferValue,
 		"IsListed":    NewProduct.IsListed,
+		"Weight":      NewProduct.Weight,
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -188,6 +197,18 @@ func EditProduct(c *fiber.Ctx) error {
 		product.Price = input.Price
 	}
 	if input.Quantity > 0 {
+		// Stock of a product sold in variants is kept per variant.
+		var variants int64
+		if err := database.DB.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&variants).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check product variants",
+			})
+		}
+		if variants > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "this product is sold in variants; update the stock of its variants instead",
+			})
+		}
 		product.Quantity = input.Quantity
 	}
 	if input.Color != "" {
@@ -205,6 +226,9 @@ func EditProduct(c *fiber.Ctx) error {
 	if input.OfferValue > 0 {
 		product.OfferValue = input.OfferValue
 	}
+	if input.Weight > 0 {
+		product.Weight = input.Weight
+	}
 
 	if err := database.DB.Save(&product).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -223,6 +247,7 @@ func EditProduct(c *fiber.Ctx) error {
 		"status":        product.Status,
 		"offer_type":    product.OfferType,
 		"offer_value":   product.OfferValue,
+		"weight":        product.Weight,
 		"category_name": categoryname,
 		"category_id":   product.CategoryID,
 	}
@@ -281,74 +306,196 @@ func DeleteProduct(c *fiber.Ctx) error {
 	})
 }
 
+// UserProductList lists products newest first, a page at a time
+// (?page=, ?per_page=). It takes the same search, filters and sorts as
+// SearchProducts.
 func UserProductList(c *fiber.Ctx) error {
+	return listProducts(c, "successfully fetched all the products details")
+}
+
+// SearchProducts finds products matching ?q= across their name,
+// description, category and colour, best matches first. Results can be
+// filtered by ?category_id=, ?min_price=, ?max_price=, ?color= (comma
+// separated), ?in_stock=true and fitment (?compatible=true or
+// ?vehicle_id=), and sorted with ?sort=relevance, price_asc, price_desc,
+// newest or popularity.
+func SearchProducts(c *fiber.Ctx) error {
+	return listProducts(c, "search results")
+}
 
-	pageParam := c.Params("page")
-	page, err := strconv.Atoi(pageParam)
-	if err != nil || page < 0 {
-		page = 1
+func listProducts(c *fiber.Ctx, message string) error {
+	query := search.Query{
+		Text:       c.Query("q"),
+		CategoryID: uint(c.QueryInt("category_id")),
+		InStock:    c.QueryBool("in_stock"),
+		Sort:       c.Query("sort"),
+		Page:       c.QueryInt("page", 1),
+		PerPage:    c.QueryInt("per_page", search.DefaultPerPage),
+	}
+	var err error
+	if query.MinPrice, err = priceParam(c, "min_price"); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if query.MaxPrice, err = priceParam(c, "max_price"); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if colors := c.Query("color"); colors != "" {
+		query.Colors = strings.Split(colors, ",")
+	}
+	if query.VehicleID, err = fitmentVehicle(c); err != nil {
+		return fitmentError(c, err)
 	}
 
-	limit := 10
-	offSet := (page - 1) * limit
+	productlist, page, err := search.Products(database.DB, query)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidQuery) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch products details",
+		})
+	}
+
+	delivery := deliveryEstimate(database.DB, c.Locals("user_id"))
+
+	offers, err := pricing.Active(database.DB, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve offers",
+		})
+	}
+
+	productIDs := make([]uint, 0, len(productlist))
+	for _, product := range productlist {
+		productIDs = append(productIDs, product.ID)
+	}
+	var variants []models.ProductVariant
+	if len(productIDs) > 0 {
+		if err := database.DB.Where("product_id IN ?", productIDs).Order("id").Find(&variants).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to retrieve product variants",
+			})
+		}
+	}
+	productVariants := make(map[uint][]models.ProductVariant)
+	for _, variant := range variants {
+		productVariants[variant.ProductID] = append(productVariants[variant.ProductID], variant)
+	}
 
-	var productlist []models.Product
+	response := make([]fiber.Map, 0, len(productlist))
+	for _, product := range productlist {
+		response = append(response, productDetails(product, productVariants[product.ID], offers, delivery))
+	}
 
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":         message,
+		"current_page":    page.Page,
+		"pagination":      page,
+		"product_details": response,
+	})
+}
+
+// priceParam reads a price from the query string, zero when it is absent.
+func priceParam(c *fiber.Ctx, name string) (float64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil || price < 0 {
+		return 0, errors.New(name + " must be a price")
+	}
+	return price, nil
+}
+
+// productDetails is a product as shoppers see it, priced with the offers
+// running and with its variants grouped under it.
+func productDetails(product models.Product, variants []models.ProductVariant, offers []models.Offer, delivery fiber.Map) fiber.Map {
+	promotions := pricing.Promotions(offers, product)
+	price := pricing.Price(product, product.Category, promotions...)
+
+	productMap := fiber.Map{
+		"product_id": product.ID,
+		"product_name":  product.ProductName,
+		"description":   product.Description,
+		"price":         product.Price,
+		"final_price":   price.Price,
+		"price_breakdown": price,
+		"quantity":      product.Quantity,
+		"color":         product.Color,
+		"status":        product.Status,
+		"category_id": product.Category.ID,
+		"category_name": product.Category.CategoryName,
+		"img_urls":      product.ImgURLs,
+		"delivery":      delivery,
+	}
+	if len(variants) > 0 {
+		productMap["options"], productMap["variants"] = variantMatrix(variants, func(variant *models.ProductVariant) pricing.Breakdown {
+			return pricing.Price(pricing.Variant(product, variant), product.Category, promotions...)
+		})
+	}
+	return productMap
+}
+
+// UserProductDetail shows one listed product. With a vehicle in the user's
+// garage, or one named by ?vehicle_id=, it carries a badge saying whether
+// the product and each of its variants fit it.
+func UserProductDetail(c *fiber.Ctx) error {
+	var product models.Product
 	if err := database.DB.Preload("Category", func(db *gorm.DB) *gorm.DB {
 		return db.Where("is_listed = ?", "listed")
-	}).Where("is_listed = ?", "listed").Limit(limit).Offset(offSet).Find(&productlist).Error; err != nil {
-		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch products details",
-		})
+	}).Where("is_listed = ?", "listed").First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+		return shippingLookupError(c, err, "product")
 	}
 
-	if len(productlist) == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"message": "No products found",
+	var variants []models.ProductVariant
+	if err := database.DB.Where("product_id = ?", product.ID).Order("id").Find(&variants).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve product variants",
 		})
 	}
 
-	var response []fiber.Map
-	for _, product := range productlist {
-		finalPrice := product.Price
+	offers, err := pricing.Active(database.DB, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve offers",
+		})
+	}
+	details := productDetails(product, variants, offers, deliveryEstimate(database.DB, c.Locals("user_id")))
 
-		if product.Category.OfferValue > product.OfferValue {
-			if product.Category.OfferType == "percentage" {
-				finalPrice -= finalPrice * product.Category.OfferValue / 100
-			} else if product.Category.OfferType == "fixed" {
-				finalPrice -= product.Category.OfferValue
-			}
-		} else {
-			if product.OfferType == "percentage" {
-				finalPrice -= finalPrice * product.OfferValue / 100
-			} else if product.OfferType == "fixed" {
-				finalPrice -= product.OfferValue
-			}
+	var vehicle *models.Vehicle
+	if vehicleID := c.Query("vehicle_id"); vehicleID != "" {
+		vehicle = &models.Vehicle{}
+		if err := database.DB.First(vehicle, "id = ?", vehicleID).Error; err != nil {
+			return shippingLookupError(c, err, "vehicle")
 		}
-
-		if finalPrice < 0 {
-			finalPrice = 0
+	} else if vehicle, err = garageVehicle(database.DB, c.Locals("user_id")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve garage",
+		})
+	}
+	if vehicle != nil {
+		variantIDs := make([]uint, 0, len(variants))
+		for _, variant := range variants {
+			variantIDs = append(variantIDs, variant.ID)
 		}
-
-		productMap := fiber.Map{
-			"product_id": product.ID,
-			"product_name":  product.ProductName,
-			"description":   product.Description,
-			"price":         product.Price,
-			"final_price":   finalPrice,
-			"quantity":      product.Quantity,
-			"color":         product.Color,
-			"status":        product.Status,
-			"category_id": product.Category.ID,
-			"category_name": product.Category.CategoryName,
-			"img_urls":      product.ImgURLs,
+		badge, err := fitment.Check(database.DB, product.ID, variantIDs, *vehicle)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to check fitment",
+			})
 		}
-		response = append(response, productMap)
+		details["fitment"] = badge
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message":         "successfully fetched all the products details",
-		"current_page": page,
-		"product_details": response,
+		"message":         "product details",
+		"product_details": details,
 	})
 }
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"fmt"
+	"kars/models"
+	"kars/search"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Price filters and sorts go by what products sell for after offers, not
+// by their list prices.
+func TestSearchByOfferPrice(t *testing.T) {
+	db := testDB(t)
+	category := models.Category{CategoryName: unique("category"), GSTRate: 18, PricesIncludeTax: true}
+	create(t, db, &category)
+	discounted := models.Product{ProductName: unique("product"), Price: 500, Quantity: 1, CategoryID: category.ID, OfferType: "percentage", OfferValue: 50}
+	create(t, db, &discounted)
+	regular := models.Product{ProductName: unique("product"), Price: 300, Quantity: 1, CategoryID: category.ID}
+	create(t, db, &regular)
+	variantPrice := 450.0
+	varied := models.Product{ProductName: unique("product"), Price: 100, Quantity: 1, CategoryID: category.ID}
+	create(t, db, &varied)
+	create(t, db, &models.ProductVariant{ProductID: varied.ID, SKU: unique("sku"), Price: &variantPrice, Quantity: 1})
+
+	app := fiber.New()
+	app.Get("/search", SearchProducts)
+
+	found := func(query string) []uint {
+		t.Helper()
+		status, body := call(t, app, fiber.MethodGet, fmt.Sprintf("/search?category_id=%d&%s", category.ID, query), nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("search %s: got %d %v", query, status, body)
+		}
+		details, _ := body["product_details"].([]interface{})
+		var ids []uint
+		for _, detail := range details {
+			product, _ := detail.(map[string]interface{})
+			id, _ := product["product_id"].(float64)
+			ids = append(ids, uint(id))
+		}
+		return ids
+	}
+
+	if ids := found("sort=price_asc"); len(ids) != 3 || ids[0] != discounted.ID {
+		t.Errorf("price_asc: got %v, want %d first", ids, discounted.ID)
+	}
+	if ids := found("max_price=260"); len(ids) != 1 || ids[0] != discounted.ID {
+		t.Errorf("max_price=260: got %v, want only %d", ids, discounted.ID)
+	}
+	if ids := found("min_price=400"); len(ids) != 1 || ids[0] != varied.ID {
+		t.Errorf("min_price=400: got %v, want only %d", ids, varied.ID)
+	}
+}
+
+// A price search matching more products than can be priced at once is
+// refused rather than loading them all.
+func TestSearchByPriceTooBroad(t *testing.T) {
+	db := testDB(t)
+	category := models.Category{CategoryName: unique("category"), GSTRate: 18, PricesIncludeTax: true}
+	create(t, db, &category)
+	products := make([]models.Product, search.MaxPriced+1)
+	for i := range products {
+		products[i] = models.Product{ProductName: unique("product"), Price: 100, Quantity: 1, CategoryID: category.ID}
+	}
+	if err := db.CreateInBatches(products, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/search", SearchProducts)
+
+	path := fmt.Sprintf("/search?category_id=%d&sort=price_asc", category.ID)
+	if status, body := call(t, app, fiber.MethodGet, path, nil); status != fiber.StatusBadRequest {
+		t.Errorf("sort=price_asc: got %d %v, want 400", status, body)
+	}
+	path = fmt.Sprintf("/search?category_id=%d&sort=newest", category.ID)
+	if status, body := call(t, app, fiber.MethodGet, path, nil); status != fiber.StatusOK {
+		t.Errorf("sort=newest: got %d %v, want 200", status, body)
+	}
+}
@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/database"
+	"kars/ledger"
+	"kars/lifecycle"
+	"kars/models"
+	"kars/payments"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Refund methods the customer can choose from.
+const (
+	refundToWallet = "wallet"
+	refundToSource = "source"
+)
+
+const (
+	refundPending   = "pending"
+	refundProcessed = "processed"
+	refundFailed    = "failed"
+)
+
+var errRefundMethod = errors.New("refund method must be 'wallet' or 'source'")
+
+// refundMethod validates the refund method of a request. Refunds go back to
+// the original payment method unless the customer asks for the wallet.
+func refundMethod(method string) (string, error) {
+	switch method {
+	case "":
+		return refundToSource, nil
+	case refundToWallet, refundToSource:
+		return method, nil
+	}
+	return "", errRefundMethod
+}
+
+// issueRefund records a refund of amount on a paid order. With
+// refundToSource each tender gets its share back: the wallet part is
+// credited at once and the online part is left pending against the payment
+// that paid the order, for sendGatewayRefunds to send once the caller has
+// committed. Orders paid in cash, and orders paid before payments were
+// recorded, are refunded to the wallet. note is the credit note the refund
+// pays out, if the order was invoiced.
+func issueRefund(tx *gorm.DB, order models.Order, amount float64, method, reason string, items []models.RefundItem, note *models.CreditNote) (models.Refund, error) {
+	amount = math.Round(amount*100) / 100
+	refund := models.Refund{
+		OrderID: order.ID,
+		UserID:  order.UserID,
+		Amount:  amount,
+		Method:  method,
+		Reason:  reason,
+		Status:  refundPending,
+		Items:   items,
+	}
+	if note != nil {
+		refund.CreditNoteID = &note.ID
+	}
+
+	refund.WalletAmount = amount
+	if method == refundToSource {
+		walletShare, gatewayShare := tenderShares(order, amount)
+		if gatewayShare > 0 {
+			var attempt models.PaymentAttempt
+			err := tx.Where("order_id = ? AND status = ?", order.ID, attemptPaid).
+				Order("paid_at DESC").First(&attempt).Error
+			if err == nil {
+				refund.WalletAmount, refund.GatewayAmount = walletShare, gatewayShare
+				refund.Gateway = attempt.Gateway
+				refund.GatewayPaymentID = attempt.PaymentID
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return refund, err
+			}
+		}
+	}
+
+	if err := tx.Create(&refund).Error; err != nil {
+		return refund, err
+	}
+
+	if refund.WalletAmount > 0 {
+		ref := ledger.Ref{OrderID: &order.ID, RefundID: &refund.ID}
+		txn, err := ledger.CreditWallet(tx, order.UserID, refund.WalletAmount, ledger.AccountRefunds, ledger.KindRefund, ref, reason)
+		if err != nil {
+			return refund, err
+		}
+		refund.LedgerTransactionID = &txn.ID
+	}
+
+	status := refundProcessed
+	if refund.GatewayAmount > 0 {
+		status = refundPending
+	}
+	return refund, settleRefund(tx, &refund, status, "")
+}
+
+var errRefundUnconfirmed = errors.New("the gateway has refunded more of the payment than it confirmed; waiting for its refund webhook")
+
+// sendGatewayRefunds sends the gateway part of the order's refunds that have
+// not reached the gateway yet. It runs after the refunds are committed, so
+// nothing the caller does later can roll back a refund the gateway has
+// already paid. A refund that cannot be sent stays pending for SyncRefund
+// to retry.
+func sendGatewayRefunds(db *gorm.DB, orderID uint) {
+	var ids []uint
+	err := db.Model(&models.Refund{}).
+		Where("order_id = ? AND status = ? AND gateway_amount > 0 AND COALESCE(gateway_refund_id, '') = ''", orderID, refundPending).
+		Pluck("id", &ids).Error
+	if err != nil {
+		log.Printf("failed to find unsent refunds of order %d: %v", orderID, err)
+		return
+	}
+	for _, id := range ids {
+		if _, err := sendGatewayRefund(db, id); err != nil {
+			log.Printf("refund %d of order %d is still pending: %v", id, orderID, err)
+		}
+	}
+}
+
+// sendGatewayRefund refunds the gateway part of a pending refund and saves
+// what the gateway answered. The refund row stays locked from the check to
+// the save, and the only write after the gateway call is the refund's own,
+// so a refund is sent once. The refund id goes with it in the notes: if
+// the answer is lost, the refund webhook finds the row by it, and until
+// then a payment with more refunded than confirmed is not refunded again.
+func sendGatewayRefund(db *gorm.DB, refundID uint) (models.Refund, error) {
+	var refund models.Refund
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&refund, refundID).Error; err != nil {
+			return err
+		}
+		if refund.Status != refundPending || refund.GatewayRefundID != "" || refund.GatewayAmount <= 0 {
+			return nil
+		}
+
+		payment, err := payments.Default.FetchPayment(refund.GatewayPaymentID)
+		if err != nil {
+			return err
+		}
+		var confirmed float64
+		err = tx.Model(&models.Refund{}).
+			Where("gateway_payment_id = ? AND COALESCE(gateway_refund_id, '') <> '' AND status <> ?", refund.GatewayPaymentID, refundFailed).
+			Select("COALESCE(SUM(gateway_amount), 0)").Scan(&confirmed).Error
+		if err != nil {
+			return err
+		}
+		if payment.AmountRefunded > payments.ToPaise(confirmed) {
+			return errRefundUnconfirmed
+		}
+
+		notes := map[string]string{
+			"order_id":  fmt.Sprint(refund.OrderID),
+			"refund_id": fmt.Sprint(refund.ID),
+		}
+		gatewayRefund, err := payments.Default.Refund(refund.GatewayPaymentID, payments.ToPaise(refund.GatewayAmount), notes)
+		if err != nil {
+			return fmt.Errorf("gateway refund for order %d: %w", refund.OrderID, err)
+		}
+		refund.GatewayRefundID = gatewayRefund.ID
+		return settleRefund(tx, &refund, gatewayRefundStatus(gatewayRefund.Status), "")
+	})
+	return refund, err
+}
+
+// gatewayRefundStatus maps a gateway refund status onto ours.
+func gatewayRefundStatus(status string) string {
+	switch status {
+	case "processed":
+		return refundProcessed
+	case "failed":
+		return refundFailed
+	}
+	return refundPending
+}
+
+// settleRefund saves the refund with its new status. Refunds only move out
+// of pending, so a late or repeated gateway report changes nothing.
+func settleRefund(tx *gorm.DB, refund *models.Refund, status, failureReason string) error {
+	updates := map[string]interface{}{
+		"ledger_transaction_id": refund.LedgerTransactionID,
+		"gateway":               refund.Gateway,
+		"gateway_payment_id":    refund.GatewayPaymentID,
+		"gateway_refund_id":     refund.GatewayRefundID,
+	}
+	if refund.Status == refundPending && status != refundPending {
+		now := time.Now()
+		refund.Status = status
+		refund.FailureReason = failureReason
+		refund.ProcessedAt = &now
+		updates["status"] = refund.Status
+		updates["failure_reason"] = refund.FailureReason
+		updates["processed_at"] = refund.ProcessedAt
+	}
+	return tx.Model(refund).Updates(updates).Error
+}
+
+func refundError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, lifecycle.ErrInvalidTransition) {
+		return transitionError(c, err)
+	}
+	log.Println(err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "failed to refund order",
+	})
+}
+
+func ListUserRefunds(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+
+	var refunds []models.Refund
+	if err := database.DB.Preload("Items").Where("user_id = ?", userID).Order("created_at DESC").Find(&refunds).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve refunds",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "refunds",
+		"refunds": refunds,
+	})
+}
+
+func ListRefunds(c *fiber.Ctx) error {
+	query := database.DB.Preload("Items").Order("created_at DESC")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		query = query.Where("order_id = ?", orderID)
+	}
+
+	var refunds []models.Refund
+	if err := query.Find(&refunds).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve refunds",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "refunds",
+		"refunds": refunds,
+	})
+}
+
+// SyncRefund asks the gateway for the state of a pending refund, for when
+// its webhook never arrived. A refund that never reached the gateway is
+// sent now.
+func SyncRefund(c *fiber.Ctx) error {
+	var refund models.Refund
+	if err := database.DB.First(&refund, "id = ?", c.Params("refund_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "refund not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve refund"})
+	}
+
+	var err error
+	if refund.GatewayRefundID == "" {
+		refund, err = sendGatewayRefund(database.DB, refund.ID)
+	} else {
+		err = database.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&refund, refund.ID).Error; err != nil {
+				return err
+			}
+			if refund.Status != refundPending {
+				return nil
+			}
+
+			gatewayRefund, err := payments.Default.FetchRefund(refund.GatewayRefundID)
+			if err != nil {
+				return err
+			}
+			return settleRefund(tx, &refund, gatewayRefundStatus(gatewayRefund.Status), "")
+		})
+	}
+	if errors.Is(err, errRefundUnconfirmed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "failed to sync refund with gateway"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "refund status updated",
+		"refund":  refund,
+	})
+}
+
+// RefundToWallet pays a failed gateway refund out to the customer's wallet
+// instead.
+func RefundToWallet(c *fiber.Ctx) error {
+	var refund models.Refund
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&refund, "id = ?", c.Params("refund_id")).Error; err != nil {
+			return err
+		}
+		if refund.Status != refundFailed {
+			return errRefundNotFailed
+		}
+
+		ref := ledger.Ref{OrderID: &refund.OrderID, RefundID: &refund.ID}
+		if _, err := ledger.CreditWallet(tx, refund.UserID, refund.GatewayAmount, ledger.AccountRefunds, ledger.KindRefund, ref, "gateway refund failed"); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		refund.Status = refundProcessed
+		refund.Method = refundToWallet
+		refund.WalletAmount = refund.Amount
+		refund.ProcessedAt = &now
+		return tx.Model(&refund).Updates(map[string]interface{}{
+			"status":        refund.Status,
+			"method":        refund.Method,
+			"wallet_amount": refund.WalletAmount,
+			"processed_at":  refund.ProcessedAt,
+		}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "refund not found"})
+	case errors.Is(err, errRefundNotFailed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to refund to wallet"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "refund credited to wallet",
+		"refund":  refund,
+	})
+}
+
+var errRefundNotFailed = errors.New("only failed refunds can be moved to the wallet")
+
+// handleRefundWebhook settles the refund a gateway refund event reports.
+// Refunds made outside the shop have no row; a full one still marks the
+// order refunded.
+func handleRefundWebhook(tx *gorm.DB, webhook payments.Webhook) error {
+	if webhook.Refund == nil {
+		return nil
+	}
+
+	var refund models.Refund
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&refund, "gateway_refund_id = ?", webhook.Refund.ID).Error
+	// A refund whose gateway answer was lost is found by the id in its notes.
+	if refundID := webhook.Refund.Notes["refund_id"]; errors.Is(err, gorm.ErrRecordNotFound) && refundID != "" {
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&refund, "id = ? AND gateway_payment_id = ?", refundID, webhook.Refund.PaymentID).Error
+		if err == nil && refund.GatewayRefundID != "" && refund.GatewayRefundID != webhook.Refund.ID {
+			return fmt.Errorf("%w: refund %d was sent as %s, not %s", errUnknownOrder, refund.ID, refund.GatewayRefundID, webhook.Refund.ID)
+		}
+		refund.GatewayRefundID = webhook.Refund.ID
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if webhook.Event == payments.EventRefundProcessed {
+			return handleRefundProcessed(tx, webhook)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status, reason := refundProcessed, ""
+	if webhook.Event == payments.EventRefundFailed {
+		status, reason = refundFailed, "gateway reported the refund as failed"
+	}
+	return settleRefund(tx, &refund, status, reason)
+}
+
+// refundOrder refunds amount, what is left of a paid order, and marks its
+// payment refunded. It does nothing for orders that were never paid.
+func refundOrder(tx *gorm.DB, order *models.Order, amount float64, method, actor, reason string, note *models.CreditNote) error {
+	if !lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentRefunded) {
+		return nil
+	}
+
+	if err := lifecycle.TransitionPayment(tx, order, lifecycle.PaymentRefunded, actor, reason); err != nil {
+		return err
+	}
+
+	if amount < 0.01 {
+		return nil
+	}
+	_, err := issueRefund(tx, *order, amount, method, reason, nil, note)
+	return err
+}
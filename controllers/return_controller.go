@@ -0,0 +1,565 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/database"
+	"kars/lifecycle"
+	"kars/models"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Conditions an inspected item can be found in. Only resellable items go
+// back into stock.
+const (
+	conditionResellable = "resellable"
+	conditionDamaged    = "damaged"
+)
+
+// errInvalidReturn marks return requests the customer cannot make; its
+// message is shown to them.
+var errInvalidReturn = errors.New("invalid return request")
+
+type returnLine struct {
+	OrderItemID uint   `json:"order_item_id"`
+	Quantity    int    `json:"quantity"`
+	Reason      string `json:"reason"`
+}
+
+type returnInput struct {
+	OrderID      uint         `json:"order_id"`
+	Reason       string       `json:"reason"`
+	PhotoURLs    []string     `json:"photo_urls"`
+	RefundMethod string       `json:"refund_method"`
+	Items        []returnLine `json:"items"`
+}
+
+// CreateReturnRequest lets a customer ask to return some of the items of a
+// delivered order.
+func CreateReturnRequest(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+
+	var input returnInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request data",
+		})
+	}
+
+	if input.OrderID == 0 || len(input.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "order id and items are required",
+		})
+	}
+
+	var request models.ReturnRequest
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ? AND user_id = ?", input.OrderID, userID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		request, err = createReturnRequest(tx, order, input)
+		return err
+	})
+	return returnRequestCreated(c, request, err)
+}
+
+func returnRequestCreated(c *fiber.Ctx, request models.ReturnRequest, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+	case errors.Is(err, errInvalidReturn), errors.Is(err, errRefundMethod):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create return request"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "return request created",
+		"return":  request,
+	})
+}
+
+// createReturnRequest validates the requested items against what is still
+// returnable on the order and the return window of each product's category.
+// The caller must hold the order lock.
+func createReturnRequest(tx *gorm.DB, order models.Order, input returnInput) (models.ReturnRequest, error) {
+	method, err := refundMethod(input.RefundMethod)
+	if err != nil {
+		return models.ReturnRequest{}, err
+	}
+
+	if order.OrderStatus != lifecycle.OrderDelivered {
+		return models.ReturnRequest{}, fmt.Errorf("%w: only delivered orders can be returned", errInvalidReturn)
+	}
+
+	returnable, err := returnableQuantities(tx, order.ID)
+	if err != nil {
+		return models.ReturnRequest{}, err
+	}
+
+	deliveredAt := lifecycle.ReachedAt(tx, &order, lifecycle.OrderDelivered)
+	request := models.ReturnRequest{
+		OrderID:      order.ID,
+		UserID:       order.UserID,
+		Status:       lifecycle.ReturnRequested,
+		Reason:       input.Reason,
+		PhotoURLs:    strings.Join(input.PhotoURLs, ","),
+		RefundMethod: method,
+	}
+
+	seen := map[uint]bool{}
+	for _, line := range input.Items {
+		if seen[line.OrderItemID] {
+			return request, fmt.Errorf("%w: order item %d is listed twice", errInvalidReturn, line.OrderItemID)
+		}
+		seen[line.OrderItemID] = true
+
+		var item models.OrderItem
+		if err := tx.First(&item, "id = ? AND order_id = ?", line.OrderItemID, order.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return request, fmt.Errorf("%w: order item %d is not part of this order", errInvalidReturn, line.OrderItemID)
+			}
+			return request, err
+		}
+
+		if line.Quantity <= 0 || line.Quantity > returnable[item.ID] {
+			return request, fmt.Errorf("%w: only %d of %s can be returned", errInvalidReturn, returnable[item.ID], item.ProductName)
+		}
+
+		var product models.Product
+		if err := tx.Preload("Category").First(&product, "id = ?", item.ProductID).Error; err != nil {
+			return request, err
+		}
+		window := product.Category.ReturnWindowDays
+		if window <= 0 {
+			return request, fmt.Errorf("%w: %s cannot be returned", errInvalidReturn, item.ProductName)
+		}
+		if closes := deliveredAt.AddDate(0, 0, window); time.Now().After(closes) {
+			return request, fmt.Errorf("%w: the return window for %s closed on %s", errInvalidReturn, item.ProductName, closes.Format("2006-01-02"))
+		}
+
+		reason := line.Reason
+		if reason == "" {
+			reason = input.Reason
+		}
+		request.Items = append(request.Items, models.ReturnItem{
+			OrderItemID: item.ID,
+			ProductID:   item.ProductID,
+			Quantity:    line.Quantity,
+			Reason:      reason,
+			VariantID:   item.VariantID,
+		})
+	}
+
+	err = tx.Create(&request).Error
+	return request, err
+}
+
+// returnableQuantities returns, per order item still in the order, how many
+// units are not already part of an open or completed return.
+func returnableQuantities(tx *gorm.DB, orderID uint) (map[uint]int, error) {
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND is_cancelled = ?", orderID, "ordered").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	var taken []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := tx.Table("return_items").
+		Select("return_items.order_item_id, SUM(CASE WHEN return_requests.status = ? THEN return_items.accepted_quantity ELSE return_items.quantity END) AS quantity", lifecycle.ReturnCompleted).
+		Joins("JOIN return_requests ON return_requests.id = return_items.return_request_id").
+		Where("return_requests.order_id = ? AND return_requests.status <> ? AND return_items.deleted_at IS NULL AND return_requests.deleted_at IS NULL", orderID, lifecycle.ReturnRejected).
+		Group("return_items.order_item_id").
+		Scan(&taken).Error
+	if err != nil {
+		return nil, err
+	}
+
+	returnable := map[uint]int{}
+	for _, item := range items {
+		returnable[item.ID] = item.Quantity
+	}
+	for _, row := range taken {
+		if _, ok := returnable[row.OrderItemID]; ok {
+			returnable[row.OrderItemID] -= row.Quantity
+		}
+	}
+	return returnable, nil
+}
+
+func ListUserReturns(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+
+	var requests []models.ReturnRequest
+	if err := database.DB.Preload("Items").Where("user_id = ?", userID).Order("created_at DESC").Find(&requests).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve return requests",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "return requests",
+		"returns": requests,
+	})
+}
+
+func GetUserReturn(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+
+	var request models.ReturnRequest
+	if err := database.DB.Preload("Items").First(&request, "id = ? AND user_id = ?", c.Params("return_id"), userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "return request not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve return request"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "return request",
+		"return":  request,
+	})
+}
+
+func ListReturns(c *fiber.Ctx) error {
+	query := database.DB.Preload("Items").Order("created_at DESC")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		query = query.Where("order_id = ?", orderID)
+	}
+
+	var requests []models.ReturnRequest
+	if err := query.Find(&requests).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve return requests",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "return requests",
+		"returns": requests,
+	})
+}
+
+func GetReturn(c *fiber.Ctx) error {
+	var request models.ReturnRequest
+	if err := database.DB.Preload("Items").First(&request, "id = ?", c.Params("return_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "return request not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve return request"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "return request",
+		"return":  request,
+	})
+}
+
+// updateReturn locks a return request and applies change to it.
+func updateReturn(c *fiber.Ctx, change func(tx *gorm.DB, request *models.ReturnRequest) error) error {
+	var request models.ReturnRequest
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&request, "id = ?", c.Params("return_id")).Error; err != nil {
+			return err
+		}
+		if err := change(tx, &request); err != nil {
+			return err
+		}
+		return tx.Preload("Items").First(&request, request.ID).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "return request not found"})
+	case errors.Is(err, errInvalidReturn):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, lifecycle.ErrInvalidTransition):
+		return transitionError(c, err)
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update return request"})
+	}
+	// An inspected return may have refunded the customer.
+	sendGatewayRefunds(database.DB, request.OrderID)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "return request " + request.Status,
+		"return":  request,
+	})
+}
+
+type returnNoteInput struct {
+	Note string `json:"note"`
+}
+
+func ApproveReturn(c *fiber.Ctx) error {
+	var input returnNoteInput
+	c.BodyParser(&input)
+
+	return updateReturn(c, func(tx *gorm.DB, request *models.ReturnRequest) error {
+		if err := lifecycle.TransitionReturn(tx, request, lifecycle.ReturnApproved); err != nil {
+			return err
+		}
+		return tx.Model(request).Update("admin_note", input.Note).Error
+	})
+}
+
+func RejectReturn(c *fiber.Ctx) error {
+	var input returnNoteInput
+	c.BodyParser(&input)
+	if input.Note == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "a note explaining the rejection is required"})
+	}
+
+	return updateReturn(c, func(tx *gorm.DB, request *models.ReturnRequest) error {
+		if err := lifecycle.TransitionReturn(tx, request, lifecycle.ReturnRejected); err != nil {
+			return err
+		}
+		return tx.Model(request).Update("admin_note", input.Note).Error
+	})
+}
+
+// ScheduleReturnPickup sets or moves the pickup date of an approved return.
+func ScheduleReturnPickup(c *fiber.Ctx) error {
+	var input struct {
+		PickupDate string `json:"pickup_date"`
+	}
+	c.BodyParser(&input)
+
+	pickup, err := time.ParseInLocation("2006-01-02", input.PickupDate, time.Local)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "pickup_date must be in YYYY-MM-DD format"})
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if pickup.Before(today) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "pickup_date cannot be in the past"})
+	}
+
+	return updateReturn(c, func(tx *gorm.DB, request *models.ReturnRequest) error {
+		if err := lifecycle.TransitionReturn(tx, request, lifecycle.ReturnPickupScheduled); err != nil {
+			return err
+		}
+		return tx.Model(request).Update("pickup_date", pickup).Error
+	})
+}
+
+func ReceiveReturn(c *fiber.Ctx) error {
+	return updateReturn(c, func(tx *gorm.DB, request *models.ReturnRequest) error {
+		if err := lifecycle.TransitionReturn(tx, request, lifecycle.ReturnReceived); err != nil {
+			return err
+		}
+		return tx.Model(request).Update("received_at", time.Now()).Error
+	})
+}
+
+// InspectReturn records what was found in a received return, restocks the
+// resellable units and refunds every accepted unit. Once every item of the
+// order has been returned the order itself moves to returned.
+func InspectReturn(c *fiber.Ctx) error {
+	var input struct {
+		Note  string `json:"note"`
+		Items []struct {
+			ReturnItemID     uint   `json:"return_item_id"`
+			AcceptedQuantity int    `json:"accepted_quantity"`
+			Condition        string `json:"condition"`
+		} `json:"items"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	actor := lifecycle.AdminActor(c.Locals("admin_id"))
+	return updateReturn(c, func(tx *gorm.DB, request *models.ReturnRequest) error {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, request.OrderID).Error; err != nil {
+			return err
+		}
+
+		if err := lifecycle.TransitionReturn(tx, request, lifecycle.ReturnCompleted); err != nil {
+			return err
+		}
+
+		var items []models.ReturnItem
+		if err := tx.Where("return_request_id = ?", request.ID).Find(&items).Error; err != nil {
+			return err
+		}
+
+		inspected := map[uint]int{}
+		for i, result := range input.Items {
+			if result.Condition != conditionResellable && result.Condition != conditionDamaged {
+				return fmt.Errorf("%w: condition must be '%s' or '%s'", errInvalidReturn, conditionResellable, conditionDamaged)
+			}
+			inspected[result.ReturnItemID] = i
+		}
+
+		accepted := map[uint]int{}
+		for n := range items {
+			item := &items[n]
+			i, ok := inspected[item.ID]
+			if !ok {
+				return fmt.Errorf("%w: return item %d was not inspected", errInvalidReturn, item.ID)
+			}
+			result := input.Items[i]
+			if result.AcceptedQuantity < 0 || result.AcceptedQuantity > item.Quantity {
+				return fmt.Errorf("%w: accepted quantity of return item %d must be between 0 and %d", errInvalidReturn, item.ID, item.Quantity)
+			}
+			item.AcceptedQuantity = result.AcceptedQuantity
+			item.Condition = result.Condition
+			accepted[item.OrderItemID] += item.AcceptedQuantity
+
+			if item.AcceptedQuantity > 0 && item.Condition == conditionResellable {
+				if err := restock(tx, item.ProductID, item.VariantID, item.AcceptedQuantity); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Accepted units are credited against the invoice; the refund pays
+		// out the credit note.
+		lines, note, err := creditOrder(tx, order, accepted, 0, fmt.Sprintf("return request %d", request.ID), &request.ID)
+		if err != nil {
+			return err
+		}
+		credit := map[uint]models.CreditNoteLine{}
+		for _, line := range lines {
+			credit[line.OrderItemID] = line
+		}
+
+		var total float64
+		var refundItems []models.RefundItem
+		for _, item := range items {
+			if line, ok := credit[item.OrderItemID]; ok && line.Quantity > 0 {
+				item.RefundAmount = math.Round(line.Amount*float64(item.AcceptedQuantity)/float64(line.Quantity)*100) / 100
+			}
+			err := tx.Model(&item).Updates(map[string]interface{}{
+				"accepted_quantity": item.AcceptedQuantity,
+				"condition":         item.Condition,
+				"refund_amount":     item.RefundAmount,
+			}).Error
+			if err != nil {
+				return err
+			}
+
+			if item.AcceptedQuantity == 0 {
+				continue
+			}
+			total += item.RefundAmount
+			refundItems = append(refundItems, models.RefundItem{
+				OrderItemID: item.OrderItemID,
+				ProductID:   item.ProductID,
+				Quantity:    item.AcceptedQuantity,
+				Amount:      item.RefundAmount,
+			})
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{"inspected_at": now}
+		if input.Note != "" {
+			updates["admin_note"] = input.Note
+		}
+
+		if total > 0 && lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentRefunded) {
+			refund, err := issueRefund(tx, order, total, request.RefundMethod, fmt.Sprintf("return request %d", request.ID), refundItems, note)
+			if err != nil {
+				return err
+			}
+			updates["refund_id"] = refund.ID
+		}
+		if err := tx.Model(request).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return closeReturnedItems(tx, &order, actor)
+	})
+}
+
+// closeReturnedItems marks order items whose every unit came back as
+// returned, and the order as returned once none of its items are left.
+func closeReturnedItems(tx *gorm.DB, order *models.Order, actor string) error {
+	returnable, err := returnableQuantities(tx, order.ID)
+	if err != nil {
+		return err
+	}
+
+	var open []uint
+	err = tx.Table("return_items").
+		Select("return_items.order_item_id").
+		Joins("JOIN return_requests ON return_requests.id = return_items.return_request_id").
+		Where("return_requests.order_id = ? AND return_requests.status NOT IN ? AND return_requests.deleted_at IS NULL", order.ID, []string{lifecycle.ReturnRejected, lifecycle.ReturnCompleted}).
+		Pluck("return_items.order_item_id", &open).Error
+	if err != nil {
+		return err
+	}
+	pending := map[uint]bool{}
+	for _, id := range open {
+		pending[id] = true
+	}
+
+	remaining := 0
+	for itemID, quantity := range returnable {
+		if quantity > 0 || pending[itemID] {
+			remaining++
+			continue
+		}
+		if err := tx.Model(&models.OrderItem{}).Where("id = ?", itemID).Update("is_cancelled", "returned").Error; err != nil {
+			return err
+		}
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	if err := lifecycle.TransitionOrder(tx, order, lifecycle.OrderReturned, actor, "all items returned"); err != nil {
+		return err
+	}
+	if lifecycle.CanTransitionPayment(order.PaymentStatus, lifecycle.PaymentRefunded) {
+		return lifecycle.TransitionPayment(tx, order, lifecycle.PaymentRefunded, actor, "all items returned")
+	}
+	return nil
+}
+
+// UpdateCategoryReturnWindow sets how many days after delivery products of a
+// category can be returned.
+func UpdateCategoryReturnWindow(c *fiber.Ctx) error {
+	var input struct {
+		ReturnWindowDays *int `json:"return_window_days"`
+	}
+	if err := c.BodyParser(&input); err != nil || input.ReturnWindowDays == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "return_window_days is required"})
+	}
+	if *input.ReturnWindowDays < 0 || *input.ReturnWindowDays > 365 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "return_window_days must be between 0 and 365"})
+	}
+
+	var category models.Category
+	if err := database.DB.First(&category, "id = ?", c.Params("category_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "category not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve category"})
+	}
+
+	if err := database.DB.Model(&category).Update("return_window_days", *input.ReturnWindowDays).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update category"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "return window updated",
+		"category": category,
+	})
+}
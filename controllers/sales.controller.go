@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"bytes"
 	"fmt"
 	"kars/database"
 	"kars/models"
@@ -13,7 +12,6 @@ import (
 	"github.com/jung-kurt/gofpdf/v2"
 	"github.com/wcharczuk/go-chart/v2"
 	"github.com/wcharczuk/go-chart/v2/drawing"
-	"gorm.io/gorm"
 )
 
 type OrderCount struct {
@@ -31,6 +29,15 @@ type AmountInformation struct {
 	TotalCouponDeduction       float64 `json:"total_coupon_deduction" gorm:"column:total_coupon_deduction"`
 	TotalDeliveryCharges       float64 `json:"total_delivery_charge" gorm:"column:total_delivery_charge"`
 	TotalAmountAfterDeduction  float64 `json:"total_amount_after_deduction" gorm:"column:total_amount_after_deduction"`
+	TotalTaxableValue          float64 `json:"total_taxable_value" gorm:"column:total_taxable_value"`
+	TotalCGST                  float64 `json:"total_cgst" gorm:"column:total_cgst"`
+	TotalSGST                  float64 `json:"total_sgst" gorm:"column:total_sgst"`
+	TotalIGST                  float64 `json:"total_igst" gorm:"column:total_igst"`
+	TotalCreditNotes           float64 `json:"total_credit_notes" gorm:"-"`
+	TotalB2BSales              float64 `json:"total_b2b_sales" gorm:"column:total_b2b_sales"`
+	TotalB2BTaxableValue       float64 `json:"total_b2b_taxable_value" gorm:"column:total_b2b_taxable_value"`
+	TotalB2CSales              float64 `json:"total_b2c_sales" gorm:"column:total_b2c_sales"`
+	TotalB2CTaxableValue       float64 `json:"total_b2c_taxable_value" gorm:"column:total_b2c_taxable_value"`
 }
 
 func getTotalSales(startDate, endDate time.Time) (float64, error) {
@@ -127,7 +134,15 @@ func GetSalesReport(c *fiber.Ctx) error {
 			COALESCE(SUM(total_price), 0) AS total_amount_before_deduction,
 			COALESCE(SUM(discount_amount), 0) AS total_coupon_deduction,
 			COALESCE(SUM(shipping_amount), 0) AS total_delivery_charge,
-			COALESCE(SUM(final_price), 0) AS total_amount_after_deduction
+			COALESCE(SUM(final_price), 0) AS total_amount_after_deduction,
+			COALESCE(SUM(taxable_amount), 0) AS total_taxable_value,
+			COALESCE(SUM(cgst_amount), 0) AS total_cgst,
+			COALESCE(SUM(sgst_amount), 0) AS total_sgst,
+			COALESCE(SUM(igst_amount), 0) AS total_igst,
+			COALESCE(SUM(CASE WHEN buyer_gstin <> '' THEN final_price END), 0) AS total_b2b_sales,
+			COALESCE(SUM(CASE WHEN buyer_gstin <> '' THEN taxable_amount END), 0) AS total_b2b_taxable_value,
+			COALESCE(SUM(CASE WHEN COALESCE(buyer_gstin, '') = '' THEN final_price END), 0) AS total_b2c_sales,
+			COALESCE(SUM(CASE WHEN COALESCE(buyer_gstin, '') = '' THEN taxable_amount END), 0) AS total_b2c_taxable_value
 		`).
 		Where("created_at BETWEEN ? AND ?", startDate.UTC(), endDate.UTC()).
 		Scan(&amountInfo).Error
@@ -137,6 +152,18 @@ func GetSalesReport(c *fiber.Ctx) error {
 		})
 	}
 
+	// Orders keep their totals when items are cancelled or returned; the
+	// credit notes issued in the period are what came off them.
+	err = database.DB.Model(&models.CreditNote{}).
+		Select("COALESCE(SUM(total_amount), 0)").
+		Where("issued_at BETWEEN ? AND ?", startDate.UTC(), endDate.UTC()).
+		Scan(&amountInfo.TotalCreditNotes).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch credit notes",
+		})
+	}
+
 	formattedStartDate := startDate.Format("2006-01-02")
 	formattedEndDate := endDate.Format("2006-01-02")
 
@@ -238,6 +265,15 @@ func generatePDFReport(orderCount OrderCount, amountInfo AmountInformation, tota
 		{"Total Coupon Deduction", amountInfo.TotalCouponDeduction},
 		{"Total Delivery Charges", amountInfo.TotalDeliveryCharges},
 		{"Total Amount After Deduction", amountInfo.TotalAmountAfterDeduction},
+		{"Total Taxable Value", amountInfo.TotalTaxableValue},
+		{"Total CGST", amountInfo.TotalCGST},
+		{"Total SGST", amountInfo.TotalSGST},
+		{"Total IGST", amountInfo.TotalIGST},
+		{"Total Credit Notes", amountInfo.TotalCreditNotes},
+		{"B2B Sales", amountInfo.TotalB2BSales},
+		{"B2B Taxable Value", amountInfo.TotalB2BTaxableValue},
+		{"B2C Sales", amountInfo.TotalB2CSales},
+		{"B2C Taxable Value", amountInfo.TotalB2CTaxableValue},
 	}
 
 	for _, amount := range amountDetails {
@@ -425,115 +461,3 @@ func generateBarChartReport(amountInfo AmountInformation) string {
 
 	return outputPath
 }
-
-func InvoiceDownload(c *fiber.Ctx) error {
-	orderID := c.Query("order_id")
-	if orderID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "order id is required",
-		})
-	}
-
-	var order models.Order
-	if err := database.DB.Preload("OrderItems").First(&order, "id = ?", orderID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-				"error": "order not found",
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to retrieve order",
-		})
-	}
-
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
-
-	pdf.SetFont("Arial", "B", 20) // Large font for heading
-	pdf.CellFormat(190, 12, "ORDER BILL", "0", 1, "C", false, 0, "")
-	pdf.Ln(10)
-
-	pdf.SetFont("Arial", "B", 12) // Bold font for section titles
-	pdf.Cell(40, 10, "From:")
-	pdf.SetFont("Arial", "", 12) // Regular font for details
-	pdf.MultiCell(150, 7, "Kars\nNear Thrissur Round\nThrissur, kerala, 680702\nPhone: +91 8921236125", "0", "L", false)
-	pdf.Ln(5)
-
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(40, 10, "To:")
-	pdf.SetFont("Arial", "", 12)
-	pdf.MultiCell(150, 7, fmt.Sprintf("%s\n%s\n%s\n%s\n%s",
-		order.OrderAddress.Name,         // Customer Name
-		order.OrderAddress.AddressLine1, // Street Address
-		order.OrderAddress.City,         // City
-		order.OrderAddress.PostalCode,
-		order.OrderAddress.PhoneNo), "0", "L", false)
-	pdf.Ln(8)
-
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(40, 10, "Order ID:")
-	pdf.SetFont("Arial", "", 12)
-	pdf.Cell(80, 10, orderID)
-	pdf.Ln(8)
-
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Cell(40, 10, "Order Date:")
-	pdf.SetFont("Arial", "", 12)
-	pdf.Cell(80, 10, order.CreatedAt.Format("2006-01-02 15:04:05"))
-	pdf.Ln(12)
-
-	pdf.SetFont("Arial", "B", 12)
-
-	pdf.CellFormat(20, 10, "Item ID", "1", 0, "C", false, 0, "")
-	pdf.CellFormat(50, 10, "Item Name", "1", 0, "C", false, 0, "")
-	pdf.CellFormat(20, 10, "Quantity", "1", 0, "C", false, 0, "")
-	pdf.CellFormat(30, 10, "Price", "1", 0, "C", false, 0, "")
-	pdf.CellFormat(30, 10, "Total", "1", 1, "C", false, 0, "")
-
-	pdf.SetFont("Arial", "", 12)
-	for _, item := range order.OrderItems {
-		if item.IsCancelled == "cancelled" {
-			continue
-		}
-
-		pdf.CellFormat(20, 10, fmt.Sprintf("%d", item.ProductID), "1", 0, "C", false, 0, "")
-		pdf.CellFormat(50, 10, item.ProductName, "1", 0, "L", false, 0, "")
-		pdf.CellFormat(20, 10, fmt.Sprintf("%d", item.Quantity), "1", 0, "C", false, 0, "")
-		pdf.CellFormat(30, 10, fmt.Sprintf("$%.2f", item.ProductPrice), "1", 0, "R", false, 0, "")
-		pdf.CellFormat(30, 10, fmt.Sprintf("$%.2f", float64(item.Quantity)*item.ProductPrice), "1", 1, "R", false, 0, "")
-	}
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Ln(8)
-	pdf.Cell(140, 10, "Total Amount:")
-	pdf.Cell(40, 10, fmt.Sprintf("$%.2f", order.TotalPrice))
-
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Ln(8)
-	pdf.Cell(140, 10, "Delivery Charge:")
-	pdf.Cell(40, 10, fmt.Sprintf("$%.2f", order.ShippingAmount))
-
-	if order.DiscountAmount != 0 {
-		pdf.SetFont("Arial", "B", 12)
-		pdf.Ln(8)
-		pdf.Cell(140, 10, "Discount Amount:")
-		pdf.Cell(40, 10, fmt.Sprintf("$%.2f", order.DiscountAmount))
-	}
-
-	pdf.SetFont("Arial", "B", 12)
-	pdf.Ln(8)
-	pdf.Cell(140, 10, "Final Amount:")
-	pdf.Cell(40, 10, fmt.Sprintf("$%.2f", order.FinalPrice))
-
-	var buf bytes.Buffer
-	err := pdf.Output(&buf)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to generate PDF",
-		})
-	}
-
-	c.Set("Content-Type", "application/pdf")
-	c.Set("Content-Disposition", "attachment; filename=invoice.pdf")
-
-	return c.Send(buf.Bytes())
-}
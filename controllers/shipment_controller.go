@@ -0,0 +1,321 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/database"
+	"kars/lifecycle"
+	"kars/models"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errInvalidShipment marks shipments that do not fit the order; its message
+// is shown to the admin.
+var errInvalidShipment = errors.New("invalid shipment")
+
+type shipmentLine struct {
+	OrderItemID uint `json:"order_item_id"`
+	Quantity    int  `json:"quantity"`
+}
+
+type shipmentInput struct {
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	Items          []shipmentLine `json:"items"`
+}
+
+// CreateShipment packs some of an order's items into a parcel. Without
+// items the parcel carries everything not yet shipped.
+func CreateShipment(c *fiber.Ctx) error {
+	var input shipmentInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	var shipment models.Shipment
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, c.Params("order_id"))
+		if err != nil {
+			return err
+		}
+		shipment, err = createShipment(tx, order, input)
+		return err
+	})
+	if err != nil {
+		return shipmentError(c, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":  "shipment created",
+		"shipment": shipment,
+	})
+}
+
+func lockOrder(tx *gorm.DB, orderID interface{}) (models.Order, error) {
+	var order models.Order
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", orderID).Error
+	return order, err
+}
+
+func shipmentError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order or shipment not found"})
+	case errors.Is(err, errInvalidShipment):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, lifecycle.ErrInvalidTransition):
+		return transitionError(c, err)
+	}
+	log.Println(err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update shipment"})
+}
+
+// createShipment checks the requested quantities against what is left to
+// ship. The caller must hold the order lock.
+func createShipment(tx *gorm.DB, order models.Order, input shipmentInput) (models.Shipment, error) {
+	switch order.OrderStatus {
+	case lifecycle.OrderPlaced, lifecycle.OrderShipped, lifecycle.OrderOutForDelivery:
+	default:
+		return models.Shipment{}, fmt.Errorf("%w: order %d is %s", errInvalidShipment, order.ID, order.OrderStatus)
+	}
+
+	unshipped, err := unshippedQuantities(tx, order.ID)
+	if err != nil {
+		return models.Shipment{}, err
+	}
+
+	if len(input.Items) == 0 {
+		for itemID, quantity := range unshipped {
+			if quantity > 0 {
+				input.Items = append(input.Items, shipmentLine{OrderItemID: itemID, Quantity: quantity})
+			}
+		}
+		if len(input.Items) == 0 {
+			return models.Shipment{}, fmt.Errorf("%w: every item of order %d has already shipped", errInvalidShipment, order.ID)
+		}
+	}
+
+	shipment := models.Shipment{
+		OrderID:        order.ID,
+		Carrier:        input.Carrier,
+		TrackingNumber: input.TrackingNumber,
+		Status:         lifecycle.ShipmentCreated,
+	}
+	for _, line := range input.Items {
+		left, ok := unshipped[line.OrderItemID]
+		if !ok {
+			return shipment, fmt.Errorf("%w: order item %d is not part of order %d", errInvalidShipment, line.OrderItemID, order.ID)
+		}
+		if line.Quantity <= 0 || line.Quantity > left {
+			return shipment, fmt.Errorf("%w: only %d of order item %d are left to ship", errInvalidShipment, left, line.OrderItemID)
+		}
+		unshipped[line.OrderItemID] -= line.Quantity
+		shipment.Items = append(shipment.Items, models.ShipmentItem{
+			OrderItemID: line.OrderItemID,
+			Quantity:    line.Quantity,
+		})
+	}
+
+	err = tx.Create(&shipment).Error
+	return shipment, err
+}
+
+// unshippedQuantities returns, per order item still in the order, how many
+// units are not in any shipment yet.
+func unshippedQuantities(tx *gorm.DB, orderID uint) (map[uint]int, error) {
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND is_cancelled = ?", orderID, "ordered").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	var shipped []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := tx.Table("shipment_items").
+		Select("shipment_items.order_item_id, SUM(shipment_items.quantity) AS quantity").
+		Joins("JOIN shipments ON shipments.id = shipment_items.shipment_id").
+		Where("shipments.order_id = ? AND shipments.deleted_at IS NULL AND shipment_items.deleted_at IS NULL", orderID).
+		Group("shipment_items.order_item_id").
+		Scan(&shipped).Error
+	if err != nil {
+		return nil, err
+	}
+
+	unshipped := map[uint]int{}
+	for _, item := range items {
+		unshipped[item.ID] = item.Quantity
+	}
+	for _, row := range shipped {
+		if _, ok := unshipped[row.OrderItemID]; ok {
+			unshipped[row.OrderItemID] -= row.Quantity
+		}
+	}
+	return unshipped, nil
+}
+
+// UpdateShipmentStatus records a tracking update entered by an admin.
+func UpdateShipmentStatus(c *fiber.Ctx) error {
+	var input struct {
+		Status      string `json:"status"`
+		Location    string `json:"location"`
+		Description string `json:"description"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if !lifecycle.IsShipmentStatus(input.Status) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown shipment status"})
+	}
+
+	actor := lifecycle.AdminActor(c.Locals("admin_id"))
+	event := models.TrackingEvent{
+		Status:      input.Status,
+		Location:    input.Location,
+		Description: input.Description,
+		Source:      actor,
+		OccurredAt:  time.Now(),
+	}
+
+	var shipment models.Shipment
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		shipment, err = trackShipment(tx, c.Params("shipment_id"), event, actor)
+		return err
+	})
+	if err != nil {
+		return shipmentError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "shipment updated",
+		"shipment": shipment,
+	})
+}
+
+// trackShipment locks a shipment and its order, records the event and rolls
+// the shipment status up into the order.
+func trackShipment(tx *gorm.DB, shipmentID interface{}, event models.TrackingEvent, actor string) (models.Shipment, error) {
+	var shipment models.Shipment
+	if err := tx.First(&shipment, "id = ?", shipmentID).Error; err != nil {
+		return shipment, err
+	}
+
+	// Orders are always locked before their shipments.
+	order, err := lockOrder(tx, shipment.OrderID)
+	if err != nil {
+		return shipment, err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&shipment, shipment.ID).Error; err != nil {
+		return shipment, err
+	}
+
+	if err := recordTrackingEvent(tx, &shipment, event); err != nil {
+		return shipment, err
+	}
+	if err := rollUpOrder(tx, &order, actor); err != nil {
+		return shipment, err
+	}
+
+	err = tx.Preload("Items").Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("occurred_at, id")
+	}).First(&shipment, shipment.ID).Error
+	return shipment, err
+}
+
+// recordTrackingEvent stores a tracking event and moves the shipment to the
+// event's status. Scans that repeat the current status are only stored.
+func recordTrackingEvent(tx *gorm.DB, shipment *models.Shipment, event models.TrackingEvent) error {
+	if event.Status != "" && event.Status != shipment.Status {
+		// Carriers often skip the pickup scan; a parcel seen anywhere has
+		// left the warehouse.
+		if shipment.Status == lifecycle.ShipmentCreated && event.Status != lifecycle.ShipmentInTransit {
+			if err := lifecycle.TransitionShipment(tx, shipment, lifecycle.ShipmentInTransit, event.OccurredAt); err != nil {
+				return err
+			}
+		}
+		if err := lifecycle.TransitionShipment(tx, shipment, event.Status, event.OccurredAt); err != nil {
+			return err
+		}
+	}
+	if event.Status == "" {
+		event.Status = shipment.Status
+	}
+	event.ShipmentID = shipment.ID
+	return tx.Create(&event).Error
+}
+
+// rollUpOrder moves the order forward to the status its shipments imply.
+// The caller must hold the order lock.
+func rollUpOrder(tx *gorm.DB, order *models.Order, actor string) error {
+	var shipments []models.Shipment
+	if err := tx.Preload("Items").Where("order_id = ?", order.ID).Find(&shipments).Error; err != nil {
+		return err
+	}
+
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND is_cancelled <> ?", order.ID, "cancelled").Find(&items).Error; err != nil {
+		return err
+	}
+
+	units, dispatchedUnits := 0, 0
+	for _, item := range items {
+		units += item.Quantity
+	}
+	for _, shipment := range shipments {
+		if shipment.Status == lifecycle.ShipmentCreated {
+			continue
+		}
+		for _, item := range shipment.Items {
+			dispatchedUnits += item.Quantity
+		}
+	}
+
+	status := lifecycle.ShipmentRollUp(shipments, units, dispatchedUnits)
+	if status == "" {
+		return nil
+	}
+	if err := lifecycle.AdvanceOrder(tx, order, status, actor, "shipment "+status); err != nil {
+		return err
+	}
+	return collectCashOnDelivery(tx, order, actor)
+}
+
+func ListOrderShipments(c *fiber.Ctx) error {
+	return orderShipments(c, database.DB)
+}
+
+// GetOrderTracking shows a customer the parcels of their order and every
+// tracking event of each.
+func GetOrderTracking(c *fiber.Ctx) error {
+	return orderShipments(c, database.DB.Where("user_id = ?", c.Locals("user_id")))
+}
+
+func orderShipments(c *fiber.Ctx, orders *gorm.DB) error {
+	var order models.Order
+	if err := orders.First(&order, "id = ?", c.Params("order_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "order not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve order"})
+	}
+
+	var shipments []models.Shipment
+	err := database.DB.Preload("Items").Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("occurred_at, id")
+	}).Where("order_id = ?", order.ID).Order("created_at").Find(&shipments).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve shipments"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":      "order tracking",
+		"order_status": order.OrderStatus,
+		"shipments":    shipments,
+	})
+}
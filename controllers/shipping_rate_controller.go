@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/models"
+	"kars/shipping"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Pointer fields let PATCH requests change only what they send.
+type shippingZoneInput struct {
+	Name           *string   `json:"name"`
+	States         *[]string `json:"states"`
+	PostalPrefixes *[]string `json:"postal_prefixes"`
+}
+
+func (input shippingZoneInput) apply(zone *models.ShippingZone) error {
+	if input.Name != nil {
+		zone.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.States != nil {
+		zone.States = joinList(*input.States)
+	}
+	if input.PostalPrefixes != nil {
+		for _, prefix := range *input.PostalPrefixes {
+			for _, r := range strings.TrimSpace(prefix) {
+				if r < '0' || r > '9' {
+					return errors.New("postal prefixes must be digits")
+				}
+			}
+		}
+		zone.PostalPrefixes = joinList(*input.PostalPrefixes)
+	}
+	if zone.Name == "" {
+		return errors.New("zone name is required")
+	}
+	if zone.States == "" && zone.PostalPrefixes == "" {
+		return errors.New("a zone needs at least one state or postal prefix")
+	}
+	return nil
+}
+
+func joinList(entries []string) string {
+	return strings.Join(shipping.Split(strings.Join(entries, ",")), ",")
+}
+
+type shippingRuleInput struct {
+	Name         *string  `json:"name"`
+	ZoneID       *uint    `json:"zone_id"`
+	Kind         *string  `json:"kind"`
+	MinWeight    *int     `json:"min_weight"`
+	MaxWeight    *int     `json:"max_weight"`
+	Rate         *float64 `json:"rate"`
+	PerKg        *float64 `json:"per_kg"`
+	FreeAbove    *float64 `json:"free_above"`
+	CODSurcharge *float64 `json:"cod_surcharge"`
+	IsActive     *bool    `json:"is_active"`
+}
+
+func (input shippingRuleInput) apply(rule *models.ShippingRule) error {
+	if input.Name != nil {
+		rule.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.ZoneID != nil {
+		// Zone id 0 turns the rule into a rule for every zone.
+		if *input.ZoneID == 0 {
+			rule.ZoneID = nil
+		} else {
+			var zone models.ShippingZone
+			if err := database.DB.First(&zone, *input.ZoneID).Error; err != nil {
+				return errors.New("shipping zone not found")
+			}
+			rule.ZoneID = input.ZoneID
+		}
+	}
+	if input.Kind != nil {
+		rule.Kind = *input.Kind
+	}
+	if input.MinWeight != nil {
+		rule.MinWeight = *input.MinWeight
+	}
+	if input.MaxWeight != nil {
+		rule.MaxWeight = *input.MaxWeight
+	}
+	if input.Rate != nil {
+		rule.Rate = *input.Rate
+	}
+	if input.PerKg != nil {
+		rule.PerKg = *input.PerKg
+	}
+	if input.FreeAbove != nil {
+		rule.FreeAbove = *input.FreeAbove
+	}
+	if input.CODSurcharge != nil {
+		rule.CODSurcharge = *input.CODSurcharge
+	}
+	if input.IsActive != nil {
+		rule.IsActive = *input.IsActive
+	}
+	return shipping.Validate(*rule)
+}
+
+func ListShippingZones(c *fiber.Ctx) error {
+	var zones []models.ShippingZone
+	if err := database.DB.Order("id").Find(&zones).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve shipping zones"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping zones", "zones": zones})
+}
+
+func AddShippingZone(c *fiber.Ctx) error {
+	var input shippingZoneInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	var zone models.ShippingZone
+	if err := input.apply(&zone); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Create(&zone).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create shipping zone"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "shipping zone created", "zone": zone})
+}
+
+func EditShippingZone(c *fiber.Ctx) error {
+	var zone models.ShippingZone
+	if err := database.DB.First(&zone, "id = ?", c.Params("zone_id")).Error; err != nil {
+		return shippingLookupError(c, err, "shipping zone")
+	}
+
+	var input shippingZoneInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.apply(&zone); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Save(&zone).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update shipping zone"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping zone updated", "zone": zone})
+}
+
+// DeleteShippingZone refuses zones that rules still point at, since those
+// rules would silently start applying everywhere.
+func DeleteShippingZone(c *fiber.Ctx) error {
+	var zone models.ShippingZone
+	if err := database.DB.First(&zone, "id = ?", c.Params("zone_id")).Error; err != nil {
+		return shippingLookupError(c, err, "shipping zone")
+	}
+
+	var rules int64
+	if err := database.DB.Model(&models.ShippingRule{}).Where("zone_id = ?", zone.ID).Count(&rules).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to check shipping rules"})
+	}
+	if rules > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "shipping zone is used by shipping rules"})
+	}
+
+	if err := database.DB.Delete(&zone).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete shipping zone"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping zone deleted"})
+}
+
+func ListShippingRules(c *fiber.Ctx) error {
+	var rules []models.ShippingRule
+	if err := database.DB.Order("id").Find(&rules).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve shipping rules"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping rules", "rules": rules})
+}
+
+func AddShippingRule(c *fiber.Ctx) error {
+	var input shippingRuleInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	rule := models.ShippingRule{IsActive: true}
+	if err := input.apply(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Create(&rule).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create shipping rule"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "shipping rule created", "rule": rule})
+}
+
+func EditShippingRule(c *fiber.Ctx) error {
+	var rule models.ShippingRule
+	if err := database.DB.First(&rule, "id = ?", c.Params("rule_id")).Error; err != nil {
+		return shippingLookupError(c, err, "shipping rule")
+	}
+
+	var input shippingRuleInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.apply(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := database.DB.Save(&rule).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update shipping rule"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping rule updated", "rule": rule})
+}
+
+func DeleteShippingRule(c *fiber.Ctx) error {
+	result := database.DB.Delete(&models.ShippingRule{}, "id = ?", c.Params("rule_id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete shipping rule"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "shipping rule not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "shipping rule deleted"})
+}
+
+func shippingLookupError(c *fiber.Ctx, err error, what string) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": what + " not found"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve " + what})
+}
+
+// QuoteShipping prices shipping for the user's cart to one of their
+// addresses, the same way checkout will. Coupons do not affect shipping.
+func QuoteShipping(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+
+	var address models.Address
+	if err := database.DB.First(&address, "id = ? AND user_id = ?", c.Query("address_id"), userID).Error; err != nil {
+		return shippingLookupError(c, err, "address")
+	}
+
+	var cart models.Cart
+	if err := database.DB.Preload("CartItems").First(&cart, "user_id = ?", userID).Error; err != nil {
+		return shippingLookupError(c, err, "cart")
+	}
+	if len(cart.CartItems) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cart is empty"})
+	}
+
+	if _, err := cartPrices(database.DB, cart.CartItems); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to price cart items"})
+	}
+	parcel, err := cartParcel(database.DB, cart.CartItems)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch products"})
+	}
+	parcel.COD = c.Query("payment_method") == "cash on delivery"
+	parcel.State = address.State
+	parcel.PostalCode = address.PostalCode
+
+	quote, err := shipping.QuoteFor(database.DB, parcel)
+	if errors.Is(err, shipping.ErrNoRate) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to calculate shipping"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "shipping quote",
+		"subtotal": parcel.Value,
+		"shipping": quote,
+	})
+}
+
+// cartParcel weighs and values cart items at the products' current weight.
+func cartParcel(db *gorm.DB, items []models.CartItem) (shipping.Parcel, error) {
+	productIDs := make([]uint, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	var products []models.Product
+	if err := db.Select("id", "weight").Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+		return shipping.Parcel{}, err
+	}
+	weights := make(map[uint]int, len(products))
+	for _, product := range products {
+		weights[product.ID] = product.Weight
+	}
+
+	var parcel shipping.Parcel
+	for _, item := range items {
+		parcel.Weight += weights[item.ProductID] * item.Quantity
+		parcel.Value += item.TotalPrice
+	}
+	return parcel, nil
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/models"
+	"kars/tax"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// productTaxConfigs resolves the tax configuration of each product.
+func productTaxConfigs(tx *gorm.DB, products map[uint]models.Product) (map[uint]tax.Config, error) {
+	categoryIDs := make([]uint, 0, len(products))
+	for _, product := range products {
+		categoryIDs = append(categoryIDs, product.CategoryID)
+	}
+	var categories []models.Category
+	if err := tx.Where("id IN ?", categoryIDs).Find(&categories).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+
+	configs := make(map[uint]tax.Config, len(products))
+	for id, product := range products {
+		configs[id] = tax.Resolve(product, byID[product.CategoryID])
+	}
+	return configs, nil
+}
+
+// applyItemTax splits each item, less its share of the order discount, into
+// taxable value and GST for delivery to state, and returns the order totals.
+func applyItemTax(items []models.OrderItem, configs map[uint]tax.Config, discount float64, state string) tax.Breakdown {
+	amounts := make([]float64, len(items))
+	total := 0.0
+	for i, item := range items {
+		amounts[i] = item.TotalPrice
+		total += item.TotalPrice
+	}
+	shares := tax.Allocate(amounts, discount)
+
+	intraState := tax.IntraState(state)
+	var totals tax.Breakdown
+	for i := range items {
+		config := configs[items[i].ProductID]
+		breakdown := tax.Split(amounts[i]-shares[i], config.Rate, intraState)
+		items[i].HSNCode = config.HSN
+		items[i].GSTRate = config.Rate
+		items[i].TaxableValue = breakdown.TaxableValue
+		items[i].CGST = breakdown.CGST
+		items[i].SGST = breakdown.SGST
+		items[i].IGST = breakdown.IGST
+		totals = totals.Add(breakdown)
+	}
+	return totals
+}
+
+// applyShippingTax splits the shipping charge of an order into taxable
+// value and GST. Shipping goes with the goods as one composite supply, so
+// it is taxed at the rate of the principal supply: the item with the
+// largest taxable value, the first of them on a tie.
+func applyShippingTax(order *models.Order, items []models.OrderItem, state string) {
+	principal := -1
+	for i := range items {
+		if principal < 0 || items[i].TaxableValue > items[principal].TaxableValue {
+			principal = i
+		}
+	}
+	rate := 0.0
+	if principal >= 0 {
+		rate = items[principal].GSTRate
+	}
+
+	breakdown := tax.Split(order.ShippingAmount, rate, tax.IntraState(state))
+	order.ShippingGSTRate = rate
+	order.ShippingTaxableValue = breakdown.TaxableValue
+	order.ShippingCGST = breakdown.CGST
+	order.ShippingSGST = breakdown.SGST
+	order.ShippingIGST = breakdown.IGST
+
+	totals := tax.Breakdown{
+		TaxableValue: order.TaxableAmount,
+		CGST:         order.CGSTAmount,
+		SGST:         order.SGSTAmount,
+		IGST:         order.IGSTAmount,
+	}.Add(breakdown)
+	order.TaxableAmount = totals.TaxableValue
+	order.CGSTAmount = totals.CGST
+	order.SGSTAmount = totals.SGST
+	order.IGSTAmount = totals.IGST
+}
+
+type taxInput struct {
+	HSNCode          *string  `json:"hsn_code"`
+	GSTRate          *float64 `json:"gst_rate"`
+	PricesIncludeTax *bool    `json:"prices_include_tax"`
+	// UseCategory clears a product's overrides.
+	UseCategory bool `json:"use_category"`
+}
+
+func (input taxInput) validate() error {
+	if input.HSNCode != nil {
+		*input.HSNCode = strings.TrimSpace(*input.HSNCode)
+		if !tax.ValidHSN(*input.HSNCode) {
+			return errors.New("hsn_code must have 4, 6 or 8 digits")
+		}
+	}
+	if input.GSTRate != nil && !tax.ValidRate(*input.GSTRate) {
+		return errors.New("gst_rate must be one of 0, 0.25, 3, 5, 12, 18 or 28")
+	}
+	return nil
+}
+
+func UpdateCategoryTax(c *fiber.Ctx) error {
+	var input taxInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var category models.Category
+	if err := database.DB.First(&category, "id = ?", c.Params("category_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "category not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve category"})
+	}
+
+	fields := map[string]interface{}{}
+	if input.HSNCode != nil {
+		fields["hsn_code"] = *input.HSNCode
+	}
+	if input.GSTRate != nil {
+		fields["gst_rate"] = *input.GSTRate
+	}
+	if input.PricesIncludeTax != nil {
+		fields["prices_include_tax"] = *input.PricesIncludeTax
+	}
+	if len(fields) > 0 {
+		if err := database.DB.Model(&category).Updates(fields).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update category"})
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":            "category tax updated",
+		"category_id":        category.ID,
+		"hsn_code":           category.HSNCode,
+		"gst_rate":           category.GSTRate,
+		"prices_include_tax": category.PricesIncludeTax,
+	})
+}
+
+func UpdateProductTax(c *fiber.Ctx) error {
+	var input taxInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+	if err := input.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var product models.Product
+	if err := database.DB.Preload("Category").First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "product not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve product"})
+	}
+
+	fields := map[string]interface{}{}
+	if input.UseCategory {
+		fields["hsn_code"] = ""
+		fields["gst_rate"] = nil
+		fields["prices_include_tax"] = nil
+	}
+	if input.HSNCode != nil {
+		fields["hsn_code"] = *input.HSNCode
+	}
+	if input.GSTRate != nil {
+		fields["gst_rate"] = *input.GSTRate
+	}
+	if input.PricesIncludeTax != nil {
+		fields["prices_include_tax"] = *input.PricesIncludeTax
+	}
+	if len(fields) > 0 {
+		if err := database.DB.Model(&models.Product{}).Where("id = ?", product.ID).Updates(fields).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update product"})
+		}
+		if err := database.DB.Preload("Category").First(&product, product.ID).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve product"})
+		}
+	}
+
+	config := tax.Resolve(product, product.Category)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":    "product tax updated",
+		"product_id": product.ID,
+		"overrides": fiber.Map{
+			"hsn_code":           product.HSNCode,
+			"gst_rate":           product.GSTRate,
+			"prices_include_tax": product.PricesIncludeTax,
+		},
+		"effective": fiber.Map{
+			"hsn_code":           config.HSN,
+			"gst_rate":           config.Rate,
+			"prices_include_tax": config.Inclusive,
+		},
+	})
+}
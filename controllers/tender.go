@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/ledger"
+	"kars/lifecycle"
+	"kars/models"
+	"math"
+
+	"gorm.io/gorm"
+)
+
+// onlineDue is the part of an order paid through the gateway. Orders placed
+// before tender amounts were stored are paid online in full.
+func onlineDue(order models.Order) float64 {
+	if order.WalletAmount > 0 || order.OnlineAmount > 0 {
+		return order.OnlineAmount
+	}
+	return order.FinalPrice
+}
+
+var errOrderNotPayable = errors.New("the order can no longer be paid")
+
+// payable reports whether an order still waits for its online payment. A
+// cancelled order has released its hold, and a paid one has captured it.
+func payable(order models.Order) bool {
+	return order.OrderStatus == lifecycle.OrderPending &&
+		(order.PaymentStatus == lifecycle.PaymentPending || order.PaymentStatus == lifecycle.PaymentFailed)
+}
+
+// ensureWalletHold makes sure the wallet part of a split order is on hold
+// before the online part is checked out again, since a failed payment
+// releases it. If the wallet no longer covers its part, the order is split
+// again with a larger online part. Only an order still waiting for payment
+// takes a hold; nothing would release it on any other.
+func ensureWalletHold(tx *gorm.DB, order *models.Order) error {
+	if !payable(*order) {
+		return errOrderNotPayable
+	}
+	if order.WalletAmount <= 0 {
+		return nil
+	}
+	held, err := ledger.Held(tx, order.ID)
+	if err != nil || held >= order.WalletAmount {
+		return err
+	}
+
+	wallet, err := ledger.LockWallet(tx, order.UserID, false)
+	if err != nil && !errors.Is(err, ledger.ErrWalletNotFound) {
+		return err
+	}
+	hold := math.Min(math.Max(wallet.TotalAmount, 0), order.WalletAmount-held)
+	hold = math.Round(hold*100) / 100
+	if hold > 0 {
+		if err := ledger.HoldWallet(tx, order.UserID, order.ID, hold); err != nil {
+			return err
+		}
+	}
+
+	walletAmount := math.Round((held+hold)*100) / 100
+	if walletAmount == order.WalletAmount {
+		return nil
+	}
+	order.WalletAmount = walletAmount
+	order.OnlineAmount = math.Round((order.FinalPrice-walletAmount)*100) / 100
+	return tx.Model(order).Updates(map[string]interface{}{
+		"wallet_amount": order.WalletAmount,
+		"online_amount": order.OnlineAmount,
+	}).Error
+}
+
+// settleWalletHold turns the held wallet part of an order into a sale once
+// the online part is paid. If the hold was released by an earlier failed
+// attempt, the wallet is debited again.
+func settleWalletHold(tx *gorm.DB, order *models.Order) error {
+	if order.WalletAmount <= 0 {
+		return nil
+	}
+	held, err := ledger.Held(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	if short := math.Round((order.WalletAmount-held)*100) / 100; short > 0 {
+		if err := ledger.HoldWallet(tx, order.UserID, order.ID, short); err != nil {
+			return fmt.Errorf("wallet part of order %d: %w", order.ID, err)
+		}
+	}
+	return ledger.CaptureHold(tx, order.ID)
+}
+
+// tenderShares splits amount across the tenders of an order in proportion to
+// what each of them paid.
+func tenderShares(order models.Order, amount float64) (wallet, online float64) {
+	walletPaid, onlinePaid := order.WalletAmount, order.OnlineAmount
+	if walletPaid == 0 && onlinePaid == 0 {
+		if order.PaymentMethod == "online payment" {
+			onlinePaid = order.FinalPrice
+		} else {
+			walletPaid = order.FinalPrice
+		}
+	}
+	if walletPaid+onlinePaid <= 0 {
+		return 0, 0
+	}
+	online = math.Round(amount*onlinePaid/(walletPaid+onlinePaid)*100) / 100
+	wallet = math.Round((amount-online)*100) / 100
+	return wallet, online
+}
+
+// reduceAmountDue takes amount, the credit for items cancelled before the
+// order was paid, off what the order still has to pay. A split order loses
+// it from both tenders in proportion, and the wallet part it no longer
+// needs is released from the hold on the customer's wallet.
+func reduceAmountDue(tx *gorm.DB, order *models.Order, amount float64, memo string) error {
+	updates := map[string]interface{}{}
+	if order.WalletAmount > 0 || order.OnlineAmount > 0 {
+		walletShare, onlineShare := tenderShares(*order, amount)
+		order.WalletAmount = math.Round(math.Max(order.WalletAmount-walletShare, 0)*100) / 100
+		order.OnlineAmount = math.Round(math.Max(order.OnlineAmount-onlineShare, 0)*100) / 100
+		updates["wallet_amount"] = order.WalletAmount
+		updates["online_amount"] = order.OnlineAmount
+
+		held, err := ledger.Held(tx, order.ID)
+		if err != nil {
+			return err
+		}
+		if err := ledger.ReleaseHoldAmount(tx, order.UserID, order.ID, held-order.WalletAmount, memo); err != nil {
+			return err
+		}
+	}
+	order.FinalPrice = math.Round(math.Max(order.FinalPrice-amount, 0)*100) / 100
+	updates["final_price"] = order.FinalPrice
+	return tx.Model(order).Updates(updates).Error
+}
@@ -468,11 +468,19 @@ func UserProfile(c *fiber.Ctx) error {
 		})
 	}
 
+	garage, err := garageVehicle(database.DB, user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch garage",
+		})
+	}
+
 	response := fiber.Map{
 		"name":       user.UserName,
 		"email":      user.Email,
 		"phone_no":   user.PhoneNo,
 		"created_at": user.CreatedAt,
+		"garage":     garage,
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
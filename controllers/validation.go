@@ -85,6 +85,10 @@ func (input *Product) ProductValidate() error {
 		return errors.New("Product imgurl is required")
 	}
 
+	if input.Weight < 0 {
+		return errors.New("Product weight must be zero or greater")
+	}
+
 	if input.OfferType != "" {
 		if input.OfferType != "percentage" && input.OfferType != "fixed" {
 			return errors.New("discount type must be either 'percentage' or 'fixed'")
@@ -127,6 +131,10 @@ func (input *Product) ProductValidateForPatch() error {
 		return errors.New("Product quantity must be zero or greater")
 	}
 
+	if input.Weight < 0 {
+		return errors.New("Product weight must be zero or greater")
+	}
+
 	if input.ImgURLs != "" && len(input.ImgURLs) == 0 {
 		return errors.New("Product imgurl is required")
 	}
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"errors"
+	"kars/database"
+	"kars/models"
+	"kars/pricing"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	errChooseVariant   = errors.New("choose a variant of this product")
+	errVariantNotFound = errors.New("variant not found")
+)
+
+// Pointer fields let PATCH requests change only what they send. A price of
+// 0 removes the variant's own price, so it sells at the product's.
+type productVariantInput struct {
+	SKU        *string            `json:"sku"`
+	Attributes *map[string]string `json:"attributes"`
+	Price      *float64           `json:"price"`
+	Quantity   *int               `json:"quantity"`
+	ImgURLs    *string            `json:"img_urls"`
+}
+
+func (input productVariantInput) apply(tx *gorm.DB, variant *models.ProductVariant) error {
+	if input.SKU != nil {
+		variant.SKU = strings.ToUpper(strings.TrimSpace(*input.SKU))
+	}
+	if input.Attributes != nil {
+		variant.Attributes = map[string]string{}
+		for name, value := range *input.Attributes {
+			name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+			if name == "" || value == "" {
+				return errors.New("attribute names and values cannot be empty")
+			}
+			variant.Attributes[name] = value
+		}
+	}
+	if input.Price != nil {
+		switch {
+		case *input.Price < 0:
+			return errors.New("price must be zero or greater")
+		case *input.Price == 0:
+			variant.Price = nil
+		default:
+			variant.Price = input.Price
+		}
+	}
+	if input.Quantity != nil {
+		if *input.Quantity < 0 {
+			return errors.New("quantity must be zero or greater")
+		}
+		variant.Quantity = *input.Quantity
+	}
+	if input.ImgURLs != nil {
+		variant.ImgURLs = strings.TrimSpace(*input.ImgURLs)
+	}
+
+	if variant.SKU == "" {
+		return errors.New("sku is required")
+	}
+	if len(variant.Attributes) == 0 {
+		return errors.New("a variant needs at least one attribute")
+	}
+
+	var siblings []models.ProductVariant
+	if err := tx.Where("product_id = ? AND id <> ?", variant.ProductID, variant.ID).Find(&siblings).Error; err != nil {
+		return err
+	}
+	for _, sibling := range siblings {
+		if sibling.SKU == variant.SKU {
+			return errors.New("sku is already used by another variant of this product")
+		}
+		if variantLabel(sibling) == variantLabel(*variant) {
+			return errors.New("the product already has a variant with these attributes")
+		}
+	}
+	var taken int64
+	if err := tx.Model(&models.ProductVariant{}).Unscoped().Where("sku = ? AND id <> ?", variant.SKU, variant.ID).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errors.New("sku is already in use")
+	}
+	return nil
+}
+
+// variantLabel names a variant by its attribute values in attribute order,
+// such as "Black, XL".
+func variantLabel(variant models.ProductVariant) string {
+	names := make([]string, 0, len(variant.Attributes))
+	for name := range variant.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = variant.Attributes[name]
+	}
+	return strings.Join(values, ", ")
+}
+
+// variantName is what a cart or order line of a product, or of a variant
+// of it, is called.
+func variantName(product models.Product, variant *models.ProductVariant) string {
+	if variant == nil {
+		return product.ProductName
+	}
+	return product.ProductName + " (" + variantLabel(*variant) + ")"
+}
+
+// requestedVariant finds the variant of product a request names. Products
+// with variants are only sold as one of them, so it is required for those
+// when required is set.
+func requestedVariant(db *gorm.DB, product models.Product, variantID string, required bool) (*models.ProductVariant, error) {
+	if variantID == "" {
+		if !required {
+			return nil, nil
+		}
+		var count int64
+		if err := db.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errChooseVariant
+		}
+		return nil, nil
+	}
+
+	var variant models.ProductVariant
+	if err := db.First(&variant, "id = ? AND product_id = ?", variantID, product.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errVariantNotFound
+		}
+		return nil, err
+	}
+	return &variant, nil
+}
+
+// whereVariant narrows a cart, wishlist or order item query to lines of the
+// variant variantID names, or to lines of no variant when it is empty.
+func whereVariant(query *gorm.DB, variantID string) *gorm.DB {
+	if variantID == "" {
+		return query.Where("variant_id IS NULL")
+	}
+	return query.Where("variant_id = ?", variantID)
+}
+
+func variantError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errChooseVariant):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, errVariantNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve variant"})
+}
+
+// variantsByID loads the variants ids name, skipping nil ids.
+func variantsByID(db *gorm.DB, ids []*uint) (map[uint]models.ProductVariant, error) {
+	var wanted []uint
+	for _, id := range ids {
+		if id != nil {
+			wanted = append(wanted, *id)
+		}
+	}
+	byID := make(map[uint]models.ProductVariant, len(wanted))
+	if len(wanted) == 0 {
+		return byID, nil
+	}
+	var variants []models.ProductVariant
+	if err := db.Where("id IN ?", wanted).Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	for _, variant := range variants {
+		byID[variant.ID] = variant
+	}
+	return byID, nil
+}
+
+// syncVariantStock sets a product's stock to what its variants hold
+// together.
+func syncVariantStock(tx *gorm.DB, productID uint) error {
+	return tx.Model(&models.Product{}).Where("id = ?", productID).
+		Update("quantity", tx.Model(&models.ProductVariant{}).Select("COALESCE(SUM(quantity), 0)").Where("product_id = ?", productID)).Error
+}
+
+// restock puts units back in stock, on the variant they were sold as if
+// any.
+func restock(tx *gorm.DB, productID uint, variantID *uint, quantity int) error {
+	if variantID == nil {
+		return tx.Model(&models.Product{}).Where("id = ?", productID).Update("quantity", gorm.Expr("quantity + ?", quantity)).Error
+	}
+	if err := tx.Model(&models.ProductVariant{}).Where("id = ?", *variantID).Update("quantity", gorm.Expr("quantity + ?", quantity)).Error; err != nil {
+		return err
+	}
+	return syncVariantStock(tx, productID)
+}
+
+// variantMatrix lays out a product's variants for listings: the values each
+// attribute comes in, and every variant with what price makes of it.
+func variantMatrix(variants []models.ProductVariant, price func(*models.ProductVariant) pricing.Breakdown) (map[string][]string, []fiber.Map) {
+	options := map[string][]string{}
+	seen := map[string]bool{}
+	list := make([]fiber.Map, 0, len(variants))
+	for i := range variants {
+		variant := &variants[i]
+		for name, value := range variant.Attributes {
+			if !seen[name+"\x00"+value] {
+				seen[name+"\x00"+value] = true
+				options[name] = append(options[name], value)
+			}
+		}
+		list = append(list, fiber.Map{
+			"variant_id":      variant.ID,
+			"sku":             variant.SKU,
+			"attributes":      variant.Attributes,
+			"quantity":        variant.Quantity,
+			"img_urls":        variant.ImgURLs,
+			"price_breakdown": price(variant),
+		})
+	}
+	for name := range options {
+		sort.Strings(options[name])
+	}
+	return options, list
+}
+
+func ListProductVariants(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+		return shippingLookupError(c, err, "product")
+	}
+
+	var variants []models.ProductVariant
+	if err := database.DB.Where("product_id = ?", product.ID).Order("id").Find(&variants).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to retrieve variants"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "product variants", "variants": variants})
+}
+
+// AddProductVariant adds a variant to a product. From the first variant on,
+// the product's stock is the sum of its variants'.
+func AddProductVariant(c *fiber.Ctx) error {
+	var input productVariantInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	var variant models.ProductVariant
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var product models.Product
+		if err := tx.First(&product, "id = ?", c.Params("product_id")).Error; err != nil {
+			return err
+		}
+		variant.ProductID = product.ID
+		if err := input.apply(tx, &variant); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		return syncVariantStock(tx, product.ID)
+	})
+	if err != nil {
+		return variantSaveError(c, err, "product")
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "variant created", "variant": variant})
+}
+
+func EditProductVariant(c *fiber.Ctx) error {
+	var input productVariantInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	var variant models.ProductVariant
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&variant, "id = ?", c.Params("variant_id")).Error; err != nil {
+			return err
+		}
+		if err := input.apply(tx, &variant); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := tx.Save(&variant).Error; err != nil {
+			return err
+		}
+		return syncVariantStock(tx, variant.ProductID)
+	})
+	if err != nil {
+		return variantSaveError(c, err, "variant")
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "variant updated", "variant": variant})
+}
+
+// DeleteProductVariant removes a variant and its stock. Carts holding it
+// lose it; past orders keep their SKU.
+func DeleteProductVariant(c *fiber.Ctx) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var variant models.ProductVariant
+		if err := tx.First(&variant, "id = ?", c.Params("variant_id")).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&variant).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("variant_id = ?", variant.ID).Delete(&models.CartItem{}).Error; err != nil {
+			return err
+		}
+		return syncVariantStock(tx, variant.ProductID)
+	})
+	if err != nil {
+		return variantSaveError(c, err, "variant")
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "variant deleted"})
+}
+
+func variantSaveError(c *fiber.Ctx, err error, what string) error {
+	var fiberErr *fiber.Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": what + " not found"})
+	case errors.As(err, &fiberErr):
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to save variant"})
+}
@@ -0,0 +1,434 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"kars/database"
+	"kars/ledger"
+	"kars/models"
+	"kars/payments"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReconcileWallets reports wallets whose cached balance has drifted from
+// their ledger entries, and any ledger transaction that does not balance.
+func ReconcileWallets(c *fiber.Ctx) error {
+	report, err := ledger.Reconcile(database.DB)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to reconcile wallets",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":    "wallet reconciliation completed",
+		"consistent": len(report.Drifted) == 0 && len(report.Unbalanced) == 0,
+		"report":     report,
+	})
+}
+
+// Wallet top-up limits, in rupees.
+const (
+	minWalletTopUp   = 100
+	maxWalletTopUp   = 10000
+	maxWalletBalance = 50000
+)
+
+const (
+	topUpCreated = "created"
+	topUpPaid    = "paid"
+	topUpFailed  = "failed"
+)
+
+// CreateWalletTopUp records the user's intent to add money to their wallet.
+// The payment itself happens on the checkout page it returns.
+func CreateWalletTopUp(c *fiber.Ctx) error {
+	userID, ok := c.Locals("user_id").(float64)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user id is required"})
+	}
+
+	var input struct {
+		Amount float64 `json:"amount"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	if input.Amount < minWalletTopUp || input.Amount > maxWalletTopUp {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("top-up amount must be between %d and %d", minWalletTopUp, maxWalletTopUp),
+		})
+	}
+	if math.Abs(math.Round(input.Amount*100)-input.Amount*100) > 1e-6 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "top-up amount can have at most two decimal places"})
+	}
+
+	var topUp models.WalletTopUp
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// The wallet lock serialises top-ups so two of them cannot both pass
+		// the balance limit.
+		wallet, err := ledger.LockWallet(tx, uint(userID), true)
+		if err != nil {
+			return err
+		}
+		if err := checkTopUpLimit(tx, wallet, input.Amount, 0); err != nil {
+			return err
+		}
+
+		topUp = models.WalletTopUp{
+			UserID: wallet.UserID,
+			Amount: input.Amount,
+			Status: topUpCreated,
+		}
+		return tx.Create(&topUp).Error
+	})
+	if errors.Is(err, errWalletBalanceLimit) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create wallet top-up"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":      "wallet top-up created",
+		"top_up":       topUp,
+		"checkout_url": fmt.Sprintf("/api/user/wallet/topup/%d/pay", topUp.ID),
+	})
+}
+
+var errWalletBalanceLimit = fmt.Errorf("wallet balance cannot exceed %d", maxWalletBalance)
+
+// checkTopUpLimit fails when the wallet balance plus every top-up still
+// waiting for payment would pass maxWalletBalance. exclude is the top-up
+// being checked out again, which is already among the open ones.
+func checkTopUpLimit(tx *gorm.DB, wallet models.Wallet, amount float64, exclude uint) error {
+	var open float64
+	err := tx.Model(&models.WalletTopUp{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("user_id = ? AND status = ? AND id <> ?", wallet.UserID, topUpCreated, exclude).
+		Scan(&open).Error
+	if err != nil {
+		return err
+	}
+	if wallet.TotalAmount+open+amount > maxWalletBalance {
+		return errWalletBalanceLimit
+	}
+	return nil
+}
+
+func RenderWalletTopUp(c *fiber.Ctx) error {
+	topUpID := c.Params("top_up_id")
+
+	var topUp models.WalletTopUp
+	if err := database.DB.First(&topUp, "id = ? AND user_id = ?", topUpID, c.Locals("user_id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "wallet top-up not found"})
+	}
+	if topUp.Status == topUpPaid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "wallet top-up already paid"})
+	}
+
+	// The page calls back into routes that need the user's token.
+	return c.Render("templates/payment.html", fiber.Map{
+		"authorization": c.Get("Authorization"),
+		"create_url":    fmt.Sprintf("/api/user/wallet/topup/%d/create-order", topUp.ID),
+		"verify_url":    fmt.Sprintf("/api/user/wallet/topup/%d/verify", topUp.ID),
+		"failed_url":    fmt.Sprintf("/api/user/wallet/topup/%d/failed", topUp.ID),
+	})
+}
+
+// CreateTopUpOrder opens a gateway order for a top-up. A failed top-up can
+// be checked out again on a new gateway order; the earlier ones are kept, so
+// a payment that completes on one of them late is still credited.
+func CreateTopUpOrder(c *fiber.Ctx) error {
+	topUpID := c.Params("top_up_id")
+
+	var topUp models.WalletTopUp
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&topUp, "id = ? AND user_id = ?", topUpID, c.Locals("user_id")).Error; err != nil {
+			return err
+		}
+		if topUp.Status == topUpPaid {
+			return errTopUpPaid
+		}
+
+		wallet, err := ledger.LockWallet(tx, topUp.UserID, true)
+		if err != nil {
+			return err
+		}
+		if err := checkTopUpLimit(tx, wallet, topUp.Amount, topUp.ID); err != nil {
+			return err
+		}
+
+		notes := map[string]string{
+			"top_up_id": fmt.Sprint(topUp.ID),
+		}
+		gatewayOrder, err := payments.Default.CreateOrder(payments.ToPaise(topUp.Amount), "INR", fmt.Sprintf("topup_%d", topUp.ID), notes)
+		if err != nil {
+			return err
+		}
+
+		topUp.Gateway = payments.Default.Name()
+		topUp.GatewayOrderID = gatewayOrder.ID
+		topUp.PaymentID = ""
+		topUp.Status = topUpCreated
+		err = tx.Model(&topUp).Updates(map[string]interface{}{
+			"gateway":          topUp.Gateway,
+			"gateway_order_id": topUp.GatewayOrderID,
+			"payment_id":       topUp.PaymentID,
+			"status":           topUp.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.WalletTopUpOrder{
+			TopUpID:        topUp.ID,
+			Gateway:        topUp.Gateway,
+			GatewayOrderID: topUp.GatewayOrderID,
+		}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "wallet top-up not found"})
+	case errors.Is(err, errTopUpPaid), errors.Is(err, errWalletBalanceLimit):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "unable to create order"})
+	}
+
+	return c.JSON(fiber.Map{
+		"order_id": topUp.GatewayOrderID,
+		"amount":   payments.ToPaise(topUp.Amount),
+		"currency": "INR",
+		"key":      payments.Default.KeyID(),
+	})
+}
+
+var errTopUpPaid = errors.New("wallet top-up already paid")
+
+func VerifyWalletTopUp(c *fiber.Ctx) error {
+	topUpID := c.Params("top_up_id")
+
+	var PaymentInfo struct {
+		RazorpayPaymentID string `json:"razorpay_payment_id"`
+		RazorpayOrderID   string `json:"razorpay_order_id"`
+		RazorpaySignature string `json:"razorpay_signature"`
+	}
+	if err := c.BodyParser(&PaymentInfo); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request data"})
+	}
+
+	if PaymentInfo.RazorpayOrderID == "" || PaymentInfo.RazorpayPaymentID == "" || PaymentInfo.RazorpaySignature == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment id, order id and signature are required"})
+	}
+
+	if err := payments.Default.VerifySignature(PaymentInfo.RazorpayOrderID, PaymentInfo.RazorpayPaymentID, PaymentInfo.RazorpaySignature); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment signature verification failed"})
+	}
+
+	payment, err := payments.Default.FetchPayment(PaymentInfo.RazorpayPaymentID)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "failed to fetch payment from gateway"})
+	}
+
+	if payment.OrderID != PaymentInfo.RazorpayOrderID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment does not belong to this top-up"})
+	}
+
+	// Only captured money is credited; an authorized payment that is never
+	// captured goes back to the customer.
+	if payment.Status != "captured" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "payment is " + payment.Status})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var topUp models.WalletTopUp
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&topUp, "id = ? AND user_id = ?", topUpID, c.Locals("user_id")).Error; err != nil {
+			return err
+		}
+		topUpOrder, err := lockTopUpOrder(tx, topUp.ID, payment.OrderID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errTopUpMismatch
+		}
+		if err != nil {
+			return err
+		}
+		return creditTopUp(tx, &topUp, &topUpOrder, payment)
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "wallet top-up not found"})
+	case errors.Is(err, errTopUpMismatch):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to credit wallet"})
+	}
+
+	return c.JSON(fiber.Map{"status": "success", "message": "Payment verified and wallet credited successfully"})
+}
+
+var errTopUpMismatch = errors.New("payment does not belong to this top-up")
+
+// lockTopUpOrder loads the gateway order of a top-up FOR UPDATE. Callers
+// lock the top-up first.
+func lockTopUpOrder(tx *gorm.DB, topUpID uint, gatewayOrderID string) (models.WalletTopUpOrder, error) {
+	var topUpOrder models.WalletTopUpOrder
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&topUpOrder, "top_up_id = ? AND gateway_order_id = ?", topUpID, gatewayOrderID).Error
+	return topUpOrder, err
+}
+
+// creditTopUp credits the wallet for a payment captured on one of a
+// top-up's gateway orders. Both the checkout callback and the webhook
+// report the same payment, so a gateway order already credited is left
+// alone. A payment that arrives after the browser reported a failure is
+// still credited: the money has been taken. So is one on an earlier
+// checkout of a top-up that a later checkout paid.
+func creditTopUp(tx *gorm.DB, topUp *models.WalletTopUp, topUpOrder *models.WalletTopUpOrder, payment payments.Payment) error {
+	if topUpOrder.PaymentID != "" {
+		return nil
+	}
+	if payment.Amount < payments.ToPaise(topUp.Amount) {
+		return errTopUpMismatch
+	}
+
+	txn, err := ledger.CreditWallet(tx, topUp.UserID, topUp.Amount, ledger.AccountGateway, ledger.KindTopUp, ledger.TopUpRef(topUp.ID), "wallet top-up")
+	if err != nil {
+		return err
+	}
+	topUpOrder.PaymentID = payment.ID
+	topUpOrder.LedgerTransactionID = &txn.ID
+	err = tx.Model(topUpOrder).Updates(map[string]interface{}{
+		"payment_id":            topUpOrder.PaymentID,
+		"ledger_transaction_id": topUpOrder.LedgerTransactionID,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if topUp.Status == topUpPaid {
+		log.Printf("top-up %d was paid again by payment %s on gateway order %s; credited that too", topUp.ID, payment.ID, topUpOrder.GatewayOrderID)
+		return nil
+	}
+	now := time.Now()
+	topUp.Status = topUpPaid
+	topUp.PaymentID = payment.ID
+	topUp.PaidAt = &now
+	topUp.LedgerTransactionID = &txn.ID
+	return tx.Model(topUp).Updates(map[string]interface{}{
+		"status":                topUp.Status,
+		"payment_id":            topUp.PaymentID,
+		"paid_at":               topUp.PaidAt,
+		"ledger_transaction_id": topUp.LedgerTransactionID,
+	}).Error
+}
+
+func FailedWalletTopUp(c *fiber.Ctx) error {
+	topUpID := c.Params("top_up_id")
+
+	var input struct {
+		Reason            string `json:"reason"`
+		RazorpayOrderID   string `json:"razorpay_order_id"`
+		RazorpayPaymentID string `json:"razorpay_payment_id"`
+		ErrorCode         string `json:"error_code"`
+		ErrorDescription  string `json:"error_description"`
+	}
+	c.BodyParser(&input)
+	if input.ErrorDescription == "" {
+		input.ErrorDescription = input.Reason
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var topUp models.WalletTopUp
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&topUp, "id = ? AND user_id = ?", topUpID, c.Locals("user_id")).Error; err != nil {
+			return err
+		}
+		if input.RazorpayOrderID != "" && input.RazorpayOrderID != topUp.GatewayOrderID {
+			return errTopUpMismatch
+		}
+		return failTopUp(tx, &topUp, input.RazorpayPaymentID, input.ErrorCode, input.ErrorDescription)
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "wallet top-up not found"})
+	case errors.Is(err, errTopUpMismatch):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update wallet top-up"})
+	}
+
+	return c.JSON(fiber.Map{"message": "wallet top-up marked as failed"})
+}
+
+func failTopUp(tx *gorm.DB, topUp *models.WalletTopUp, paymentID, code, description string) error {
+	if topUp.Status != topUpCreated {
+		return nil
+	}
+	now := time.Now()
+	topUp.Status = topUpFailed
+	topUp.PaymentID = paymentID
+	topUp.ErrorCode = code
+	topUp.ErrorDescription = description
+	topUp.FailedAt = &now
+	return tx.Model(topUp).Updates(map[string]interface{}{
+		"status":            topUp.Status,
+		"payment_id":        topUp.PaymentID,
+		"error_code":        topUp.ErrorCode,
+		"error_description": topUp.ErrorDescription,
+		"failed_at":         topUp.FailedAt,
+	}).Error
+}
+
+// handleTopUpWebhook applies a payment webhook to the top-up that owns its
+// gateway order, current or earlier. It reports false when the gateway
+// order is not a top-up's.
+func handleTopUpWebhook(tx *gorm.DB, webhook payments.Webhook) (bool, error) {
+	if webhook.Payment == nil || webhook.Payment.OrderID == "" {
+		return false, nil
+	}
+
+	var found models.WalletTopUpOrder
+	err := tx.First(&found, "gateway_order_id = ?", webhook.Payment.OrderID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	var topUp models.WalletTopUp
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&topUp, found.TopUpID).Error; err != nil {
+		return true, err
+	}
+	topUpOrder, err := lockTopUpOrder(tx, topUp.ID, found.GatewayOrderID)
+	if err != nil {
+		return true, err
+	}
+
+	switch webhook.Event {
+	case payments.EventPaymentCaptured:
+		err = creditTopUp(tx, &topUp, &topUpOrder, *webhook.Payment)
+		if errors.Is(err, errTopUpMismatch) {
+			log.Printf("payment %s for top-up %d captured %d paise, top-up needs %.2f", webhook.Payment.ID, topUp.ID, webhook.Payment.Amount, topUp.Amount)
+			return true, nil
+		}
+		return true, err
+	case payments.EventPaymentFailed:
+		// A failure on an earlier checkout says nothing of the current one.
+		if topUpOrder.GatewayOrderID != topUp.GatewayOrderID {
+			return true, nil
+		}
+		return true, failTopUp(tx, &topUp, webhook.Payment.ID, webhook.Payment.ErrorCode, webhook.Payment.ErrorDescription)
+	}
+	return true, nil
+}
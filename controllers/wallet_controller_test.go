@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"fmt"
+	"kars/models"
+	"kars/payments"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// newTopUp has user ask to add amount to their wallet and returns the
+// top-up.
+func newTopUp(t *testing.T, app *fiber.App, user models.User, amount float64) models.WalletTopUp {
+	t.Helper()
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d", user.ID), map[string]float64{"amount": amount})
+	if status != fiber.StatusCreated {
+		t.Fatalf("create top-up: got %d %v", status, body)
+	}
+	created, _ := body["top_up"].(map[string]interface{})
+	id, _ := created["ID"].(float64)
+
+	var topUp models.WalletTopUp
+	if err := testDB(t).First(&topUp, uint(id)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return topUp
+}
+
+// One user cannot check out, or fail, another user's top-up.
+func TestTopUpOfAnotherUser(t *testing.T) {
+	db := testDB(t)
+	useFakeGateway(t)
+	owner, _ := newUser(t, db)
+	other, _ := newUser(t, db)
+
+	app := fiber.New()
+	app.Post(fmt.Sprintf("/topup/%d", owner.ID), asUser(owner, CreateWalletTopUp))
+	app.Post("/topup/:top_up_id/create-order", asUser(other, CreateTopUpOrder))
+	app.Post("/topup/:top_up_id/failed", asUser(other, FailedWalletTopUp))
+
+	topUp := newTopUp(t, app, owner, 500)
+	for _, action := range []string{"create-order", "failed"} {
+		if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d/%s", topUp.ID, action), nil); status != fiber.StatusNotFound {
+			t.Errorf("%s by another user: got %d %v, want 404", action, status, body)
+		}
+	}
+
+	if err := db.First(&topUp, topUp.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if topUp.Status != topUpCreated || topUp.GatewayOrderID != "" {
+		t.Errorf("top-up is %q with gateway order %q, want it untouched", topUp.Status, topUp.GatewayOrderID)
+	}
+}
+
+// A payment the gateway has only authorized is not credited to the wallet.
+func TestVerifyAuthorizedTopUp(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+	user, _ := newUser(t, db)
+
+	app := fiber.New()
+	app.Post(fmt.Sprintf("/topup/%d", user.ID), asUser(user, CreateWalletTopUp))
+	app.Post("/topup/:top_up_id/create-order", asUser(user, CreateTopUpOrder))
+	app.Post("/topup/:top_up_id/verify", asUser(user, VerifyWalletTopUp))
+
+	topUp := newTopUp(t, app, user, 500)
+	status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d/create-order", topUp.ID), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("create-order: got %d %v", status, body)
+	}
+	gatewayOrderID, _ := body["order_id"].(string)
+
+	payment, signature, err := fake.Authorize(gatewayOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := map[string]string{
+		"razorpay_payment_id": payment.ID,
+		"razorpay_order_id":   gatewayOrderID,
+		"razorpay_signature":  signature,
+	}
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d/verify", topUp.ID), verify); status != fiber.StatusBadRequest {
+		t.Errorf("verify: got %d %v, want 400", status, body)
+	}
+
+	if err := db.First(&topUp, topUp.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if topUp.Status == topUpPaid {
+		t.Errorf("top-up is %q, want it unpaid", topUp.Status)
+	}
+	var credited int64
+	if err := db.Model(&models.Wallet{}).Where("user_id = ? AND total_amount > 0", user.ID).Count(&credited).Error; err != nil {
+		t.Fatal(err)
+	}
+	if credited != 0 {
+		t.Error("the authorized payment was credited to the wallet")
+	}
+}
+
+// A payment captured on an earlier checkout of a top-up, reported after the
+// top-up was checked out again, is still credited, and only once.
+func TestLateCaptureOfEarlierTopUpCheckout(t *testing.T) {
+	db := testDB(t)
+	fake := useFakeGateway(t)
+	user, _ := newUser(t, db)
+
+	app := fiber.New()
+	app.Post(fmt.Sprintf("/topup/%d", user.ID), asUser(user, CreateWalletTopUp))
+	app.Post("/topup/:top_up_id/create-order", asUser(user, CreateTopUpOrder))
+	app.Post("/topup/:top_up_id/failed", asUser(user, FailedWalletTopUp))
+
+	topUp := newTopUp(t, app, user, 500)
+	checkout := func() string {
+		t.Helper()
+		status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d/create-order", topUp.ID), nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("create-order: got %d %v", status, body)
+		}
+		gatewayOrderID, _ := body["order_id"].(string)
+		return gatewayOrderID
+	}
+
+	first := checkout()
+	if status, body := call(t, app, fiber.MethodPost, fmt.Sprintf("/topup/%d/failed", topUp.ID), map[string]string{"razorpay_order_id": first}); status != fiber.StatusOK {
+		t.Fatalf("failed: got %d %v", status, body)
+	}
+	checkout()
+
+	payment, _, err := fake.Pay(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			handled, err := handleTopUpWebhook(tx, payments.Webhook{Event: payments.EventPaymentCaptured, Payment: &payment})
+			if !handled {
+				t.Error("the capture was not matched to the top-up")
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wallet models.Wallet
+	if err := db.First(&wallet, "user_id = ?", user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if wallet.TotalAmount != 500 {
+		t.Errorf("wallet balance = %v, want the 500 paid", wallet.TotalAmount)
+	}
+	if err := db.First(&topUp, topUp.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if topUp.Status != topUpPaid || topUp.PaymentID != payment.ID {
+		t.Errorf("top-up is %q paid by %q, want paid by %s", topUp.Status, topUp.PaymentID, payment.ID)
+	}
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"kars/database"
 	"kars/models"
+	"kars/pricing"
+	"time"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -47,8 +49,15 @@ func AddWishList(c *fiber.Ctx) error {
 		})
 	}
 
+	// A variant is optional here; the wishlist can hold a product before a
+	// colour or size is picked.
+	variant, err := requestedVariant(database.DB, product, c.Query("variant_id"), false)
+	if err != nil {
+		return variantError(c, err)
+	}
+
 	var wishList models.Wishlist
-	if err := database.DB.First(&wishList, "user_id = ? AND product_id = ?", userID, productID).Error; err == nil {
+	if err := whereVariant(database.DB, c.Query("variant_id")).First(&wishList, "user_id = ? AND product_id = ?", userID, productID).Error; err == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "product already exist in the wishlist",
 		})
@@ -57,9 +66,12 @@ func AddWishList(c *fiber.Ctx) error {
 	wishList = models.Wishlist{
 		UserID:             user.ID,
 		ProductID:          product.ID,
-		ProductName:        product.ProductName,
+		ProductName:        variantName(product, variant),
 		ProductDescription: product.Description,
-		ProductPrice:       product.Price,
+		ProductPrice:       pricing.Variant(product, variant).Price,
+	}
+	if variant != nil {
+		wishList.VariantID = &variant.ID
 	}
 
 	if err := database.DB.Create(&wishList).Error; err != nil {
@@ -90,7 +102,7 @@ func RemoveFromWishList(c *fiber.Ctx) error {
 	}
 
 	var wishList models.Wishlist
-	if err := database.DB.First(&wishList, "user_id = ? AND product_id = ?", userID, productID).Error; err != nil {
+	if err := whereVariant(database.DB, c.Query("variant_id")).First(&wishList, "user_id = ? AND product_id = ?", userID, productID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "product not found in the wishlist",
@@ -144,15 +156,61 @@ func ListWishList(c *fiber.Ctx) error {
 		})
 	}
 
+	productIDs := make([]uint, 0, len(wishList))
+	variantIDs := make([]*uint, 0, len(wishList))
+	for _, item := range wishList {
+		productIDs = append(productIDs, item.ProductID)
+		variantIDs = append(variantIDs, item.VariantID)
+	}
+	var products []models.Product
+	if len(productIDs) > 0 {
+		if err := database.DB.Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to retrieve products",
+			})
+		}
+	}
+	byID := make(map[uint]models.Product, len(products))
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+	variants, err := variantsByID(database.DB, variantIDs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to retrieve product variants",
+		})
+	}
+	pricer, err := pricing.NewPricer(database.DB, products, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to price products",
+		})
+	}
+
 	var response []fiber.Map
 	for _, item := range wishList {
-		response = append(response, fiber.Map{
+		entry := fiber.Map{
 			"user_id":            item.UserID,
 			"product_id":         item.ProductID,
 			"product_decription": item.ProductDescription,
 			"product_name":       item.ProductName,
 			"product_price":      item.ProductPrice,
-		})
+			"variant_id":         item.VariantID,
+		}
+		// Items whose product or variant is gone keep the price they were
+		// added at.
+		product, ok := byID[item.ProductID]
+		var variant *models.ProductVariant
+		if item.VariantID != nil {
+			found, exists := variants[*item.VariantID]
+			variant, ok = &found, ok && exists
+		}
+		if ok {
+			price := pricer.Price(product, variant)
+			entry["product_price"] = price.Price
+			entry["price_breakdown"] = price
+		}
+		response = append(response, entry)
 	}
 
 	if len(response) == 0{
@@ -0,0 +1,79 @@
+package couriers
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Event is one tracking update reported by a carrier. Status is already
+// mapped to a shipment status, or empty for scans that do not change it.
+type Event struct {
+	ID             string
+	TrackingNumber string
+	Code           string
+	Status         string
+	Location       string
+	Description    string
+	OccurredAt     time.Time
+}
+
+// Adapter turns a carrier's webhook deliveries into tracking events.
+type Adapter interface {
+	// Name identifies the carrier in the webhook URL and stored records.
+	Name() string
+	// Verify checks the signature of a delivery. header returns the value
+	// of a request header.
+	Verify(body []byte, header func(string) string) error
+	Parse(body []byte) ([]Event, error)
+}
+
+var (
+	ErrInvalidSignature = errors.New("invalid courier webhook signature")
+	ErrUnknownCarrier   = errors.New("unknown carrier")
+)
+
+var adapters = map[string]Adapter{}
+
+// Register makes an adapter available under its name, replacing any adapter
+// registered before with the same name.
+func Register(adapter Adapter) {
+	adapters[strings.ToLower(adapter.Name())] = adapter
+}
+
+func Get(name string) (Adapter, error) {
+	adapter, ok := adapters[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrUnknownCarrier
+	}
+	return adapter, nil
+}
+
+// Init registers a generic JSON adapter for every carrier in COURIERS
+// (comma separated, default "generic"), each signed with
+// COURIER_<NAME>_SECRET.
+func Init() {
+	names := os.Getenv("COURIERS")
+	if names == "" {
+		names = "generic"
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		secret := os.Getenv(SecretEnv(name))
+		if secret == "" {
+			log.Printf("%s is not set; %s webhooks will be rejected", SecretEnv(name), name)
+		}
+		Register(NewGeneric(name, secret))
+		log.Println("Courier webhook enabled:", name)
+	}
+}
+
+// SecretEnv is the environment variable holding a carrier's webhook secret.
+func SecretEnv(name string) string {
+	return "COURIER_" + strings.ToUpper(strings.NewReplacer("-", "_", " ", "_").Replace(name)) + "_SECRET"
+}
@@ -0,0 +1,134 @@
+package couriers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the raw body.
+const SignatureHeader = "X-Courier-Signature"
+
+// Shipment statuses the carrier codes map to. They match the lifecycle
+// package, which this package does not import.
+const (
+	StatusInTransit      = "in transit"
+	StatusOutForDelivery = "out for delivery"
+	StatusDeliveryFailed = "delivery failed"
+	StatusDelivered      = "delivered"
+)
+
+// DefaultStatuses maps the status codes carriers commonly send to shipment
+// statuses. Codes are compared after lower casing and replacing spaces and
+// dashes with underscores.
+var DefaultStatuses = map[string]string{
+	"picked_up":        StatusInTransit,
+	"shipped":          StatusInTransit,
+	"dispatched":       StatusInTransit,
+	"in_transit":       StatusInTransit,
+	"out_for_delivery": StatusOutForDelivery,
+	"delivered":        StatusDelivered,
+	"delivery_failed":  StatusDeliveryFailed,
+	"undelivered":      StatusDeliveryFailed,
+	"failed_attempt":   StatusDeliveryFailed,
+}
+
+// GenericPayload is the JSON a generic carrier posts: either one event or
+// a batch under "events".
+type GenericPayload struct {
+	GenericEvent
+	Events []GenericEvent `json:"events,omitempty"`
+}
+
+type GenericEvent struct {
+	EventID        string    `json:"event_id,omitempty"`
+	TrackingNumber string    `json:"tracking_number,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	Location       string    `json:"location,omitempty"`
+	Description    string    `json:"description,omitempty"`
+	OccurredAt     time.Time `json:"occurred_at,omitempty"`
+}
+
+// Generic accepts GenericPayload deliveries signed with a shared secret.
+type Generic struct {
+	name     string
+	secret   string
+	Statuses map[string]string
+}
+
+func NewGeneric(name, secret string) *Generic {
+	return &Generic{name: name, secret: secret, Statuses: DefaultStatuses}
+}
+
+func (g *Generic) Name() string {
+	return g.name
+}
+
+func (g *Generic) Verify(body []byte, header func(string) string) error {
+	if g.secret == "" {
+		return errors.New("courier webhook secret is not configured")
+	}
+	if !hmac.Equal([]byte(Sign(g.secret, body)), []byte(header(SignatureHeader))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (g *Generic) Parse(body []byte) ([]Event, error) {
+	var payload GenericPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	raw := payload.Events
+	if len(raw) == 0 {
+		raw = []GenericEvent{payload.GenericEvent}
+	}
+
+	events := make([]Event, 0, len(raw))
+	for _, item := range raw {
+		if item.TrackingNumber == "" {
+			return nil, errors.New("courier event without tracking number")
+		}
+		if item.EventID == "" {
+			item.EventID = eventHash(item)
+		}
+		if item.OccurredAt.IsZero() {
+			item.OccurredAt = time.Now()
+		}
+		events = append(events, Event{
+			ID:             item.EventID,
+			TrackingNumber: item.TrackingNumber,
+			Code:           item.Status,
+			Status:         g.Statuses[normalizeCode(item.Status)],
+			Location:       item.Location,
+			Description:    item.Description,
+			OccurredAt:     item.OccurredAt,
+		})
+	}
+	return events, nil
+}
+
+// Sign returns the signature a generic carrier sends with body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func normalizeCode(code string) string {
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// eventHash identifies events sent without an id, so retries of the same
+// scan still deduplicate.
+func eventHash(event GenericEvent) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		event.TrackingNumber, event.Status, event.Location, event.OccurredAt.UTC().Format(time.RFC3339Nano),
+	}, "|")))
+	return hex.EncodeToString(sum[:])
+}
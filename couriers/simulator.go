@@ -0,0 +1,78 @@
+package couriers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Scenarios the simulator can play for a parcel.
+const (
+	ScenarioDelivered = "delivered"
+	// ScenarioRetry fails the first delivery attempt and succeeds on the
+	// second.
+	ScenarioRetry = "retry"
+	// ScenarioFailed never gets the parcel delivered.
+	ScenarioFailed = "failed"
+)
+
+// Delivery is one signed webhook request as a generic carrier would send it.
+type Delivery struct {
+	Body      []byte
+	Signature string
+}
+
+// Simulator plays a carrier locally, producing the webhook deliveries a
+// parcel would get over its life so the delivery flow can be exercised
+// without a real carrier account.
+type Simulator struct {
+	Secret string
+	// Step is the time between two scans of a scenario.
+	Step time.Duration
+}
+
+func NewSimulator(secret string) *Simulator {
+	return &Simulator{Secret: secret, Step: 6 * time.Hour}
+}
+
+// Script returns the deliveries for a parcel in the given scenario, the
+// first one scanned at start.
+func (s *Simulator) Script(trackingNumber, scenario string, start time.Time) ([]Delivery, error) {
+	var codes []string
+	switch scenario {
+	case ScenarioDelivered:
+		codes = []string{"picked_up", "in_transit", "out_for_delivery", "delivered"}
+	case ScenarioRetry:
+		codes = []string{"picked_up", "in_transit", "out_for_delivery", "undelivered", "out_for_delivery", "delivered"}
+	case ScenarioFailed:
+		codes = []string{"picked_up", "in_transit", "out_for_delivery", "undelivered"}
+	default:
+		return nil, fmt.Errorf("unknown scenario %q", scenario)
+	}
+
+	deliveries := make([]Delivery, 0, len(codes))
+	for i, code := range codes {
+		event := GenericEvent{
+			EventID:        fmt.Sprintf("sim-%s-%d", trackingNumber, i+1),
+			TrackingNumber: trackingNumber,
+			Status:         code,
+			Location:       "Simulated hub",
+			Description:    "simulated " + code + " scan",
+			OccurredAt:     start.Add(time.Duration(i) * s.Step),
+		}
+		delivery, err := s.Sign(GenericPayload{GenericEvent: event})
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (s *Simulator) Sign(payload GenericPayload) (Delivery, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return Delivery{Body: body, Signature: Sign(s.Secret, body)}, nil
+}
@@ -0,0 +1,24 @@
+package couriers_test
+
+import (
+	"kars/couriers"
+	"testing"
+	"time"
+)
+
+func TestTamperedDelivery(t *testing.T) {
+	deliveries, err := couriers.NewSimulator("secret").Script("TRK1", couriers.ScenarioDelivered, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := func(string) string { return deliveries[0].Signature }
+
+	if err := couriers.NewGeneric("generic", "other").Verify(deliveries[0].Body, header); err != couriers.ErrInvalidSignature {
+		t.Errorf("wrong secret: got %v, want %v", err, couriers.ErrInvalidSignature)
+	}
+	body := append([]byte{}, deliveries[0].Body...)
+	body[len(body)-2] ^= 1
+	if err := couriers.NewGeneric("generic", "secret").Verify(body, header); err != couriers.ErrInvalidSignature {
+		t.Errorf("altered body: got %v, want %v", err, couriers.ErrInvalidSignature)
+	}
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"kars/models"
+	"kars/search"
 	"log"
 )
 func MigrateModels() error {
@@ -31,6 +32,8 @@ func MigrateModels() error {
 
 	if err := DB.AutoMigrate(&models.Address{}); err != nil{
 		log.Println("Failed to migrate address model:", err)
+	}else if err := backfillDefaultAddresses(); err != nil{
+		log.Println("Failed to backfill default addresses:", err)
 	}else{
 		log.Println("Address model migration was successfull")
 	}
@@ -59,6 +62,150 @@ func MigrateModels() error {
 		log.Println("order item model migration was successfull")
 	}
 
+	if err := DB.AutoMigrate(&models.OrderStatusHistory{}); err != nil{
+		log.Println("Failed to migrate order status history model:", err)
+	}else{
+		log.Println("order status history model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.PaymentAttempt{}); err != nil{
+		log.Println("Failed to migrate payment attempt model:", err)
+	}else{
+		log.Println("payment attempt model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Refund{}); err != nil{
+		log.Println("Failed to migrate refund model:", err)
+	}else{
+		log.Println("refund model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.RefundItem{}); err != nil{
+		log.Println("Failed to migrate refund item model:", err)
+	}else{
+		log.Println("refund item model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ReturnRequest{}); err != nil{
+		log.Println("Failed to migrate return request model:", err)
+	}else{
+		log.Println("return request model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ReturnItem{}); err != nil{
+		log.Println("Failed to migrate return item model:", err)
+	}else{
+		log.Println("return item model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Shipment{}); err != nil{
+		log.Println("Failed to migrate shipment model:", err)
+	}else{
+		log.Println("shipment model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ShipmentItem{}); err != nil{
+		log.Println("Failed to migrate shipment item model:", err)
+	}else{
+		log.Println("shipment item model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.TrackingEvent{}); err != nil{
+		log.Println("Failed to migrate tracking event model:", err)
+	}else{
+		log.Println("tracking event model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ShippingZone{}); err != nil{
+		log.Println("Failed to migrate shipping zone model:", err)
+	}else{
+		log.Println("shipping zone model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ShippingRule{}); err != nil{
+		log.Println("Failed to migrate shipping rule model:", err)
+	}else{
+		log.Println("shipping rule model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Pincode{}); err != nil{
+		log.Println("Failed to migrate pincode model:", err)
+	}else{
+		log.Println("pincode model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.DocumentSequence{}); err != nil{
+		log.Println("Failed to migrate document sequence model:", err)
+	}else{
+		log.Println("document sequence model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Invoice{}); err != nil{
+		log.Println("Failed to migrate invoice model:", err)
+	}else{
+		log.Println("invoice model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.InvoiceLine{}); err != nil{
+		log.Println("Failed to migrate invoice line model:", err)
+	}else{
+		log.Println("invoice line model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.CreditNote{}); err != nil{
+		log.Println("Failed to migrate credit note model:", err)
+	}else{
+		log.Println("credit note model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.CreditNoteLine{}); err != nil{
+		log.Println("Failed to migrate credit note line model:", err)
+	}else{
+		log.Println("credit note line model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.BusinessProfile{}); err != nil{
+		log.Println("Failed to migrate business profile model:", err)
+	}else{
+		log.Println("business profile model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Offer{}); err != nil{
+		log.Println("Failed to migrate offer model:", err)
+	}else{
+		log.Println("offer model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ProductVariant{}); err != nil{
+		log.Println("Failed to migrate product variant model:", err)
+	}else{
+		log.Println("product variant model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.Vehicle{}); err != nil{
+		log.Println("Failed to migrate vehicle model:", err)
+	}else{
+		log.Println("vehicle model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.ProductFitment{}); err != nil{
+		log.Println("Failed to migrate product fitment model:", err)
+	}else{
+		log.Println("product fitment model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.GarageVehicle{}); err != nil{
+		log.Println("Failed to migrate garage vehicle model:", err)
+	}else{
+		log.Println("garage vehicle model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.WebhookEvent{}); err != nil{
+		log.Println("Failed to migrate webhook event model:", err)
+	}else{
+		log.Println("webhook event model migration was successfull")
+	}
+
 	if err := DB.AutoMigrate(&models.Wishlist{}); err != nil{
 		log.Println("Failed to migrate wishlist model:", err)
 	}else{
@@ -83,11 +230,56 @@ func MigrateModels() error {
 		log.Println("coupon wallet migration was successfull")
 	}
 
-	if err := DB.AutoMigrate(&models.WalletHistory{}); err != nil{
-		log.Println("Failed to migrate wallet History model:", err)
+	if err := DB.AutoMigrate(&models.LedgerTransaction{}); err != nil{
+		log.Println("Failed to migrate ledger transaction model:", err)
+	}else{
+		log.Println("ledger transaction model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.LedgerEntry{}); err != nil{
+		log.Println("Failed to migrate ledger entry model:", err)
 	}else{
-		log.Println("coupon wallet History migration was successfull")
+		log.Println("ledger entry model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.WalletTopUp{}); err != nil{
+		log.Println("Failed to migrate wallet top up model:", err)
+	}else{
+		log.Println("wallet top up model migration was successfull")
+	}
+
+	if err := DB.AutoMigrate(&models.WalletTopUpOrder{}); err != nil{
+		log.Println("Failed to migrate wallet top up order model:", err)
+	}else if err := backfillTopUpOrders(); err != nil{
+		log.Println("Failed to backfill wallet top up orders:", err)
+	}else{
+		log.Println("wallet top up order model migration was successfull")
+	}
+
+	if err := search.Setup(DB); err != nil{
+		log.Println("Failed to set up product search:", err)
+	}else{
+		log.Println("product search setup was successfull")
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+// backfillDefaultAddresses gives users who added addresses before there
+// were default addresses one, their first address, as adding it now would.
+func backfillDefaultAddresses() error {
+	return DB.Exec(`UPDATE addresses SET is_default = true
+	WHERE id IN (SELECT MIN(id) FROM addresses WHERE deleted_at IS NULL GROUP BY user_id HAVING NOT BOOL_OR(is_default))`).Error
+}
+
+// backfillTopUpOrders records the gateway order of every top-up checked out
+// before their gateway orders were kept, with the payment of those already
+// credited.
+func backfillTopUpOrders() error {
+	return DB.Exec(`INSERT INTO wallet_top_up_orders (created_at, updated_at, top_up_id, gateway, gateway_order_id, payment_id, ledger_transaction_id)
+	SELECT NOW(), NOW(), id, gateway, gateway_order_id,
+		CASE WHEN status = 'paid' THEN payment_id ELSE '' END,
+		CASE WHEN status = 'paid' THEN ledger_transaction_id END
+	FROM wallet_top_ups
+	WHERE gateway_order_id <> '' AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM wallet_top_up_orders WHERE wallet_top_up_orders.gateway_order_id = wallet_top_ups.gateway_order_id)`).Error
+}
@@ -0,0 +1,242 @@
+// Package fitment keeps the vehicle table and works out which products fit
+// which vehicles.
+package fitment
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"kars/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// What a product's fitment badge says about a vehicle. A product with no
+// fitment data at all is unknown rather than not fitting, since it may fit
+// any car.
+const (
+	StatusFits       = "fits"
+	StatusDoesNotFit = "does_not_fit"
+	StatusUnknown    = "unknown"
+)
+
+// FirstYear is the oldest model year the vehicle table takes.
+const FirstYear = 1950
+
+var ErrInvalidVehicle = errors.New("a vehicle needs a make, a model and a model year")
+
+// Normalize trims a vehicle's fields and checks them. Model years run from
+// FirstYear to next year's models.
+func Normalize(vehicle *models.Vehicle) error {
+	vehicle.Make = strings.TrimSpace(vehicle.Make)
+	vehicle.ModelName = strings.TrimSpace(vehicle.ModelName)
+	vehicle.Trim = strings.TrimSpace(vehicle.Trim)
+	if vehicle.Make == "" || vehicle.ModelName == "" {
+		return ErrInvalidVehicle
+	}
+	if vehicle.Year < FirstYear || vehicle.Year > time.Now().Year()+1 {
+		return fmt.Errorf("model year must be between %d and %d", FirstYear, time.Now().Year()+1)
+	}
+	return nil
+}
+
+// Search narrows a vehicle query by make, model and trim, matched without
+// regard to case, and by model year. Zero values match everything.
+func Search(db *gorm.DB, maker, model string, year int, trim string) *gorm.DB {
+	query := db.Model(&models.Vehicle{})
+	if maker = strings.TrimSpace(maker); maker != "" {
+		query = query.Where("LOWER(make) = LOWER(?)", maker)
+	}
+	if model = strings.TrimSpace(model); model != "" {
+		query = query.Where("LOWER(model) = LOWER(?)", model)
+	}
+	if year != 0 {
+		query = query.Where("year = ?", year)
+	}
+	if trim = strings.TrimSpace(trim); trim != "" {
+		query = query.Where("LOWER(trim) = LOWER(?)", trim)
+	}
+	return query
+}
+
+// Compatible selects the ids of products that fit vehicleID, or of which a
+// variant does, for use as a subquery.
+func Compatible(db *gorm.DB, vehicleID uint) *gorm.DB {
+	return db.Model(&models.ProductFitment{}).Select("product_id").Where("vehicle_id = ?", vehicleID)
+}
+
+// Badge is what a product page says about fitting a vehicle: the status of
+// the product and of each of its variants, keyed by variant id.
+type Badge struct {
+	Vehicle  models.Vehicle  `json:"vehicle"`
+	Status   string          `json:"status"`
+	Variants map[uint]string `json:"variants,omitempty"`
+}
+
+// Check works out the badge of a product and its variants for vehicle. A
+// product fits when it or any of its variants does.
+func Check(db *gorm.DB, productID uint, variantIDs []uint, vehicle models.Vehicle) (Badge, error) {
+	badge := Badge{Vehicle: vehicle}
+	var fitments []models.ProductFitment
+	if err := db.Where("product_id = ?", productID).Find(&fitments).Error; err != nil {
+		return badge, err
+	}
+
+	badge.Status = status(fitments, nil, vehicle.ID)
+	if len(variantIDs) > 0 {
+		badge.Variants = make(map[uint]string, len(variantIDs))
+		for _, variantID := range variantIDs {
+			badge.Variants[variantID] = status(fitments, &variantID, vehicle.ID)
+		}
+	}
+	return badge, nil
+}
+
+func status(fitments []models.ProductFitment, variantID *uint, vehicleID uint) string {
+	if len(fitments) == 0 {
+		return StatusUnknown
+	}
+	for _, fitment := range fitments {
+		if fitment.VehicleID != vehicleID {
+			continue
+		}
+		if variantID == nil || fitment.VariantID == nil || *fitment.VariantID == *variantID {
+			return StatusFits
+		}
+	}
+	return StatusDoesNotFit
+}
+
+// Save adds a vehicle, or restores it if it was deleted, leaving its id in
+// vehicle either way.
+func Save(db *gorm.DB, vehicle *models.Vehicle) error {
+	return upsert(db).Create(vehicle).Error
+}
+
+func upsert(db *gorm.DB) *gorm.DB {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "make"}, {Name: "model"}, {Name: "year"}, {Name: "trim"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "deleted_at"}),
+	})
+}
+
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Errors   []string `json:"errors"`
+}
+
+// ImportVehicles loads a CSV with the header make,model,year and an
+// optional trim column. A year may be a range such as 2015-2018, which adds
+// the vehicle for every year in it. Vehicles already listed are kept, and
+// restored if they were deleted. Bad rows are reported and skipped.
+func ImportVehicles(db *gorm.DB, r io.Reader) (ImportResult, error) {
+	result := ImportResult{Errors: []string{}}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return result, fmt.Errorf("reading header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"make", "model", "year"} {
+		if _, ok := columns[required]; !ok {
+			return result, fmt.Errorf("missing column %q", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	// One upsert statement cannot touch the same row twice, so repeated
+	// vehicles are dropped here.
+	var batch []models.Vehicle
+	seen := map[string]bool{}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return result, err
+		}
+
+		vehicles, err := parseVehicleRow(field, record)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		for _, vehicle := range vehicles {
+			key := strings.ToLower(fmt.Sprintf("%s\x00%s\x00%d\x00%s", vehicle.Make, vehicle.ModelName, vehicle.Year, vehicle.Trim))
+			if !seen[key] {
+				seen[key] = true
+				batch = append(batch, vehicle)
+			}
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		return upsert(tx).CreateInBatches(&batch, 500).Error
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Imported = len(batch)
+	return result, nil
+}
+
+func parseVehicleRow(field func([]string, string) string, record []string) ([]models.Vehicle, error) {
+	from, to, err := parseYears(field(record, "year"))
+	if err != nil {
+		return nil, err
+	}
+
+	var vehicles []models.Vehicle
+	for year := from; year <= to; year++ {
+		vehicle := models.Vehicle{
+			Make:      field(record, "make"),
+			ModelName: field(record, "model"),
+			Year:      year,
+			Trim:      field(record, "trim"),
+		}
+		if err := Normalize(&vehicle); err != nil {
+			return nil, err
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+	return vehicles, nil
+}
+
+func parseYears(value string) (int, int, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	from, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, errors.New("year must be a model year or a range such as 2015-2018")
+	}
+	if !isRange {
+		return from, from, nil
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil || to < from {
+		return 0, 0, errors.New("year must be a model year or a range such as 2015-2018")
+	}
+	return from, to, nil
+}
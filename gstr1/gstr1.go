@@ -0,0 +1,428 @@
+// Package gstr1 builds the monthly GSTR-1 return of outward supplies from
+// the stored invoices and credit notes, in the GST portal's JSON schema.
+package gstr1
+
+import (
+	"kars/invoices"
+	"kars/models"
+	"kars/tax"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// B2CLLimit is the invoice value above which inter-state sales to
+// unregistered buyers are reported invoice by invoice.
+const B2CLLimit = 100000
+
+// Return is a GSTR-1 for one tax period.
+type Return struct {
+	GSTIN  string `json:"gstin"`
+	Period string `json:"fp"`
+	B2B    []B2B  `json:"b2b,omitempty"`
+	B2CL   []B2CL `json:"b2cl,omitempty"`
+	B2CS   []B2CS `json:"b2cs,omitempty"`
+	CDNR   []CDNR `json:"cdnr,omitempty"`
+	CDNUR  []Note `json:"cdnur,omitempty"`
+	HSN    HSN    `json:"hsn"`
+}
+
+// B2B holds the invoices of one registered buyer.
+type B2B struct {
+	GSTIN    string    `json:"ctin"`
+	Name     string    `json:"-"`
+	Invoices []Invoice `json:"inv"`
+}
+
+// B2CL holds the large inter-state invoices to one state.
+type B2CL struct {
+	PlaceOfSupply string    `json:"pos"`
+	Invoices      []Invoice `json:"inv"`
+}
+
+type Invoice struct {
+	Number        string  `json:"inum"`
+	Date          string  `json:"idt"`
+	Value         float64 `json:"val"`
+	PlaceOfSupply string  `json:"pos,omitempty"`
+	ReverseCharge string  `json:"rchrg,omitempty"`
+	Type          string  `json:"inv_typ,omitempty"`
+	Items         []Item  `json:"itms"`
+}
+
+// Item is the part of an invoice or note taxed at one rate.
+type Item struct {
+	Num    int        `json:"num"`
+	Detail ItemDetail `json:"itm_det"`
+}
+
+type ItemDetail struct {
+	TaxableValue float64 `json:"txval"`
+	Rate         float64 `json:"rt"`
+	IGST         float64 `json:"iamt,omitempty"`
+	CGST         float64 `json:"camt,omitempty"`
+	SGST         float64 `json:"samt,omitempty"`
+	Cess         float64 `json:"csamt"`
+}
+
+// B2CS is the net small B2C supply to one state at one rate, after the
+// credit notes issued against it.
+type B2CS struct {
+	SupplyType    string  `json:"sply_ty"`
+	PlaceOfSupply string  `json:"pos"`
+	Type          string  `json:"typ"`
+	Rate          float64 `json:"rt"`
+	TaxableValue  float64 `json:"txval"`
+	IGST          float64 `json:"iamt,omitempty"`
+	CGST          float64 `json:"camt,omitempty"`
+	SGST          float64 `json:"samt,omitempty"`
+	Cess          float64 `json:"csamt"`
+}
+
+// CDNR holds the credit notes issued to one registered buyer.
+type CDNR struct {
+	GSTIN string `json:"ctin"`
+	Name  string `json:"-"`
+	Notes []Note `json:"nt"`
+}
+
+// Note is a credit note. URType is only set for notes to unregistered
+// buyers, against B2CL invoices.
+type Note struct {
+	Type          string  `json:"ntty"`
+	Number        string  `json:"nt_num"`
+	Date          string  `json:"nt_dt"`
+	Value         float64 `json:"val"`
+	PlaceOfSupply string  `json:"pos"`
+	ReverseCharge string  `json:"rchrg,omitempty"`
+	InvoiceType   string  `json:"inv_typ,omitempty"`
+	URType        string  `json:"typ,omitempty"`
+	Items         []Item  `json:"itms"`
+}
+
+type HSN struct {
+	Data []HSNRow `json:"data"`
+}
+
+// HSNRow sums the goods sold under one HSN code at one rate, net of
+// credit notes.
+type HSNRow struct {
+	Num          int     `json:"num"`
+	Code         string  `json:"hsn_sc"`
+	Description  string  `json:"desc"`
+	UQC          string  `json:"uqc"`
+	Quantity     float64 `json:"qty"`
+	Value        float64 `json:"val"`
+	TaxableValue float64 `json:"txval"`
+	Rate         float64 `json:"rt"`
+	IGST         float64 `json:"iamt"`
+	CGST         float64 `json:"camt"`
+	SGST         float64 `json:"samt"`
+	Cess         float64 `json:"csamt"`
+}
+
+// Section of the return an invoice, and the credit notes against it, go in.
+const (
+	sectionB2B  = "b2b"
+	sectionB2CL = "b2cl"
+	sectionB2CS = "b2cs"
+)
+
+// line is an invoice or credit note line.
+type line struct {
+	hsn, name                       string
+	quantity                        int
+	rate, taxable, igst, cgst, sgst float64
+}
+
+type b2csKey struct {
+	supplyType, pos string
+	rate            float64
+}
+
+type hsnKey struct {
+	code string
+	rate float64
+}
+
+// Build puts together the return of gstin for a month from the invoices
+// and credit notes dated in it.
+func Build(db *gorm.DB, gstin string, year int, month time.Month) (Return, error) {
+	start := time.Date(year, month, 1, 0, 0, 0, 0, invoices.IST)
+	end := start.AddDate(0, 1, 0)
+	ret := Return{GSTIN: gstin, Period: start.Format("012006")}
+
+	var issued []models.Invoice
+	if err := db.Preload("Lines").Where("issued_at >= ? AND issued_at < ?", start, end).Order("issued_at, id").Find(&issued).Error; err != nil {
+		return ret, err
+	}
+	var notes []models.CreditNote
+	if err := db.Preload("Lines").Where("issued_at >= ? AND issued_at < ?", start, end).Order("issued_at, id").Find(&notes).Error; err != nil {
+		return ret, err
+	}
+
+	// Notes may be against invoices of earlier months.
+	against := map[uint]models.Invoice{}
+	var ids []uint
+	for _, note := range notes {
+		ids = append(ids, note.InvoiceID)
+	}
+	if len(ids) > 0 {
+		var originals []models.Invoice
+		if err := db.Preload("Lines").Where("id IN ?", ids).Find(&originals).Error; err != nil {
+			return ret, err
+		}
+		for _, invoice := range originals {
+			against[invoice.ID] = invoice
+		}
+	}
+
+	b := builder{
+		b2b:  map[string]*B2B{},
+		b2cl: map[string]*B2CL{},
+		b2cs: map[b2csKey]*B2CS{},
+		cdnr: map[string]*CDNR{},
+		hsn:  map[hsnKey]*HSNRow{},
+	}
+	for _, invoice := range issued {
+		b.addInvoice(invoice)
+	}
+	for _, note := range notes {
+		b.addNote(note, against[note.InvoiceID])
+	}
+	b.fill(&ret)
+	return ret, nil
+}
+
+type builder struct {
+	b2b   map[string]*B2B
+	b2cl  map[string]*B2CL
+	b2cs  map[b2csKey]*B2CS
+	cdnr  map[string]*CDNR
+	cdnur []Note
+	hsn   map[hsnKey]*HSNRow
+}
+
+func section(invoice models.Invoice) string {
+	if invoice.BuyerGSTIN != "" {
+		return sectionB2B
+	}
+	if !tax.IntraState(invoice.PlaceOfSupply) && invoice.TotalAmount > B2CLLimit {
+		return sectionB2CL
+	}
+	return sectionB2CS
+}
+
+func (b *builder) addInvoice(invoice models.Invoice) {
+	var lines []line
+	for _, l := range invoice.Lines {
+		lines = append(lines, line{l.HSNCode, l.ProductName, l.Quantity, l.GSTRate, l.TaxableValue, l.IGST, l.CGST, l.SGST})
+	}
+	if invoice.ShippingGSTRate > 0 {
+		lines = append(lines, shippingLine(invoice, invoice.ShippingGSTRate, invoice.ShippingAmount, invoice.ShippingIGST, invoice.ShippingCGST, invoice.ShippingSGST))
+	}
+	b.addHSN(lines, 1)
+
+	pos := tax.StateCode(invoice.PlaceOfSupply)
+	entry := Invoice{
+		Number: invoice.Number,
+		Date:   invoice.IssuedAt.In(invoices.IST).Format("02-01-2006"),
+		Value:  tax.Round(invoice.TotalAmount),
+		Items:  items(lines),
+	}
+
+	switch section(invoice) {
+	case sectionB2B:
+		party, ok := b.b2b[invoice.BuyerGSTIN]
+		if !ok {
+			party = &B2B{GSTIN: invoice.BuyerGSTIN, Name: invoice.BuyerLegalName}
+			b.b2b[invoice.BuyerGSTIN] = party
+		}
+		entry.PlaceOfSupply = pos
+		entry.ReverseCharge = "N"
+		entry.Type = "R"
+		party.Invoices = append(party.Invoices, entry)
+	case sectionB2CL:
+		state, ok := b.b2cl[pos]
+		if !ok {
+			state = &B2CL{PlaceOfSupply: pos}
+			b.b2cl[pos] = state
+		}
+		state.Invoices = append(state.Invoices, entry)
+	default:
+		b.addB2CS(invoice.PlaceOfSupply, lines, 1)
+	}
+}
+
+// addNote reports a credit note in the section of the invoice it is
+// against. Notes against small B2C invoices are netted off the B2CS rows.
+func (b *builder) addNote(note models.CreditNote, invoice models.Invoice) {
+	var lines []line
+	for _, l := range note.Lines {
+		lines = append(lines, line{l.HSNCode, l.ProductName, l.Quantity, l.GSTRate, l.TaxableValue, l.IGST, l.CGST, l.SGST})
+	}
+	if note.ShippingGSTRate > 0 {
+		lines = append(lines, shippingLine(invoice, note.ShippingGSTRate, note.ShippingAmount, note.ShippingIGST, note.ShippingCGST, note.ShippingSGST))
+	}
+	b.addHSN(lines, -1)
+
+	entry := Note{
+		Type:          "C",
+		Number:        note.Number,
+		Date:          note.IssuedAt.In(invoices.IST).Format("02-01-2006"),
+		Value:         tax.Round(note.TotalAmount),
+		PlaceOfSupply: tax.StateCode(note.PlaceOfSupply),
+		Items:         items(lines),
+	}
+
+	switch section(invoice) {
+	case sectionB2B:
+		party, ok := b.cdnr[invoice.BuyerGSTIN]
+		if !ok {
+			party = &CDNR{GSTIN: invoice.BuyerGSTIN, Name: invoice.BuyerLegalName}
+			b.cdnr[invoice.BuyerGSTIN] = party
+		}
+		entry.ReverseCharge = "N"
+		entry.InvoiceType = "R"
+		party.Notes = append(party.Notes, entry)
+	case sectionB2CL:
+		entry.URType = "B2CL"
+		b.cdnur = append(b.cdnur, entry)
+	default:
+		b.addB2CS(note.PlaceOfSupply, lines, -1)
+	}
+}
+
+// shippingLine reports a shipping charge as part of the principal supply
+// it was taxed with, under the HSN code of the invoice's largest line at
+// its rate.
+func shippingLine(invoice models.Invoice, rate, taxable, igst, cgst, sgst float64) line {
+	shipping := line{name: "Delivery charge", rate: rate, taxable: taxable, igst: igst, cgst: cgst, sgst: sgst}
+	largest := -1.0
+	for _, l := range invoice.Lines {
+		if l.GSTRate == rate && l.TaxableValue > largest {
+			shipping.hsn, largest = l.HSNCode, l.TaxableValue
+		}
+	}
+	return shipping
+}
+
+func (b *builder) addB2CS(state string, lines []line, sign float64) {
+	supplyType := "INTER"
+	if tax.IntraState(state) {
+		supplyType = "INTRA"
+	}
+	for _, l := range lines {
+		key := b2csKey{supplyType, tax.StateCode(state), l.rate}
+		row, ok := b.b2cs[key]
+		if !ok {
+			row = &B2CS{SupplyType: supplyType, PlaceOfSupply: key.pos, Type: "OE", Rate: l.rate}
+			b.b2cs[key] = row
+		}
+		row.TaxableValue += sign * l.taxable
+		row.IGST += sign * l.igst
+		row.CGST += sign * l.cgst
+		row.SGST += sign * l.sgst
+	}
+}
+
+func (b *builder) addHSN(lines []line, sign float64) {
+	for _, l := range lines {
+		key := hsnKey{l.hsn, l.rate}
+		row, ok := b.hsn[key]
+		if !ok {
+			row = &HSNRow{Code: l.hsn, Description: l.name, UQC: "NOS", Rate: l.rate}
+			b.hsn[key] = row
+		}
+		row.Quantity += sign * float64(l.quantity)
+		row.Value += sign * (l.taxable + l.igst + l.cgst + l.sgst)
+		row.TaxableValue += sign * l.taxable
+		row.IGST += sign * l.igst
+		row.CGST += sign * l.cgst
+		row.SGST += sign * l.sgst
+	}
+}
+
+// items groups lines by rate, one item per rate as the portal expects.
+func items(lines []line) []Item {
+	byRate := map[float64]*ItemDetail{}
+	var rates []float64
+	for _, l := range lines {
+		detail, ok := byRate[l.rate]
+		if !ok {
+			detail = &ItemDetail{Rate: l.rate}
+			byRate[l.rate] = detail
+			rates = append(rates, l.rate)
+		}
+		detail.TaxableValue += l.taxable
+		detail.IGST += l.igst
+		detail.CGST += l.cgst
+		detail.SGST += l.sgst
+	}
+	sort.Float64s(rates)
+
+	list := make([]Item, 0, len(rates))
+	for i, rate := range rates {
+		detail := byRate[rate]
+		list = append(list, Item{Num: i + 1, Detail: ItemDetail{
+			TaxableValue: tax.Round(detail.TaxableValue),
+			Rate:         rate,
+			IGST:         tax.Round(detail.IGST),
+			CGST:         tax.Round(detail.CGST),
+			SGST:         tax.Round(detail.SGST),
+		}})
+	}
+	return list
+}
+
+func (b *builder) fill(ret *Return) {
+	for _, party := range b.b2b {
+		ret.B2B = append(ret.B2B, *party)
+	}
+	sort.Slice(ret.B2B, func(i, j int) bool { return ret.B2B[i].GSTIN < ret.B2B[j].GSTIN })
+
+	for _, state := range b.b2cl {
+		ret.B2CL = append(ret.B2CL, *state)
+	}
+	sort.Slice(ret.B2CL, func(i, j int) bool { return ret.B2CL[i].PlaceOfSupply < ret.B2CL[j].PlaceOfSupply })
+
+	for _, row := range b.b2cs {
+		row.TaxableValue = tax.Round(row.TaxableValue)
+		row.IGST = tax.Round(row.IGST)
+		row.CGST = tax.Round(row.CGST)
+		row.SGST = tax.Round(row.SGST)
+		ret.B2CS = append(ret.B2CS, *row)
+	}
+	sort.Slice(ret.B2CS, func(i, j int) bool {
+		if ret.B2CS[i].PlaceOfSupply != ret.B2CS[j].PlaceOfSupply {
+			return ret.B2CS[i].PlaceOfSupply < ret.B2CS[j].PlaceOfSupply
+		}
+		return ret.B2CS[i].Rate < ret.B2CS[j].Rate
+	})
+
+	for _, party := range b.cdnr {
+		ret.CDNR = append(ret.CDNR, *party)
+	}
+	sort.Slice(ret.CDNR, func(i, j int) bool { return ret.CDNR[i].GSTIN < ret.CDNR[j].GSTIN })
+	ret.CDNUR = b.cdnur
+
+	for _, row := range b.hsn {
+		row.Value = tax.Round(row.Value)
+		row.TaxableValue = tax.Round(row.TaxableValue)
+		row.IGST = tax.Round(row.IGST)
+		row.CGST = tax.Round(row.CGST)
+		row.SGST = tax.Round(row.SGST)
+		ret.HSN.Data = append(ret.HSN.Data, *row)
+	}
+	sort.Slice(ret.HSN.Data, func(i, j int) bool {
+		a, b := ret.HSN.Data[i], ret.HSN.Data[j]
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		return a.Rate < b.Rate
+	})
+	for i := range ret.HSN.Data {
+		ret.HSN.Data[i].Num = i + 1
+	}
+}
@@ -0,0 +1,92 @@
+package gstr1
+
+import (
+	"kars/tax"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// XLSX lays the return out in the sheets and columns of the GST offline
+// tool's Excel template, so it can be imported there and reviewed.
+func XLSX(ret Return) (*excelize.File, error) {
+	f := excelize.NewFile()
+
+	var b2b [][]interface{}
+	for _, party := range ret.B2B {
+		for _, invoice := range party.Invoices {
+			for _, item := range invoice.Items {
+				b2b = append(b2b, []interface{}{party.GSTIN, party.Name, invoice.Number, invoice.Date, invoice.Value, posLabel(invoice.PlaceOfSupply), "N", "Regular B2B", item.Detail.Rate, item.Detail.TaxableValue, item.Detail.Cess})
+			}
+		}
+	}
+	var b2cl [][]interface{}
+	for _, state := range ret.B2CL {
+		for _, invoice := range state.Invoices {
+			for _, item := range invoice.Items {
+				b2cl = append(b2cl, []interface{}{invoice.Number, invoice.Date, invoice.Value, posLabel(state.PlaceOfSupply), item.Detail.Rate, item.Detail.TaxableValue, item.Detail.Cess})
+			}
+		}
+	}
+	var b2cs [][]interface{}
+	for _, row := range ret.B2CS {
+		b2cs = append(b2cs, []interface{}{row.Type, posLabel(row.PlaceOfSupply), row.Rate, row.TaxableValue, row.Cess})
+	}
+	var cdnr [][]interface{}
+	for _, party := range ret.CDNR {
+		for _, note := range party.Notes {
+			for _, item := range note.Items {
+				cdnr = append(cdnr, []interface{}{party.GSTIN, party.Name, note.Number, note.Date, note.Type, posLabel(note.PlaceOfSupply), "N", "Regular B2B", note.Value, item.Detail.Rate, item.Detail.TaxableValue, item.Detail.Cess})
+			}
+		}
+	}
+	var cdnur [][]interface{}
+	for _, note := range ret.CDNUR {
+		for _, item := range note.Items {
+			cdnur = append(cdnur, []interface{}{note.URType, note.Number, note.Date, note.Type, posLabel(note.PlaceOfSupply), note.Value, item.Detail.Rate, item.Detail.TaxableValue, item.Detail.Cess})
+		}
+	}
+	var hsn [][]interface{}
+	for _, row := range ret.HSN.Data {
+		hsn = append(hsn, []interface{}{row.Code, row.Description, row.UQC + "-NUMBERS", row.Quantity, row.Value, row.Rate, row.TaxableValue, row.IGST, row.CGST, row.SGST, row.Cess})
+	}
+
+	sheets := []struct {
+		name   string
+		header []interface{}
+		rows   [][]interface{}
+	}{
+		{"b2b", []interface{}{"GSTIN/UIN of Recipient", "Receiver Name", "Invoice Number", "Invoice date", "Invoice Value", "Place Of Supply", "Reverse Charge", "Invoice Type", "Rate", "Taxable Value", "Cess Amount"}, b2b},
+		{"b2cl", []interface{}{"Invoice Number", "Invoice date", "Invoice Value", "Place Of Supply", "Rate", "Taxable Value", "Cess Amount"}, b2cl},
+		{"b2cs", []interface{}{"Type", "Place Of Supply", "Rate", "Taxable Value", "Cess Amount"}, b2cs},
+		{"cdnr", []interface{}{"GSTIN/UIN of Recipient", "Receiver Name", "Note Number", "Note Date", "Note Type", "Place Of Supply", "Reverse Charge", "Note Supply Type", "Note Value", "Rate", "Taxable Value", "Cess Amount"}, cdnr},
+		{"cdnur", []interface{}{"UR Type", "Note Number", "Note Date", "Note Type", "Place Of Supply", "Note Value", "Rate", "Taxable Value", "Cess Amount"}, cdnur},
+		{"hsn", []interface{}{"HSN", "Description", "UQC", "Total Quantity", "Total Value", "Rate", "Taxable Value", "Integrated Tax Amount", "Central Tax Amount", "State/UT Tax Amount", "Cess Amount"}, hsn},
+	}
+	for _, sheet := range sheets {
+		if _, err := f.NewSheet(sheet.name); err != nil {
+			return nil, err
+		}
+		if err := f.SetSheetRow(sheet.name, "A1", &sheet.header); err != nil {
+			return nil, err
+		}
+		for i := range sheet.rows {
+			cell, err := excelize.CoordinatesToCellName(1, i+2)
+			if err != nil {
+				return nil, err
+			}
+			if err := f.SetSheetRow(sheet.name, cell, &sheet.rows[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := f.DeleteSheet("Sheet1"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// posLabel writes a state code the way the offline tool lists places of
+// supply, 32-Kerala.
+func posLabel(code string) string {
+	return code + "-" + tax.StateName(code)
+}
@@ -0,0 +1,243 @@
+package invoices
+
+import (
+	"errors"
+	"fmt"
+	"kars/models"
+	"kars/tax"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrOverCredit is returned when more units of an item are credited than
+// are left on the invoice.
+var ErrOverCredit = errors.New("credit exceeds what was invoiced")
+
+type credited struct {
+	OrderItemID  uint
+	Quantity     int
+	TaxableValue float64
+	CGST         float64
+	SGST         float64
+	IGST         float64
+}
+
+// CreditLines works out the credit for quantities of an order's items, keyed
+// by order item id. Units are credited at their share of what the item sold
+// for; the last units of an item take whatever is left of it, so the credits
+// of an item add up to its invoiced value exactly.
+func CreditLines(tx *gorm.DB, order models.Order, quantities map[uint]int) ([]models.CreditNoteLine, error) {
+	before, err := creditedItems(tx, order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(quantities))
+	for id, quantity := range quantities {
+		if quantity > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND id IN ?", order.ID, ids).Order("id").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) != len(ids) {
+		return nil, fmt.Errorf("%w: order %d does not have every item credited", ErrOverCredit, order.ID)
+	}
+
+	var lines []models.CreditNoteLine
+	for _, item := range items {
+		quantity := quantities[item.ID]
+		done := before[item.ID]
+		left := item.Quantity - done.Quantity
+		if quantity > left {
+			return nil, fmt.Errorf("%w: only %d of order item %d are left to credit", ErrOverCredit, left, item.ID)
+		}
+
+		value := itemValue(order, item)
+		var line tax.Breakdown
+		if quantity == left {
+			line = tax.Breakdown{
+				TaxableValue: tax.Round(value.TaxableValue - done.TaxableValue),
+				CGST:         tax.Round(value.CGST - done.CGST),
+				SGST:         tax.Round(value.SGST - done.SGST),
+				IGST:         tax.Round(value.IGST - done.IGST),
+			}
+		} else {
+			share := float64(quantity) / float64(item.Quantity)
+			line = tax.Breakdown{
+				TaxableValue: tax.Round(value.TaxableValue * share),
+				CGST:         tax.Round(value.CGST * share),
+				SGST:         tax.Round(value.SGST * share),
+				IGST:         tax.Round(value.IGST * share),
+			}
+		}
+
+		lines = append(lines, models.CreditNoteLine{
+			OrderItemID:  item.ID,
+			ProductName:  item.ProductName,
+			HSNCode:      item.HSNCode,
+			Quantity:     quantity,
+			GSTRate:      item.GSTRate,
+			TaxableValue: line.TaxableValue,
+			CGST:         line.CGST,
+			SGST:         line.SGST,
+			IGST:         line.IGST,
+			Amount:       tax.Round(line.TaxableValue + line.Tax()),
+		})
+	}
+	return lines, nil
+}
+
+// Uncredited returns, per item of the order that is still ordered, how many
+// units no credit note has taken back yet.
+func Uncredited(tx *gorm.DB, order models.Order) (map[uint]int, error) {
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND is_cancelled = ?", order.ID, "ordered").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	before, err := creditedItems(tx, order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	quantities := map[uint]int{}
+	for _, item := range items {
+		if left := item.Quantity - before[item.ID].Quantity; left > 0 {
+			quantities[item.ID] = left
+		}
+	}
+	return quantities, nil
+}
+
+func creditedItems(tx *gorm.DB, orderID uint) (map[uint]credited, error) {
+	var rows []credited
+	err := tx.Table("credit_note_lines").
+		Select("credit_note_lines.order_item_id, SUM(credit_note_lines.quantity) AS quantity, SUM(credit_note_lines.taxable_value) AS taxable_value, SUM(credit_note_lines.cgst) AS cgst, SUM(credit_note_lines.sgst) AS sgst, SUM(credit_note_lines.igst) AS igst").
+		Joins("JOIN credit_notes ON credit_notes.id = credit_note_lines.credit_note_id").
+		Where("credit_notes.order_id = ? AND credit_notes.deleted_at IS NULL AND credit_note_lines.deleted_at IS NULL", orderID).
+		Group("credit_note_lines.order_item_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byItem := map[uint]credited{}
+	for _, row := range rows {
+		byItem[row.OrderItemID] = row
+	}
+	return byItem, nil
+}
+
+// CreditTotal is what lines and a shipping credit come to.
+func CreditTotal(lines []models.CreditNoteLine, shipping float64) float64 {
+	total := shipping
+	for _, line := range lines {
+		total += line.Amount
+	}
+	return tax.Round(total)
+}
+
+// IssueCreditNote stores a numbered credit note for lines, and shipping if
+// any, against the order's invoice. Orders that were never invoiced need no
+// credit note, and get nil. The caller must hold the order lock.
+func IssueCreditNote(tx *gorm.DB, order models.Order, reason string, returnRequestID *uint, lines []models.CreditNoteLine, shipping float64) (*models.CreditNote, error) {
+	if len(lines) == 0 && shipping <= 0 {
+		return nil, nil
+	}
+
+	var invoice models.Invoice
+	if err := tx.First(&invoice, "order_id = ?", order.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	note := models.CreditNote{
+		InvoiceID:       invoice.ID,
+		OrderID:         order.ID,
+		UserID:          order.UserID,
+		FinancialYear:   FinancialYear(now),
+		IssuedAt:        now,
+		Reason:          reason,
+		ReturnRequestID: returnRequestID,
+		PlaceOfSupply:   invoice.PlaceOfSupply,
+		TotalAmount:     CreditTotal(lines, shipping),
+		Lines:           lines,
+	}
+	var total tax.Breakdown
+	for _, line := range lines {
+		total = total.Add(tax.Breakdown{TaxableValue: line.TaxableValue, CGST: line.CGST, SGST: line.SGST, IGST: line.IGST})
+	}
+	note.TaxableAmount = total.TaxableValue
+
+	if shipping > 0 {
+		credit := shippingCredit(invoice, shipping)
+		note.ShippingAmount = credit.TaxableValue
+		note.ShippingGSTRate = invoice.ShippingGSTRate
+		note.ShippingCGST = credit.CGST
+		note.ShippingSGST = credit.SGST
+		note.ShippingIGST = credit.IGST
+		total = total.Add(credit)
+	}
+	note.CGSTAmount = total.CGST
+	note.SGSTAmount = total.SGST
+	note.IGSTAmount = total.IGST
+
+	var err error
+	note.Number, err = nextNumber(tx, CreditNotePrefix, note.FinancialYear)
+	if err != nil {
+		return nil, err
+	}
+	note.Document, err = renderCreditNote(note, invoice, order)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(&note).Error; err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// shippingCredit splits shipping, an amount of the invoice's shipping
+// charge with GST, the way the invoice split the charge. Crediting the
+// whole charge takes back exactly what was invoiced.
+func shippingCredit(invoice models.Invoice, shipping float64) tax.Breakdown {
+	invoiced := tax.Breakdown{
+		TaxableValue: invoice.ShippingAmount,
+		CGST:         invoice.ShippingCGST,
+		SGST:         invoice.ShippingSGST,
+		IGST:         invoice.ShippingIGST,
+	}
+	gross := tax.Round(invoiced.TaxableValue + invoiced.Tax())
+	if gross <= 0 || tax.Round(shipping) >= gross {
+		return invoiced
+	}
+	share := shipping / gross
+	credit := tax.Breakdown{
+		CGST: tax.Round(invoiced.CGST * share),
+		SGST: tax.Round(invoiced.SGST * share),
+		IGST: tax.Round(invoiced.IGST * share),
+	}
+	credit.TaxableValue = tax.Round(shipping - credit.Tax())
+	return credit
+}
+
+// Credited is the total of the credit notes issued on an order.
+func Credited(db *gorm.DB, orderID uint) (float64, error) {
+	var total float64
+	err := db.Model(&models.CreditNote{}).Where("order_id = ?", orderID).
+		Select("COALESCE(SUM(total_amount), 0)").Scan(&total).Error
+	return total, err
+}
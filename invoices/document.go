@@ -0,0 +1,207 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"kars/models"
+	"kars/tax"
+
+	"github.com/jung-kurt/gofpdf/v2"
+)
+
+const sellerAddress = "Kars\nNear Thrissur Round\nThrissur, kerala, 680702\nPhone: +91 8921236125"
+
+type detail struct {
+	label, value string
+}
+
+type amountLine struct {
+	label  string
+	amount float64
+}
+
+func renderInvoice(invoice models.Invoice, order models.Order) ([]byte, error) {
+	pdf := newDocument("TAX INVOICE", order, append([]detail{
+		{"Invoice No:", invoice.Number},
+		{"Invoice Date:", invoice.IssuedAt.In(IST).Format("2006-01-02 15:04:05")},
+		{"Order ID:", fmt.Sprint(order.ID)},
+		{"Order Date:", order.CreatedAt.In(IST).Format("2006-01-02 15:04:05")},
+		{"Place of Supply:", invoice.PlaceOfSupply},
+	}, buyerDetails(invoice)...))
+
+	pdf.SetFont("Arial", "B", 10)
+	pdf.CellFormat(50, 10, "Item Name", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(18, 10, "HSN", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(12, 10, "Qty", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(24, 10, "Price", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(26, 10, "Taxable", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(14, 10, "GST", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(20, 10, "Tax", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(26, 10, "Total", "1", 1, "C", false, 0, "")
+
+	pdf.SetFont("Arial", "", 10)
+	gross := 0.0
+	for _, line := range invoice.Lines {
+		gross += line.Amount
+		pdf.CellFormat(50, 10, line.ProductName, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(18, 10, line.HSNCode, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(12, 10, fmt.Sprintf("%d", line.Quantity), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(24, 10, fmt.Sprintf("Rs. %.2f", line.UnitPrice), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(26, 10, fmt.Sprintf("Rs. %.2f", line.TaxableValue), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(14, 10, tax.Label(line.GSTRate), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(20, 10, fmt.Sprintf("%.2f", line.CGST+line.SGST+line.IGST), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(26, 10, fmt.Sprintf("Rs. %.2f", line.Amount), "1", 1, "R", false, 0, "")
+	}
+
+	// The delivery charge is printed with its GST, as the customer paid it;
+	// the tax summary below splits it out.
+	shippingTax := invoice.ShippingCGST + invoice.ShippingSGST + invoice.ShippingIGST
+	totals := []amountLine{
+		{"Total Amount:", gross},
+		{"Delivery Charge:", invoice.ShippingAmount + shippingTax},
+	}
+	if invoice.DiscountAmount != 0 {
+		totals = append(totals, amountLine{"Discount Amount:", invoice.DiscountAmount})
+	}
+	totals = append(totals, amountLine{"Final Amount:", invoice.TotalAmount})
+	writeTotals(pdf, totals)
+
+	writeTax(pdf, invoice.TaxableAmount+invoice.ShippingAmount, invoice.CGSTAmount, invoice.SGSTAmount, invoice.IGSTAmount)
+	return output(pdf)
+}
+
+func renderCreditNote(note models.CreditNote, invoice models.Invoice, order models.Order) ([]byte, error) {
+	pdf := newDocument("CREDIT NOTE", order, append([]detail{
+		{"Credit Note No:", note.Number},
+		{"Date:", note.IssuedAt.In(IST).Format("2006-01-02 15:04:05")},
+		{"Against Invoice:", fmt.Sprintf("%s dated %s", invoice.Number, invoice.IssuedAt.In(IST).Format("2006-01-02"))},
+		{"Order ID:", fmt.Sprint(order.ID)},
+		{"Place of Supply:", note.PlaceOfSupply},
+		{"Reason:", note.Reason},
+	}, buyerDetails(invoice)...))
+
+	pdf.SetFont("Arial", "B", 10)
+	pdf.CellFormat(60, 10, "Item Name", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(18, 10, "HSN", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(12, 10, "Qty", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(30, 10, "Taxable", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(16, 10, "GST", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(24, 10, "Tax", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(30, 10, "Amount", "1", 1, "C", false, 0, "")
+
+	pdf.SetFont("Arial", "", 10)
+	for _, line := range note.Lines {
+		pdf.CellFormat(60, 10, line.ProductName, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(18, 10, line.HSNCode, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(12, 10, fmt.Sprintf("%d", line.Quantity), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(30, 10, fmt.Sprintf("Rs. %.2f", line.TaxableValue), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(16, 10, tax.Label(line.GSTRate), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(24, 10, fmt.Sprintf("%.2f", line.CGST+line.SGST+line.IGST), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 10, fmt.Sprintf("Rs. %.2f", line.Amount), "1", 1, "R", false, 0, "")
+	}
+
+	var totals []amountLine
+	if note.ShippingAmount != 0 {
+		totals = append(totals, amountLine{"Delivery Charge:", note.ShippingAmount + note.ShippingCGST + note.ShippingSGST + note.ShippingIGST})
+	}
+	totals = append(totals, amountLine{"Total Credit:", note.TotalAmount})
+	writeTotals(pdf, totals)
+
+	writeTax(pdf, note.TaxableAmount+note.ShippingAmount, note.CGSTAmount, note.SGSTAmount, note.IGSTAmount)
+	return output(pdf)
+}
+
+// buyerDetails are the lines a B2B invoice, and its credit notes, print
+// for the buyer's registration.
+func buyerDetails(invoice models.Invoice) []detail {
+	if invoice.BuyerGSTIN == "" {
+		return nil
+	}
+	return []detail{
+		{"Buyer GSTIN:", invoice.BuyerGSTIN},
+		{"Bill To:", invoice.BuyerLegalName},
+		{"", invoice.BuyerBillingAddress},
+	}
+}
+
+// newDocument starts a page with the title, the seller and buyer addresses
+// and a line for each of details.
+func newDocument(title string, order models.Order, details []detail) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "B", 20)
+	pdf.CellFormat(190, 12, title, "0", 1, "C", false, 0, "")
+	pdf.Ln(10)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(40, 10, "From:")
+	pdf.SetFont("Arial", "", 12)
+	pdf.MultiCell(150, 7, sellerAddress, "0", "L", false)
+	pdf.Ln(5)
+
+	to := "To:"
+	if order.BuyerGSTIN != "" {
+		to = "Ship To:"
+	}
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(40, 10, to)
+	pdf.SetFont("Arial", "", 12)
+	pdf.MultiCell(150, 7, fmt.Sprintf("%s\n%s\n%s\n%s\n%s",
+		order.OrderAddress.Name,
+		order.OrderAddress.AddressLine1,
+		order.OrderAddress.City,
+		order.OrderAddress.PostalCode,
+		order.OrderAddress.PhoneNo), "0", "L", false)
+	pdf.Ln(8)
+
+	for _, line := range details {
+		pdf.SetFont("Arial", "B", 12)
+		pdf.Cell(40, 10, line.label)
+		pdf.SetFont("Arial", "", 12)
+		pdf.Cell(150, 10, line.value)
+		pdf.Ln(8)
+	}
+	pdf.Ln(4)
+	return pdf
+}
+
+func writeTotals(pdf *gofpdf.Fpdf, totals []amountLine) {
+	pdf.SetFont("Arial", "B", 12)
+	for _, line := range totals {
+		pdf.Ln(8)
+		pdf.Cell(140, 10, line.label)
+		pdf.Cell(40, 10, fmt.Sprintf("Rs. %.2f", line.amount))
+	}
+}
+
+// writeTax lists the GST included in the amounts above it.
+func writeTax(pdf *gofpdf.Fpdf, taxable, cgst, sgst, igst float64) {
+	lines := []amountLine{
+		{"Taxable Value:", taxable},
+		{"CGST:", cgst},
+		{"SGST:", sgst},
+		{"IGST:", igst},
+	}
+	pdf.Ln(10)
+	pdf.SetFont("Arial", "", 11)
+	for i, line := range lines {
+		if line.amount == 0 && i > 0 {
+			continue
+		}
+		pdf.Ln(7)
+		pdf.Cell(140, 10, line.label)
+		pdf.Cell(40, 10, fmt.Sprintf("Rs. %.2f", line.amount))
+	}
+	pdf.Ln(7)
+	pdf.Cell(140, 10, "Total GST (included):")
+	pdf.Cell(40, 10, fmt.Sprintf("Rs. %.2f", cgst+sgst+igst))
+}
+
+func output(pdf *gofpdf.Fpdf) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,129 @@
+// Package invoices issues the tax documents of orders: one invoice per order,
+// frozen once issued, and credit notes against it for whatever is later
+// cancelled or returned.
+package invoices
+
+import (
+	"errors"
+	"kars/models"
+	"kars/tax"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Issue stores the numbered invoice of an order along with its document.
+// An order that already has an invoice gets it back unchanged. The caller
+// must hold the order lock.
+func Issue(tx *gorm.DB, order models.Order) (models.Invoice, error) {
+	var invoice models.Invoice
+	err := tx.Preload("Lines").First(&invoice, "order_id = ?", order.ID).Error
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return invoice, err
+	}
+
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ? AND is_cancelled <> ?", order.ID, "cancelled").Order("id").Find(&items).Error; err != nil {
+		return invoice, err
+	}
+
+	now := time.Now()
+	invoice = models.Invoice{
+		OrderID:        order.ID,
+		UserID:         order.UserID,
+		FinancialYear:  FinancialYear(now),
+		IssuedAt:       now,
+		PlaceOfSupply:  placeOfSupply(order),
+		DiscountAmount: order.DiscountAmount,
+
+		BuyerGSTIN:          order.BuyerGSTIN,
+		BuyerLegalName:      order.BuyerLegalName,
+		BuyerBillingAddress: order.BuyerBillingAddress,
+	}
+
+	var total tax.Breakdown
+	for _, item := range items {
+		value := itemValue(order, item)
+		total = total.Add(value)
+		invoice.Lines = append(invoice.Lines, models.InvoiceLine{
+			OrderItemID:  item.ID,
+			ProductName:  item.ProductName,
+			HSNCode:      item.HSNCode,
+			Quantity:     item.Quantity,
+			UnitPrice:    item.ProductPrice,
+			GSTRate:      item.GSTRate,
+			TaxableValue: value.TaxableValue,
+			CGST:         value.CGST,
+			SGST:         value.SGST,
+			IGST:         value.IGST,
+			Amount:       item.TotalPrice,
+		})
+	}
+	invoice.TaxableAmount = total.TaxableValue
+
+	shipping := shippingValue(order)
+	invoice.ShippingAmount = shipping.TaxableValue
+	invoice.ShippingGSTRate = order.ShippingGSTRate
+	invoice.ShippingCGST = shipping.CGST
+	invoice.ShippingSGST = shipping.SGST
+	invoice.ShippingIGST = shipping.IGST
+
+	total = total.Add(shipping)
+	invoice.CGSTAmount = total.CGST
+	invoice.SGSTAmount = total.SGST
+	invoice.IGSTAmount = total.IGST
+	invoice.TotalAmount = tax.Round(total.TaxableValue + total.Tax())
+
+	invoice.Number, err = nextNumber(tx, InvoicePrefix, invoice.FinancialYear)
+	if err != nil {
+		return invoice, err
+	}
+	invoice.Document, err = renderInvoice(invoice, order)
+	if err != nil {
+		return invoice, err
+	}
+
+	err = tx.Create(&invoice).Error
+	return invoice, err
+}
+
+// itemValue is what an order item sold for after its share of the coupon
+// discount. Items ordered before GST was recorded count as untaxed.
+func itemValue(order models.Order, item models.OrderItem) tax.Breakdown {
+	value := tax.Breakdown{
+		TaxableValue: item.TaxableValue,
+		CGST:         item.CGST,
+		SGST:         item.SGST,
+		IGST:         item.IGST,
+	}
+	if value.TaxableValue+value.Tax() == 0 && item.TotalPrice > 0 {
+		net := item.TotalPrice
+		if order.TotalPrice > 0 {
+			net *= 1 - order.DiscountAmount/order.TotalPrice
+		}
+		value.TaxableValue = tax.Round(net)
+	}
+	return value
+}
+
+// shippingValue is the shipping charge of an order split into taxable value
+// and GST. Orders placed before shipping was taxed count it as untaxed.
+func shippingValue(order models.Order) tax.Breakdown {
+	value := tax.Breakdown{
+		TaxableValue: order.ShippingTaxableValue,
+		CGST:         order.ShippingCGST,
+		SGST:         order.ShippingSGST,
+		IGST:         order.ShippingIGST,
+	}
+	if value.TaxableValue+value.Tax() == 0 {
+		value.TaxableValue = order.ShippingAmount
+	}
+	return value
+}
+
+func placeOfSupply(order models.Order) string {
+	if order.PlaceOfSupply != "" {
+		return order.PlaceOfSupply
+	}
+	return order.OrderAddress.State
+}
@@ -0,0 +1,50 @@
+package invoices
+
+import (
+	"fmt"
+	"kars/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Number series prefixes. A number reads KARS/2026-27/000123.
+const (
+	InvoicePrefix    = "KARS"
+	CreditNotePrefix = "KARS-CN"
+)
+
+// IST is the time zone tax documents are dated in.
+var IST = time.FixedZone("IST", 5*60*60+30*60)
+
+// FinancialYear is the Indian financial year t falls in, April to March,
+// written as 2026-27.
+func FinancialYear(t time.Time) string {
+	t = t.In(IST)
+	start := t.Year()
+	if t.Month() < time.April {
+		start--
+	}
+	return fmt.Sprintf("%d-%02d", start, (start+1)%100)
+}
+
+// nextNumber takes the next number of prefix's series for the financial
+// year. The sequence row stays locked until tx ends, so numbers are issued
+// one at a time and a rollback leaves no gap.
+func nextNumber(tx *gorm.DB, prefix, financialYear string) (string, error) {
+	series := prefix + "/" + financialYear
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DocumentSequence{Series: series}).Error; err != nil {
+		return "", err
+	}
+
+	var sequence models.DocumentSequence
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sequence, "series = ?", series).Error; err != nil {
+		return "", err
+	}
+	sequence.Last++
+	if err := tx.Model(&sequence).Update("last", sequence.Last).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%06d", series, sequence.Last), nil
+}
@@ -0,0 +1,97 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"kars/ledger"
+	"os"
+)
+
+// Accounts the journal posts to. A Chart maps them to the ledger names of
+// the books the journal is imported into.
+const (
+	AccountDebtors        = "debtors"
+	AccountSales          = "sales"
+	AccountSalesReturns   = "sales_returns"
+	AccountShipping       = "shipping"
+	AccountOutputCGST     = "output_cgst"
+	AccountOutputSGST     = "output_sgst"
+	AccountOutputIGST     = "output_igst"
+	AccountGateway        = "gateway"
+	AccountGatewayFees    = "gateway_fees"
+	AccountCashOnDelivery = "cash_on_delivery"
+	AccountWallets        = "customer_wallets"
+	AccountWalletHolds    = "wallet_holds"
+	AccountOpening        = "opening_balance"
+)
+
+// Chart maps journal accounts to ledger names.
+type Chart map[string]string
+
+// DefaultChart names the accounts after a usual Tally chart of accounts.
+func DefaultChart() Chart {
+	return Chart{
+		AccountDebtors:        "Sundry Debtors - Customers",
+		AccountSales:          "Sales",
+		AccountSalesReturns:   "Sales Returns",
+		AccountShipping:       "Shipping Charges Collected",
+		AccountOutputCGST:     "Output CGST",
+		AccountOutputSGST:     "Output SGST",
+		AccountOutputIGST:     "Output IGST",
+		AccountGateway:        "Payment Gateway Clearing",
+		AccountGatewayFees:    "Payment Gateway Charges",
+		AccountCashOnDelivery: "COD Receivable - Couriers",
+		AccountWallets:        "Customer Wallets",
+		AccountWalletHolds:    "Customer Wallet Holds",
+		AccountOpening:        "Wallet Opening Balances",
+	}
+}
+
+// LoadChart reads a JSON object of account to ledger name from path over
+// the default chart, so it only needs the names that differ. An empty path
+// gives the default chart.
+func LoadChart(path string) (Chart, error) {
+	chart := DefaultChart()
+	if path == "" {
+		return chart, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("chart of accounts %s: %w", path, err)
+	}
+	for account, name := range names {
+		if _, ok := chart[account]; !ok {
+			return nil, fmt.Errorf("chart of accounts %s: unknown account %q", path, account)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("chart of accounts %s: no ledger name for %q", path, account)
+		}
+		chart[account] = name
+	}
+	return chart, nil
+}
+
+// Name is the ledger name of account.
+func (c Chart) Name(account string) string {
+	if name, ok := c[account]; ok {
+		return name
+	}
+	return account
+}
+
+// walletAccounts maps the wallet ledger's accounts onto the journal's.
+// Wallet money spent on an order or refunded onto the wallet settles the
+// customer's account, which the invoice or credit note was booked to.
+var walletAccounts = map[string]string{
+	ledger.AccountWallet:      AccountWallets,
+	ledger.AccountSales:       AccountDebtors,
+	ledger.AccountRefunds:     AccountDebtors,
+	ledger.AccountGateway:     AccountGateway,
+	ledger.AccountWalletHolds: AccountWalletHolds,
+	ledger.AccountOpening:     AccountOpening,
+}
@@ -0,0 +1,128 @@
+package journal
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"kars/invoices"
+	"strconv"
+)
+
+// Export formats.
+const (
+	FormatCSV   = "csv"
+	FormatTally = "xml"
+)
+
+func amount(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// WriteCSV writes one row per voucher entry.
+func WriteCSV(w io.Writer, vouchers []Voucher) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"date", "voucher_type", "voucher_number", "reference", "ledger", "debit", "credit", "narration"}); err != nil {
+		return err
+	}
+	for _, v := range vouchers {
+		date := v.Date.In(invoices.IST).Format("2006-01-02")
+		for _, entry := range v.Entries {
+			if err := out.Write([]string{date, v.Type, v.Number, v.Reference, entry.Ledger, amount(entry.Debit), amount(entry.Credit), v.Narration}); err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+type tallyEnvelope struct {
+	XMLName xml.Name `xml:"ENVELOPE"`
+	Header  struct {
+		Request string `xml:"TALLYREQUEST"`
+	} `xml:"HEADER"`
+	Body struct {
+		Import struct {
+			Description struct {
+				Report  string `xml:"REPORTNAME"`
+				Company string `xml:"STATICVARIABLES>SVCURRENTCOMPANY,omitempty"`
+			} `xml:"REQUESTDESC"`
+			Messages []tallyMessage `xml:"REQUESTDATA>TALLYMESSAGE"`
+		} `xml:"IMPORTDATA"`
+	} `xml:"BODY"`
+}
+
+type tallyMessage struct {
+	UDF     string       `xml:"xmlns:UDF,attr"`
+	Voucher tallyVoucher `xml:"VOUCHER"`
+}
+
+type tallyVoucher struct {
+	Type      string       `xml:"VCHTYPE,attr"`
+	Action    string       `xml:"ACTION,attr"`
+	Date      string       `xml:"DATE"`
+	TypeName  string       `xml:"VOUCHERTYPENAME"`
+	Number    string       `xml:"VOUCHERNUMBER"`
+	Reference string       `xml:"REFERENCE,omitempty"`
+	Narration string       `xml:"NARRATION"`
+	Entries   []tallyEntry `xml:"ALLLEDGERENTRIES.LIST"`
+}
+
+// tallyEntry follows Tally's signs: debits are negative amounts deemed
+// positive, credits positive amounts that are not.
+type tallyEntry struct {
+	Ledger         string `xml:"LEDGERNAME"`
+	DeemedPositive string `xml:"ISDEEMEDPOSITIVE"`
+	Amount         string `xml:"AMOUNT"`
+}
+
+// WriteTally writes the vouchers as a Tally import request for company, or
+// for the company open in Tally when it is empty.
+func WriteTally(w io.Writer, vouchers []Voucher, company string) error {
+	var envelope tallyEnvelope
+	envelope.Header.Request = "Import Data"
+	envelope.Body.Import.Description.Report = "Vouchers"
+	envelope.Body.Import.Description.Company = company
+
+	for _, v := range vouchers {
+		voucher := tallyVoucher{
+			Type:      v.Type,
+			Action:    "Create",
+			Date:      v.Date.In(invoices.IST).Format("20060102"),
+			TypeName:  v.Type,
+			Number:    v.Number,
+			Reference: v.Reference,
+			Narration: v.Narration,
+		}
+		for _, entry := range v.Entries {
+			if entry.Debit > 0 {
+				voucher.Entries = append(voucher.Entries, tallyEntry{entry.Ledger, "Yes", amount(-entry.Debit)})
+			} else {
+				voucher.Entries = append(voucher.Entries, tallyEntry{entry.Ledger, "No", amount(entry.Credit)})
+			}
+		}
+		envelope.Body.Import.Messages = append(envelope.Body.Import.Messages, tallyMessage{UDF: "TallyUDF", Voucher: voucher})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(envelope)
+}
+
+// Write writes the vouchers in format, FormatCSV or FormatTally.
+func Write(w io.Writer, vouchers []Voucher, format, company string) error {
+	switch format {
+	case FormatCSV:
+		return WriteCSV(w, vouchers)
+	case FormatTally:
+		return WriteTally(w, vouchers, company)
+	}
+	return fmt.Errorf("unknown journal format %q", format)
+}
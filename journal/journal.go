@@ -0,0 +1,287 @@
+// Package journal turns the shop's sales, refunds, wallet movements and
+// gateway payments into double-entry vouchers for bookkeeping software.
+package journal
+
+import (
+	"errors"
+	"fmt"
+	"kars/invoices"
+	"kars/models"
+	"kars/tax"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Voucher types, named as in Tally.
+const (
+	TypeSales      = "Sales"
+	TypeCreditNote = "Credit Note"
+	TypeReceipt    = "Receipt"
+	TypePayment    = "Payment"
+	TypeJournal    = "Journal"
+)
+
+var ErrInvalidPeriod = errors.New("invalid period")
+
+// Voucher is one balanced posting.
+type Voucher struct {
+	Date      time.Time
+	Type      string
+	Number    string
+	Reference string
+	Narration string
+	Entries   []Entry
+}
+
+// Entry is one ledger line of a voucher; exactly one of Debit and Credit
+// is set.
+type Entry struct {
+	Ledger string
+	Debit  float64
+	Credit float64
+}
+
+// Period parses an inclusive range of days, 2006-01-02, into the times it
+// runs from and up to.
+func Period(from, to string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01-02", from, invoices.IST)
+	if err != nil {
+		return start, start, fmt.Errorf("%w: from must be a date, YYYY-MM-DD", ErrInvalidPeriod)
+	}
+	end, err := time.ParseInLocation("2006-01-02", to, invoices.IST)
+	if err != nil {
+		return start, end, fmt.Errorf("%w: to must be a date, YYYY-MM-DD", ErrInvalidPeriod)
+	}
+	if end.Before(start) {
+		return start, end, fmt.Errorf("%w: to is before from", ErrInvalidPeriod)
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
+
+// Build collects the vouchers dated from start up to end: invoices and
+// credit notes, payments received through the gateway and in cash on
+// delivery, gateway refunds, and the wallet ledger's transactions.
+func Build(db *gorm.DB, chart Chart, start, end time.Time) ([]Voucher, error) {
+	b := builder{db: db, chart: chart, start: start, end: end}
+	for _, collect := range []func() error{b.sales, b.creditNotes, b.gatewayReceipts, b.cashReceipts, b.gatewayRefunds, b.wallet} {
+		if err := collect(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(b.vouchers, func(i, j int) bool {
+		return b.vouchers[i].Date.Before(b.vouchers[j].Date)
+	})
+	return b.vouchers, nil
+}
+
+type builder struct {
+	db         *gorm.DB
+	chart      Chart
+	start, end time.Time
+	vouchers   []Voucher
+}
+
+func (b *builder) debit(v *Voucher, account string, amount float64) {
+	if amount = tax.Round(amount); amount > 0 {
+		v.Entries = append(v.Entries, Entry{Ledger: b.chart.Name(account), Debit: amount})
+	}
+}
+
+func (b *builder) credit(v *Voucher, account string, amount float64) {
+	if amount = tax.Round(amount); amount > 0 {
+		v.Entries = append(v.Entries, Entry{Ledger: b.chart.Name(account), Credit: amount})
+	}
+}
+
+func (b *builder) add(v Voucher) {
+	if len(v.Entries) > 1 {
+		b.vouchers = append(b.vouchers, v)
+	}
+}
+
+// sales books each invoice to the customer, against sales, output tax and
+// shipping.
+func (b *builder) sales() error {
+	var list []models.Invoice
+	if err := b.db.Where("issued_at >= ? AND issued_at < ?", b.start, b.end).Order("issued_at, id").Find(&list).Error; err != nil {
+		return err
+	}
+	for _, invoice := range list {
+		v := Voucher{
+			Date:      invoice.IssuedAt,
+			Type:      TypeSales,
+			Number:    invoice.Number,
+			Reference: fmt.Sprintf("order %d", invoice.OrderID),
+			Narration: fmt.Sprintf("Invoice %s for order %d", invoice.Number, invoice.OrderID),
+		}
+		b.debit(&v, AccountDebtors, invoice.TaxableAmount+invoice.CGSTAmount+invoice.SGSTAmount+invoice.IGSTAmount+invoice.ShippingAmount)
+		b.credit(&v, AccountSales, invoice.TaxableAmount)
+		b.credit(&v, AccountOutputCGST, invoice.CGSTAmount)
+		b.credit(&v, AccountOutputSGST, invoice.SGSTAmount)
+		b.credit(&v, AccountOutputIGST, invoice.IGSTAmount)
+		b.credit(&v, AccountShipping, invoice.ShippingAmount)
+		b.add(v)
+	}
+	return nil
+}
+
+// creditNotes reverses the sale of what was cancelled or returned.
+func (b *builder) creditNotes() error {
+	var list []models.CreditNote
+	if err := b.db.Where("issued_at >= ? AND issued_at < ?", b.start, b.end).Order("issued_at, id").Find(&list).Error; err != nil {
+		return err
+	}
+	for _, note := range list {
+		v := Voucher{
+			Date:      note.IssuedAt,
+			Type:      TypeCreditNote,
+			Number:    note.Number,
+			Reference: fmt.Sprintf("order %d", note.OrderID),
+			Narration: fmt.Sprintf("Credit note %s for order %d: %s", note.Number, note.OrderID, note.Reason),
+		}
+		b.debit(&v, AccountSalesReturns, note.TaxableAmount)
+		b.debit(&v, AccountOutputCGST, note.CGSTAmount)
+		b.debit(&v, AccountOutputSGST, note.SGSTAmount)
+		b.debit(&v, AccountOutputIGST, note.IGSTAmount)
+		b.debit(&v, AccountShipping, note.ShippingAmount)
+		b.credit(&v, AccountDebtors, note.TaxableAmount+note.CGSTAmount+note.SGSTAmount+note.IGSTAmount+note.ShippingAmount)
+		b.add(v)
+	}
+	return nil
+}
+
+// gatewayReceipts books each paid attempt to the gateway, less the fee it
+// kept.
+func (b *builder) gatewayReceipts() error {
+	var list []models.PaymentAttempt
+	if err := b.db.Where("status = ? AND paid_at >= ? AND paid_at < ?", "paid", b.start, b.end).Order("paid_at, id").Find(&list).Error; err != nil {
+		return err
+	}
+	for _, attempt := range list {
+		v := Voucher{
+			Date:      *attempt.PaidAt,
+			Type:      TypeReceipt,
+			Number:    fmt.Sprintf("PAY-%d", attempt.ID),
+			Reference: attempt.PaymentID,
+			Narration: fmt.Sprintf("%s payment %s for order %d", attempt.Gateway, attempt.PaymentID, attempt.OrderID),
+		}
+		b.debit(&v, AccountGateway, attempt.Amount-attempt.Fee)
+		b.debit(&v, AccountGatewayFees, attempt.Fee)
+		b.credit(&v, AccountDebtors, attempt.Amount)
+		b.add(v)
+	}
+	return nil
+}
+
+// cashReceipts books cash on delivery orders when they are marked paid,
+// for what the courier collected: the order less what was credited before.
+func (b *builder) cashReceipts() error {
+	var list []struct {
+		OrderID    uint
+		FinalPrice float64
+		PaidAt     time.Time
+	}
+	err := b.db.Table("order_status_histories").
+		Select("order_status_histories.order_id, orders.final_price, order_status_histories.created_at AS paid_at").
+		Joins("JOIN orders ON orders.id = order_status_histories.order_id").
+		Where("order_status_histories.field = ? AND order_status_histories.to_status = ? AND orders.payment_method = ?", "payment_status", "paid", "cash on delivery").
+		Where("order_status_histories.created_at >= ? AND order_status_histories.created_at < ?", b.start, b.end).
+		Where("order_status_histories.deleted_at IS NULL").
+		Order("order_status_histories.created_at").
+		Scan(&list).Error
+	if err != nil {
+		return err
+	}
+
+	for _, paid := range list {
+		var credited float64
+		err := b.db.Model(&models.CreditNote{}).Where("order_id = ? AND issued_at <= ?", paid.OrderID, paid.PaidAt).
+			Select("COALESCE(SUM(total_amount), 0)").Scan(&credited).Error
+		if err != nil {
+			return err
+		}
+
+		v := Voucher{
+			Date:      paid.PaidAt,
+			Type:      TypeReceipt,
+			Number:    fmt.Sprintf("COD-%d", paid.OrderID),
+			Reference: fmt.Sprintf("order %d", paid.OrderID),
+			Narration: fmt.Sprintf("Cash collected on delivery of order %d", paid.OrderID),
+		}
+		b.debit(&v, AccountCashOnDelivery, paid.FinalPrice-credited)
+		b.credit(&v, AccountDebtors, paid.FinalPrice-credited)
+		b.add(v)
+	}
+	return nil
+}
+
+// gatewayRefunds books the money paid back through the gateway. Refunds
+// to the wallet are in the wallet ledger, including failed gateway refunds
+// moved there.
+func (b *builder) gatewayRefunds() error {
+	var list []models.Refund
+	err := b.db.Where("status = ? AND method <> ? AND gateway_amount > 0", "processed", "wallet").
+		Where("processed_at >= ? AND processed_at < ?", b.start, b.end).
+		Order("processed_at, id").Find(&list).Error
+	if err != nil {
+		return err
+	}
+	for _, refund := range list {
+		v := Voucher{
+			Date:      *refund.ProcessedAt,
+			Type:      TypePayment,
+			Number:    fmt.Sprintf("RFD-%d", refund.ID),
+			Reference: refund.GatewayRefundID,
+			Narration: fmt.Sprintf("Refund for order %d through %s: %s", refund.OrderID, refund.Gateway, refund.Reason),
+		}
+		b.debit(&v, AccountDebtors, refund.GatewayAmount)
+		b.credit(&v, AccountGateway, refund.GatewayAmount)
+		b.add(v)
+	}
+	return nil
+}
+
+// wallet books the wallet ledger's transactions, with the entries of each
+// account netted.
+func (b *builder) wallet() error {
+	var list []models.LedgerTransaction
+	if err := b.db.Preload("Entries").Where("created_at >= ? AND created_at < ?", b.start, b.end).Order("created_at, id").Find(&list).Error; err != nil {
+		return err
+	}
+	for _, txn := range list {
+		v := Voucher{
+			Date:      txn.CreatedAt,
+			Type:      TypeJournal,
+			Number:    fmt.Sprintf("WAL-%d", txn.ID),
+			Narration: fmt.Sprintf("Wallet %s: %s", txn.Kind, txn.Memo),
+		}
+		if txn.OrderID != nil {
+			v.Reference = fmt.Sprintf("order %d", *txn.OrderID)
+		}
+
+		net := map[string]float64{}
+		var accounts []string
+		for _, entry := range txn.Entries {
+			account, ok := walletAccounts[entry.Account]
+			if !ok {
+				account = entry.Account
+			}
+			if _, seen := net[account]; !seen {
+				accounts = append(accounts, account)
+			}
+			net[account] += entry.Debit - entry.Credit
+		}
+		for _, account := range accounts {
+			if net[account] > 0 {
+				b.debit(&v, account, net[account])
+			} else {
+				b.credit(&v, account, -net[account])
+			}
+		}
+		b.add(v)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"kars/models"
+
+	"gorm.io/gorm"
+)
+
+// HoldWallet moves amount out of the user's wallet into the hold account
+// until the rest of the order is paid.
+func HoldWallet(tx *gorm.DB, userID, orderID uint, amount float64) error {
+	_, err := DebitWallet(tx, userID, amount, AccountWalletHolds, KindWalletHold, OrderRef(orderID), "held for online payment")
+	return err
+}
+
+// Held returns how much wallet money is still on hold for an order.
+func Held(tx *gorm.DB, orderID uint) (float64, error) {
+	var held float64
+	err := tx.Model(&models.LedgerEntry{}).
+		Select("COALESCE(SUM(ledger_entries.credit - ledger_entries.debit), 0)").
+		Joins("JOIN ledger_transactions ON ledger_transactions.id = ledger_entries.transaction_id").
+		Where("ledger_entries.account = ? AND ledger_transactions.order_id = ?", AccountWalletHolds, orderID).
+		Scan(&held).Error
+	return round(held), err
+}
+
+// CaptureHold turns an order's held wallet money into a sale.
+func CaptureHold(tx *gorm.DB, orderID uint) error {
+	held, err := Held(tx, orderID)
+	if err != nil || held <= 0 {
+		return err
+	}
+	_, err = Post(tx, KindHoldCapture, OrderRef(orderID), "online payment confirmed",
+		Leg{Account: AccountWalletHolds, Debit: held},
+		Leg{Account: AccountSales, Credit: held},
+	)
+	return err
+}
+
+// ReleaseHold returns an order's held wallet money to the user's wallet.
+func ReleaseHold(tx *gorm.DB, userID, orderID uint, memo string) error {
+	held, err := Held(tx, orderID)
+	if err != nil || held <= 0 {
+		return err
+	}
+	_, err = CreditWallet(tx, userID, held, AccountWalletHolds, KindHoldRelease, OrderRef(orderID), memo)
+	return err
+}
+
+// ReleaseHoldAmount returns amount of an order's held wallet money to the
+// user's wallet, for an order that comes to need less of it.
+func ReleaseHoldAmount(tx *gorm.DB, userID, orderID uint, amount float64, memo string) error {
+	if amount = round(amount); amount <= 0 {
+		return nil
+	}
+	_, err := CreditWallet(tx, userID, amount, AccountWalletHolds, KindHoldRelease, OrderRef(orderID), memo)
+	return err
+}
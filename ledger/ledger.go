@@ -0,0 +1,208 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"kars/models"
+	"math"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Accounts. The wallet account holds what the shop owes its customers, so a
+// credit raises a wallet balance and a debit lowers it.
+const (
+	AccountWallet  = "wallet"
+	AccountSales   = "sales"
+	AccountRefunds = "refunds"
+	AccountGateway = "gateway"
+	// AccountWalletHolds carries wallet money set aside for an order whose
+	// online part has not been paid yet.
+	AccountWalletHolds = "wallet_holds"
+	AccountOpening     = "opening_balance"
+)
+
+// Transaction kinds.
+const (
+	KindOrderPayment   = "order_payment"
+	KindRefund         = "refund"
+	KindTopUp          = "top_up"
+	KindWalletHold     = "wallet_hold"
+	KindHoldCapture    = "hold_capture"
+	KindHoldRelease    = "hold_release"
+	KindOpeningBalance = "opening_balance"
+)
+
+var (
+	ErrUnbalanced          = errors.New("ledger transaction is not balanced")
+	ErrInvalidAmount       = errors.New("ledger amount must be positive")
+	ErrWalletNotFound      = errors.New("wallet not found")
+	ErrInsufficientBalance = errors.New("insufficient wallet balance")
+)
+
+// Ref points a ledger transaction at the record that caused it.
+type Ref struct {
+	OrderID  *uint
+	RefundID *uint
+	TopUpID  *uint
+}
+
+func OrderRef(orderID uint) Ref {
+	return Ref{OrderID: &orderID}
+}
+
+func TopUpRef(topUpID uint) Ref {
+	return Ref{TopUpID: &topUpID}
+}
+
+// Leg is one side of a posting. WalletID must be set on wallet legs.
+type Leg struct {
+	Account  string
+	WalletID *uint
+	Debit    float64
+	Credit   float64
+}
+
+func round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Post writes a balanced transaction and moves the cached balance of every
+// wallet it touches. Callers must hold the lock on those wallets; the
+// helpers below take it for them.
+func Post(tx *gorm.DB, kind string, ref Ref, memo string, legs ...Leg) (models.LedgerTransaction, error) {
+	txn, err := postEntries(tx, kind, ref, memo, legs)
+	if err != nil {
+		return txn, err
+	}
+
+	for _, leg := range legs {
+		if leg.WalletID == nil {
+			continue
+		}
+		err := tx.Model(&models.Wallet{}).Where("id = ?", *leg.WalletID).
+			Update("total_amount", gorm.Expr("total_amount + ? - ?", leg.Credit, leg.Debit)).Error
+		if err != nil {
+			return models.LedgerTransaction{}, err
+		}
+	}
+	return txn, nil
+}
+
+func postEntries(tx *gorm.DB, kind string, ref Ref, memo string, legs []Leg) (models.LedgerTransaction, error) {
+	var debits, credits float64
+	for i := range legs {
+		legs[i].Debit = round(legs[i].Debit)
+		legs[i].Credit = round(legs[i].Credit)
+		if legs[i].Debit < 0 || legs[i].Credit < 0 {
+			return models.LedgerTransaction{}, ErrInvalidAmount
+		}
+		if legs[i].Account == AccountWallet && legs[i].WalletID == nil {
+			return models.LedgerTransaction{}, fmt.Errorf("wallet leg without a wallet id")
+		}
+		debits += legs[i].Debit
+		credits += legs[i].Credit
+	}
+	if len(legs) < 2 || round(debits) != round(credits) || round(debits) == 0 {
+		return models.LedgerTransaction{}, ErrUnbalanced
+	}
+
+	txn := models.LedgerTransaction{
+		Kind:     kind,
+		OrderID:  ref.OrderID,
+		RefundID: ref.RefundID,
+		TopUpID:  ref.TopUpID,
+		Memo:     memo,
+	}
+	for _, leg := range legs {
+		txn.Entries = append(txn.Entries, models.LedgerEntry{
+			Account:  leg.Account,
+			WalletID: leg.WalletID,
+			Debit:    leg.Debit,
+			Credit:   leg.Credit,
+		})
+	}
+	if err := tx.Create(&txn).Error; err != nil {
+		return models.LedgerTransaction{}, err
+	}
+	return txn, nil
+}
+
+// LockWallet loads the user's wallet FOR UPDATE. With create set, a missing
+// wallet is created instead of returning ErrWalletNotFound.
+func LockWallet(tx *gorm.DB, userID uint, create bool) (models.Wallet, error) {
+	var wallet models.Wallet
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id").First(&wallet, "user_id = ?", userID).Error
+	if err == nil {
+		return wallet, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return wallet, err
+	}
+	if !create {
+		return wallet, ErrWalletNotFound
+	}
+	wallet = models.Wallet{UserID: userID}
+	err = tx.Create(&wallet).Error
+	return wallet, err
+}
+
+// CreditWallet moves amount from the given account into the user's wallet,
+// creating the wallet on its first credit.
+func CreditWallet(tx *gorm.DB, userID uint, amount float64, from, kind string, ref Ref, memo string) (models.LedgerTransaction, error) {
+	if round(amount) <= 0 {
+		return models.LedgerTransaction{}, ErrInvalidAmount
+	}
+	wallet, err := LockWallet(tx, userID, true)
+	if err != nil {
+		return models.LedgerTransaction{}, err
+	}
+	return Post(tx, kind, ref, memo,
+		Leg{Account: from, Debit: amount},
+		Leg{Account: AccountWallet, WalletID: &wallet.ID, Credit: amount},
+	)
+}
+
+// DebitWallet moves amount out of the user's wallet into the given account.
+// It fails with ErrInsufficientBalance rather than overdrawing the wallet.
+func DebitWallet(tx *gorm.DB, userID uint, amount float64, to, kind string, ref Ref, memo string) (models.LedgerTransaction, error) {
+	if round(amount) <= 0 {
+		return models.LedgerTransaction{}, ErrInvalidAmount
+	}
+	wallet, err := LockWallet(tx, userID, false)
+	if err != nil {
+		return models.LedgerTransaction{}, err
+	}
+	if round(wallet.TotalAmount) < round(amount) {
+		return models.LedgerTransaction{}, ErrInsufficientBalance
+	}
+	return Post(tx, kind, ref, memo,
+		Leg{Account: AccountWallet, WalletID: &wallet.ID, Debit: amount},
+		Leg{Account: to, Credit: amount},
+	)
+}
+
+// Balance computes a wallet's balance from its entries.
+func Balance(db *gorm.DB, walletID uint) (float64, error) {
+	var balance float64
+	err := db.Model(&models.LedgerEntry{}).
+		Select("COALESCE(SUM(credit - debit), 0)").
+		Where("account = ? AND wallet_id = ?", AccountWallet, walletID).
+		Scan(&balance).Error
+	return round(balance), err
+}
+
+// Entries returns a wallet's entries with their transactions, newest first.
+func Entries(db *gorm.DB, walletID uint) ([]WalletEntry, error) {
+	var entries []WalletEntry
+	err := db.Table("ledger_entries").
+		Select("ledger_entries.id, ledger_entries.created_at, ledger_entries.debit, ledger_entries.credit, "+
+			"ledger_transactions.id AS transaction_id, ledger_transactions.kind, ledger_transactions.order_id, "+
+			"ledger_transactions.refund_id, ledger_transactions.top_up_id, ledger_transactions.memo").
+		Joins("JOIN ledger_transactions ON ledger_transactions.id = ledger_entries.transaction_id").
+		Where("ledger_entries.account = ? AND ledger_entries.wallet_id = ? AND ledger_entries.deleted_at IS NULL", AccountWallet, walletID).
+		Order("ledger_entries.id DESC").
+		Scan(&entries).Error
+	return entries, err
+}
@@ -0,0 +1,185 @@
+package ledger
+
+import (
+	"fmt"
+	"kars/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type WalletEntry struct {
+	ID            uint      `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	TransactionID uint      `json:"transaction_id"`
+	Kind          string    `json:"kind"`
+	OrderID       *uint     `json:"order_id"`
+	RefundID      *uint     `json:"refund_id"`
+	TopUpID       *uint     `json:"top_up_id"`
+	Memo          string    `json:"memo"`
+	Debit         float64   `json:"debit"`
+	Credit        float64   `json:"credit"`
+}
+
+// Drift is a wallet whose cached balance disagrees with its entries.
+type Drift struct {
+	WalletID      uint    `json:"wallet_id"`
+	UserID        uint    `json:"user_id"`
+	CachedBalance float64 `json:"cached_balance"`
+	LedgerBalance float64 `json:"ledger_balance"`
+	Difference    float64 `json:"difference"`
+}
+
+// Unbalanced is a transaction whose debits and credits do not match.
+type Unbalanced struct {
+	TransactionID uint    `json:"transaction_id"`
+	Debits        float64 `json:"debits"`
+	Credits       float64 `json:"credits"`
+}
+
+type Report struct {
+	WalletsChecked int          `json:"wallets_checked"`
+	Drifted        []Drift      `json:"drifted"`
+	Unbalanced     []Unbalanced `json:"unbalanced"`
+}
+
+// Reconcile compares every wallet's cached balance with the sum of its
+// entries and checks that every transaction balances.
+func Reconcile(db *gorm.DB) (Report, error) {
+	var report Report
+
+	var rows []struct {
+		WalletID      uint
+		UserID        uint
+		CachedBalance float64
+		LedgerBalance float64
+	}
+	err := db.Table("wallets").
+		Select("wallets.id AS wallet_id, wallets.user_id, wallets.total_amount AS cached_balance, "+
+			"COALESCE(SUM(ledger_entries.credit - ledger_entries.debit), 0) AS ledger_balance").
+		Joins("LEFT JOIN ledger_entries ON ledger_entries.wallet_id = wallets.id AND ledger_entries.account = ? AND ledger_entries.deleted_at IS NULL", AccountWallet).
+		Where("wallets.deleted_at IS NULL").
+		Group("wallets.id").
+		Order("wallets.id").
+		Scan(&rows).Error
+	if err != nil {
+		return report, err
+	}
+
+	report.WalletsChecked = len(rows)
+	report.Drifted = []Drift{}
+	for _, row := range rows {
+		diff := round(row.CachedBalance - row.LedgerBalance)
+		if diff == 0 {
+			continue
+		}
+		report.Drifted = append(report.Drifted, Drift{
+			WalletID:      row.WalletID,
+			UserID:        row.UserID,
+			CachedBalance: round(row.CachedBalance),
+			LedgerBalance: round(row.LedgerBalance),
+			Difference:    diff,
+		})
+	}
+
+	report.Unbalanced = []Unbalanced{}
+	err = db.Model(&models.LedgerEntry{}).
+		Select("transaction_id, SUM(debit) AS debits, SUM(credit) AS credits").
+		Group("transaction_id").
+		Having("ROUND(CAST(SUM(debit) - SUM(credit) AS numeric), 2) <> 0").
+		Scan(&report.Unbalanced).Error
+	return report, err
+}
+
+// OpenBalances gives every wallet that has no entries yet, which is the
+// state wallets were left in before the ledger existed, entries for its
+// balance. Each row of the wallet's old history becomes an entry against
+// the opening balance account, and whatever of the balance the history does
+// not explain is posted after them. It is safe to run on every start, from
+// any number of servers at once.
+func OpenBalances(db *gorm.DB) error {
+	hasHistory := db.Migrator().HasTable(&models.WalletHistory{})
+	unopened := db.Where("NOT EXISTS (?)",
+		db.Model(&models.LedgerEntry{}).Select("1").Where("ledger_entries.wallet_id = wallets.id"),
+	)
+	if hasHistory {
+		unopened = unopened.Where("total_amount <> 0 OR EXISTS (?)",
+			db.Model(&models.WalletHistory{}).Select("1").Where("wallet_histories.wallet_id = wallets.id"),
+		)
+	} else {
+		unopened = unopened.Where("total_amount <> 0")
+	}
+
+	var wallets []models.Wallet
+	if err := unopened.Find(&wallets).Error; err != nil {
+		return err
+	}
+
+	for _, wallet := range wallets {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Another server may have opened the wallet, or the wallet
+			// may have been used, since it was listed.
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&wallet, wallet.ID).Error; err != nil {
+				return err
+			}
+			var entries int64
+			if err := tx.Model(&models.LedgerEntry{}).Where("wallet_id = ?", wallet.ID).Count(&entries).Error; err != nil {
+				return err
+			}
+			if entries > 0 {
+				return nil
+			}
+
+			var history []models.WalletHistory
+			if hasHistory {
+				if err := tx.Where("wallet_id = ?", wallet.ID).Order("id").Find(&history).Error; err != nil {
+					return err
+				}
+			}
+
+			var explained float64
+			for _, row := range history {
+				amount := round(row.Amount)
+				if row.Type == "debit" {
+					amount = -amount
+				}
+				if amount == 0 {
+					continue
+				}
+				if err := openingEntry(tx, wallet.ID, amount, fmt.Sprintf("wallet history %d: %s", row.ID, row.Type)); err != nil {
+					return err
+				}
+				explained += amount
+			}
+
+			// The cached balance already holds these amounts, so the
+			// entries are written without moving it again.
+			if rest := round(wallet.TotalAmount - explained); rest != 0 {
+				return openingEntry(tx, wallet.ID, rest, "balance before ledger")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openingEntry records amount, positive for money into the wallet, against
+// the opening balance account without touching the cached balance.
+func openingEntry(tx *gorm.DB, walletID uint, amount float64, memo string) error {
+	legs := []Leg{
+		{Account: AccountOpening, Debit: amount},
+		{Account: AccountWallet, WalletID: &walletID, Credit: amount},
+	}
+	if amount < 0 {
+		legs = []Leg{
+			{Account: AccountWallet, WalletID: &walletID, Debit: -amount},
+			{Account: AccountOpening, Credit: -amount},
+		}
+	}
+	_, err := postEntries(tx, KindOpeningBalance, Ref{}, memo, legs)
+	return err
+}
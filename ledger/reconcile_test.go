@@ -0,0 +1,74 @@
+package ledger
+
+import (
+	"kars/models"
+	"os"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB opens the PostgreSQL database in TEST_DB_DSN, as the controller
+// tests do, and skips the test without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Wallet{}, &models.WalletHistory{}, &models.LedgerTransaction{}, &models.LedgerEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Servers starting together open a wallet once, from its old history.
+func TestOpenBalances(t *testing.T) {
+	db := testDB(t)
+	wallet := models.Wallet{UserID: 0, TotalAmount: 150}
+	if err := db.Create(&wallet).Error; err != nil {
+		t.Fatal(err)
+	}
+	history := []models.WalletHistory{
+		{WalletID: wallet.ID, Type: "credit", Amount: 200},
+		{WalletID: wallet.ID, Type: "debit", Amount: 80},
+	}
+	if err := db.Create(&history).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = OpenBalances(db)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Entries(db, wallet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two history rows and the ₹30 they do not explain.
+	if len(entries) != 3 {
+		t.Errorf("got %d wallet entries, want 3", len(entries))
+	}
+	if balance, err := Balance(db, wallet.ID); err != nil || balance != 150 {
+		t.Errorf("ledger balance = %v (%v), want 150", balance, err)
+	}
+}
@@ -0,0 +1,183 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"kars/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Order statuses.
+const (
+	OrderPending        = "pending"
+	OrderPlaced         = "placed"
+	OrderShipped        = "shipped"
+	OrderOutForDelivery = "out for delivery"
+	OrderDelivered      = "delivered"
+	OrderCancelled      = "cancelled"
+	OrderReturned       = "returned"
+)
+
+// Payment statuses.
+const (
+	PaymentPending   = "pending"
+	PaymentPaid      = "paid"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded"
+	PaymentCancelled = "cancelled"
+)
+
+const (
+	fieldOrderStatus   = "order_status"
+	fieldPaymentStatus = "payment_status"
+)
+
+// ActorSystem is recorded for changes made by the application itself,
+// such as gateway callbacks.
+const ActorSystem = "system"
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+var orderTransitions = map[string][]string{
+	OrderPending:        {OrderPlaced, OrderCancelled},
+	OrderPlaced:         {OrderShipped, OrderCancelled},
+	OrderShipped:        {OrderOutForDelivery, OrderDelivered},
+	OrderOutForDelivery: {OrderDelivered},
+	OrderDelivered:      {OrderReturned},
+}
+
+var paymentTransitions = map[string][]string{
+	PaymentPending: {PaymentPaid, PaymentFailed, PaymentCancelled},
+	PaymentFailed:  {PaymentPaid, PaymentPending, PaymentCancelled},
+	PaymentPaid:    {PaymentRefunded},
+}
+
+func UserActor(userID interface{}) string {
+	return fmt.Sprintf("user:%v", userID)
+}
+
+func AdminActor(adminID interface{}) string {
+	return fmt.Sprintf("admin:%v", adminID)
+}
+
+func CourierActor(carrier string) string {
+	return "courier:" + carrier
+}
+
+// normalize tolerates legacy rows such as "paid " written before the
+// statuses were centralised here.
+func normalize(status string) string {
+	return strings.TrimSpace(status)
+}
+
+func allowed(transitions map[string][]string, from, to string) bool {
+	for _, next := range transitions[normalize(from)] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func CanTransitionOrder(from, to string) bool {
+	return allowed(orderTransitions, from, to)
+}
+
+func CanTransitionPayment(from, to string) bool {
+	return allowed(paymentTransitions, from, to)
+}
+
+// IsOrderStatus reports whether status is one of the known order statuses.
+func IsOrderStatus(status string) bool {
+	switch status {
+	case OrderPending, OrderPlaced, OrderShipped, OrderOutForDelivery, OrderDelivered, OrderCancelled, OrderReturned:
+		return true
+	}
+	return false
+}
+
+// TransitionOrder moves order to the given order status and records the
+// change. The update is conditional on the status the caller read, so a
+// concurrent change makes it fail with ErrInvalidTransition.
+func TransitionOrder(tx *gorm.DB, order *models.Order, to, actor, reason string) error {
+	return transition(tx, order, fieldOrderStatus, orderTransitions, &order.OrderStatus, to, actor, reason)
+}
+
+// TransitionPayment is TransitionOrder for the payment status.
+func TransitionPayment(tx *gorm.DB, order *models.Order, to, actor, reason string) error {
+	return transition(tx, order, fieldPaymentStatus, paymentTransitions, &order.PaymentStatus, to, actor, reason)
+}
+
+// CheckOrder returns the error TransitionOrder would return for an invalid
+// move, without changing anything.
+func CheckOrder(order *models.Order, to string) error {
+	return check(order, fieldOrderStatus, orderTransitions, order.OrderStatus, to)
+}
+
+func check(order *models.Order, field string, transitions map[string][]string, from, to string) error {
+	if !allowed(transitions, from, to) {
+		return fmt.Errorf("%w: %s of order %d cannot change from %q to %q", ErrInvalidTransition, strings.ReplaceAll(field, "_", " "), order.ID, normalize(from), to)
+	}
+	return nil
+}
+
+func transition(tx *gorm.DB, order *models.Order, field string, transitions map[string][]string, current *string, to, actor, reason string) error {
+	from := *current
+	if err := check(order, field, transitions, from, to); err != nil {
+		return err
+	}
+
+	result := tx.Model(&models.Order{}).Where("id = ? AND "+field+" = ?", order.ID, from).Update(field, to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s of order %d changed concurrently", ErrInvalidTransition, strings.ReplaceAll(field, "_", " "), order.ID)
+	}
+
+	*current = to
+	return record(tx, order.ID, field, normalize(from), to, actor, reason)
+}
+
+// RecordCreated writes the initial history rows for a newly created order.
+func RecordCreated(tx *gorm.DB, order *models.Order, actor string) error {
+	if err := record(tx, order.ID, fieldOrderStatus, "", order.OrderStatus, actor, "order created"); err != nil {
+		return err
+	}
+	return record(tx, order.ID, fieldPaymentStatus, "", order.PaymentStatus, actor, "order created")
+}
+
+func record(tx *gorm.DB, orderID uint, field, from, to, actor, reason string) error {
+	history := models.OrderStatusHistory{
+		OrderID:    orderID,
+		Field:      field,
+		FromStatus: from,
+		ToStatus:   to,
+		Actor:      actor,
+		Reason:     reason,
+	}
+	return tx.Create(&history).Error
+}
+
+// History returns the status changes of an order, oldest first.
+func History(db *gorm.DB, orderID uint) ([]models.OrderStatusHistory, error) {
+	var history []models.OrderStatusHistory
+	err := db.Where("order_id = ?", orderID).Order("created_at, id").Find(&history).Error
+	return history, err
+}
+
+// ReachedAt returns when an order last moved to the given order status.
+// Orders that changed status before history was recorded fall back to
+// their last update.
+func ReachedAt(db *gorm.DB, order *models.Order, status string) time.Time {
+	var history models.OrderStatusHistory
+	err := db.Where("order_id = ? AND field = ? AND to_status = ?", order.ID, fieldOrderStatus, status).
+		Order("created_at DESC").First(&history).Error
+	if err != nil {
+		return order.UpdatedAt
+	}
+	return history.CreatedAt
+}
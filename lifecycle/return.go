@@ -0,0 +1,54 @@
+package lifecycle
+
+import (
+	"fmt"
+	"kars/models"
+
+	"gorm.io/gorm"
+)
+
+// Return request statuses.
+const (
+	ReturnRequested       = "requested"
+	ReturnApproved        = "approved"
+	ReturnRejected        = "rejected"
+	ReturnPickupScheduled = "pickup scheduled"
+	ReturnReceived        = "received"
+	ReturnCompleted       = "completed"
+)
+
+var returnTransitions = map[string][]string{
+	ReturnRequested:       {ReturnApproved, ReturnRejected},
+	ReturnApproved:        {ReturnPickupScheduled},
+	ReturnPickupScheduled: {ReturnReceived, ReturnPickupScheduled},
+	ReturnReceived:        {ReturnCompleted},
+}
+
+func CanTransitionReturn(from, to string) bool {
+	return allowed(returnTransitions, from, to)
+}
+
+// IsOpenReturn reports whether a return request still holds its items.
+func IsOpenReturn(status string) bool {
+	return status != ReturnRejected && status != ReturnCompleted
+}
+
+// TransitionReturn moves a return request to the given status. Like
+// TransitionOrder it fails with ErrInvalidTransition when the move is not
+// allowed or the request changed concurrently.
+func TransitionReturn(tx *gorm.DB, request *models.ReturnRequest, to string) error {
+	if !CanTransitionReturn(request.Status, to) {
+		return fmt.Errorf("%w: return request %d cannot change from %q to %q", ErrInvalidTransition, request.ID, request.Status, to)
+	}
+
+	result := tx.Model(&models.ReturnRequest{}).Where("id = ? AND status = ?", request.ID, request.Status).Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: return request %d changed concurrently", ErrInvalidTransition, request.ID)
+	}
+
+	request.Status = to
+	return nil
+}
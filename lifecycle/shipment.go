@@ -0,0 +1,120 @@
+package lifecycle
+
+import (
+	"fmt"
+	"kars/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Shipment statuses.
+const (
+	ShipmentCreated        = "created"
+	ShipmentInTransit      = "in transit"
+	ShipmentOutForDelivery = "out for delivery"
+	ShipmentDeliveryFailed = "delivery failed"
+	ShipmentDelivered      = "delivered"
+)
+
+var shipmentTransitions = map[string][]string{
+	ShipmentCreated:        {ShipmentInTransit},
+	ShipmentInTransit:      {ShipmentOutForDelivery, ShipmentDelivered},
+	ShipmentOutForDelivery: {ShipmentDelivered, ShipmentDeliveryFailed},
+	ShipmentDeliveryFailed: {ShipmentOutForDelivery, ShipmentInTransit},
+}
+
+func CanTransitionShipment(from, to string) bool {
+	return allowed(shipmentTransitions, from, to)
+}
+
+func IsShipmentStatus(status string) bool {
+	switch status {
+	case ShipmentCreated, ShipmentInTransit, ShipmentOutForDelivery, ShipmentDeliveryFailed, ShipmentDelivered:
+		return true
+	}
+	return false
+}
+
+// TransitionShipment moves a shipment to the given status, stamping the
+// dispatch and delivery times. at is when the change happened.
+func TransitionShipment(tx *gorm.DB, shipment *models.Shipment, to string, at time.Time) error {
+	if !CanTransitionShipment(shipment.Status, to) {
+		return fmt.Errorf("%w: shipment %d cannot change from %q to %q", ErrInvalidTransition, shipment.ID, shipment.Status, to)
+	}
+
+	updates := map[string]interface{}{"status": to}
+	if shipment.ShippedAt == nil && to != ShipmentCreated {
+		updates["shipped_at"] = at
+		shipment.ShippedAt = &at
+	}
+	if to == ShipmentDelivered {
+		updates["delivered_at"] = at
+		shipment.DeliveredAt = &at
+	}
+
+	result := tx.Model(&models.Shipment{}).Where("id = ? AND status = ?", shipment.ID, shipment.Status).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: shipment %d changed concurrently", ErrInvalidTransition, shipment.ID)
+	}
+
+	shipment.Status = to
+	return nil
+}
+
+// ShipmentRollUp is the order status implied by the state of its shipments:
+// shipped once any parcel has left, out for delivery or delivered once every
+// unit has left and every parcel is out for delivery or delivered. It returns
+// "" while nothing has been dispatched.
+func ShipmentRollUp(shipments []models.Shipment, units, dispatchedUnits int) string {
+	dispatched, delivered, outForDelivery := 0, 0, 0
+	for _, shipment := range shipments {
+		switch shipment.Status {
+		case ShipmentCreated:
+			continue
+		case ShipmentDelivered:
+			delivered++
+		case ShipmentOutForDelivery:
+			outForDelivery++
+		}
+		dispatched++
+	}
+
+	switch {
+	case dispatched == 0:
+		return ""
+	case dispatchedUnits < units:
+		return OrderShipped
+	case delivered == dispatched:
+		return OrderDelivered
+	case delivered+outForDelivery == dispatched:
+		return OrderOutForDelivery
+	}
+	return OrderShipped
+}
+
+var orderRank = map[string]int{
+	OrderPlaced:         1,
+	OrderShipped:        2,
+	OrderOutForDelivery: 3,
+	OrderDelivered:      4,
+}
+
+// AdvanceOrder moves an order forward to status through the fulfilment
+// statuses in between. It never moves an order backwards, so a late carrier
+// scan cannot undo a delivery.
+func AdvanceOrder(tx *gorm.DB, order *models.Order, status, actor, reason string) error {
+	for orderRank[normalize(order.OrderStatus)] < orderRank[status] && orderRank[normalize(order.OrderStatus)] > 0 {
+		next := status
+		if !CanTransitionOrder(order.OrderStatus, next) {
+			next = OrderShipped
+		}
+		if err := TransitionOrder(tx, order, next, actor, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"kars/couriers"
 	"kars/database"
+	"kars/ledger"
+	"kars/payments"
 	"kars/routes"
+	"kars/shipping"
 	"kars/utils"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 )
 
 func main() {
 	utils.Init()
 	database.ConnectDB()
 	database.MigrateModels()
+	if err := ledger.OpenBalances(database.DB); err != nil {
+		log.Fatal("Failed to open wallet ledger balances:", err)
+	}
+	if err := shipping.SeedDefaults(database.DB); err != nil {
+		log.Fatal("Failed to seed shipping rules:", err)
+	}
+	payments.Init()
+	couriers.Init()
 	app := fiber.New()
+	// Handlers roll their transactions back and re-panic; the panic ends
+	// up here as a 500 instead of taking the server down.
+	app.Use(recover.New())
 	routes.Routes(app)
 	if err := app.Listen("0.0.0.0:3000"); err != nil {
 		log.Fatal("Failed to start the server:", err)
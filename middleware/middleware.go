@@ -135,5 +135,7 @@ func AdminMiddleware(c *fiber.Ctx) error {
 		})
 	}
 
+	c.Locals("admin_id", claims["admin_id"])
+
 	return c.Next()
 }
@@ -16,5 +16,6 @@ type Address struct {
 	PostalCode   string `gorm:"not null"`
 	Country      string `gorm:"not null"`
 	LandMark     string
-	AddressType  string `gorm:"not null"` // Could be 'shipping', 'billing', etc.
+	AddressType  string `gorm:"not null"`               // Could be 'shipping', 'billing', etc.
+	IsDefault    bool   `gorm:"not null;default:false"` // Used for delivery estimates
 }
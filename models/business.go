@@ -0,0 +1,17 @@
+package models
+
+import "gorm.io/gorm"
+
+// BusinessProfile is a user's GST registration. Orders placed with a B2B
+// invoice are billed to it.
+type BusinessProfile struct {
+	gorm.Model
+	UserID       uint   `json:"user_id" gorm:"uniqueIndex"`
+	GSTIN        string `json:"gstin" gorm:"type:varchar(15);index"`
+	LegalName    string `json:"legal_name"`
+	AddressLine1 string `json:"address_line1"`
+	AddressLine2 string `json:"address_line2"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+	PostalCode   string `json:"postal_code" gorm:"type:varchar(6)"`
+}
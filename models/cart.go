@@ -19,4 +19,8 @@ type CartItem struct {
 	ProductPrice float64 `json:"product_price"`
 	TotalPrice   float64 `json:"total_price"` // Using float64 for decimal values
 	Quantity     int     `json:"quantity"`
+
+	// Set when a variant of the product was chosen.
+	VariantID *uint  `json:"variant_id" gorm:"index"`
+	SKU       string `json:"sku"`
 }
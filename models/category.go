@@ -11,4 +11,11 @@ type Category struct {
 	OfferType    string    `gorm:"type:varchar(10);default:null" json:"offer_type"`
 	OfferValue   float64   `gorm:"type:decimal;default:0" json:"offer_value"`
 	Products     []Product `gorm:"foreignKey:CategoryID" json:"products"`
+	// ReturnWindowDays is how long after delivery products of this category
+	// can be returned; 0 makes them non-returnable.
+	ReturnWindowDays int `gorm:"not null;default:7" json:"return_window_days"`
+	// GST applied to the category's products unless a product overrides it.
+	HSNCode          string  `gorm:"type:varchar(8)" json:"hsn_code"`
+	GSTRate          float64 `gorm:"not null;default:18" json:"gst_rate"`
+	PricesIncludeTax bool    `gorm:"not null;default:true" json:"prices_include_tax"`
 }
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DocumentSequence is the last number issued in a series of tax documents.
+// It is only advanced in the transaction that stores the document, so a
+// rolled back document gives its number back.
+type DocumentSequence struct {
+	Series    string `gorm:"primaryKey;type:varchar(30)"`
+	Last      int
+	UpdatedAt time.Time
+}
+
+// Invoice is the tax invoice of an order. It is frozen once issued; later
+// changes to the order are made with credit notes against it.
+type Invoice struct {
+	gorm.Model
+	OrderID        uint          `json:"order_id" gorm:"uniqueIndex"`
+	UserID         uint          `json:"user_id" gorm:"index"`
+	Number         string        `json:"number" gorm:"type:varchar(30);uniqueIndex"`
+	FinancialYear  string        `json:"financial_year" gorm:"type:varchar(7);index"`
+	IssuedAt       time.Time     `json:"issued_at"`
+	PlaceOfSupply  string        `json:"place_of_supply"`
+	TaxableAmount  float64       `json:"taxable_amount" gorm:"type:decimal(10,2)"`
+	CGSTAmount     float64       `json:"cgst_amount" gorm:"type:decimal(10,2)"`
+	SGSTAmount     float64       `json:"sgst_amount" gorm:"type:decimal(10,2)"`
+	IGSTAmount     float64       `json:"igst_amount" gorm:"type:decimal(10,2)"`
+	ShippingAmount float64       `json:"shipping_amount" gorm:"type:decimal(10,2)"`
+	DiscountAmount float64       `json:"discount_amount" gorm:"type:decimal(10,2)"`
+	TotalAmount    float64       `json:"total_amount" gorm:"type:decimal(10,2)"`
+	Document       []byte        `json:"-"`
+	Lines          []InvoiceLine `json:"lines" gorm:"foreignKey:InvoiceID"`
+
+	// GST on the shipping charge, whose taxable value is ShippingAmount.
+	// The GST amounts above include it; TaxableAmount is the lines' alone.
+	ShippingGSTRate float64 `json:"shipping_gst_rate"`
+	ShippingCGST    float64 `json:"shipping_cgst" gorm:"type:decimal(10,2)"`
+	ShippingSGST    float64 `json:"shipping_sgst" gorm:"type:decimal(10,2)"`
+	ShippingIGST    float64 `json:"shipping_igst" gorm:"type:decimal(10,2)"`
+
+	// The buyer's registration on a B2B invoice.
+	BuyerGSTIN          string `json:"buyer_gstin" gorm:"type:varchar(15);index"`
+	BuyerLegalName      string `json:"buyer_legal_name"`
+	BuyerBillingAddress string `json:"buyer_billing_address"`
+}
+
+// InvoiceLine is one order item as invoiced. Amount is the line before the
+// coupon discount; the taxable value and GST are after it.
+type InvoiceLine struct {
+	gorm.Model
+	InvoiceID    uint    `json:"invoice_id" gorm:"index"`
+	OrderItemID  uint    `json:"order_item_id"`
+	ProductName  string  `json:"product_name"`
+	HSNCode      string  `json:"hsn_code" gorm:"type:varchar(8)"`
+	Quantity     int     `json:"quantity"`
+	UnitPrice    float64 `json:"unit_price" gorm:"type:decimal(10,2)"`
+	GSTRate      float64 `json:"gst_rate"`
+	TaxableValue float64 `json:"taxable_value" gorm:"type:decimal(10,2)"`
+	CGST         float64 `json:"cgst" gorm:"type:decimal(10,2)"`
+	SGST         float64 `json:"sgst" gorm:"type:decimal(10,2)"`
+	IGST         float64 `json:"igst" gorm:"type:decimal(10,2)"`
+	Amount       float64 `json:"amount" gorm:"type:decimal(10,2)"`
+}
+
+// CreditNote reduces an issued invoice for cancelled or returned units, and
+// for the shipping charge when the whole order is cancelled.
+type CreditNote struct {
+	gorm.Model
+	InvoiceID       uint             `json:"invoice_id" gorm:"index"`
+	OrderID         uint             `json:"order_id" gorm:"index"`
+	UserID          uint             `json:"user_id" gorm:"index"`
+	Number          string           `json:"number" gorm:"type:varchar(30);uniqueIndex"`
+	FinancialYear   string           `json:"financial_year" gorm:"type:varchar(7);index"`
+	IssuedAt        time.Time        `json:"issued_at"`
+	Reason          string           `json:"reason"`
+	ReturnRequestID *uint            `json:"return_request_id" gorm:"index"`
+	PlaceOfSupply   string           `json:"place_of_supply"`
+	TaxableAmount   float64          `json:"taxable_amount" gorm:"type:decimal(10,2)"`
+	CGSTAmount      float64          `json:"cgst_amount" gorm:"type:decimal(10,2)"`
+	SGSTAmount      float64          `json:"sgst_amount" gorm:"type:decimal(10,2)"`
+	IGSTAmount      float64          `json:"igst_amount" gorm:"type:decimal(10,2)"`
+	ShippingAmount  float64          `json:"shipping_amount" gorm:"type:decimal(10,2)"`
+	TotalAmount     float64          `json:"total_amount" gorm:"type:decimal(10,2)"`
+	Document        []byte           `json:"-"`
+	Lines           []CreditNoteLine `json:"lines" gorm:"foreignKey:CreditNoteID"`
+
+	// GST on the shipping credited, as on the invoice.
+	ShippingGSTRate float64 `json:"shipping_gst_rate"`
+	ShippingCGST    float64 `json:"shipping_cgst" gorm:"type:decimal(10,2)"`
+	ShippingSGST    float64 `json:"shipping_sgst" gorm:"type:decimal(10,2)"`
+	ShippingIGST    float64 `json:"shipping_igst" gorm:"type:decimal(10,2)"`
+}
+
+// CreditNoteLine is a number of units of an order item credited back.
+// Amount is the taxable value plus GST.
+type CreditNoteLine struct {
+	gorm.Model
+	CreditNoteID uint    `json:"credit_note_id" gorm:"index"`
+	OrderItemID  uint    `json:"order_item_id" gorm:"index"`
+	ProductName  string  `json:"product_name"`
+	HSNCode      string  `json:"hsn_code" gorm:"type:varchar(8)"`
+	Quantity     int     `json:"quantity"`
+	GSTRate      float64 `json:"gst_rate"`
+	TaxableValue float64 `json:"taxable_value" gorm:"type:decimal(10,2)"`
+	CGST         float64 `json:"cgst" gorm:"type:decimal(10,2)"`
+	SGST         float64 `json:"sgst" gorm:"type:decimal(10,2)"`
+	IGST         float64 `json:"igst" gorm:"type:decimal(10,2)"`
+	Amount       float64 `json:"amount" gorm:"type:decimal(10,2)"`
+}
+
+var ErrDocumentIssued = errors.New("issued invoices and credit notes cannot be modified")
+
+func (Invoice) BeforeUpdate(tx *gorm.DB) error        { return ErrDocumentIssued }
+func (Invoice) BeforeDelete(tx *gorm.DB) error        { return ErrDocumentIssued }
+func (InvoiceLine) BeforeUpdate(tx *gorm.DB) error    { return ErrDocumentIssued }
+func (InvoiceLine) BeforeDelete(tx *gorm.DB) error    { return ErrDocumentIssued }
+func (CreditNote) BeforeUpdate(tx *gorm.DB) error     { return ErrDocumentIssued }
+func (CreditNote) BeforeDelete(tx *gorm.DB) error     { return ErrDocumentIssued }
+func (CreditNoteLine) BeforeUpdate(tx *gorm.DB) error { return ErrDocumentIssued }
+func (CreditNoteLine) BeforeDelete(tx *gorm.DB) error { return ErrDocumentIssued }
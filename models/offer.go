@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Offer is a discount that runs from StartsAt until EndsAt, or with no end
+// when EndsAt is nil. Target is product, category or all; TargetID names
+// the product or category. Stacking is exclusive or stackable.
+type Offer struct {
+	gorm.Model
+	Name       string     `json:"name" gorm:"type:varchar(100);not null"`
+	Target     string     `json:"target" gorm:"type:varchar(10);not null;index:idx_offer_target"`
+	TargetID   *uint      `json:"target_id" gorm:"index:idx_offer_target"`
+	OfferType  string     `json:"offer_type" gorm:"type:varchar(10);not null"`
+	OfferValue float64    `json:"offer_value" gorm:"type:decimal(10,2);not null"`
+	Priority   int        `json:"priority" gorm:"not null;default:0"`
+	Stacking   string     `json:"stacking" gorm:"type:varchar(10);not null;default:'exclusive'"`
+	StartsAt   time.Time  `json:"starts_at" gorm:"not null;index"`
+	EndsAt     *time.Time `json:"ends_at" gorm:"index"`
+	IsActive   bool       `json:"is_active" gorm:"not null;default:true"`
+}
@@ -22,12 +22,37 @@ type Order struct {
 	DiscountAmount float64      `json:"discount_amount"`
 	ShippingAmount float64      `json:"shipping_amount"`
 	FinalPrice     float64      `json:"final_price"`
+	WalletAmount   float64      `json:"wallet_amount"`
+	OnlineAmount   float64      `json:"online_amount"`
 	OrderAddress   OrderAddress `json:"order_address" gorm:"embedded;embeddedPrefix:address_"`
 	PaymentMethod  string       `json:"payment_method"`
 	PaymentStatus  string       `json:"payment_status"`
 	OrderStatus    string       `json:"order_status"`
 	CouponCode     string       `json:"coupon_code"`
 	OrderItems     []OrderItem  `json:"order_items" gorm:"foreignKey:OrderID;constraint:OnDelete:CASCADE;"`
+
+	// GST in FinalPrice, summed over the items and the shipping charge.
+	// PlaceOfSupply is the delivery state the split was decided on.
+	TaxableAmount float64 `json:"taxable_amount"`
+	CGSTAmount    float64 `json:"cgst_amount"`
+	SGSTAmount    float64 `json:"sgst_amount"`
+	IGSTAmount    float64 `json:"igst_amount"`
+	PlaceOfSupply string  `json:"place_of_supply"`
+
+	// ShippingAmount split into taxable value and GST. Shipping is taxed
+	// at the rate of the principal supply, the item with the largest
+	// taxable value.
+	ShippingGSTRate      float64 `json:"shipping_gst_rate"`
+	ShippingTaxableValue float64 `json:"shipping_taxable_value"`
+	ShippingCGST         float64 `json:"shipping_cgst"`
+	ShippingSGST         float64 `json:"shipping_sgst"`
+	ShippingIGST         float64 `json:"shipping_igst"`
+
+	// Set for orders billed to the buyer's business profile; empty for
+	// B2C orders.
+	BuyerGSTIN          string `json:"buyer_gstin" gorm:"type:varchar(15);index"`
+	BuyerLegalName      string `json:"buyer_legal_name"`
+	BuyerBillingAddress string `json:"buyer_billing_address"`
 }
 
 type OrderItem struct {
@@ -39,4 +64,27 @@ type OrderItem struct {
 	Quantity     int     `json:"quantity"`
 	IsCancelled  string  `gorm:"type:varchar(10);default:ordered" json:"is_cancelled"`
 	TotalPrice   float64 `json:"total_price"`
+
+	// TotalPrice less the item's share of the coupon discount, split into
+	// taxable value and GST.
+	HSNCode      string  `json:"hsn_code" gorm:"type:varchar(8)"`
+	GSTRate      float64 `json:"gst_rate"`
+	TaxableValue float64 `json:"taxable_value"`
+	CGST         float64 `json:"cgst"`
+	SGST         float64 `json:"sgst"`
+	IGST         float64 `json:"igst"`
+
+	// The variant sold, for products sold in variants.
+	VariantID *uint  `json:"variant_id" gorm:"index"`
+	SKU       string `json:"sku"`
+}
+
+type OrderStatusHistory struct {
+	gorm.Model
+	OrderID    uint   `json:"order_id" gorm:"not null;index"`
+	Field      string `json:"field" gorm:"type:varchar(20);not null"` // order_status or payment_status
+	FromStatus string `json:"from_status"`
+	ToStatus   string `json:"to_status"`
+	Actor      string `json:"actor"`
+	Reason     string `json:"reason"`
 }
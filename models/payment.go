@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebhookEvent records every processed webhook delivery so that retries of
+// the same event are ignored.
+type WebhookEvent struct {
+	gorm.Model
+	Source  string `json:"source" gorm:"type:varchar(50);not null;uniqueIndex:idx_webhook_event"`
+	EventID string `json:"event_id" gorm:"type:varchar(255);not null;uniqueIndex:idx_webhook_event"`
+	Event   string `json:"event"`
+}
+
+// PaymentAttempt is one try at paying an order through the gateway. A row is
+// created with the gateway order; each payment made against that gateway
+// order fills in or adds a row with its payment id and outcome.
+type PaymentAttempt struct {
+	gorm.Model
+	OrderID          uint       `json:"order_id" gorm:"not null;index"`
+	Gateway          string     `json:"gateway" gorm:"type:varchar(20)"`
+	GatewayOrderID   string     `json:"gateway_order_id" gorm:"index"`
+	PaymentID        string     `json:"payment_id" gorm:"index"`
+	Status           string     `json:"status" gorm:"type:varchar(20);default:'created'"` // created, paid or failed
+	ErrorCode        string     `json:"error_code"`
+	ErrorDescription string     `json:"error_description"`
+	Amount           float64    `json:"amount" gorm:"type:decimal(10,2)"`
+	PaidAt           *time.Time `json:"paid_at"`
+	FailedAt         *time.Time `json:"failed_at"`
+
+	// Fee is what the gateway kept from a paid attempt.
+	Fee float64 `json:"fee" gorm:"type:decimal(10,2)"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Pincode records whether the shop delivers to a postal code and how long
+// parcels take to get there.
+type Pincode struct {
+	gorm.Model
+	Code         string `json:"code" gorm:"type:varchar(6);not null;uniqueIndex"`
+	Serviceable  bool   `json:"serviceable"`
+	CODAvailable bool   `json:"cod_available"`
+	TransitDays  int    `json:"transit_days"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+}
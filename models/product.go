@@ -18,4 +18,12 @@ type Product struct {
 	OfferType   string   `gorm:"type:varchar(20);default:null" json:"offer_type"`
 	OfferValue  float64  `gorm:"type:decimal;default:0" json:"offer_value"`
 	IsListed    string   `gorm:"type:varchar(20);default:'listed'" json:"is_listed"`
+	Weight      int      `gorm:"not null;default:0" json:"weight"` // grams, shipped weight
+	// Tax overrides; empty or nil fields fall back to the category.
+	HSNCode          string   `gorm:"type:varchar(8)" json:"hsn_code"`
+	GSTRate          *float64 `json:"gst_rate"`
+	PricesIncludeTax *bool    `json:"prices_include_tax"`
+
+	// Full-text search document, kept up to date by a database trigger.
+	SearchVector string `gorm:"type:tsvector;<-:false;->:false" json:"-"`
 }
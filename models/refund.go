@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Refund is money paid back on an order. WalletAmount is credited to the
+// wallet straight away; GatewayAmount is refunded through the payment
+// gateway and settles later, which Status tracks.
+type Refund struct {
+	gorm.Model
+	OrderID             uint         `json:"order_id" gorm:"index"`
+	UserID              uint         `json:"user_id" gorm:"index"`
+	Amount              float64      `json:"amount" gorm:"type:decimal(10,2)"`
+	WalletAmount        float64      `json:"wallet_amount" gorm:"type:decimal(10,2)"`
+	GatewayAmount       float64      `json:"gateway_amount" gorm:"type:decimal(10,2)"`
+	Method              string       `json:"method" gorm:"type:varchar(20)"`
+	Status              string       `json:"status" gorm:"type:varchar(20);default:'pending';index"`
+	Reason              string       `json:"reason"`
+	Gateway             string       `json:"gateway" gorm:"type:varchar(20)"`
+	GatewayPaymentID    string       `json:"gateway_payment_id"`
+	GatewayRefundID     string       `json:"gateway_refund_id" gorm:"index"`
+	FailureReason       string       `json:"failure_reason"`
+	LedgerTransactionID *uint        `json:"ledger_transaction_id"`
+	CreditNoteID        *uint        `json:"credit_note_id" gorm:"index"`
+	ProcessedAt         *time.Time   `json:"processed_at"`
+	Items               []RefundItem `json:"items" gorm:"foreignKey:RefundID"`
+}
+
+type RefundItem struct {
+	gorm.Model
+	RefundID    uint    `json:"refund_id" gorm:"index"`
+	OrderItemID uint    `json:"order_item_id"`
+	ProductID   uint    `json:"product_id"`
+	Quantity    int     `json:"quantity"`
+	Amount      float64 `json:"amount" gorm:"type:decimal(10,2)"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReturnRequest is a customer's request to send back some items of a
+// delivered order. Items are restocked and refunded only after an admin has
+// received and inspected them.
+type ReturnRequest struct {
+	gorm.Model
+	OrderID      uint         `json:"order_id" gorm:"index"`
+	UserID       uint         `json:"user_id" gorm:"index"`
+	Status       string       `json:"status" gorm:"type:varchar(20);default:'requested';index"`
+	Reason       string       `json:"reason" gorm:"type:text"`
+	PhotoURLs    string       `json:"photo_urls" gorm:"type:text"`
+	RefundMethod string       `json:"refund_method" gorm:"type:varchar(20)"`
+	AdminNote    string       `json:"admin_note" gorm:"type:text"`
+	PickupDate   *time.Time   `json:"pickup_date"`
+	ReceivedAt   *time.Time   `json:"received_at"`
+	InspectedAt  *time.Time   `json:"inspected_at"`
+	RefundID     *uint        `json:"refund_id"`
+	Items        []ReturnItem `json:"items" gorm:"foreignKey:ReturnRequestID"`
+}
+
+// ReturnItem is one order item of a return request. AcceptedQuantity and
+// Condition are filled in at inspection.
+type ReturnItem struct {
+	gorm.Model
+	ReturnRequestID  uint    `json:"return_request_id" gorm:"index"`
+	OrderItemID      uint    `json:"order_item_id" gorm:"index"`
+	ProductID        uint    `json:"product_id"`
+	Quantity         int     `json:"quantity"`
+	Reason           string  `json:"reason"`
+	AcceptedQuantity int     `json:"accepted_quantity"`
+	Condition        string  `json:"condition" gorm:"type:varchar(20)"`
+	RefundAmount     float64 `json:"refund_amount" gorm:"type:decimal(10,2)"`
+
+	VariantID *uint `json:"variant_id"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Shipment is one parcel of an order. An order can ship in several parcels,
+// each carrying some quantity of its items.
+type Shipment struct {
+	gorm.Model
+	OrderID        uint            `json:"order_id" gorm:"index"`
+	Carrier        string          `json:"carrier" gorm:"type:varchar(50)"`
+	TrackingNumber string          `json:"tracking_number" gorm:"type:varchar(50);index"`
+	Status         string          `json:"status" gorm:"type:varchar(20);default:'created'"`
+	ShippedAt      *time.Time      `json:"shipped_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	Items          []ShipmentItem  `json:"items" gorm:"foreignKey:ShipmentID"`
+	Events         []TrackingEvent `json:"events" gorm:"foreignKey:ShipmentID"`
+}
+
+type ShipmentItem struct {
+	gorm.Model
+	ShipmentID  uint `json:"shipment_id" gorm:"index"`
+	OrderItemID uint `json:"order_item_id" gorm:"index"`
+	Quantity    int  `json:"quantity"`
+}
+
+// TrackingEvent is a scan or status update reported for a shipment, by an
+// admin or by the carrier.
+type TrackingEvent struct {
+	gorm.Model
+	ShipmentID  uint      `json:"shipment_id" gorm:"index"`
+	Status      string    `json:"status" gorm:"type:varchar(20)"`
+	Location    string    `json:"location"`
+	Description string    `json:"description"`
+	Source      string    `json:"source" gorm:"type:varchar(30)"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
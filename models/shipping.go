@@ -0,0 +1,31 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// ShippingZone groups delivery addresses by state and postal code prefix.
+// States and PostalPrefixes are comma separated lists.
+type ShippingZone struct {
+	gorm.Model
+	Name           string `json:"name" gorm:"type:varchar(50);not null"`
+	States         string `json:"states" gorm:"type:text"`
+	PostalPrefixes string `json:"postal_prefixes" gorm:"type:text"`
+}
+
+// ShippingRule prices a parcel. Rules without a zone apply to every address
+// that no zone-specific rule covers. Weights are in grams; a MaxWeight of
+// zero leaves the slab open ended.
+type ShippingRule struct {
+	gorm.Model
+	Name         string  `json:"name" gorm:"type:varchar(50);not null"`
+	ZoneID       *uint   `json:"zone_id" gorm:"index"`
+	Kind         string  `json:"kind" gorm:"type:varchar(10);not null"` // flat or slab
+	MinWeight    int     `json:"min_weight"`
+	MaxWeight    int     `json:"max_weight"`
+	Rate         float64 `json:"rate"`
+	PerKg        float64 `json:"per_kg"` // slab: charge per started kg above MinWeight
+	FreeAbove    float64 `json:"free_above"`
+	CODSurcharge float64 `json:"cod_surcharge"`
+	IsActive     bool    `json:"is_active"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "gorm.io/gorm"
+
+// ProductVariant is one sellable version of a product, such as a colour and
+// size of a seat cover. Attributes maps attribute names to values. Price
+// overrides the product's price when set. A product's Quantity is the sum
+// of its variants' once it has any.
+type ProductVariant struct {
+	gorm.Model
+	ProductID  uint              `json:"product_id" gorm:"not null;index"`
+	SKU        string            `json:"sku" gorm:"type:varchar(64);not null;uniqueIndex"`
+	Attributes map[string]string `json:"attributes" gorm:"type:jsonb;serializer:json"`
+	Price      *float64          `json:"price" gorm:"type:decimal(10,2)"`
+	Quantity   int               `json:"quantity" gorm:"not null;default:0"`
+	ImgURLs    string            `json:"img_urls" gorm:"type:text"`
+}
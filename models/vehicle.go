@@ -0,0 +1,32 @@
+package models
+
+import "gorm.io/gorm"
+
+// Vehicle is one make, model, model year and trim of car. Trim is empty for
+// vehicles listed without one.
+type Vehicle struct {
+	gorm.Model
+	Make      string `json:"make" gorm:"type:varchar(50);not null;uniqueIndex:idx_vehicle"`
+	ModelName string `json:"model" gorm:"column:model;type:varchar(50);not null;uniqueIndex:idx_vehicle"`
+	Year      int    `json:"year" gorm:"not null;uniqueIndex:idx_vehicle"`
+	Trim      string `json:"trim" gorm:"type:varchar(50);not null;default:'';uniqueIndex:idx_vehicle"`
+}
+
+// ProductFitment records that a product fits a vehicle. With VariantID set
+// only that variant of the product fits it.
+type ProductFitment struct {
+	gorm.Model
+	ProductID uint    `json:"product_id" gorm:"not null;index"`
+	VariantID *uint   `json:"variant_id" gorm:"index"`
+	VehicleID uint    `json:"vehicle_id" gorm:"not null;index"`
+	Vehicle   Vehicle `json:"vehicle"`
+}
+
+// GarageVehicle is the vehicle a user saved in My Garage, which products
+// are checked against.
+type GarageVehicle struct {
+	gorm.Model
+	UserID    uint    `json:"user_id" gorm:"uniqueIndex"`
+	VehicleID uint    `json:"vehicle_id" gorm:"not null"`
+	Vehicle   Vehicle `json:"vehicle"`
+}
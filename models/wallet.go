@@ -1,16 +1,84 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"errors"
+	"time"
 
+	"gorm.io/gorm"
+)
+
+// Wallet.TotalAmount is a cached balance. It is only changed by the ledger
+// package, in the same transaction that posts the matching entries.
 type Wallet struct {
 	gorm.Model
-	UserID      uint     `json:"user_id"`
-	TotalAmount float64  `json:"total_amount"`
+	UserID      uint    `json:"user_id" gorm:"index"`
+	TotalAmount float64 `json:"total_amount"`
 }
 
+// WalletHistory is the wallet log kept before the ledger. ledger.OpenBalances
+// moves its rows into ledger entries; nothing writes it any more.
 type WalletHistory struct {
 	gorm.Model
 	WalletID uint    `json:"wallet_id"`
 	Type     string  `json:"type"`
 	Amount   float64 `json:"amount"`
 }
+
+// LedgerTransaction groups the balanced entries of a single posting.
+type LedgerTransaction struct {
+	gorm.Model
+	Kind     string        `json:"kind" gorm:"type:varchar(30);index"`
+	OrderID  *uint         `json:"order_id" gorm:"index"`
+	RefundID *uint         `json:"refund_id" gorm:"index"`
+	TopUpID  *uint         `json:"top_up_id" gorm:"index"`
+	Memo     string        `json:"memo"`
+	Entries  []LedgerEntry `json:"entries" gorm:"foreignKey:TransactionID"`
+}
+
+// LedgerEntry is one side of a posting. WalletID is set only for entries
+// on the wallet account.
+type LedgerEntry struct {
+	gorm.Model
+	TransactionID uint    `json:"transaction_id" gorm:"index"`
+	Account       string  `json:"account" gorm:"type:varchar(30);index"`
+	WalletID      *uint   `json:"wallet_id" gorm:"index"`
+	Debit         float64 `json:"debit" gorm:"type:decimal(12,2)"`
+	Credit        float64 `json:"credit" gorm:"type:decimal(12,2)"`
+}
+
+// WalletTopUp is a user's request to add money to their wallet through the
+// payment gateway. Each checkout of a failed top-up replaces GatewayOrderID
+// with a new gateway order; every one of them is kept in WalletTopUpOrder.
+type WalletTopUp struct {
+	gorm.Model
+	UserID              uint       `json:"user_id" gorm:"index"`
+	Amount              float64    `json:"amount" gorm:"type:decimal(10,2)"`
+	Gateway             string     `json:"gateway" gorm:"type:varchar(20)"`
+	GatewayOrderID      string     `json:"gateway_order_id" gorm:"index"`
+	PaymentID           string     `json:"payment_id"`
+	Status              string     `json:"status" gorm:"type:varchar(20);default:'created'"`
+	ErrorCode           string     `json:"error_code"`
+	ErrorDescription    string     `json:"error_description"`
+	LedgerTransactionID *uint      `json:"ledger_transaction_id"`
+	PaidAt              *time.Time `json:"paid_at"`
+	FailedAt            *time.Time `json:"failed_at"`
+}
+
+// WalletTopUpOrder is a gateway order opened for a top-up. A payment
+// captured on an earlier checkout of the top-up still finds it here, and is
+// credited once, against the gateway order it was paid on.
+type WalletTopUpOrder struct {
+	gorm.Model
+	TopUpID             uint   `json:"top_up_id" gorm:"index"`
+	Gateway             string `json:"gateway" gorm:"type:varchar(20)"`
+	GatewayOrderID      string `json:"gateway_order_id" gorm:"uniqueIndex"`
+	PaymentID           string `json:"payment_id"`
+	LedgerTransactionID *uint  `json:"ledger_transaction_id"`
+}
+
+var ErrLedgerImmutable = errors.New("ledger records cannot be modified")
+
+func (LedgerTransaction) BeforeUpdate(tx *gorm.DB) error { return ErrLedgerImmutable }
+func (LedgerTransaction) BeforeDelete(tx *gorm.DB) error { return ErrLedgerImmutable }
+func (LedgerEntry) BeforeUpdate(tx *gorm.DB) error       { return ErrLedgerImmutable }
+func (LedgerEntry) BeforeDelete(tx *gorm.DB) error       { return ErrLedgerImmutable }
@@ -9,4 +9,5 @@ type Wishlist struct {
     ProductDescription string  `json:"product_description" gorm:"type:text"`         
     ProductName       string  `json:"product_name" gorm:"not null"`                
     ProductPrice      float64 `json:"product_price" gorm:"not null"`                
+    VariantID         *uint   `json:"variant_id"`
 }
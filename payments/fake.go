@@ -0,0 +1,192 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Fake is an in-process gateway with no network access. It signs payments
+// exactly like Razorpay so the checkout flow can run against it unchanged.
+type Fake struct {
+	secret string
+
+	mu       sync.Mutex
+	next     int
+	orders   map[string]Order
+	notes    map[string]map[string]string
+	payments map[string]Payment
+	refunds  map[string]Refund
+}
+
+var ErrNotFound = errors.New("not found")
+
+func NewFake(secret string) *Fake {
+	if secret == "" {
+		secret = "fake_secret"
+	}
+	return &Fake{
+		secret:   secret,
+		orders:   map[string]Order{},
+		notes:    map[string]map[string]string{},
+		payments: map[string]Payment{},
+		refunds:  map[string]Refund{},
+	}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) KeyID() string {
+	return "fake_key"
+}
+
+func (f *Fake) id(prefix string) string {
+	f.next++
+	return fmt.Sprintf("%s_fake%06d", prefix, f.next)
+}
+
+func (f *Fake) CreateOrder(amount int64, currency, receipt string, notes map[string]string) (Order, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order := Order{
+		ID:       f.id("order"),
+		Amount:   amount,
+		Currency: currency,
+		Receipt:  receipt,
+		Status:   "created",
+	}
+	f.orders[order.ID] = order
+	f.notes[order.ID] = notes
+	return order, nil
+}
+
+// Pay captures the full amount of a fake order and returns the payment
+// together with the signature the checkout page would have received.
+func (f *Fake) Pay(orderID string) (Payment, string, error) {
+	return f.pay(orderID, "captured")
+}
+
+// Authorize is Pay for a payment the bank approved but the gateway has not
+// captured yet, as when auto-capture is off or delayed.
+func (f *Fake) Authorize(orderID string) (Payment, string, error) {
+	return f.pay(orderID, "authorized")
+}
+
+func (f *Fake) pay(orderID, status string) (Payment, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order, ok := f.orders[orderID]
+	if !ok {
+		return Payment{}, "", fmt.Errorf("fake: order %s: %w", orderID, ErrNotFound)
+	}
+
+	payment := Payment{
+		ID:       f.id("pay"),
+		OrderID:  order.ID,
+		Amount:   order.Amount,
+		Currency: order.Currency,
+		Status:   status,
+		Method:   "fake",
+		Fee:      order.Amount * 2 / 100, // Razorpay's standard 2%
+		Notes:    f.notes[order.ID],
+	}
+	f.payments[payment.ID] = payment
+
+	if status == "captured" {
+		order.Status = "paid"
+	} else {
+		order.Status = "attempted"
+	}
+	f.orders[order.ID] = order
+
+	return payment, sign(f.secret, order.ID+"|"+payment.ID), nil
+}
+
+// Fail records a failed payment attempt against a fake order.
+func (f *Fake) Fail(orderID, code, description string) (Payment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order, ok := f.orders[orderID]
+	if !ok {
+		return Payment{}, fmt.Errorf("fake: order %s: %w", orderID, ErrNotFound)
+	}
+
+	payment := Payment{
+		ID:               f.id("pay"),
+		OrderID:          order.ID,
+		Amount:           order.Amount,
+		Currency:         order.Currency,
+		Status:           "failed",
+		Method:           "fake",
+		ErrorCode:        code,
+		ErrorDescription: description,
+		Notes:            f.notes[order.ID],
+	}
+	f.payments[payment.ID] = payment
+	return payment, nil
+}
+
+func (f *Fake) VerifySignature(orderID, paymentID, signature string) error {
+	return verify(f.secret, orderID+"|"+paymentID, signature)
+}
+
+func (f *Fake) FetchPayment(paymentID string) (Payment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	payment, ok := f.payments[paymentID]
+	if !ok {
+		return Payment{}, fmt.Errorf("fake: payment %s: %w", paymentID, ErrNotFound)
+	}
+	return payment, nil
+}
+
+func (f *Fake) Refund(paymentID string, amount int64, notes map[string]string) (Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	payment, ok := f.payments[paymentID]
+	if !ok {
+		return Refund{}, fmt.Errorf("fake: payment %s: %w", paymentID, ErrNotFound)
+	}
+	if payment.Status != "captured" {
+		return Refund{}, fmt.Errorf("fake: payment %s is %s, not captured", paymentID, payment.Status)
+	}
+
+	refunded := payment.AmountRefunded
+	if amount == 0 {
+		amount = payment.Amount - refunded
+	}
+	if amount <= 0 || refunded+amount > payment.Amount {
+		return Refund{}, fmt.Errorf("fake: refund of %d exceeds the unrefunded amount of payment %s", amount, paymentID)
+	}
+
+	refund := Refund{
+		ID:        f.id("rfnd"),
+		PaymentID: paymentID,
+		Amount:    amount,
+		Status:    "processed",
+		Notes:     notes,
+	}
+	f.refunds[refund.ID] = refund
+
+	payment.AmountRefunded += amount
+	f.payments[payment.ID] = payment
+	return refund, nil
+}
+
+func (f *Fake) FetchRefund(refundID string) (Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refund, ok := f.refunds[refundID]
+	if !ok {
+		return Refund{}, fmt.Errorf("fake: refund %s: %w", refundID, ErrNotFound)
+	}
+	return refund, nil
+}
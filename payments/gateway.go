@@ -0,0 +1,125 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+)
+
+// Order is an order created on the gateway side. Amounts are in the
+// smallest currency unit (paise for INR).
+type Order struct {
+	ID       string `json:"id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Receipt  string `json:"receipt"`
+	Status   string `json:"status"`
+}
+
+type Payment struct {
+	ID               string            `json:"id"`
+	OrderID          string            `json:"order_id"`
+	Amount           int64             `json:"amount"`
+	AmountRefunded   int64             `json:"amount_refunded"`
+	Currency         string            `json:"currency"`
+	Status           string            `json:"status"`
+	Method           string            `json:"method"`
+	Fee              int64             `json:"fee"`
+	ErrorCode        string            `json:"error_code"`
+	ErrorDescription string            `json:"error_description"`
+	Notes            map[string]string `json:"notes"`
+}
+
+type Refund struct {
+	ID        string            `json:"id"`
+	PaymentID string            `json:"payment_id"`
+	Amount    int64             `json:"amount"`
+	Status    string            `json:"status"`
+	Notes     map[string]string `json:"notes"`
+}
+
+// Gateway is implemented by every payment provider the shop can take
+// payments through.
+type Gateway interface {
+	// Name identifies the gateway in stored records.
+	Name() string
+	// KeyID is the public key handed to the checkout page.
+	KeyID() string
+	CreateOrder(amount int64, currency, receipt string, notes map[string]string) (Order, error)
+	// VerifySignature checks the signature the checkout page receives after
+	// a successful payment and returns ErrInvalidSignature if it is forged.
+	VerifySignature(orderID, paymentID, signature string) error
+	FetchPayment(paymentID string) (Payment, error)
+	// Refund refunds amount of a captured payment; zero refunds it in full.
+	Refund(paymentID string, amount int64, notes map[string]string) (Refund, error)
+	// FetchRefund returns the current state of a refund, which settles
+	// asynchronously on most gateways.
+	FetchRefund(refundID string) (Refund, error)
+}
+
+var ErrInvalidSignature = errors.New("invalid payment signature")
+
+// Default is the gateway selected by Init.
+var Default Gateway
+
+type Config struct {
+	Gateway       string
+	KeyID         string
+	KeySecret     string
+	WebhookSecret string
+}
+
+// ConfigFromEnv reads PAYMENT_GATEWAY ("razorpay" or "fake", default
+// "razorpay"), the Razorpay credentials and RAZORPAY_WEBHOOK_SECRET.
+func ConfigFromEnv() Config {
+	gateway := os.Getenv("PAYMENT_GATEWAY")
+	if gateway == "" {
+		gateway = "razorpay"
+	}
+	return Config{
+		Gateway:       gateway,
+		KeyID:         os.Getenv("RAZORPAY_KEY_ID"),
+		KeySecret:     os.Getenv("RAZORPAY_KEY_SECRET"),
+		WebhookSecret: os.Getenv("RAZORPAY_WEBHOOK_SECRET"),
+	}
+}
+
+func New(cfg Config) (Gateway, error) {
+	switch cfg.Gateway {
+	case "razorpay":
+		if cfg.KeyID == "" || cfg.KeySecret == "" {
+			return nil, errors.New("missing RAZORPAY_KEY_ID or RAZORPAY_KEY_SECRET")
+		}
+		return NewRazorpay(cfg.KeyID, cfg.KeySecret), nil
+	case "fake":
+		return NewFake(cfg.KeySecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", cfg.Gateway)
+	}
+}
+
+func Init() {
+	cfg := ConfigFromEnv()
+	gateway, err := New(cfg)
+	if err != nil {
+		log.Fatal("Failed to configure payment gateway: ", err)
+	}
+	Default = gateway
+	webhookSecret = cfg.WebhookSecret
+	if webhookSecret == "" {
+		log.Println("RAZORPAY_WEBHOOK_SECRET is not set; payment webhooks will be rejected")
+	}
+	log.Println("Payment gateway:", gateway.Name())
+}
+
+// ToPaise converts a rupee amount as stored on orders to paise.
+func ToPaise(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// FromPaise converts paise back to rupees.
+func FromPaise(amount int64) float64 {
+	return float64(amount) / 100
+}
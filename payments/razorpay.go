@@ -0,0 +1,153 @@
+package payments
+
+import (
+	"fmt"
+
+	"github.com/razorpay/razorpay-go"
+)
+
+type Razorpay struct {
+	keyID     string
+	keySecret string
+	client    *razorpay.Client
+}
+
+func NewRazorpay(keyID, keySecret string) *Razorpay {
+	return &Razorpay{
+		keyID:     keyID,
+		keySecret: keySecret,
+		client:    razorpay.NewClient(keyID, keySecret),
+	}
+}
+
+func (r *Razorpay) Name() string {
+	return "razorpay"
+}
+
+func (r *Razorpay) KeyID() string {
+	return r.keyID
+}
+
+func (r *Razorpay) CreateOrder(amount int64, currency, receipt string, notes map[string]string) (Order, error) {
+	data := map[string]interface{}{
+		"amount":   amount,
+		"currency": currency,
+		"receipt":  receipt,
+		"notes":    notes,
+	}
+
+	body, err := r.client.Order.Create(data, nil)
+	if err != nil {
+		return Order{}, fmt.Errorf("razorpay: create order: %w", err)
+	}
+
+	return Order{
+		ID:       stringField(body, "id"),
+		Amount:   intField(body, "amount"),
+		Currency: stringField(body, "currency"),
+		Receipt:  stringField(body, "receipt"),
+		Status:   stringField(body, "status"),
+	}, nil
+}
+
+func (r *Razorpay) VerifySignature(orderID, paymentID, signature string) error {
+	return verify(r.keySecret, orderID+"|"+paymentID, signature)
+}
+
+func (r *Razorpay) FetchPayment(paymentID string) (Payment, error) {
+	body, err := r.client.Payment.Fetch(paymentID, nil, nil)
+	if err != nil {
+		return Payment{}, fmt.Errorf("razorpay: fetch payment: %w", err)
+	}
+	return paymentFromMap(body), nil
+}
+
+// Refund sends the amount with every refund, so a full refund asks for what
+// is left of the payment.
+func (r *Razorpay) Refund(paymentID string, amount int64, notes map[string]string) (Refund, error) {
+	if amount == 0 {
+		payment, err := r.FetchPayment(paymentID)
+		if err != nil {
+			return Refund{}, err
+		}
+		amount = payment.Amount - payment.AmountRefunded
+		if amount <= 0 {
+			return Refund{}, fmt.Errorf("razorpay: payment %s is already refunded in full", paymentID)
+		}
+	}
+
+	data := map[string]interface{}{
+		"notes": notes,
+	}
+
+	body, err := r.client.Payment.Refund(paymentID, int(amount), data, nil)
+	if err != nil {
+		return Refund{}, fmt.Errorf("razorpay: refund payment: %w", err)
+	}
+
+	return refundFromMap(body), nil
+}
+
+func (r *Razorpay) FetchRefund(refundID string) (Refund, error) {
+	body, err := r.client.Refund.Fetch(refundID, nil, nil)
+	if err != nil {
+		return Refund{}, fmt.Errorf("razorpay: fetch refund: %w", err)
+	}
+	return refundFromMap(body), nil
+}
+
+func refundFromMap(body map[string]interface{}) Refund {
+	return Refund{
+		ID:        stringField(body, "id"),
+		PaymentID: stringField(body, "payment_id"),
+		Amount:    intField(body, "amount"),
+		Status:    stringField(body, "status"),
+		Notes:     notesField(body),
+	}
+}
+
+func paymentFromMap(body map[string]interface{}) Payment {
+	return Payment{
+		ID:               stringField(body, "id"),
+		OrderID:          stringField(body, "order_id"),
+		Amount:           intField(body, "amount"),
+		AmountRefunded:   intField(body, "amount_refunded"),
+		Currency:         stringField(body, "currency"),
+		Status:           stringField(body, "status"),
+		Method:           stringField(body, "method"),
+		Fee:              intField(body, "fee"),
+		ErrorCode:        stringField(body, "error_code"),
+		ErrorDescription: stringField(body, "error_description"),
+		Notes:            notesField(body),
+	}
+}
+
+// notesField reads the notes of an entity, which Razorpay sends as an empty
+// array when there are none.
+func notesField(body map[string]interface{}) map[string]string {
+	result := map[string]string{}
+	if notes, ok := body["notes"].(map[string]interface{}); ok {
+		for key, value := range notes {
+			result[key] = fmt.Sprint(value)
+		}
+	}
+	return result
+}
+
+func stringField(body map[string]interface{}, key string) string {
+	value, _ := body[key].(string)
+	return value
+}
+
+// intField reads a numeric field; JSON numbers decode as float64.
+func intField(body map[string]interface{}, key string) int64 {
+	switch value := body[key].(type) {
+	case float64:
+		return int64(value)
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package payments
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// razorpayServer stands in for the Razorpay API with one captured payment
+// of ₹100, amountRefunded paise of it already refunded. The body of each
+// refund request is passed to refunded.
+func razorpayServer(t *testing.T, amountRefunded int64, refunded func(body map[string]interface{})) *Razorpay {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/payments/pay_1", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":              "pay_1",
+			"amount":          10000,
+			"amount_refunded": amountRefunded,
+			"status":          "captured",
+		})
+	})
+	mux.HandleFunc("POST /v1/payments/pay_1/refund", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		refunded(body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         "rfnd_1",
+			"payment_id": "pay_1",
+			"amount":     body["amount"],
+			"status":     "processed",
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	gateway := NewRazorpay("key", "secret")
+	gateway.client.Payment.Request.BaseURL = server.URL
+	return gateway
+}
+
+func TestRazorpayFullRefund(t *testing.T) {
+	var requested interface{}
+	gateway := razorpayServer(t, 2500, func(body map[string]interface{}) {
+		requested = body["amount"]
+	})
+
+	refund, err := gateway.Refund("pay_1", 0, map[string]string{"refund_id": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != float64(7500) || refund.Amount != 7500 {
+		t.Errorf("refund of %v paise requested, %d refunded; want 7500", requested, refund.Amount)
+	}
+}
+
+func TestRazorpayPartialRefund(t *testing.T) {
+	var requested interface{}
+	gateway := razorpayServer(t, 0, func(body map[string]interface{}) {
+		requested = body["amount"]
+	})
+
+	if _, err := gateway.Refund("pay_1", 4000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if requested != float64(4000) {
+		t.Errorf("refund of %v paise requested, want 4000", requested)
+	}
+}
+
+func TestRazorpayFullRefundOfRefundedPayment(t *testing.T) {
+	gateway := razorpayServer(t, 10000, func(map[string]interface{}) {
+		t.Error("a refund was requested for a payment with nothing left to refund")
+	})
+
+	if _, err := gateway.Refund("pay_1", 0, nil); err == nil {
+		t.Error("got no error refunding a fully refunded payment")
+	}
+}
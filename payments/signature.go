@@ -0,0 +1,23 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// sign returns the hex encoded HMAC-SHA256 of message, the scheme Razorpay
+// uses for both checkout and webhook signatures.
+func sign(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret, message, signature string) error {
+	expected := sign(secret, message)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package payments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// Webhook event names handled by the shop.
+const (
+	EventPaymentCaptured = "payment.captured"
+	EventPaymentFailed   = "payment.failed"
+	EventRefundProcessed = "refund.processed"
+	EventRefundFailed    = "refund.failed"
+)
+
+var webhookSecret string
+
+// Webhook is a parsed gateway webhook. Payment and Refund are nil when the
+// event does not carry that entity.
+type Webhook struct {
+	ID      string
+	Event   string
+	Payment *Payment
+	Refund  *Refund
+}
+
+// VerifyWebhook checks the X-Razorpay-Signature header of a webhook against
+// the raw request body.
+func VerifyWebhook(body []byte, signature string) error {
+	if webhookSecret == "" {
+		return errors.New("webhook secret is not configured")
+	}
+	return verify(webhookSecret, string(body), signature)
+}
+
+// SignWebhook signs body with the configured webhook secret, for tools that
+// need to replay events locally.
+func SignWebhook(body []byte) string {
+	return sign(webhookSecret, string(body))
+}
+
+// ParseWebhook decodes a webhook body. eventID is the X-Razorpay-Event-Id
+// header; when it is missing the body hash is used so retries of the same
+// delivery still deduplicate.
+func ParseWebhook(body []byte, eventID string) (Webhook, error) {
+	var raw struct {
+		Event   string `json:"event"`
+		Payload struct {
+			Payment *struct {
+				Entity map[string]interface{} `json:"entity"`
+			} `json:"payment"`
+			Refund *struct {
+				Entity map[string]interface{} `json:"entity"`
+			} `json:"refund"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return Webhook{}, err
+	}
+
+	if eventID == "" {
+		sum := sha256.Sum256(body)
+		eventID = hex.EncodeToString(sum[:])
+	}
+
+	webhook := Webhook{
+		ID:    eventID,
+		Event: raw.Event,
+	}
+	if raw.Payload.Payment != nil {
+		payment := paymentFromMap(raw.Payload.Payment.Entity)
+		webhook.Payment = &payment
+	}
+	if raw.Payload.Refund != nil {
+		refund := refundFromMap(raw.Payload.Refund.Entity)
+		webhook.Refund = &refund
+	}
+	return webhook, nil
+}
@@ -0,0 +1,80 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"kars/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// What a scheduled offer applies to.
+const (
+	TargetProduct  = "product"
+	TargetCategory = "category"
+	TargetAll      = "all"
+)
+
+// Stacking policies of scheduled offers.
+const (
+	StackingExclusive = "exclusive"
+	StackingStackable = "stackable"
+)
+
+// Validate checks a scheduled offer before it is saved.
+func Validate(offer models.Offer) error {
+	switch {
+	case offer.Name == "":
+		return errors.New("offer name is required")
+	case offer.Target != TargetProduct && offer.Target != TargetCategory && offer.Target != TargetAll:
+		return fmt.Errorf("target must be %q, %q or %q", TargetProduct, TargetCategory, TargetAll)
+	case offer.Target == TargetAll && offer.TargetID != nil:
+		return errors.New("offers for all products take no target_id")
+	case offer.Target != TargetAll && offer.TargetID == nil:
+		return fmt.Errorf("a %s offer needs a target_id", offer.Target)
+	case offer.OfferType != TypePercentage && offer.OfferType != TypeFixed:
+		return fmt.Errorf("offer_type must be %q or %q", TypePercentage, TypeFixed)
+	case offer.OfferValue <= 0:
+		return errors.New("offer_value must be greater than 0")
+	case offer.OfferType == TypePercentage && offer.OfferValue >= 100:
+		return errors.New("percentage offers must be below 100")
+	case offer.Stacking != StackingExclusive && offer.Stacking != StackingStackable:
+		return fmt.Errorf("stacking must be %q or %q", StackingExclusive, StackingStackable)
+	case offer.StartsAt.IsZero():
+		return errors.New("starts_at is required")
+	case offer.EndsAt != nil && !offer.EndsAt.After(offer.StartsAt):
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// Active returns the scheduled offers running at a time. Offers start and
+// end by their dates alone; is_active only lets an admin pause one.
+func Active(db *gorm.DB, at time.Time) ([]models.Offer, error) {
+	var offers []models.Offer
+	err := db.Where("is_active = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", true, at, at).
+		Order("priority DESC, id").Find(&offers).Error
+	return offers, err
+}
+
+// Promotions picks the scheduled offers that apply to product.
+func Promotions(offers []models.Offer, product models.Product) []Offer {
+	var promotions []Offer
+	for _, offer := range offers {
+		switch {
+		case offer.Target == TargetAll,
+			offer.Target == TargetProduct && offer.TargetID != nil && *offer.TargetID == product.ID,
+			offer.Target == TargetCategory && offer.TargetID != nil && *offer.TargetID == product.CategoryID:
+			promotions = append(promotions, Offer{
+				Source:    SourcePromotion,
+				Name:      offer.Name,
+				Type:      offer.OfferType,
+				Value:     offer.OfferValue,
+				Priority:  offer.Priority,
+				Stackable: offer.Stacking == StackingStackable,
+			})
+		}
+	}
+	return promotions
+}
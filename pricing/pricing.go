@@ -0,0 +1,163 @@
+// Package pricing works out what a product sells for: its base price less
+// the best of the product's own offer, its category's and the scheduled
+// offers running, and any stackable offers on top.
+package pricing
+
+import (
+	"kars/models"
+	"kars/tax"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Offer types.
+const (
+	TypePercentage = "percentage"
+	TypeFixed      = "fixed"
+)
+
+// Where an offer comes from.
+const (
+	SourceProduct   = "product"
+	SourceCategory  = "category"
+	SourcePromotion = "promotion"
+)
+
+// Offer is a discount that can apply to a product. Exclusive offers compete
+// and only one applies; stackable offers apply on top of it.
+type Offer struct {
+	Source    string  `json:"source"`
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Value     float64 `json:"value"`
+	Priority  int     `json:"priority"`
+	Stackable bool    `json:"stackable"`
+}
+
+// Discount is what the offer takes off price. Offers of an unknown type, or
+// that would give the product away, take nothing.
+func (o Offer) Discount(price float64) float64 {
+	var discount float64
+	switch o.Type {
+	case TypePercentage:
+		discount = price * o.Value / 100
+	case TypeFixed:
+		discount = o.Value
+	}
+	discount = tax.Round(discount)
+	if discount <= 0 || discount >= price {
+		return 0
+	}
+	return discount
+}
+
+// AppliedOffer is an offer and what it took off.
+type AppliedOffer struct {
+	Offer
+	Discount float64 `json:"discount"`
+}
+
+// Breakdown explains a price: the base price, the offers applied to it in
+// order, and what it comes to.
+type Breakdown struct {
+	BasePrice float64        `json:"base_price"`
+	Offers    []AppliedOffer `json:"applied_offers"`
+	Discount  float64        `json:"discount"`
+	Price     float64        `json:"price"`
+}
+
+// Price prices a product. Of the exclusive offers, the one with the highest
+// priority applies, the one taking the most off if several share it, and
+// the product's own before the category's on a tie. Stackable offers then
+// apply one after another, highest priority first, each to the price left
+// by the ones before.
+func Price(product models.Product, category models.Category, promotions ...Offer) Breakdown {
+	breakdown := Breakdown{BasePrice: product.Price, Price: product.Price, Offers: []AppliedOffer{}}
+
+	offers := make([]Offer, 0, len(promotions)+2)
+	if product.OfferType != "" {
+		offers = append(offers, Offer{Source: SourceProduct, Name: product.ProductName + " offer", Type: product.OfferType, Value: product.OfferValue})
+	}
+	if category.OfferType != "" {
+		offers = append(offers, Offer{Source: SourceCategory, Name: category.CategoryName + " offer", Type: category.OfferType, Value: category.OfferValue})
+	}
+	offers = append(offers, promotions...)
+
+	var best *AppliedOffer
+	var stackable []Offer
+	for _, offer := range offers {
+		if offer.Stackable {
+			stackable = append(stackable, offer)
+			continue
+		}
+		discount := offer.Discount(product.Price)
+		if discount == 0 {
+			continue
+		}
+		if best == nil || offer.Priority > best.Priority || (offer.Priority == best.Priority && discount > best.Discount) {
+			best = &AppliedOffer{Offer: offer, Discount: discount}
+		}
+	}
+	if best != nil {
+		breakdown.Offers = append(breakdown.Offers, *best)
+		breakdown.Price = tax.Round(breakdown.Price - best.Discount)
+	}
+
+	sort.SliceStable(stackable, func(i, j int) bool { return stackable[i].Priority > stackable[j].Priority })
+	for _, offer := range stackable {
+		if discount := offer.Discount(breakdown.Price); discount > 0 {
+			breakdown.Offers = append(breakdown.Offers, AppliedOffer{Offer: offer, Discount: discount})
+			breakdown.Price = tax.Round(breakdown.Price - discount)
+		}
+	}
+
+	breakdown.Discount = tax.Round(product.Price - breakdown.Price)
+	return breakdown
+}
+
+// Variant is product as variant of it sells, at the variant's price when
+// it has one. A nil variant leaves the product as it is.
+func Variant(product models.Product, variant *models.ProductVariant) models.Product {
+	if variant != nil && variant.Price != nil {
+		product.Price = *variant.Price
+	}
+	return product
+}
+
+// Pricer prices products with the categories and offers they need loaded
+// once.
+type Pricer struct {
+	categories map[uint]models.Category
+	offers     []models.Offer
+}
+
+// NewPricer loads what pricing products takes at a time: the categories
+// they are in and the offers running then.
+func NewPricer(db *gorm.DB, products []models.Product, at time.Time) (*Pricer, error) {
+	categoryIDs := make([]uint, 0, len(products))
+	for _, product := range products {
+		categoryIDs = append(categoryIDs, product.CategoryID)
+	}
+	var categories []models.Category
+	if len(categoryIDs) > 0 {
+		if err := db.Where("id IN ?", categoryIDs).Find(&categories).Error; err != nil {
+			return nil, err
+		}
+	}
+	pricer := &Pricer{categories: make(map[uint]models.Category, len(categories))}
+	for _, category := range categories {
+		pricer.categories[category.ID] = category
+	}
+
+	var err error
+	pricer.offers, err = Active(db, at)
+	return pricer, err
+}
+
+// Price prices product, or variant of it when variant is not nil.
+func (p *Pricer) Price(product models.Product, variant *models.ProductVariant) Breakdown {
+	product = Variant(product, variant)
+	return Price(product, p.categories[product.CategoryID], Promotions(p.offers, product)...)
+}
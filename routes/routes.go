@@ -22,6 +22,15 @@ func Routes(app *fiber.App) {
 	app.Post("/api/user/login", controllers.UserLogin)
 	app.Post("/api/user/logout", controllers.UserLogout)
 	app.Get("/api/user/products", middleware.CheckUserStatus, controllers.UserProductList)
+	app.Get("/api/user/products/search", middleware.CheckUserStatus, controllers.SearchProducts)
+	app.Get("/api/user/products/:product_id", middleware.CheckUserStatus, controllers.UserProductDetail)
+	app.Get("/api/user/vehicles", middleware.CheckUserStatus, controllers.ListVehicles)
+	app.Get("/api/user/garage", middleware.CheckUserStatus, controllers.GetGarage)
+	app.Put("/api/user/garage", middleware.CheckUserStatus, controllers.SaveGarage)
+	app.Delete("/api/user/garage", middleware.CheckUserStatus, controllers.DeleteGarage)
+	app.Get("/api/user/business-profile", middleware.CheckUserStatus, controllers.GetBusinessProfile)
+	app.Put("/api/user/business-profile", middleware.CheckUserStatus, controllers.SaveBusinessProfile)
+	app.Delete("/api/user/business-profile", middleware.CheckUserStatus, controllers.DeleteBusinessProfile)
 
 	//Admin Side Routes
 	app.Post("/api/admin/signup", controllers.AdminSignUp)
@@ -29,8 +38,64 @@ func Routes(app *fiber.App) {
 	app.Get("/api/admin/userslist", controllers.UserList)
 	app.Post("/api/admin/user/block/:user_id", middleware.AdminMiddleware, controllers.BlockUser)
 	app.Get("/api/admin/orderslist", controllers.OrderList)
-	app.Patch("/api/admin/order/cancel/:order_id", controllers.CancelOrder)
-	app.Patch("/api/admin/order/:order_id", controllers.ChangeStatusShipped)
+	app.Patch("/api/admin/order/cancel/:order_id", middleware.AdminMiddleware, controllers.CancelOrder)
+	app.Patch("/api/admin/order/:order_id", middleware.AdminMiddleware, controllers.ChangeStatusShipped)
+	app.Patch("/api/admin/order/:order_id/status", middleware.AdminMiddleware, controllers.UpdateOrderStatus)
+	app.Get("/api/admin/order/:order_id/history", middleware.AdminMiddleware, controllers.GetOrderStatusHistory)
+	app.Get("/api/admin/order/:order_id/payments", middleware.AdminMiddleware, controllers.ListPaymentAttempts)
+	app.Post("/api/admin/order/:order_id/shipments", middleware.AdminMiddleware, controllers.CreateShipment)
+	app.Get("/api/admin/order/:order_id/shipments", middleware.AdminMiddleware, controllers.ListOrderShipments)
+	app.Patch("/api/admin/shipments/:shipment_id", middleware.AdminMiddleware, controllers.UpdateShipmentStatus)
+	app.Get("/api/admin/order/:order_id/label", middleware.AdminMiddleware, controllers.ShippingLabel)
+	app.Get("/api/admin/order/:order_id/packing-slip", middleware.AdminMiddleware, controllers.PackingSlip)
+	app.Get("/api/admin/orders/labels", middleware.AdminMiddleware, controllers.BatchShippingLabels)
+	app.Get("/api/admin/orders/packing-slips", middleware.AdminMiddleware, controllers.BatchPackingSlips)
+	app.Get("/api/admin/shipping/zones", middleware.AdminMiddleware, controllers.ListShippingZones)
+	app.Post("/api/admin/shipping/zones", middleware.AdminMiddleware, controllers.AddShippingZone)
+	app.Patch("/api/admin/shipping/zones/:zone_id", middleware.AdminMiddleware, controllers.EditShippingZone)
+	app.Delete("/api/admin/shipping/zones/:zone_id", middleware.AdminMiddleware, controllers.DeleteShippingZone)
+	app.Get("/api/admin/shipping/rules", middleware.AdminMiddleware, controllers.ListShippingRules)
+	app.Post("/api/admin/shipping/rules", middleware.AdminMiddleware, controllers.AddShippingRule)
+	app.Patch("/api/admin/shipping/rules/:rule_id", middleware.AdminMiddleware, controllers.EditShippingRule)
+	app.Delete("/api/admin/shipping/rules/:rule_id", middleware.AdminMiddleware, controllers.DeleteShippingRule)
+	app.Get("/api/admin/pincodes", middleware.AdminMiddleware, controllers.ListPincodes)
+	app.Post("/api/admin/pincodes/import", middleware.AdminMiddleware, controllers.ImportPincodes)
+	app.Get("/api/admin/wallets/reconcile", middleware.AdminMiddleware, controllers.ReconcileWallets)
+	app.Get("/api/admin/returns", middleware.AdminMiddleware, controllers.ListReturns)
+	app.Get("/api/admin/returns/:return_id", middleware.AdminMiddleware, controllers.GetReturn)
+	app.Patch("/api/admin/returns/:return_id/approve", middleware.AdminMiddleware, controllers.ApproveReturn)
+	app.Patch("/api/admin/returns/:return_id/reject", middleware.AdminMiddleware, controllers.RejectReturn)
+	app.Patch("/api/admin/returns/:return_id/pickup", middleware.AdminMiddleware, controllers.ScheduleReturnPickup)
+	app.Patch("/api/admin/returns/:return_id/receive", middleware.AdminMiddleware, controllers.ReceiveReturn)
+	app.Patch("/api/admin/returns/:return_id/inspect", middleware.AdminMiddleware, controllers.InspectReturn)
+	app.Patch("/api/admin/category/:category_id/return-window", middleware.AdminMiddleware, controllers.UpdateCategoryReturnWindow)
+	app.Patch("/api/admin/category/:category_id/tax", middleware.AdminMiddleware, controllers.UpdateCategoryTax)
+	app.Patch("/api/admin/product/:product_id/tax", middleware.AdminMiddleware, controllers.UpdateProductTax)
+	app.Get("/api/admin/product/:product_id/price", middleware.AdminMiddleware, controllers.PreviewProductPrice)
+	app.Get("/api/admin/product/:product_id/variants", middleware.AdminMiddleware, controllers.ListProductVariants)
+	app.Post("/api/admin/product/:product_id/variants", middleware.AdminMiddleware, controllers.AddProductVariant)
+	app.Patch("/api/admin/variants/:variant_id", middleware.AdminMiddleware, controllers.EditProductVariant)
+	app.Delete("/api/admin/variants/:variant_id", middleware.AdminMiddleware, controllers.DeleteProductVariant)
+	app.Get("/api/admin/product/:product_id/fitments", middleware.AdminMiddleware, controllers.ListProductFitments)
+	app.Post("/api/admin/product/:product_id/fitments", middleware.AdminMiddleware, controllers.AddProductFitments)
+	app.Delete("/api/admin/fitments/:fitment_id", middleware.AdminMiddleware, controllers.DeleteProductFitment)
+	app.Get("/api/admin/vehicles", middleware.AdminMiddleware, controllers.ListVehicles)
+	app.Post("/api/admin/vehicles", middleware.AdminMiddleware, controllers.AddVehicle)
+	app.Post("/api/admin/vehicles/import", middleware.AdminMiddleware, controllers.ImportVehicles)
+	app.Delete("/api/admin/vehicles/:vehicle_id", middleware.AdminMiddleware, controllers.DeleteVehicle)
+	app.Get("/api/admin/offers", middleware.AdminMiddleware, controllers.ListOffers)
+	app.Post("/api/admin/offers", middleware.AdminMiddleware, controllers.AddOffer)
+	app.Patch("/api/admin/offers/:offer_id", middleware.AdminMiddleware, controllers.EditOffer)
+	app.Delete("/api/admin/offers/:offer_id", middleware.AdminMiddleware, controllers.DeleteOffer)
+	app.Get("/api/admin/refunds", middleware.AdminMiddleware, controllers.ListRefunds)
+	app.Patch("/api/admin/refunds/:refund_id/sync", middleware.AdminMiddleware, controllers.SyncRefund)
+	app.Patch("/api/admin/refunds/:refund_id/wallet", middleware.AdminMiddleware, controllers.RefundToWallet)
+	app.Get("/api/admin/invoices", middleware.AdminMiddleware, controllers.ListInvoices)
+	app.Get("/api/admin/invoices/:invoice_id", middleware.AdminMiddleware, controllers.AdminInvoiceDownload)
+	app.Get("/api/admin/credit-notes", middleware.AdminMiddleware, controllers.ListCreditNotes)
+	app.Get("/api/admin/credit-notes/:credit_note_id", middleware.AdminMiddleware, controllers.CreditNoteDownload)
+	app.Get("/api/admin/gst/gstr1", middleware.AdminMiddleware, controllers.ExportGSTR1)
+	app.Get("/api/admin/journal", middleware.AdminMiddleware, controllers.ExportJournal)
 
 	//Category Routes
 	app.Post("/api/category", controllers.AddCategory)
@@ -59,6 +124,10 @@ func Routes(app *fiber.App) {
 	app.Get("/api/user/order", middleware.CheckUserStatus, controllers.ListOrdersForUser)
 	app.Post("/api/user/order/:order_id", middleware.CheckUserStatus, controllers.ReturnOrder)
 	app.Post("/api/user/cancel/product/:order_id/:product_id", middleware.CheckUserStatus,controllers.CancelOneProduct)
+	app.Get("/api/user/order/:order_id/history", middleware.CheckUserStatus, controllers.GetOrderStatusHistory)
+	app.Get("/api/user/order/:order_id/tracking", middleware.CheckUserStatus, controllers.GetOrderTracking)
+	app.Get("/api/user/shipping/quote", middleware.CheckUserStatus, controllers.QuoteShipping)
+	app.Get("/api/user/pincode/:pincode", middleware.CheckUserStatus, controllers.CheckPincodeDelivery)
 
 	//WishList Routes
 	app.Post("/api/user/wishlist/:product_id", middleware.CheckUserStatus, controllers.AddWishList)
@@ -72,15 +141,29 @@ func Routes(app *fiber.App) {
 	app.Post("/api/user/coupon/:order_id", middleware.CheckUserStatus, controllers.CancelCoupon)
 
 	//Payment Routes
-	app.Get("/api/user/render-razorpay", controllers.RenderRayzorPay)
-	app.Get("/api/user/repayment", controllers.RenderRayzorPay)
-	app.Post("/api/user/create-order/:order_id", controllers.CreateOrder)
+	app.Get("/api/user/render-razorpay", middleware.CheckUserStatus, controllers.RenderRayzorPay)
+	app.Get("/api/user/repayment", middleware.CheckUserStatus, controllers.RenderRayzorPay)
+	app.Post("/api/user/create-order/:order_id", middleware.CheckUserStatus, controllers.CreateOrder)
 	app.Post("api/user/verify-payment/:order_id", controllers.VerifyPayment)
-	app.Post("api/user/failed-handling/:order_id", controllers.FailedHandling)
+	app.Post("api/user/failed-handling/:order_id", middleware.CheckUserStatus, controllers.FailedHandling)
+	app.Post("/api/payments/fake/pay/:gateway_order_id", controllers.FakePay)
+	app.Post("/api/payments/webhook", controllers.PaymentWebhook)
+	app.Post("/api/couriers/:carrier/webhook", controllers.CourierWebhook)
 
 	//Sales Route
 	app.Get("/api/admin/sales", controllers.GetSalesReport)
 	app.Get("/api/user/wallet", middleware.CheckUserStatus, controllers.GetWallet)
-	app.Get("/api/user/invoice", controllers.InvoiceDownload)
+	app.Get("/api/user/refunds", middleware.CheckUserStatus, controllers.ListUserRefunds)
+	app.Post("/api/user/returns", middleware.CheckUserStatus, controllers.CreateReturnRequest)
+	app.Get("/api/user/returns", middleware.CheckUserStatus, controllers.ListUserReturns)
+	app.Get("/api/user/returns/:return_id", middleware.CheckUserStatus, controllers.GetUserReturn)
+	app.Post("/api/user/wallet/topup", middleware.CheckUserStatus, controllers.CreateWalletTopUp)
+	app.Get("/api/user/wallet/topup/:top_up_id/pay", middleware.CheckUserStatus, controllers.RenderWalletTopUp)
+	app.Post("/api/user/wallet/topup/:top_up_id/create-order", middleware.CheckUserStatus, controllers.CreateTopUpOrder)
+	app.Post("/api/user/wallet/topup/:top_up_id/verify", middleware.CheckUserStatus, controllers.VerifyWalletTopUp)
+	app.Post("/api/user/wallet/topup/:top_up_id/failed", middleware.CheckUserStatus, controllers.FailedWalletTopUp)
+	app.Get("/api/user/invoice", middleware.CheckUserStatus, controllers.InvoiceDownload)
+	app.Get("/api/user/credit-notes", middleware.CheckUserStatus, controllers.ListUserCreditNotes)
+	app.Get("/api/user/credit-notes/:credit_note_id", middleware.CheckUserStatus, controllers.CreditNoteDownload)
 	app.Get("/api/admin/top/products", controllers.TopSellingProducts)
 }
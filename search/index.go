@@ -0,0 +1,55 @@
+package search
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// setupStatements keep products.search_vector up to date. A product's
+// document weighs its name above its category and colour, and those above
+// its description. Renaming a category touches its products so that their
+// documents pick up the new name.
+var setupStatements = []string{
+	fmt.Sprintf(`CREATE OR REPLACE FUNCTION products_search_vector() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector :=
+		setweight(to_tsvector('%[1]s', coalesce(NEW.product_name, '')), 'A') ||
+		setweight(to_tsvector('%[1]s', coalesce((SELECT category_name FROM categories WHERE id = NEW.category_id), '')), 'B') ||
+		setweight(to_tsvector('%[1]s', coalesce(NEW.color, '')), 'B') ||
+		setweight(to_tsvector('%[1]s', coalesce(NEW.description, '')), 'C');
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql`, Config),
+	`DROP TRIGGER IF EXISTS products_search_vector ON products`,
+	`CREATE TRIGGER products_search_vector BEFORE INSERT OR UPDATE ON products
+	FOR EACH ROW EXECUTE FUNCTION products_search_vector()`,
+	`CREATE OR REPLACE FUNCTION categories_search_vector() RETURNS trigger AS $$
+BEGIN
+	IF NEW.category_name IS DISTINCT FROM OLD.category_name THEN
+		UPDATE products SET search_vector = NULL WHERE category_id = NEW.id;
+	END IF;
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS categories_search_vector ON categories`,
+	`CREATE TRIGGER categories_search_vector AFTER UPDATE ON categories
+	FOR EACH ROW EXECUTE FUNCTION categories_search_vector()`,
+	`CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector)`,
+	// Products saved before the trigger existed get their documents now.
+	`UPDATE products SET search_vector = NULL WHERE search_vector IS NULL`,
+}
+
+// Setup installs what full-text search needs in the database. It runs
+// after the products and categories tables are migrated, and is safe to
+// run again.
+func Setup(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range setupStatements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,265 @@
+// Package search finds listed products with PostgreSQL full-text search,
+// filters them and pages through the results.
+package search
+
+import (
+	"errors"
+	"fmt"
+	"kars/fitment"
+	"kars/models"
+	"kars/pricing"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Config is the text search configuration product documents and queries
+// are parsed with, so that "covers" finds "cover".
+const Config = "english"
+
+// Orders results can be sorted in.
+const (
+	SortRelevance  = "relevance"
+	SortPriceLow   = "price_asc"
+	SortPriceHigh  = "price_desc"
+	SortNewest     = "newest"
+	SortPopularity = "popularity"
+)
+
+const (
+	DefaultPerPage = 10
+	MaxPerPage     = 50
+	// MaxPriced is how many products a search filtering or sorting on
+	// price may have to price; broader searches must be narrowed first.
+	MaxPriced = 1000
+)
+
+var ErrInvalidQuery = errors.New("invalid search")
+
+// Query is a product search. Zero values leave a filter off. Prices are
+// what products sell for now, after offers; a product sold in variants is
+// priced by its variants, matches a price range when one of them is in it
+// and sorts by the cheapest of them that is.
+type Query struct {
+	Text       string
+	CategoryID uint
+	MinPrice   float64
+	MaxPrice   float64
+	Colors     []string
+	InStock    bool
+	// VehicleID keeps only products that fit the vehicle.
+	VehicleID uint
+	Sort      string
+	Page      int
+	PerPage   int
+}
+
+// Page describes the page of results returned and how many there are.
+type Page struct {
+	Page        int   `json:"page"`
+	PerPage     int   `json:"per_page"`
+	Total       int64 `json:"total"`
+	TotalPages  int   `json:"total_pages"`
+	HasNext     bool  `json:"has_next"`
+	HasPrevious bool  `json:"has_previous"`
+}
+
+// normalize fills in defaults and checks q. Results are by relevance when
+// there is text to be relevant to, and newest first otherwise.
+func (q *Query) normalize() error {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PerPage < 1 {
+		q.PerPage = DefaultPerPage
+	}
+	if q.PerPage > MaxPerPage {
+		q.PerPage = MaxPerPage
+	}
+	if q.MinPrice < 0 || q.MaxPrice < 0 || (q.MaxPrice > 0 && q.MinPrice > q.MaxPrice) {
+		return fmt.Errorf("%w: the price range is empty", ErrInvalidQuery)
+	}
+
+	colors := make([]string, 0, len(q.Colors))
+	for _, color := range q.Colors {
+		if color = strings.ToLower(strings.TrimSpace(color)); color != "" {
+			colors = append(colors, color)
+		}
+	}
+	q.Colors = colors
+
+	switch q.Sort {
+	case "":
+		q.Sort = SortNewest
+		if q.Text != "" {
+			q.Sort = SortRelevance
+		}
+	case SortRelevance:
+		if q.Text == "" {
+			q.Sort = SortNewest
+		}
+	case SortPriceLow, SortPriceHigh, SortNewest, SortPopularity:
+	default:
+		return fmt.Errorf("%w: sort must be relevance, price_asc, price_desc, newest or popularity", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Products runs q, returning a page of listed products in listed
+// categories, with their categories loaded.
+func Products(db *gorm.DB, q Query) ([]models.Product, Page, error) {
+	if err := q.normalize(); err != nil {
+		return nil, Page{}, err
+	}
+	if q.MinPrice > 0 || q.MaxPrice > 0 || q.Sort == SortPriceLow || q.Sort == SortPriceHigh {
+		return byPrice(db, q)
+	}
+	page := Page{Page: q.Page, PerPage: q.PerPage}
+
+	if err := filter(db, q).Count(&page.Total).Error; err != nil {
+		return nil, page, err
+	}
+	page.TotalPages = int((page.Total + int64(q.PerPage) - 1) / int64(q.PerPage))
+	page.HasNext = q.Page < page.TotalPages
+	page.HasPrevious = q.Page > 1
+
+	var products []models.Product
+	err := order(filter(db, q).Select("products.*").Preload("Category"), q).
+		Limit(q.PerPage).Offset((q.Page - 1) * q.PerPage).Find(&products).Error
+	return products, page, err
+}
+
+// order sorts the products of query as q asks, newest first among equals.
+func order(query *gorm.DB, q Query) *gorm.DB {
+	switch q.Sort {
+	case SortRelevance:
+		query = query.Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "ts_rank(products.search_vector, websearch_to_tsquery(?, ?)) DESC",
+			Vars: []interface{}{Config, q.Text},
+		}})
+	case SortNewest:
+		query = query.Order("products.created_at DESC")
+	case SortPopularity:
+		query = query.Joins("LEFT JOIN (SELECT product_id, SUM(quantity) AS sold FROM order_items WHERE is_cancelled = 'ordered' AND deleted_at IS NULL GROUP BY product_id) AS sales ON sales.product_id = products.id").
+			Order("COALESCE(sales.sold, 0) DESC")
+	}
+	return query.Order("products.id DESC")
+}
+
+// byPrice runs a query that filters or sorts on price. Offers are scheduled
+// and variants override prices, so the database cannot tell what a product
+// sells for: every product matching the other filters is priced here, and
+// the page is cut from those left. Offers only ever lower a price, so
+// products no price of which reaches the minimum are left out beforehand.
+func byPrice(db *gorm.DB, q Query) ([]models.Product, Page, error) {
+	page := Page{Page: q.Page, PerPage: q.PerPage}
+
+	query := filter(db, q)
+	if q.MinPrice > 0 {
+		query = query.Where("products.price >= ? OR EXISTS (SELECT 1 FROM product_variants WHERE product_variants.product_id = products.id AND product_variants.deleted_at IS NULL AND product_variants.price >= ?)", q.MinPrice, q.MinPrice)
+	}
+	var products []models.Product
+	if err := order(query.Select("products.*").Preload("Category"), q).Limit(MaxPriced + 1).Find(&products).Error; err != nil {
+		return nil, page, err
+	}
+	if len(products) > MaxPriced {
+		return nil, page, fmt.Errorf("%w: more than %d products match; narrow the search to filter or sort on price", ErrInvalidQuery, MaxPriced)
+	}
+	productIDs := make([]uint, 0, len(products))
+	for _, product := range products {
+		productIDs = append(productIDs, product.ID)
+	}
+	productVariants := make(map[uint][]models.ProductVariant)
+	if len(productIDs) > 0 {
+		var variants []models.ProductVariant
+		if err := db.Where("product_id IN ?", productIDs).Find(&variants).Error; err != nil {
+			return nil, page, err
+		}
+		for _, variant := range variants {
+			productVariants[variant.ProductID] = append(productVariants[variant.ProductID], variant)
+		}
+	}
+	pricer, err := pricing.NewPricer(db, products, time.Now())
+	if err != nil {
+		return nil, page, err
+	}
+
+	type priced struct {
+		product models.Product
+		price   float64
+	}
+	matched := make([]priced, 0, len(products))
+	for _, product := range products {
+		var prices []float64
+		if variants := productVariants[product.ID]; len(variants) > 0 {
+			for i := range variants {
+				prices = append(prices, pricer.Price(product, &variants[i]).Price)
+			}
+		} else {
+			prices = append(prices, pricer.Price(product, nil).Price)
+		}
+
+		lowest, found := 0.0, false
+		for _, price := range prices {
+			if (q.MinPrice > 0 && price < q.MinPrice) || (q.MaxPrice > 0 && price > q.MaxPrice) {
+				continue
+			}
+			if !found || price < lowest {
+				lowest, found = price, true
+			}
+		}
+		if found {
+			matched = append(matched, priced{product: product, price: lowest})
+		}
+	}
+	switch q.Sort {
+	case SortPriceLow:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].price < matched[j].price })
+	case SortPriceHigh:
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].price > matched[j].price })
+	}
+
+	page.Total = int64(len(matched))
+	page.TotalPages = int((page.Total + int64(q.PerPage) - 1) / int64(q.PerPage))
+	page.HasNext = q.Page < page.TotalPages
+	page.HasPrevious = q.Page > 1
+
+	start := min((q.Page-1)*q.PerPage, len(matched))
+	end := min(start+q.PerPage, len(matched))
+	products = make([]models.Product, 0, end-start)
+	for _, match := range matched[start:end] {
+		products = append(products, match.product)
+	}
+	return products, page, nil
+}
+
+// filter selects the products q matches on everything but price, which
+// byPrice checks. It is built afresh for counting and for fetching, since a
+// counted query cannot be reused.
+func filter(db *gorm.DB, q Query) *gorm.DB {
+	query := db.Model(&models.Product{}).
+		Joins("JOIN categories ON categories.id = products.category_id AND categories.deleted_at IS NULL").
+		Where("products.is_listed = ? AND categories.is_listed = ?", "listed", "listed")
+	if q.Text != "" {
+		query = query.Where("products.search_vector @@ websearch_to_tsquery(?, ?)", Config, q.Text)
+	}
+	if q.CategoryID != 0 {
+		query = query.Where("products.category_id = ?", q.CategoryID)
+	}
+	// A product comes in a colour when it is its colour, or the colour of
+	// one of its variants.
+	if len(q.Colors) > 0 {
+		query = query.Where("LOWER(products.color) IN ? OR EXISTS (SELECT 1 FROM product_variants WHERE product_variants.product_id = products.id AND product_variants.deleted_at IS NULL AND LOWER(COALESCE(product_variants.attributes->>'color', product_variants.attributes->>'colour')) IN ?)", q.Colors, q.Colors)
+	}
+	if q.InStock {
+		query = query.Where("products.quantity > 0")
+	}
+	if q.VehicleID != 0 {
+		query = query.Where("products.id IN (?)", fitment.Compatible(db, q.VehicleID))
+	}
+	return query
+}
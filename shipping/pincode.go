@@ -0,0 +1,197 @@
+package shipping
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"kars/models"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidPincode  = errors.New("postal code must be a 6 digit pincode")
+	ErrNotServiceable  = errors.New("we do not deliver to this pincode yet")
+	ErrCODNotAvailable = errors.New("cash on delivery is not available for this pincode")
+)
+
+var pincodePattern = regexp.MustCompile(`^[1-9][0-9]{5}$`)
+
+// DispatchCutoff is the hour after which orders leave the next day.
+const DispatchCutoff = 14
+
+func NormalizePincode(code string) string {
+	return strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+}
+
+// CheckPincode returns the serviceability of a pincode. Until a pincode
+// table has been imported every valid pincode is served, and the returned
+// record is zero.
+func CheckPincode(db *gorm.DB, code string, cod bool) (models.Pincode, error) {
+	code = NormalizePincode(code)
+	if !pincodePattern.MatchString(code) {
+		return models.Pincode{}, ErrInvalidPincode
+	}
+
+	var pincode models.Pincode
+	err := db.Where("code = ?", code).First(&pincode).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var count int64
+		if err := db.Model(&models.Pincode{}).Count(&count).Error; err != nil {
+			return pincode, err
+		}
+		if count == 0 {
+			return pincode, nil
+		}
+		return pincode, ErrNotServiceable
+	}
+	if err != nil {
+		return pincode, err
+	}
+
+	if !pincode.Serviceable {
+		return pincode, ErrNotServiceable
+	}
+	if cod && !pincode.CODAvailable {
+		return pincode, ErrCODNotAvailable
+	}
+	return pincode, nil
+}
+
+// EstimateDelivery is the day a parcel ordered at placed should arrive.
+// Orders after the cutoff or on a Sunday leave on the next working day, and
+// parcels do not move on Sundays.
+func EstimateDelivery(pincode models.Pincode, placed time.Time) time.Time {
+	day := time.Date(placed.Year(), placed.Month(), placed.Day(), 0, 0, 0, 0, placed.Location())
+	if placed.Hour() >= DispatchCutoff {
+		day = day.AddDate(0, 0, 1)
+	}
+	for day.Weekday() == time.Sunday {
+		day = day.AddDate(0, 0, 1)
+	}
+	for days := pincode.TransitDays; days > 0; {
+		day = day.AddDate(0, 0, 1)
+		if day.Weekday() != time.Sunday {
+			days--
+		}
+	}
+	return day
+}
+
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Errors   []string `json:"errors"`
+}
+
+// ImportPincodes loads a CSV with the header
+// pincode,serviceable,cod,transit_days and optional city and state columns.
+// Existing pincodes are updated. Bad rows are reported and skipped.
+func ImportPincodes(db *gorm.DB, r io.Reader) (ImportResult, error) {
+	result := ImportResult{Errors: []string{}}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return result, fmt.Errorf("reading header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"pincode", "serviceable", "cod", "transit_days"} {
+		if _, ok := columns[required]; !ok {
+			return result, fmt.Errorf("missing column %q", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	// A pincode listed twice keeps its last row; one upsert statement
+	// cannot touch the same row twice.
+	var batch []models.Pincode
+	seen := map[string]int{}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return result, err
+		}
+
+		pincode, err := parsePincodeRow(field, record)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		if i, ok := seen[pincode.Code]; ok {
+			batch[i] = pincode
+			continue
+		}
+		seen[pincode.Code] = len(batch)
+		batch = append(batch, pincode)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}},
+			DoUpdates: clause.AssignmentColumns([]string{"serviceable", "cod_available", "transit_days", "city", "state", "updated_at", "deleted_at"}),
+		}).CreateInBatches(&batch, 500).Error
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Imported = len(batch)
+	return result, nil
+}
+
+func parsePincodeRow(field func([]string, string) string, record []string) (models.Pincode, error) {
+	pincode := models.Pincode{
+		Code:  NormalizePincode(field(record, "pincode")),
+		City:  field(record, "city"),
+		State: field(record, "state"),
+	}
+	if !pincodePattern.MatchString(pincode.Code) {
+		return pincode, ErrInvalidPincode
+	}
+
+	var err error
+	if pincode.Serviceable, err = parseFlag(field(record, "serviceable")); err != nil {
+		return pincode, fmt.Errorf("serviceable: %v", err)
+	}
+	if pincode.CODAvailable, err = parseFlag(field(record, "cod")); err != nil {
+		return pincode, fmt.Errorf("cod: %v", err)
+	}
+	if pincode.TransitDays, err = strconv.Atoi(field(record, "transit_days")); err != nil || pincode.TransitDays < 0 {
+		return pincode, errors.New("transit_days must be a whole number of days")
+	}
+	return pincode, nil
+}
+
+func parseFlag(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "y", "yes", "true":
+		return true, nil
+	case "0", "n", "no", "false", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("unrecognised value %q", value)
+}
@@ -0,0 +1,203 @@
+// Package shipping prices orders from the shipping zones and rules admins
+// keep in the database.
+package shipping
+
+import (
+	"errors"
+	"fmt"
+	"kars/models"
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Rule kinds.
+const (
+	KindFlat = "flat"
+	KindSlab = "slab"
+)
+
+var ErrNoRate = errors.New("shipping is not available to this address")
+
+// Parcel is what gets priced: the items' total weight in grams and value,
+// where it goes and whether it is paid on delivery.
+type Parcel struct {
+	Weight     int
+	Value      float64
+	COD        bool
+	State      string
+	PostalCode string
+}
+
+type Quote struct {
+	ZoneID       *uint   `json:"zone_id"`
+	Zone         string  `json:"zone"`
+	RuleID       uint    `json:"rule_id"`
+	Rule         string  `json:"rule"`
+	Weight       int     `json:"weight"`
+	Charge       float64 `json:"charge"`
+	FreeShipping bool    `json:"free_shipping"`
+	CODSurcharge float64 `json:"cod_surcharge"`
+	Total        float64 `json:"total"`
+}
+
+// Split returns the comma separated entries of a zone list, trimmed and
+// without blanks.
+func Split(list string) []string {
+	var out []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// MatchZone returns the zone an address falls in. The longest matching
+// postal code prefix wins; a state match counts for less than any prefix.
+func MatchZone(zones []models.ShippingZone, state, postalCode string) *models.ShippingZone {
+	var best *models.ShippingZone
+	bestScore := 0
+	postalCode = strings.ReplaceAll(postalCode, " ", "")
+	for i := range zones {
+		score := 0
+		for _, prefix := range Split(zones[i].PostalPrefixes) {
+			if strings.HasPrefix(postalCode, prefix) && len(prefix)+1 > score {
+				score = len(prefix) + 1
+			}
+		}
+		if score == 0 {
+			for _, s := range Split(zones[i].States) {
+				if strings.EqualFold(s, strings.TrimSpace(state)) {
+					score = 1
+					break
+				}
+			}
+		}
+		if score > bestScore {
+			best, bestScore = &zones[i], score
+		}
+	}
+	return best
+}
+
+// Calculate prices a parcel. A zone's own rules take precedence over rules
+// without a zone; among those whose weight slab fits the parcel the one with
+// the highest minimum weight, then the lowest id, is used.
+func Calculate(zones []models.ShippingZone, rules []models.ShippingRule, parcel Parcel) (Quote, error) {
+	zone := MatchZone(zones, parcel.State, parcel.PostalCode)
+
+	var rule *models.ShippingRule
+	for _, zoned := range []bool{true, false} {
+		for i := range rules {
+			candidate := &rules[i]
+			if !candidate.IsActive || !fits(*candidate, parcel.Weight) {
+				continue
+			}
+			if zoned && (zone == nil || candidate.ZoneID == nil || *candidate.ZoneID != zone.ID) {
+				continue
+			}
+			if !zoned && candidate.ZoneID != nil {
+				continue
+			}
+			if rule == nil || candidate.MinWeight > rule.MinWeight ||
+				(candidate.MinWeight == rule.MinWeight && candidate.ID < rule.ID) {
+				rule = candidate
+			}
+		}
+		if rule != nil {
+			break
+		}
+	}
+	if rule == nil {
+		return Quote{}, ErrNoRate
+	}
+
+	quote := Quote{
+		RuleID: rule.ID,
+		Rule:   rule.Name,
+		Weight: parcel.Weight,
+	}
+	if zone != nil {
+		quote.ZoneID = &zone.ID
+		quote.Zone = zone.Name
+	}
+
+	if rule.FreeAbove > 0 && parcel.Value >= rule.FreeAbove {
+		quote.FreeShipping = true
+	} else {
+		quote.Charge = rule.Rate
+		if rule.Kind == KindSlab && parcel.Weight > rule.MinWeight {
+			kgs := math.Ceil(float64(parcel.Weight-rule.MinWeight) / 1000)
+			quote.Charge += kgs * rule.PerKg
+		}
+	}
+	if parcel.COD {
+		quote.CODSurcharge = rule.CODSurcharge
+	}
+
+	quote.Charge = round(quote.Charge)
+	quote.CODSurcharge = round(quote.CODSurcharge)
+	quote.Total = round(quote.Charge + quote.CODSurcharge)
+	return quote, nil
+}
+
+func fits(rule models.ShippingRule, weight int) bool {
+	return weight >= rule.MinWeight && (rule.MaxWeight == 0 || weight <= rule.MaxWeight)
+}
+
+// Validate checks a rule before it is stored.
+func Validate(rule models.ShippingRule) error {
+	switch {
+	case rule.Name == "":
+		return errors.New("rule name is required")
+	case rule.Kind != KindFlat && rule.Kind != KindSlab:
+		return fmt.Errorf("rule kind must be %q or %q", KindFlat, KindSlab)
+	case rule.MinWeight < 0 || rule.MaxWeight < 0:
+		return errors.New("weights must be zero or greater")
+	case rule.MaxWeight != 0 && rule.MaxWeight < rule.MinWeight:
+		return errors.New("max_weight must not be below min_weight")
+	case rule.Rate < 0 || rule.PerKg < 0 || rule.FreeAbove < 0 || rule.CODSurcharge < 0:
+		return errors.New("charges must be zero or greater")
+	case rule.Kind == KindFlat && rule.PerKg != 0:
+		return errors.New("per_kg only applies to slab rules")
+	}
+	return nil
+}
+
+// QuoteFor prices a parcel against the zones and active rules in db.
+func QuoteFor(db *gorm.DB, parcel Parcel) (Quote, error) {
+	var zones []models.ShippingZone
+	if err := db.Find(&zones).Error; err != nil {
+		return Quote{}, err
+	}
+	var rules []models.ShippingRule
+	if err := db.Where("is_active = ?", true).Find(&rules).Error; err != nil {
+		return Quote{}, err
+	}
+	return Calculate(zones, rules, parcel)
+}
+
+// SeedDefaults creates the standard rule, a flat 30 on orders below 500,
+// when no rule has ever existed, so checkout works on a fresh database.
+func SeedDefaults(db *gorm.DB) error {
+	var count int64
+	if err := db.Unscoped().Model(&models.ShippingRule{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return db.Create(&models.ShippingRule{
+		Name:      "Standard",
+		Kind:      KindFlat,
+		Rate:      30,
+		FreeAbove: 500,
+		IsActive:  true,
+	}).Error
+}
+
+func round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,177 @@
+// Package tax works out GST on order lines: which rate applies to a
+// product, how much of a line is taxable value and how the tax splits into
+// CGST and SGST within the seller's state or IGST across states.
+package tax
+
+import (
+	"fmt"
+	"kars/models"
+	"math"
+	"os"
+	"strings"
+)
+
+// Rates are the GST slabs a product can be taxed at, in percent.
+var Rates = []float64{0, 0.25, 3, 5, 12, 18, 28}
+
+func ValidRate(rate float64) bool {
+	for _, r := range Rates {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidHSN accepts the 4, 6 or 8 digit HSN codes used on invoices; an empty
+// code is allowed.
+func ValidHSN(code string) bool {
+	if code == "" {
+		return true
+	}
+	if len(code) != 4 && len(code) != 6 && len(code) != 8 {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Config is the tax treatment of a product.
+type Config struct {
+	HSN       string
+	Rate      float64
+	Inclusive bool
+}
+
+// Resolve returns the tax configuration of a product. Product settings
+// override the category's; anything the product leaves unset comes from the
+// category.
+func Resolve(product models.Product, category models.Category) Config {
+	config := Config{
+		HSN:       category.HSNCode,
+		Rate:      category.GSTRate,
+		Inclusive: category.PricesIncludeTax,
+	}
+	if product.HSNCode != "" {
+		config.HSN = product.HSNCode
+	}
+	if product.GSTRate != nil {
+		config.Rate = *product.GSTRate
+	}
+	if product.PricesIncludeTax != nil {
+		config.Inclusive = *product.PricesIncludeTax
+	}
+	return config
+}
+
+// Gross is what the customer pays for amount at the configured price: the
+// amount itself when prices include tax, the amount plus tax otherwise.
+func Gross(amount float64, config Config) float64 {
+	if config.Inclusive {
+		return amount
+	}
+	return Round(amount * (1 + config.Rate/100))
+}
+
+// Breakdown is the tax in a line.
+type Breakdown struct {
+	TaxableValue float64 `json:"taxable_value"`
+	CGST         float64 `json:"cgst"`
+	SGST         float64 `json:"sgst"`
+	IGST         float64 `json:"igst"`
+}
+
+func (b Breakdown) Tax() float64 {
+	return Round(b.CGST + b.SGST + b.IGST)
+}
+
+func (b Breakdown) Add(other Breakdown) Breakdown {
+	return Breakdown{
+		TaxableValue: Round(b.TaxableValue + other.TaxableValue),
+		CGST:         Round(b.CGST + other.CGST),
+		SGST:         Round(b.SGST + other.SGST),
+		IGST:         Round(b.IGST + other.IGST),
+	}
+}
+
+// Split takes a tax-inclusive amount apart into taxable value and tax.
+// Within the seller's state the tax is halved into CGST and SGST, with any
+// odd paisa going to CGST.
+func Split(amount, rate float64, intraState bool) Breakdown {
+	taxable := Round(amount * 100 / (100 + rate))
+	tax := Round(amount - taxable)
+	if tax == 0 {
+		return Breakdown{TaxableValue: taxable}
+	}
+	if !intraState {
+		return Breakdown{TaxableValue: taxable, IGST: tax}
+	}
+	cgst := math.Ceil(tax*100/2-1e-9) / 100
+	return Breakdown{TaxableValue: taxable, CGST: cgst, SGST: Round(tax - cgst)}
+}
+
+// Allocate spreads discount over amounts in proportion to each, so that the
+// shares add up to the discount exactly.
+func Allocate(amounts []float64, discount float64) []float64 {
+	shares := make([]float64, len(amounts))
+	total := 0.0
+	for _, amount := range amounts {
+		total += amount
+	}
+	if total <= 0 || discount == 0 {
+		return shares
+	}
+
+	left := Round(discount)
+	last := -1
+	for i, amount := range amounts {
+		if amount > 0 {
+			last = i
+		}
+	}
+	for i, amount := range amounts {
+		if i == last {
+			shares[i] = Round(left)
+			break
+		}
+		shares[i] = Round(discount * amount / total)
+		left -= shares[i]
+	}
+	return shares
+}
+
+// SellerState is the state the shop ships from, SELLER_STATE, by default
+// Kerala.
+func SellerState() string {
+	if state := strings.TrimSpace(os.Getenv("SELLER_STATE")); state != "" {
+		return state
+	}
+	return "Kerala"
+}
+
+// IntraState reports whether a delivery to state stays within the seller's
+// state. States may be given by name or GST state code.
+func IntraState(state string) bool {
+	return SameState(SellerState(), state)
+}
+
+func SameState(a, b string) bool {
+	codeA, codeB := StateCode(a), StateCode(b)
+	if codeA != "" && codeB != "" {
+		return codeA == codeB
+	}
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+func Round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Label is how a rate is printed, without trailing zeros.
+func Label(rate float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", rate), "0"), ".") + "%"
+}
@@ -0,0 +1,78 @@
+package tax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrInvalidGSTIN = errors.New("invalid GSTIN")
+
+const gstinAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NormalizeGSTIN upper-cases a GSTIN and drops spaces around it.
+func NormalizeGSTIN(gstin string) string {
+	return strings.ToUpper(strings.TrimSpace(gstin))
+}
+
+// ValidateGSTIN checks a normalized GSTIN: a state code, the holder's PAN,
+// an entity number, a Z and a check character over the first fourteen.
+func ValidateGSTIN(gstin string) error {
+	if len(gstin) != 15 {
+		return fmt.Errorf("%w: a GSTIN has 15 characters", ErrInvalidGSTIN)
+	}
+	if StateName(gstin[:2]) == "" {
+		return fmt.Errorf("%w: %s is not a state code", ErrInvalidGSTIN, gstin[:2])
+	}
+	if !validPAN(gstin[2:12]) {
+		return fmt.Errorf("%w: characters 3 to 12 must be a PAN", ErrInvalidGSTIN)
+	}
+	if gstin[12] == '0' || strings.IndexByte(gstinAlphabet, gstin[12]) < 0 {
+		return fmt.Errorf("%w: character 13 must be 1-9 or A-Z", ErrInvalidGSTIN)
+	}
+	if gstin[13] != 'Z' {
+		return fmt.Errorf("%w: character 14 must be Z", ErrInvalidGSTIN)
+	}
+	if gstinCheck(gstin[:14]) != gstin[14] {
+		return fmt.Errorf("%w: check character does not match", ErrInvalidGSTIN)
+	}
+	return nil
+}
+
+// SellerGSTIN is the shop's own registration, SELLER_GSTIN.
+func SellerGSTIN() string {
+	return NormalizeGSTIN(os.Getenv("SELLER_GSTIN"))
+}
+
+// GSTINState is the code of the state a GSTIN is registered in.
+func GSTINState(gstin string) string {
+	if len(gstin) < 2 {
+		return ""
+	}
+	return gstin[:2]
+}
+
+// validPAN accepts five letters, four digits and a letter.
+func validPAN(pan string) bool {
+	for i := 0; i < len(pan); i++ {
+		digit := pan[i] >= '0' && pan[i] <= '9'
+		letter := pan[i] >= 'A' && pan[i] <= 'Z'
+		if (i >= 5 && i < 9) != digit || (i < 5 || i == 9) != letter {
+			return false
+		}
+	}
+	return len(pan) == 10
+}
+
+// gstinCheck computes the check character: each character's value in base
+// 36 is weighted 1 and 2 alternately, the product's two base 36 digits are
+// added up, and the check brings the sum to a multiple of 36.
+func gstinCheck(body string) byte {
+	sum := 0
+	for i := 0; i < len(body); i++ {
+		product := strings.IndexByte(gstinAlphabet, body[i]) * (i%2 + 1)
+		sum += product/36 + product%36
+	}
+	return gstinAlphabet[(36-sum%36)%36]
+}
@@ -0,0 +1,88 @@
+package tax
+
+import "strings"
+
+// stateCodes maps state and union territory names to the two digit codes
+// GST uses for them, which also start every GSTIN.
+var stateCodes = map[string]string{
+	"jammu and kashmir": "01",
+	"himachal pradesh":  "02",
+	"punjab":            "03",
+	"chandigarh":        "04",
+	"uttarakhand":       "05",
+	"haryana":           "06",
+	"delhi":             "07",
+	"rajasthan":         "08",
+	"uttar pradesh":     "09",
+	"bihar":             "10",
+	"sikkim":            "11",
+	"arunachal pradesh": "12",
+	"nagaland":          "13",
+	"manipur":           "14",
+	"mizoram":           "15",
+	"tripura":           "16",
+	"meghalaya":         "17",
+	"assam":             "18",
+	"west bengal":       "19",
+	"jharkhand":         "20",
+	"odisha":            "21",
+	"chhattisgarh":      "22",
+	"madhya pradesh":    "23",
+	"gujarat":           "24",
+	"dadra and nagar haveli and daman and diu": "26",
+	"maharashtra":                 "27",
+	"karnataka":                   "29",
+	"goa":                         "30",
+	"lakshadweep":                 "31",
+	"kerala":                      "32",
+	"tamil nadu":                  "33",
+	"puducherry":                  "34",
+	"andaman and nicobar islands": "35",
+	"telangana":                   "36",
+	"andhra pradesh":              "37",
+	"ladakh":                      "38",
+}
+
+var stateAliases = map[string]string{
+	"orissa":       "odisha",
+	"pondicherry":  "puducherry",
+	"new delhi":    "delhi",
+	"nct of delhi": "delhi",
+	"uttaranchal":  "uttarakhand",
+	"j&k":          "jammu and kashmir",
+}
+
+// StateCode returns the GST code of a state given by name or code, or ""
+// when the state is not recognised.
+func StateCode(state string) string {
+	name := strings.ToLower(strings.Join(strings.Fields(state), " "))
+	name = strings.ReplaceAll(name, " & ", " and ")
+	if alias, ok := stateAliases[name]; ok {
+		name = alias
+	}
+	if code, ok := stateCodes[name]; ok {
+		return code
+	}
+	for _, code := range stateCodes {
+		if code == name {
+			return code
+		}
+	}
+	return ""
+}
+
+// StateName returns the name of the state with the given GST code.
+func StateName(code string) string {
+	for name, c := range stateCodes {
+		if c == code {
+			words := strings.Fields(name)
+			for i, word := range words {
+				if word != "and" {
+					words[i] = strings.ToUpper(word[:1]) + word[1:]
+				}
+			}
+			return strings.Join(words, " ")
+		}
+	}
+	return ""
+}
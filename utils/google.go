@@ -2,7 +2,9 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 
@@ -11,10 +13,11 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
-// Initialize the environment variables
+// Initialize the environment variables. Without a .env file, as in the
+// package tests, the process environment is used as it is.
 func init() {
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 }